@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Return the feature flags the server is running with
+func (s *Server) featuresHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cfg.Features)
+}
+
+// List the streaming generations currently in flight
+func (s *Server) generationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.generations.active())
+}
+
+// Stop a generation's upstream stream; connected clients get an error event
+func (s *Server) cancelGenerationHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	gen, ok := s.generations.get(id)
+	if !ok {
+		http.Error(w, "Unknown or expired generation", http.StatusNotFound)
+		return
+	}
+	logf(r.Context(), "Cancelling generation %s for %s", id, clientName(r.Context()))
+	gen.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Report conversation cache counters, when the store keeps any
+func (s *Server) conversationStatsHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.conversations.(interface{ Stats() ConversationStats })
+	if !ok {
+		http.Error(w, "The conversation store does not report stats", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(store.Stats())
+}
+
+// Report estimated spend since startup per client and model
+func (s *Server) spendHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.spend.report())
+}
+
+// Report the rolling health score of every Azure endpoint called so far
+func (s *Server) endpointHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.health.report())
+}
+
+// StreamStats counts streaming work in flight
+type StreamStats struct {
+	Active      int `json:"active"`
+	Limit       int `json:"limit,omitempty"`
+	Connections int `json:"connections"`
+}
+
+// Report active upstream streams against the cap and connected SSE clients
+func (s *Server) streamStatsHandler(w http.ResponseWriter, r *http.Request) {
+	active, limit := s.generations.usage()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StreamStats{Active: active, Limit: limit, Connections: s.streams.count()})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdminListAndCancelGenerations(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{
+		"admin-key": {Name: "ops", Admin: true},
+		"user-key":  {Name: "alice"},
+	}
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}}
+	_, front := newTestServer(t, cfg, azure)
+
+	stream := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`, "X-API-Key", "user-key")
+	defer stream.Body.Close()
+
+	list := func(key string) (int, []generationInfo) {
+		req, _ := http.NewRequest("GET", front.URL+"/admin/generations", nil)
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var infos []generationInfo
+		json.Unmarshal([]byte(readBody(t, resp)), &infos)
+		return resp.StatusCode, infos
+	}
+
+	if status, _ := list("user-key"); status != http.StatusForbidden {
+		t.Errorf("non-admin status = %d, want 403", status)
+	}
+	_, infos := list("admin-key")
+	if len(infos) != 1 || infos[0].Client != "alice" || infos[0].ID != stream.Header.Get("X-Generation-ID") {
+		t.Fatalf("active generations = %+v", infos)
+	}
+
+	req, _ := http.NewRequest("POST", front.URL+"/admin/generations/"+infos[0].ID+"/cancel", nil)
+	req.Header.Set("X-API-Key", "admin-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("cancel status = %d, want 204", resp.StatusCode)
+	}
+
+	names := eventNames(parseSSE(readBody(t, stream)))
+	if len(names) == 0 || names[len(names)-1] != "error" {
+		t.Errorf("events = %v, want the stream to end with an error event", names)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, infos := list("admin-key"); len(infos) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled generation is still listed as active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
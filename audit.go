@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditConfig selects where audit entries are written
+type AuditConfig struct {
+	// "stdout", "file" or empty to disable auditing
+	Sink string `json:"sink"`
+	Path string `json:"path,omitempty"`
+	// Record the prompt and answer themselves, not only their hashes
+	FullContent bool `json:"fullContent"`
+	// Entries queued for the sink before new ones are dropped, at least 1
+	Buffer int `json:"buffer"`
+}
+
+// AuditEntry records one answered request. Each entry carries the hash of
+// the previous one, so removing or editing an entry breaks the chain.
+type AuditEntry struct {
+	Time         time.Time   `json:"time"`
+	RequestID    string      `json:"requestId"`
+	Client       string      `json:"client"`
+	ClientIP     string      `json:"clientIp,omitempty"`
+	Model        string      `json:"model"`
+	PromptHash   string      `json:"promptHash"`
+	ResponseHash string      `json:"responseHash"`
+	Usage        *TokenUsage `json:"usage,omitempty"`
+	Prompt       string      `json:"prompt,omitempty"`
+	Response     string      `json:"response,omitempty"`
+	PrevHash     string      `json:"prevHash"`
+	Hash         string      `json:"hash"`
+}
+
+// AuditSink stores audit entries, in order
+type AuditSink interface {
+	WriteEntry(AuditEntry) error
+}
+
+// jsonLinesSink writes one JSON entry per line
+type jsonLinesSink struct {
+	w io.Writer
+}
+
+func (s jsonLinesSink) WriteEntry(e AuditEntry) error {
+	return json.NewEncoder(s.w).Encode(e)
+}
+
+// auditLogger hashes and chains entries and hands them to the sink from a
+// background goroutine, so a slow sink never delays a response
+type auditLogger struct {
+	sink        AuditSink
+	fullContent bool
+	prevHash    string // hash of the last entry already in the sink
+	entries     chan AuditEntry
+	done        chan struct{}
+	dropped     atomic.Int64 // entries lost to a full queue or a closed logger
+
+	mu     sync.RWMutex // guards closed against sends on a closed channel
+	closed bool
+}
+
+// Build the audit logger for the config, nil when auditing is disabled
+func newAuditLogger(cfg AuditConfig) (*auditLogger, error) {
+	var sink AuditSink
+	prevHash := ""
+	switch cfg.Sink {
+	case "":
+		return nil, nil
+	case "stdout":
+		sink = jsonLinesSink{os.Stdout}
+	case "file":
+		f, err := os.OpenFile(cfg.Path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit file: %w", err)
+		}
+		// Continue the chain of the entries from earlier runs
+		if prevHash, err = lastAuditHash(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading audit file %s: %w", cfg.Path, err)
+		}
+		sink = jsonLinesSink{f}
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q, want stdout or file", cfg.Sink)
+	}
+	return startAuditLogger(sink, cfg.FullContent, cfg.Buffer, prevHash), nil
+}
+
+// Start a logger whose first entry chains onto prevHash, the hash of the
+// last entry already in the sink or "" for an empty one
+func startAuditLogger(sink AuditSink, fullContent bool, buffer int, prevHash string) *auditLogger {
+	a := &auditLogger{
+		sink:        sink,
+		fullContent: fullContent,
+		prevHash:    prevHash,
+		entries:     make(chan AuditEntry, buffer),
+		done:        make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Chain and write entries in arrival order
+func (a *auditLogger) run() {
+	defer close(a.done)
+	prev := a.prevHash
+	for e := range a.entries {
+		e.PrevHash = prev
+		e.Hash = auditHash(e)
+		prev = e.Hash
+		if err := a.sink.WriteEntry(e); err != nil {
+			log.Printf("WARNING: failed to write audit entry %s: %v", e.RequestID, err)
+		}
+	}
+}
+
+// Hash of the last entry in an audit file of JSON lines, "" when it has
+// none. The file is read backwards from the end, so a long log is not
+// read in full.
+func lastAuditHash(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	var tail []byte
+	buf := make([]byte, 4096)
+	for pos := info.Size(); pos > 0; {
+		n := min(int64(len(buf)), pos)
+		pos -= n
+		if _, err := f.ReadAt(buf[:n], pos); err != nil {
+			return "", err
+		}
+		tail = append(append([]byte(nil), buf[:n]...), tail...)
+		if i := bytes.LastIndexByte(bytes.TrimRight(tail, "\n"), '\n'); i >= 0 {
+			tail = tail[i+1:]
+			break
+		}
+	}
+	tail = bytes.TrimSpace(tail)
+	if len(tail) == 0 {
+		return "", nil
+	}
+	var last AuditEntry
+	if err := json.Unmarshal(tail, &last); err != nil {
+		return "", fmt.Errorf("last entry is not valid JSON: %w", err)
+	}
+	if last.Hash == "" {
+		return "", fmt.Errorf("last entry has no hash")
+	}
+	return last.Hash, nil
+}
+
+// Hash of an entry's content and its predecessor's hash
+func auditHash(e AuditEntry) string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Queue an audit entry for an answered request. A full queue drops the
+// entry rather than blocking the caller; each drop is counted and logged.
+func (a *auditLogger) record(ctx context.Context, model, prompt, response string, usage *AzureUsage) {
+	if a == nil {
+		return
+	}
+	e := AuditEntry{
+		Time:         time.Now().UTC(),
+		RequestID:    CorrelationID(ctx),
+		Client:       clientName(ctx),
+		ClientIP:     clientIPFromContext(ctx),
+		Model:        model,
+		PromptHash:   sha256Hex(prompt),
+		ResponseHash: sha256Hex(response),
+	}
+	if usage != nil {
+		u := usage.toTokenUsage()
+		e.Usage = &u
+	}
+	if a.fullContent {
+		e.Prompt = prompt
+		e.Response = response
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		logf(ctx, "WARNING: audit log closed, dropped entry (%d dropped since startup)", a.dropped.Add(1))
+		return
+	}
+	select {
+	case a.entries <- e:
+	default:
+		logf(ctx, "WARNING: audit queue full, dropped entry (%d dropped since startup)", a.dropped.Add(1))
+	}
+}
+
+// Flush queued entries and stop the writer
+func (a *auditLogger) Close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.entries)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memoryAuditSink collects entries for inspection
+type memoryAuditSink struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (m *memoryAuditSink) WriteEntry(e AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+func TestAuditEntryPerRequest(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{"key": {Name: "alice"}}
+	srv, front := newTestServer(t, cfg, &azureStub{content: "Answer.", deltas: []string{"Stre", "amed."}})
+	sink := &memoryAuditSink{}
+	srv.audit = startAuditLogger(sink, false, 16, "")
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "X-API-Key", "key", correlationHeader, "req-1"))
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"again","stream":true}`, "X-API-Key", "key"))
+	srv.audit.Close()
+
+	if len(sink.entries) != 2 {
+		t.Fatalf("got %d audit entries, want one per request", len(sink.entries))
+	}
+	first, second := sink.entries[0], sink.entries[1]
+	if first.RequestID != "req-1" || first.Client != "alice" || first.PromptHash != sha256Hex("hi") || first.ResponseHash != sha256Hex("Answer.") {
+		t.Errorf("first entry = %+v", first)
+	}
+	if first.Prompt != "" || first.Response != "" {
+		t.Error("content recorded without full content enabled")
+	}
+	if second.ResponseHash != sha256Hex("Streamed.") {
+		t.Errorf("streamed entry hashed %s, want the streamed answer", second.ResponseHash)
+	}
+	if first.PrevHash != "" || second.PrevHash != first.Hash || auditHash(second) != second.Hash {
+		t.Error("entries are not hash-chained")
+	}
+}
+
+func TestAuditFullContent(t *testing.T) {
+	srv, front := newTestServer(t, defaultConfig(), &azureStub{content: "Answer."})
+	sink := &memoryAuditSink{}
+	srv.audit = startAuditLogger(sink, true, 16, "")
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+	srv.audit.Close()
+
+	if len(sink.entries) != 1 || sink.entries[0].Prompt != "hi" || sink.entries[0].Response != "Answer." {
+		t.Fatalf("entries = %+v, want the full prompt and answer", sink.entries)
+	}
+}
+
+func TestAuditChainContinuesAcrossRestarts(t *testing.T) {
+	cfg := AuditConfig{Sink: "file", Path: filepath.Join(t.TempDir(), "audit.jsonl"), Buffer: 16}
+	for _, prompt := range []string{"first run", "second run"} {
+		a, err := newAuditLogger(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.record(context.Background(), "gpt-4o", prompt, "answer", nil)
+		a.Close()
+	}
+
+	data, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit file has %d lines, want 2", len(lines))
+	}
+	var first, second AuditEntry
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+	if first.Hash == "" || second.PrevHash != first.Hash || auditHash(second) != second.Hash {
+		t.Errorf("second run's entry chains onto %q, want the first run's hash %q", second.PrevHash, first.Hash)
+	}
+
+	os.WriteFile(cfg.Path, append(data, "{truncated"...), 0o600)
+	if _, err := newAuditLogger(cfg); err == nil {
+		t.Error("started on an audit file whose last entry is corrupt, want an error")
+	}
+}
+
+func TestLastAuditHashReadsLongEntries(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if hash, err := lastAuditHash(f); hash != "" || err != nil {
+		t.Errorf("empty file: hash %q, err %v, want neither", hash, err)
+	}
+	sink := jsonLinesSink{f}
+	sink.WriteEntry(AuditEntry{Prompt: "short", Hash: "h1"})
+	sink.WriteEntry(AuditEntry{Prompt: strings.Repeat("x", 10000), Hash: "h2"})
+	if hash, err := lastAuditHash(f); hash != "h2" || err != nil {
+		t.Errorf("hash = %q, err %v, want the entry spanning several reads", hash, err)
+	}
+}
+
+// blockingAuditSink holds every write until release is closed
+type blockingAuditSink struct {
+	memoryAuditSink
+	release chan struct{}
+}
+
+func (b *blockingAuditSink) WriteEntry(e AuditEntry) error {
+	<-b.release
+	return b.memoryAuditSink.WriteEntry(e)
+}
+
+func TestAuditCountsDroppedEntries(t *testing.T) {
+	sink := &blockingAuditSink{release: make(chan struct{})}
+	a := startAuditLogger(sink, false, 1, "")
+	for i := 0; i < 4; i++ {
+		a.record(context.Background(), "gpt-4o", "hi", "answer", nil)
+	}
+	close(sink.release)
+	a.Close()
+	a.record(context.Background(), "gpt-4o", "late", "answer", nil)
+
+	dropped := a.dropped.Load()
+	if dropped < 3 || int(dropped)+len(sink.entries) != 5 {
+		t.Errorf("dropped %d and wrote %d of 5 entries, want every entry not written counted", dropped, len(sink.entries))
+	}
+}
+
+func TestAuditBufferMustBePositive(t *testing.T) {
+	t.Setenv("AUDIT_BUFFER", "0")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig accepted AUDIT_BUFFER=0")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey int
+
+const (
+	clientContextKey contextKey = iota
+	correlationContextKey
+	clientIPContextKey
+)
+
+// Middleware that authenticates the caller by API key when clients are configured
+func (s *Server) requireClient(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.cfg.Clients) == 0 {
+			next(w, r)
+			return
+		}
+
+		client, ok := s.cfg.Clients[r.Header.Get("X-API-Key")]
+		if !ok {
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), clientContextKey, &client)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// requireClient as a Middleware, for use with Chain
+func (s *Server) clientAuth(next http.Handler) http.Handler {
+	return s.requireClient(next.ServeHTTP)
+}
+
+// requireAdmin as a Middleware, for use with Chain
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return s.requireAdmin(next.ServeHTTP)
+}
+
+// Returns the authenticated client for the request, or nil when auth is disabled
+func clientFromContext(ctx context.Context) *ClientConfig {
+	client, _ := ctx.Value(clientContextKey).(*ClientConfig)
+	return client
+}
+
+// Middleware that only admits authenticated admin clients. Admin endpoints
+// stay closed when client authentication is disabled.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireClient(func(w http.ResponseWriter, r *http.Request) {
+		client := clientFromContext(r.Context())
+		if client == nil || !client.Admin {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Returns the authenticated client's name, or "" when auth is disabled
+func clientName(ctx context.Context) string {
+	if client := clientFromContext(ctx); client != nil {
+		return client.Name
+	}
+	return ""
+}
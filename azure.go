@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upstreamError describes a failed call to Azure OpenAI
+type upstreamError struct {
+	Status   int    // status to return to our caller
+	Message  string // caller-facing message
+	Upstream int    // status returned by Azure, zero if no response
+	Body     []byte // raw Azure response body, if any
+	Code     string // machine-readable code, when the failure is actionable by us
+	Err      error
+
+	// Azure's ID for the failed request, for support escalation
+	RequestID string
+
+	// Set when the same request may succeed if sent again
+	Retryable bool
+}
+
+func (e *upstreamError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	if e.Upstream != 0 {
+		return fmt.Sprintf("%s: status %d: %s", e.Message, e.Upstream, string(e.Body))
+	}
+	return e.Message
+}
+
+// Error body returned by Azure OpenAI on non-2xx responses
+type azureErrorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Send a chat completion request to Azure OpenAI. Non-2xx responses are
+// returned as an *upstreamError with the body already consumed.
+func (s *Server) postAzure(ctx context.Context, endpoint string, data map[string]interface{}) (*http.Response, error) {
+	if !s.cfg.AllowInsecureUpstream {
+		if err := checkPayloadSchemes(endpoint, data); err != nil {
+			return nil, &upstreamError{Status: http.StatusInternalServerError, Message: "Refusing to send credentials to a non-https upstream", Err: err}
+		}
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, &upstreamError{Status: http.StatusInternalServerError, Message: "Failed to marshal request data", Err: err}
+	}
+
+	if s.cfg.LogUpstreamPayload {
+		debugf(ctx, true, "Azure request payload: %s", payloadForLog(data, s.cfg.UpstreamPayloadLogLimit))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, &upstreamError{Status: http.StatusInternalServerError, Message: "Failed to create request", Err: err}
+	}
+	for name, value := range s.cfg.UpstreamHeaders {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("api-key", s.cfg.APIKey)
+	if id := CorrelationID(ctx); id != "" {
+		req.Header.Set(correlationHeader, id)
+		req.Header.Set("x-ms-client-request-id", azureClientRequestID(id))
+	}
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// A caller that went away says nothing about the endpoint
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			s.health.observe(endpoint, false, time.Since(start))
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &upstreamError{Status: http.StatusGatewayTimeout, Message: "Azure OpenAI request timed out", Err: err}
+		}
+		return nil, &upstreamError{Status: http.StatusInternalServerError, Message: "Failed to send request to Azure OpenAI", Err: err}
+	}
+
+	s.health.observe(endpoint, healthyStatus(resp.StatusCode), time.Since(start))
+
+	// The transport only decompresses responses to its own Accept-Encoding,
+	// but some proxies gzip bodies regardless
+	if err := decodeContentEncoding(resp); err != nil {
+		resp.Body.Close()
+		return nil, &upstreamError{Status: http.StatusBadGateway, Message: "Failed to decompress response from Azure OpenAI", Err: err}
+	}
+
+	requestID := upstreamRequestID(resp.Header)
+	if requestID != "" {
+		logf(ctx, "Azure request ID: %s", requestID)
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		logf(ctx, "Error response from Azure: %s", string(body))
+		ue := &upstreamError{Status: http.StatusBadGateway, Message: "Azure OpenAI returned an error", Upstream: resp.StatusCode, Body: body, RequestID: requestID}
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			logf(ctx, "WARNING: Azure OpenAI rejected our credentials (status %d), check AZURE_API_KEY and AZURE_ENDPOINT", resp.StatusCode)
+			ue.Message = "Azure OpenAI rejected the configured credentials"
+			ue.Code = "upstream_auth_failed"
+		case isSearchAuthError(ue):
+			logf(ctx, "WARNING: Azure Search rejected our credentials, check AZURE_SEARCH_KEY and the tenant search keys")
+			ue.Message = "Azure Search rejected the configured credentials"
+			ue.Code = "upstream_auth_failed"
+		}
+		return nil, ue
+	}
+
+	return resp, nil
+}
+
+// Response header echoing Azure's request ID to our callers
+const upstreamRequestHeader = "X-Upstream-Request-ID"
+
+// The ID Azure support asks for when escalating a request: API Management's
+// apim-request-id, or the service's own x-ms-request-id behind no gateway
+func upstreamRequestID(h http.Header) string {
+	if id := h.Get("apim-request-id"); id != "" {
+		return id
+	}
+	return h.Get("x-ms-request-id")
+}
+
+// gzipBody closes both the gzip reader and the underlying response body
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// Replace a gzip-encoded response body with a transparently decompressing one
+func decodeContentEncoding(resp *http.Response) error {
+	if !strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip") {
+		return nil
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = gzipBody{Reader: zr, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+// Send a chat completion request to Azure OpenAI and decode the response,
+// sending it again up to UpstreamRetries times when the failure is
+// retryable, and up to EmptyChoicesRetries times when Azure answered with
+// no choices
+func (s *Server) callAzure(ctx context.Context, endpoint string, data map[string]interface{}) (*AzureResponse, error) {
+	policy := s.policyFor(endpoint)
+	retries, emptyRetries := 0, 0
+	for attempt := 1; ; attempt++ {
+		resp, err := s.callAzureOnce(ctx, endpoint, data)
+		ue, ok := err.(*upstreamError)
+		if err == nil || !ok || ctx.Err() != nil {
+			return resp, err
+		}
+		switch {
+		case ue.Code == "upstream_empty" && emptyRetries < policy.emptyChoicesRetries:
+			emptyRetries++
+		case ue.Retryable && retries < policy.retries:
+			retries++
+		default:
+			return resp, err
+		}
+		logf(ctx, "Retrying Azure request after attempt %d failed: %v", attempt, ue)
+	}
+}
+
+func (s *Server) callAzureOnce(ctx context.Context, endpoint string, data map[string]interface{}) (*AzureResponse, error) {
+	resp, err := s.postAzure(ctx, endpoint, data)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &upstreamError{Status: http.StatusGatewayTimeout, Message: "Azure OpenAI request timed out", Err: err}
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, incompleteResponse(ctx, len(body), resp.ContentLength, err)
+		}
+		return nil, &upstreamError{Status: http.StatusInternalServerError, Message: "Failed to read response from Azure OpenAI", Err: err}
+	}
+	if resp.ContentLength > 0 && int64(len(body)) < resp.ContentLength {
+		return nil, incompleteResponse(ctx, len(body), resp.ContentLength, io.ErrUnexpectedEOF)
+	}
+
+	logf(ctx, "Raw response from Azure: %s", string(body))
+
+	var azureResponse AzureResponse
+	err = json.Unmarshal(body, &azureResponse)
+	if err != nil {
+		logf(ctx, "Unmarshal error: %v", err)
+		// A body cut off without a Content-Length only shows up here
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) && syntaxErr.Offset >= int64(len(body)) {
+			return nil, incompleteResponse(ctx, len(body), resp.ContentLength, err)
+		}
+		return nil, &upstreamError{Status: http.StatusInternalServerError, Message: "Failed to unmarshal response data", Err: err}
+	}
+
+	if len(azureResponse.Choices) == 0 {
+		return nil, emptyChoicesError(ctx, azureResponse.PromptFilterResults)
+	}
+
+	azureResponse.RequestID = upstreamRequestID(resp.Header)
+	return &azureResponse, nil
+}
+
+// Error for a 200 response without choices. When the content filter
+// flagged the prompt the answer was withheld and asking again is pointless;
+// otherwise the empty answer is usually transient.
+func emptyChoicesError(ctx context.Context, filters []AzurePromptFilterResult) *upstreamError {
+	for _, result := range promptFilterResults(filters) {
+		if result.Filtered {
+			logf(ctx, "Azure returned no choices, prompt filtered for %s", result.Category)
+			return &upstreamError{
+				Status:  http.StatusBadRequest,
+				Message: "The request was blocked by the content filter",
+				Code:    "content_filtered",
+			}
+		}
+	}
+	logf(ctx, "Azure returned no choices")
+	return &upstreamError{Status: http.StatusInternalServerError, Message: "No response choices returned", Code: "upstream_empty"}
+}
+
+// Error for a response body that ended early, e.g. on a connection reset
+func incompleteResponse(ctx context.Context, read int, contentLength int64, err error) *upstreamError {
+	logf(ctx, "Incomplete response from Azure: read %d of %d bytes", read, contentLength)
+	return &upstreamError{
+		Status:    http.StatusBadGateway,
+		Message:   "Azure OpenAI returned an incomplete response",
+		Code:      "upstream_incomplete",
+		Err:       err,
+		Retryable: true,
+	}
+}
+
+const searchFallbackWarning = "Search grounding is temporarily unavailable; this answer is not based on the indexed documents."
+
+// Run call, and when it fails because of Azure Search and fallback is
+// enabled, retry it once with the data_sources block removed. Reports
+// whether the final attempt was grounded, plus any warnings for the caller.
+// Payloads without data_sources are never grounded and never retried.
+func (s *Server) withSearchFallback(ctx context.Context, data map[string]interface{}, call func() error) (bool, []string, error) {
+	if _, ok := data["data_sources"]; !ok {
+		return false, nil, call()
+	}
+
+	err := call()
+	if err == nil || !s.cfg.Features.FallbackWithoutSearch || !isSearchError(err) {
+		return true, nil, err
+	}
+
+	logf(ctx, "Azure Search failed, retrying without grounding: %v", err)
+	delete(data, "data_sources")
+	return false, []string{searchFallbackWarning}, call()
+}
+
+// Write an upstream failure to the caller, as a structured error when it
+// has a code. Messages are our own, so nothing from the request leaks.
+func (s *Server) writeUpstreamError(w http.ResponseWriter, r *http.Request, ue *upstreamError) {
+	var details map[string]interface{}
+	if ue.RequestID != "" {
+		w.Header().Set(upstreamRequestHeader, ue.RequestID)
+		details = map[string]interface{}{"upstreamRequestId": ue.RequestID}
+	}
+	if ue.Code != "" {
+		s.writeError(w, r, ue.Status, ue.Code, ue.Message, details)
+		return
+	}
+	http.Error(w, ue.Message, ue.Status)
+}
+
+// Reports whether a search failure was Azure Search refusing our key
+func isSearchAuthError(err error) bool {
+	if !isSearchError(err) {
+		return false
+	}
+	message := strings.ToLower(string(err.(*upstreamError).Body))
+	for _, marker := range []string{"401", "403", "unauthorized", "forbidden", "authorization failed", "authentication failed", "api key"} {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether an upstream error was caused by the Azure Search data source
+// rather than the model itself (bad index, search outage, invalid search key).
+func isSearchError(err error) bool {
+	ue, ok := err.(*upstreamError)
+	if !ok || ue.Upstream == 0 {
+		return false
+	}
+
+	var errBody azureErrorBody
+	message := string(ue.Body)
+	if json.Unmarshal(ue.Body, &errBody) == nil && errBody.Error.Message != "" {
+		message = errBody.Error.Message
+	}
+	message = strings.ToLower(message)
+
+	for _, marker := range []string{"cognitivesearch", "cognitive search", "azure search", "azure_search", "search index", "search service"} {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGroundingDisabledReportsUngrounded(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Features.Grounding = false
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, cfg, azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	var chat ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &chat)
+
+	if chat.Grounded {
+		t.Error("ungrounded answer reported grounded: true")
+	}
+	if len(chat.Warnings) != 0 {
+		t.Errorf("warnings = %v, want none when grounding is disabled", chat.Warnings)
+	}
+	if _, ok := azure.payload(t, 0)["data_sources"]; ok {
+		t.Error("data_sources sent with grounding disabled")
+	}
+}
+
+func TestSearchFallbackRetriesWithoutDataSources(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Features.FallbackWithoutSearch = true
+	calls := 0
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":"400","message":"Invalid AzureCognitiveSearch configuration detected"}}`))
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"Answer."}}]}`))
+	}
+	_, front := newTestServer(t, cfg, azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	var chat ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &chat)
+
+	if resp.StatusCode != http.StatusOK || chat.Grounded || len(chat.Warnings) != 1 {
+		t.Fatalf("status=%d grounded=%v warnings=%v, want 200, false and one warning", resp.StatusCode, chat.Grounded, chat.Warnings)
+	}
+	if _, ok := azure.payload(t, 1)["data_sources"]; ok {
+		t.Error("retry still carried data_sources")
+	}
+}
+
+func TestBlockingRequestTimesOutWith504(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AzureTimeout = 50 * time.Millisecond
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}}
+	_, front := newTestServer(t, cfg, azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", resp.StatusCode)
+	}
+}
+
+func TestLoadConfigRejectsAzureTimeoutAboveWriteTimeout(t *testing.T) {
+	t.Setenv("AZURE_TIMEOUT", "90s")
+	t.Setenv("SERVER_WRITE_TIMEOUT", "60s")
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("loadConfig accepted AZURE_TIMEOUT >= SERVER_WRITE_TIMEOUT")
+	}
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(s))
+	zw.Close()
+	return b.Bytes()
+}
+
+func TestGzipEncodedAzureResponse(t *testing.T) {
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped(t, `{"choices":[{"message":{"content":"Compressed answer."}}]}`))
+	}}
+	srv, front := newTestServer(t, defaultConfig(), azure)
+	// Without DisableCompression the transport would decompress for us
+	srv.client = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	var chat ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &chat)
+	if resp.StatusCode != http.StatusOK || chat.Response != "Compressed answer." {
+		t.Fatalf("status=%d response=%q", resp.StatusCode, chat.Response)
+	}
+}
+
+func TestGzipEncodedAzureStream(t *testing.T) {
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped(t, "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n"))
+	}}
+	srv, front := newTestServer(t, defaultConfig(), azure)
+	srv.client = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)))
+	var tokens []string
+	for _, ev := range events {
+		if ev.Name == "token" {
+			tokens = append(tokens, ev.Data)
+		}
+	}
+	if len(tokens) != 1 || tokens[0] != `{"content":"Hi"}` {
+		t.Fatalf("tokens = %v, events = %v", tokens, eventNames(events))
+	}
+}
+
+func TestAzureAuthFailureIsTyped(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"openai key", http.StatusUnauthorized, `{"error":{"code":"401","message":"Access denied due to invalid subscription key"}}`},
+		{"search key", http.StatusBadRequest, `{"error":{"code":"400","message":"An error occurred when calling Azure Cognitive Search: Azure Search Error: 403, message='Authorization failed.'"}}`},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.APIKey = "secret-key-value"
+		azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}}
+		_, front := newTestServer(t, cfg, azure)
+
+		resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+		body := readBody(t, resp)
+		var errResp ErrorResponse
+		json.Unmarshal([]byte(body), &errResp)
+		if resp.StatusCode != http.StatusBadGateway || errResp.Code != "upstream_auth_failed" {
+			t.Errorf("%s: status=%d body=%s, want 502 upstream_auth_failed", tt.name, resp.StatusCode, body)
+		}
+		if bytes.Contains([]byte(body), []byte(cfg.APIKey)) {
+			t.Errorf("%s: response echoed the API key", tt.name)
+		}
+	}
+}
+
+func TestUpstreamRequestIDIsSurfaced(t *testing.T) {
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-request-id", "ms-1")
+		w.Header().Set("apim-request-id", "apim-1")
+		var payload map[string]interface{}
+		if json.NewDecoder(r.Body).Decode(&payload); payload["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"Answer."}}]}`))
+	}}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	var chat ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &chat)
+	if chat.UpstreamRequestID != "apim-1" {
+		t.Errorf("blocking upstreamRequestId = %q, want the apim-request-id", chat.UpstreamRequestID)
+	}
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)
+	events := parseSSE(readBody(t, resp))
+	var started map[string]string
+	var done StreamDone
+	for _, ev := range events {
+		switch ev.Name {
+		case "generation":
+			json.Unmarshal([]byte(ev.Data), &started)
+		case "done":
+			json.Unmarshal([]byte(ev.Data), &done)
+		}
+	}
+	if resp.Header.Get("X-Upstream-Request-ID") != "apim-1" || started["upstreamRequestId"] != "apim-1" || done.UpstreamRequestID != "apim-1" {
+		t.Errorf("stream header=%q generation=%v done=%q", resp.Header.Get("X-Upstream-Request-ID"), started, done.UpstreamRequestID)
+	}
+}
+
+func TestUpstreamRequestIDOnError(t *testing.T) {
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-request-id", "ms-2")
+		w.WriteHeader(http.StatusUnauthorized)
+	}}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	var errResp ErrorResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &errResp)
+	if resp.Header.Get("X-Upstream-Request-ID") != "ms-2" || errResp.Details["upstreamRequestId"] != "ms-2" {
+		t.Errorf("header=%q error=%+v, want x-ms-request-id ms-2", resp.Header.Get("X-Upstream-Request-ID"), errResp)
+	}
+}
+
+func TestTruncatedBodyIsRetried(t *testing.T) {
+	full := `{"choices":[{"message":{"content":"Answer."}}]}`
+	azure := &azureStub{}
+	calls := 0
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			// Promise the whole body but send half, as on a connection reset
+			w.Header().Set("Content-Length", strconv.Itoa(len(full)))
+			io.WriteString(w, full[:len(full)/2])
+			return
+		}
+		io.WriteString(w, full)
+	}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || calls != 2 {
+		t.Fatalf("status=%d calls=%d body=%s", resp.StatusCode, calls, body)
+	}
+}
+
+func TestTruncatedBodyReportsUpstreamIncomplete(t *testing.T) {
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		// Chunked and cut off mid-object
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[{"message":{"content":"Ans`)
+	}
+	cfg := defaultConfig()
+	cfg.UpstreamRetries = 0
+	_, front := newTestServer(t, cfg, azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	var got ErrorResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if resp.StatusCode != http.StatusBadGateway || got.Code != "upstream_incomplete" {
+		t.Fatalf("status=%d error=%+v", resp.StatusCode, got)
+	}
+}
+
+func TestEmptyChoicesAreRetried(t *testing.T) {
+	azure := &azureStub{}
+	calls := 0
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			io.WriteString(w, `{"choices":[]}`)
+			return
+		}
+		io.WriteString(w, `{"choices":[{"message":{"content":"Answer."}}]}`)
+	}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || calls != 2 {
+		t.Fatalf("status=%d calls=%d body=%s", resp.StatusCode, calls, body)
+	}
+}
+
+func TestEmptyChoicesGiveUp(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantCalls  int
+	}{
+		{"transient", `{"choices":[]}`, http.StatusInternalServerError, "upstream_empty", 3},
+		{"content filtered", `{"choices":[],"prompt_filter_results":[{"prompt_index":0,"content_filter_results":{"hate":{"filtered":true,"severity":"high"}}}]}`, http.StatusBadRequest, "content_filtered", 1},
+	}
+	for _, tt := range tests {
+		calls := 0
+		azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, tt.body)
+		}}
+		cfg := defaultConfig()
+		cfg.EmptyChoicesRetries = 2
+		_, front := newTestServer(t, cfg, azure)
+
+		resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+		var got ErrorResponse
+		json.Unmarshal([]byte(readBody(t, resp)), &got)
+		if resp.StatusCode != tt.wantStatus || got.Code != tt.wantCode || calls != tt.wantCalls {
+			t.Errorf("%s: status=%d code=%q calls=%d, want %d %q %d", tt.name, resp.StatusCode, got.Code, calls, tt.wantStatus, tt.wantCode, tt.wantCalls)
+		}
+	}
+}
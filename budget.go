@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// What to do with a prompt whose estimated tokens exceed the budget
+const (
+	promptBudgetTruncate  = "truncate"  // drop the oldest history messages
+	promptBudgetSummarize = "summarize" // replace the history with a summary
+	promptBudgetReject    = "reject"    // fail with 413 context_too_large
+)
+
+// PromptBudgetConfig caps the estimated input tokens of a chat request,
+// system prompt, history and message together
+type PromptBudgetConfig struct {
+	// Zero disables the budget
+	MaxTokens int `json:"maxTokens"`
+
+	// truncate, summarize or reject. Whatever the mode, a prompt still
+	// over budget without any history is rejected.
+	Mode string `json:"mode"`
+
+	// Completion budget for the history summary in summarize mode, written
+	// by the ConversationSummary model
+	SummaryMaxTokens int `json:"summaryMaxTokens"`
+}
+
+const historySummaryPrompt = `Summarize the conversation below so the summary can stand in for it as context for the next question. Keep names, facts, decisions and open questions. Reply with the summary only.`
+
+// Render chat messages as a plain transcript for summarizing
+func formatMessageTranscript(messages []map[string]interface{}) string {
+	var b strings.Builder
+	for _, m := range messages {
+		role, _ := m["role"].(string)
+		content, _ := m["content"].(string)
+		fmt.Fprintf(&b, "%s: %s\n\n", role, content)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Ask the summary model to condense history messages into one
+func (s *Server) summarizeHistory(ctx context.Context, history []map[string]interface{}) (map[string]interface{}, error) {
+	_, model, _ := s.cfg.modelFor(s.cfg.ConversationSummary.Model)
+	data := map[string]interface{}{
+		"messages": []map[string]interface{}{
+			{"role": "system", "content": historySummaryPrompt},
+			{"role": "user", "content": formatMessageTranscript(history)},
+		},
+	}
+	applyParams(data, GenerationParams{MaxTokens: s.cfg.PromptBudget.SummaryMaxTokens, TopP: 1}, model)
+
+	ctx, cancel := context.WithTimeout(ctx, s.policyFor(model.Endpoint).timeout)
+	defer cancel()
+	resp, err := s.callAzure(ctx, model.Endpoint, data)
+	if err != nil {
+		return nil, err
+	}
+	summary := strings.TrimSpace(resp.Choices[0].Message.Content)
+	return map[string]interface{}{"role": "system", "content": "Summary of the earlier conversation: " + summary}, nil
+}
+
+// Bring the payload's messages within the prompt token budget. The history
+// is the historyLen messages after the system prompt. Reports false after
+// writing the error when the request has to be rejected.
+func (s *Server) fitPromptBudget(w http.ResponseWriter, r *http.Request, data map[string]interface{}, historyLen int) bool {
+	budget := s.cfg.PromptBudget
+	messages := data["messages"].([]map[string]interface{})
+	estimate := estimateMessagesTokens(s.tokens, messages)
+	if budget.MaxTokens <= 0 || estimate <= budget.MaxTokens {
+		return true
+	}
+
+	system, history, rest := messages[:1], messages[1:1+historyLen], messages[1+historyLen:]
+	fitted := estimate
+	switch budget.Mode {
+	case promptBudgetTruncate:
+		for len(history) > 0 && fitted > budget.MaxTokens {
+			history = history[1:]
+			fitted = estimateMessagesTokens(s.tokens, joinMessages(system, history, rest))
+		}
+		logf(r.Context(), "Dropped %d history messages to fit the %d token prompt budget", historyLen-len(history), budget.MaxTokens)
+	case promptBudgetSummarize:
+		if len(history) > 0 {
+			summary, err := s.summarizeHistory(r.Context(), history)
+			if err != nil {
+				ue := err.(*upstreamError)
+				logf(r.Context(), "Azure history summary request failed: %v", ue)
+				s.writeUpstreamError(w, r, ue)
+				return false
+			}
+			history = []map[string]interface{}{summary}
+			fitted = estimateMessagesTokens(s.tokens, joinMessages(system, history, rest))
+			logf(r.Context(), "Summarized %d history messages to fit the %d token prompt budget", historyLen, budget.MaxTokens)
+		}
+	}
+	if fitted > budget.MaxTokens {
+		s.writeError(w, r, http.StatusRequestEntityTooLarge, "context_too_large", "The prompt is larger than the allowed token budget", map[string]interface{}{
+			"promptTokens": fitted,
+			"budget":       budget.MaxTokens,
+			"mode":         budget.Mode,
+		})
+		return false
+	}
+	data["messages"] = joinMessages(system, history, rest)
+	return true
+}
+
+// Concatenate message slices into a new one
+func joinMessages(parts ...[]map[string]interface{}) []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func budgetPayload() map[string]interface{} {
+	return map[string]interface{}{"messages": []map[string]interface{}{
+		{"role": "system", "content": "Be brief."},
+		{"role": "user", "content": strings.Repeat("old question ", 20)},
+		{"role": "assistant", "content": strings.Repeat("old answer ", 20)},
+		{"role": "user", "content": "New question?"},
+	}}
+}
+
+// Run fitPromptBudget on budgetPayload with the given budget, returning the
+// payload's messages afterwards and the response written, if any
+func runPromptBudget(t *testing.T, srv *Server, mode string, maxTokens int) ([]map[string]interface{}, *httptest.ResponseRecorder, bool) {
+	t.Helper()
+	srv.cfg.PromptBudget.Mode = mode
+	srv.cfg.PromptBudget.MaxTokens = maxTokens
+	data := budgetPayload()
+	w := httptest.NewRecorder()
+	ok := srv.fitPromptBudget(w, httptest.NewRequest("POST", "/api/chat", nil), data, 2)
+	return data["messages"].([]map[string]interface{}), w, ok
+}
+
+func TestPromptBudgetModesAtBoundary(t *testing.T) {
+	azure := &azureStub{content: "They talked about old things."}
+	srv, _ := newTestServer(t, defaultConfig(), azure)
+	full := estimateMessagesTokens(srv.tokens, budgetPayload()["messages"].([]map[string]interface{}))
+
+	for _, mode := range []string{promptBudgetTruncate, promptBudgetSummarize, promptBudgetReject} {
+		if messages, _, ok := runPromptBudget(t, srv, mode, full); !ok || len(messages) != 4 {
+			t.Errorf("%s at the budget: ok=%v, %d messages; want the payload untouched", mode, ok, len(messages))
+		}
+	}
+
+	messages, _, ok := runPromptBudget(t, srv, promptBudgetTruncate, full-1)
+	if !ok || len(messages) != 3 || messages[1]["role"] != "assistant" {
+		t.Errorf("truncate one over the budget: ok=%v, messages=%v; want the oldest message dropped", ok, messages)
+	}
+
+	messages, _, ok = runPromptBudget(t, srv, promptBudgetSummarize, full-1)
+	if !ok || len(messages) != 3 || messages[1]["content"] != "Summary of the earlier conversation: They talked about old things." {
+		t.Errorf("summarize one over the budget: ok=%v, messages=%v", ok, messages)
+	}
+	if len(azure.payloads) != 1 {
+		t.Errorf("azure received %d summary requests, want 1", len(azure.payloads))
+	}
+
+	_, w, ok := runPromptBudget(t, srv, promptBudgetReject, full-1)
+	var got ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if ok || w.Code != http.StatusRequestEntityTooLarge || got.Code != "context_too_large" || got.Details["promptTokens"] != float64(full) {
+		t.Errorf("reject one over the budget: ok=%v status=%d error=%+v", ok, w.Code, got)
+	}
+}
+
+func TestPromptBudgetRejectsWhenHistoryIsNotEnough(t *testing.T) {
+	srv, _ := newTestServer(t, defaultConfig(), &azureStub{})
+	if _, w, ok := runPromptBudget(t, srv, promptBudgetTruncate, 5); ok || w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("truncate below the message alone: ok=%v status=%d, want 413", ok, w.Code)
+	}
+}
+
+func TestChatPromptBudget(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PromptBudget = PromptBudgetConfig{MaxTokens: 10, Mode: promptBudgetReject, SummaryMaxTokens: 300}
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, cfg, azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || len(azure.payloads) != 0 {
+		t.Errorf("status = %d after %d Azure calls, want 413 before any", resp.StatusCode, len(azure.payloads))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Inline markers such as "[2]", "[doc3]" or "[1, 4]", with the space
+// before them so a dropped marker does not leave a gap before punctuation
+var inlineMarkerRegex = regexp.MustCompile(`(\s*)\[((?:doc)?\d+(?:\s*,\s*(?:doc)?\d+)*)\]`)
+
+var leadingNumberRegex = regexp.MustCompile(`^\s*(?:\[(\d+)\]|(\d+)[.)])\s*`)
+
+// citationSource is a reference the model's markers can point at
+type citationSource struct {
+	index  int    // position in the reference list it came from
+	number int    // number the model used for it
+	text   string // reference text without its number
+	ref    Reference
+}
+
+// Sources for inline markers: Azure citations numbered docN when the
+// answer was grounded, otherwise the model's own numbered reference lines
+func citationSources(context *AzureMessageContext, lines []string) []citationSource {
+	var sources []citationSource
+	if context != nil && len(context.Citations) > 0 {
+		for i, ref := range citationsToReferences(context.Citations, 0) {
+			text := ref.Title
+			if ref.URL != "" {
+				text += ". " + ref.URL
+			}
+			sources = append(sources, citationSource{index: i, number: i + 1, text: text, ref: ref})
+		}
+		return sources
+	}
+	for i, line := range lines {
+		number := i + 1
+		if m := leadingNumberRegex.FindStringSubmatch(line); m != nil {
+			digits := m[1] + m[2]
+			number, _ = strconv.Atoi(digits)
+		}
+		text := leadingNumberRegex.ReplaceAllString(line, "")
+		sources = append(sources, citationSource{index: i, number: number, text: text, ref: parseStructuredReference(line)})
+	}
+	return sources
+}
+
+// Renumber the inline markers in content as 1, 2, ... in order of first
+// use and drop markers that match no source. Returns the rewritten
+// content and the sources reordered so that marker n is sources[n-1];
+// sources never cited follow the cited ones.
+func renumberCitations(content string, sources []citationSource) (string, []citationSource) {
+	byNumber := make(map[int]int, len(sources))
+	for i, src := range sources {
+		if _, dup := byNumber[src.number]; !dup {
+			byNumber[src.number] = i
+		}
+	}
+
+	assigned := make(map[int]int) // index into sources -> new number
+	var ordered []citationSource
+	content = inlineMarkerRegex.ReplaceAllStringFunc(content, func(match string) string {
+		m := inlineMarkerRegex.FindStringSubmatch(match)
+		var numbers []string
+		for _, part := range strings.Split(m[2], ",") {
+			n, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(part), "doc"))
+			idx, ok := byNumber[n]
+			if !ok {
+				continue
+			}
+			if _, ok := assigned[idx]; !ok {
+				ordered = append(ordered, sources[idx])
+				assigned[idx] = len(ordered)
+			}
+			numbers = append(numbers, strconv.Itoa(assigned[idx]))
+		}
+		if len(numbers) == 0 {
+			return ""
+		}
+		return m[1] + "[" + strings.Join(numbers, ", ") + "]"
+	})
+
+	for i, src := range sources {
+		if _, ok := assigned[i]; !ok {
+			ordered = append(ordered, src)
+		}
+	}
+	return content, ordered
+}
+
+// Put refs, as extracted from the same citations or lines as sources, in
+// the order of the renumbered sources
+func reorderReferences(refs []Reference, sources []citationSource) []Reference {
+	if len(refs) != len(sources) {
+		return refs
+	}
+	ordered := make([]Reference, len(sources))
+	for i, src := range sources {
+		ordered[i] = refs[src.index]
+	}
+	return ordered
+}
+
+// Build the aligned reference list and citation map for renumbered sources
+func citationOutput(sources []citationSource) ([]string, map[string]Reference) {
+	references := make([]string, len(sources))
+	citationMap := make(map[string]Reference, len(sources))
+	for i, src := range sources {
+		references[i] = fmt.Sprintf("[%d] %s", i+1, src.text)
+		citationMap[strconv.Itoa(i+1)] = src.ref
+	}
+	return references, citationMap
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRenumberCitations(t *testing.T) {
+	lines := []string{"1. Alpha. https://a.example", "2. Beta", "3. Gamma"}
+	content := "Go is fast [3]. It is simple [1, 9]. Unknown source [7]. Again [3]."
+
+	got, sources := renumberCitations(content, citationSources(nil, lines))
+	if want := "Go is fast [1]. It is simple [2]. Unknown source. Again [1]."; got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+	refs, citationMap := citationOutput(sources)
+	if want := []string{"[1] Gamma", "[2] Alpha. https://a.example", "[3] Beta"}; !reflect.DeepEqual(refs, want) {
+		t.Errorf("references = %q, want %q", refs, want)
+	}
+	if citationMap["2"].URL != "https://a.example" || citationMap["1"].Title != "Gamma" {
+		t.Errorf("citationMap = %+v", citationMap)
+	}
+}
+
+func TestRenumberAzureDocMarkers(t *testing.T) {
+	ctx := &AzureMessageContext{Citations: []AzureCitation{{Title: "First"}, {Title: "Second", URL: "https://s"}}}
+	got, sources := renumberCitations("See [doc2] and [doc1][doc2].", citationSources(ctx, nil))
+	if want := "See [1] and [2][1]."; got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+	if sources[0].ref.Title != "Second" || sources[1].ref.Title != "First" {
+		t.Errorf("sources = %+v", sources)
+	}
+}
+
+func TestInlineCitationsResponse(t *testing.T) {
+	azure := &azureStub{content: "Answer [2] and [5].\nReferences:\n1. One\n2. Two"}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","inlineCitations":true}`)
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if got.Response != "Answer [1] and." || len(got.References) != 2 || got.References[0] != "[1] Two" || got.CitationMap["1"].Title != "Two" {
+		t.Fatalf("response = %+v", got)
+	}
+}
+
+func TestReferenceOrderByAppearance(t *testing.T) {
+	azure := &azureStub{content: "Beta first [2], then Gamma [3], then Beta again [2].\nReferences:\n1. Alpha\n2. Beta\n3. Gamma"}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","referenceOrder":"appearance","reference_formats":["strings","structured"]}`)
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if want := "Beta first [1], then Gamma [2], then Beta again [1]."; got.Response != want {
+		t.Errorf("response = %q, want %q", got.Response, want)
+	}
+	if want := []string{"[1] Beta", "[2] Gamma", "[3] Alpha"}; !reflect.DeepEqual(got.References, want) {
+		t.Errorf("references = %q, want %q", got.References, want)
+	}
+	var titles []string
+	for _, ref := range got.StructuredReferences {
+		titles = append(titles, ref.Title)
+	}
+	if want := []string{"Beta", "Gamma", "Alpha"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("structured titles = %q, want %q", titles, want)
+	}
+	if got.CitationMap != nil {
+		t.Error("citationMap returned without inlineCitations")
+	}
+}
+
+func TestReferenceOrderWithoutMarkersKeepsModelOrder(t *testing.T) {
+	azure := &azureStub{content: "No markers here.\nReferences:\n1. Alpha\n2. Beta"}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","referenceOrder":"appearance"}`)
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if want := []string{"1. Alpha", "2. Beta"}; !reflect.DeepEqual(got.References, want) {
+		t.Errorf("references = %q, want %q", got.References, want)
+	}
+
+	if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","referenceOrder":"alphabetical"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid referenceOrder status = %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct without header", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"untrusted source spoofing", "203.0.113.7:4000", []string{"1.2.3.4"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:4000", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"trusted single host", "192.168.1.5:4000", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"client-supplied hop before the proxy", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.9"}, "198.51.100.9"},
+		{"proxy chain", "10.1.2.3:4000", []string{"198.51.100.9, 10.9.9.9"}, "198.51.100.9"},
+		{"repeated headers", "10.1.2.3:4000", []string{"198.51.100.9", "10.9.9.9"}, "198.51.100.9"},
+		{"garbage hop", "10.1.2.3:4000", []string{"not-an-ip"}, "10.1.2.3"},
+		{"trusted proxy without header", "10.1.2.3:4000", nil, "10.1.2.3"},
+		{"ipv6", "[2001:db8::1]:4000", []string{"1.2.3.4"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := resolveClientIP(r, trusted); got != tt.want {
+			t.Errorf("%s: resolveClientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxiesRejectsGarbage(t *testing.T) {
+	if _, err := parseTrustedProxies("10.0.0.0/8,nope"); err == nil {
+		t.Error("parseTrustedProxies accepted an invalid entry")
+	}
+}
+
+func TestClientIPMiddleware(t *testing.T) {
+	trusted, _ := parseTrustedProxies("10.0.0.0/8")
+	var got string
+	h := clientIPMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = ClientIP(r)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.9")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "198.51.100.9" {
+		t.Errorf("ClientIP behind a trusted proxy = %q", got)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+	if ip := ClientIP(r); ip != "203.0.113.7" {
+		t.Errorf("ClientIP without the middleware = %q", ip)
+	}
+}
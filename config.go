@@ -0,0 +1,1053 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SearchConfig holds the Azure Cognitive Search settings used for grounding
+type SearchConfig struct {
+	Endpoint string `json:"endpoint,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Index    string `json:"index,omitempty"`
+
+	// Semantic configurations defined on the index that requests may pick
+	// with semanticConfig, besides "default"
+	SemanticConfigs []string `json:"semanticConfigs,omitempty"`
+
+	// OData filter applied to every search, and the fields requests may
+	// filter on with searchFilters
+	Filter           string   `json:"filter,omitempty"`
+	FilterableFields []string `json:"filterableFields,omitempty"`
+
+	// Path prefixes of the documents citations may come from, matched on
+	// the citation's filepath or else its URL. With an allowlist only
+	// matching documents are cited; the denylist always wins. Filtered
+	// citations are logged and their markers dropped. InstructSources also
+	// tells the model which documents to ignore.
+	AllowedSources  []string `json:"allowedSources,omitempty"`
+	DeniedSources   []string `json:"deniedSources,omitempty"`
+	InstructSources bool     `json:"instructSources,omitempty"`
+
+	// Semantic configuration selected for the current request
+	SemanticConfig string `json:"-"`
+}
+
+// TenantConfig holds server-side settings that differ per tenant
+type TenantConfig struct {
+	Search SearchConfig `json:"search"`
+
+	// Generation defaults for the tenant's clients, e.g. a lower temperature
+	Defaults ParamOverrides `json:"defaults,omitempty"`
+
+	// Overrides the answer footer for the tenant's clients; empty turns it off
+	Footer *string `json:"footer,omitempty"`
+}
+
+// ClientConfig describes an API client allowed to call the service
+type ClientConfig struct {
+	Name   string `json:"name"`
+	Tenant string `json:"tenant,omitempty"`
+
+	// Admin clients may call the /admin endpoints
+	Admin bool `json:"admin,omitempty"`
+
+	// Overrides the global per-request cost ceiling for this client
+	MaxRequestCost float64 `json:"maxRequestCost,omitempty"`
+
+	// Generation defaults for this client, layered over the tenant's
+	Defaults ParamOverrides `json:"defaults,omitempty"`
+
+	// Models this client may use; empty falls back to DefaultAllowedModels
+	AllowedModels []string `json:"allowedModels,omitempty"`
+
+	// Label routing rules can match on, e.g. "premium"
+	Tier string `json:"tier,omitempty"`
+}
+
+// ModelConfig holds settings for a selectable model deployment
+type ModelConfig struct {
+	// Chat completions URL for the deployment, defaults to AZURE_ENDPOINT
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Prices per 1000 tokens, in the configured currency
+	InputCostPer1K  float64 `json:"inputCostPer1K,omitempty"`
+	OutputCostPer1K float64 `json:"outputCostPer1K,omitempty"`
+
+	// Default generation parameters for this model
+	Defaults ParamOverrides `json:"defaults,omitempty"`
+
+	// Total tokens the deployment accepts, prompt and completion together.
+	// When set and no configured default fixes maxTokens, max_tokens is
+	// sized to fit.
+	ContextWindow int `json:"contextWindow,omitempty"`
+
+	// Parameters the deployment accepts, defaulting to true for chat models
+	// and false for reasoning models. Unsupported ones are left out of the
+	// payload rather than sent and rejected.
+	SupportsTemperature *bool `json:"supportsTemperature,omitempty"`
+	SupportsTopP        *bool `json:"supportsTopP,omitempty"`
+	SupportsPenalties   *bool `json:"supportsPenalties,omitempty"`
+
+	// Reasoning models take max_completion_tokens instead of max_tokens and
+	// accept no sampling parameters unless the flags above say otherwise
+	Reasoning bool `json:"reasoning,omitempty"`
+
+	// Overrides of AzureTimeout, UpstreamRetries and EmptyChoicesRetries
+	// for calls to this model's endpoint, e.g. a longer timeout for a slow
+	// fallback deployment. Timeout is a duration such as "90s". Models on
+	// the same endpoint share its policy.
+	Timeout             string `json:"timeout,omitempty"`
+	UpstreamRetries     *int   `json:"upstreamRetries,omitempty"`
+	EmptyChoicesRetries *int   `json:"emptyChoicesRetries,omitempty"`
+
+	// More chat completions URLs serving the same deployment, balanced with
+	// Endpoint by their health scores. They share its timeouts and retries.
+	Replicas []string `json:"replicas,omitempty"`
+}
+
+// Features holds the boolean toggles that change handler behavior
+type Features struct {
+	// Send the Azure Search data_sources block with chat requests
+	Grounding bool `json:"grounding"`
+	// Retry without data_sources when Azure Search fails
+	FallbackWithoutSearch bool `json:"fallbackWithoutSearch"`
+	// Reject request bodies containing unknown fields
+	StrictDecoding bool `json:"strictDecoding"`
+	// Reject chat requests whose Content-Type is not application/json
+	RequireJSONContentType bool `json:"requireJsonContentType"`
+	// Stream the cached sources of a repeated grounded query before its answer
+	CachedReferences bool `json:"cachedReferences"`
+	// Return Azure's verdicts on the prompt as promptFilterResults
+	PromptFilterResults bool `json:"promptFilterResults"`
+	// Attach trace exemplars to the latency histogram on OpenMetrics scrapes
+	MetricsExemplars bool `json:"metricsExemplars"`
+}
+
+// ServerConfig holds settings for the HTTP server itself
+type ServerConfig struct {
+	Addr              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// On SIGTERM, open streams get StreamShutdownGrace to finish before they
+	// are told to stop, and the whole drain is cut off after ShutdownTimeout
+	ShutdownTimeout     time.Duration
+	StreamShutdownGrace time.Duration
+
+	// TLS is enabled when both files are set
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion uint16
+
+	// Proxies whose X-Forwarded-For is believed when resolving ClientIP
+	TrustedProxies []netip.Prefix
+}
+
+// Config is the resolved server configuration
+type Config struct {
+	Server ServerConfig `json:"-"`
+
+	APIKey   string `json:"-"`
+	Endpoint string `json:"-"`
+
+	// Allow http upstream URLs, for local testing against a stub only;
+	// otherwise every URL sent credentials must be https
+	AllowInsecureUpstream bool `json:"-"`
+
+	// Deadline for the Azure calls behind a blocking /api/chat request,
+	// kept below Server.WriteTimeout so callers get an error response
+	// instead of a dropped connection
+	AzureTimeout time.Duration `json:"-"`
+
+	// Streams are cancelled when Azure sends no token within
+	// StreamFirstTokenTimeout or the stream runs longer than StreamTimeout;
+	// zero disables either
+	StreamFirstTokenTimeout time.Duration `json:"-"`
+	StreamTimeout           time.Duration `json:"-"`
+
+	Search SearchConfig `json:"-"`
+
+	Features Features `json:"features"`
+
+	// Clients is keyed by the API key presented in the X-API-Key header.
+	// When empty, client authentication is disabled.
+	Clients map[string]ClientConfig `json:"clients"`
+	Tenants map[string]TenantConfig `json:"tenants"`
+
+	Models       map[string]ModelConfig `json:"models"`
+	DefaultModel string                 `json:"defaultModel"`
+
+	// Models a client without its own allowedModels may use; empty allows all
+	DefaultAllowedModels []string `json:"defaultAllowedModels"`
+
+	// Rules choosing the model for requests that name none, first match
+	// wins; requests matching no rule use DefaultModel
+	RoutingRules []RoutingRule `json:"routingRules"`
+
+	// Generation defaults for every request, layered over defaultParams and
+	// under the model, tenant and client defaults
+	Defaults ParamOverrides `json:"defaults"`
+
+	// Currency of the model prices, reported with each cost
+	Currency string `json:"currency"`
+
+	// Reject requests whose estimated worst-case cost exceeds this, zero disables
+	MaxRequestCost float64 `json:"maxRequestCost"`
+
+	// Tokens held back from the context window when sizing max_tokens, and
+	// the most an automatically sized max_tokens may be
+	ContextSafetyMargin int `json:"contextSafetyMargin"`
+	MaxTokensCeiling    int `json:"maxTokensCeiling"`
+
+	// References kept per domain or author in a response, zero for no cap
+	MaxReferencesPerSource int `json:"maxReferencesPerSource"`
+
+	// Order structured references by retrieval score, highest first, unless
+	// they were renumbered to match inline markers
+	SortReferencesByScore bool `json:"sortReferencesByScore"`
+
+	// Check the links of the streamed "enriched" references with a HEAD
+	// request each, giving up on all of them after LinkCheckTimeout
+	ValidateReferenceLinks bool          `json:"validateReferenceLinks"`
+	LinkCheckTimeout       time.Duration `json:"-"`
+
+	// Size and lifetime of the per-query reference cache
+	ReferenceCacheEntries int           `json:"referenceCacheEntries"`
+	ReferenceCacheTTL     time.Duration `json:"-"`
+
+	// Longest answer returned by the blocking route, in characters; longer
+	// answers are cut at a sentence or word and flagged truncatedDisplay.
+	// Zero disables. References are never cut.
+	MaxResponseChars int `json:"maxResponseChars"`
+
+	// Longest citation excerpt returned with include_snippets, in characters
+	SnippetMaxChars int `json:"snippetMaxChars"`
+
+	// Longest reference title and authors returned, in characters; longer
+	// ones, usually a whole paragraph a failed parse took for the field, are
+	// cut with an ellipsis. Zero disables either.
+	ReferenceTitleMaxChars  int `json:"referenceTitleMaxChars"`
+	ReferenceAuthorMaxChars int `json:"referenceAuthorMaxChars"`
+
+	// Completion budget for ?references_only=true requests
+	ReferencesOnlyMaxTokens int `json:"referencesOnlyMaxTokens"`
+
+	// Events buffered per streaming generation for resume, and how long a
+	// finished generation can still be resumed
+	StreamBufferEvents int           `json:"streamBufferEvents"`
+	StreamResumeGrace  time.Duration `json:"-"`
+
+	// Streams served at once, zero for no limit, and the Retry-After sent
+	// to requests over it
+	MaxConcurrentStreams int           `json:"maxConcurrentStreams"`
+	StreamRetryAfter     time.Duration `json:"-"`
+
+	// Interval of keep-alive comments sent until the first token, zero disables
+	StreamHeartbeatInterval time.Duration `json:"-"`
+
+	// How streamed deltas are batched into token events: immediate, word,
+	// sentence or interval:<duration>, e.g. interval:50ms
+	StreamFlush string `json:"streamFlush"`
+
+	// Turns of a stored conversation sent to the model by default, and the
+	// most a request may ask for with maxHistoryTurns
+	HistoryTurns    int `json:"historyTurns"`
+	MaxHistoryTurns int `json:"maxHistoryTurns"`
+
+	// Bound on stored conversations, least recently used evicted first, and
+	// how long an unused conversation is kept; zero disables either limit
+	ConversationMaxEntries int           `json:"conversationMaxEntries"`
+	ConversationTTL        time.Duration `json:"-"`
+
+	// Largest a stored conversation may serialize to, in bytes; the oldest
+	// turns are dropped to fit. Zero disables the limit.
+	ConversationMaxBytes int `json:"conversationMaxBytes"`
+
+	// Times a retryable Azure failure, such as a truncated body, is sent again
+	UpstreamRetries int `json:"upstreamRetries"`
+
+	// Times a request is sent again when Azure answers 200 with no choices,
+	// unless the content filter withheld the answer
+	EmptyChoicesRetries int `json:"emptyChoicesRetries"`
+
+	// Extra headers attached to every Azure request, e.g. preview feature flags
+	UpstreamHeaders map[string]string `json:"upstreamHeaders"`
+
+	// System prompt as a text/template, filled in per request from PromptContext
+	SystemPrompt  string        `json:"systemPrompt"`
+	PromptContext PromptContext `json:"promptContext"`
+
+	// Named parameter presets a request can select with paramProfile
+	ParamProfiles map[string]ParamOverrides `json:"paramProfiles"`
+
+	// Named personas a request can select, and the one used when it names none
+	Personas       map[string]PersonaConfig `json:"personas"`
+	DefaultPersona string                   `json:"defaultPersona"`
+
+	// Text wrapped around every user message
+	PromptGuardrails PromptGuardrails `json:"promptGuardrails"`
+
+	// Log full prompts and other verbose detail
+	DebugLogging bool `json:"debugLogging"`
+
+	// Log each outbound Azure payload, credentials removed and cut to the
+	// limit in bytes
+	LogUpstreamPayload      bool `json:"logUpstreamPayload"`
+	UpstreamPayloadLogLimit int  `json:"upstreamPayloadLogLimit"`
+
+	// Response bodies for structured errors by code, for integrations that
+	// expect their own error shape
+	ErrorTemplates map[string]ErrorTemplate `json:"errorTemplates"`
+
+	// Cap on the encoded size in bytes of the data_sources block of one
+	// request; zero disables it
+	MaxDataSourcesBytes int `json:"maxDataSourcesBytes"`
+
+	// Caps on the documents a request passes in context
+	ContextDocuments ContextDocumentsConfig `json:"contextDocuments"`
+
+	// Rolling health scores that spread requests over model replicas
+	EndpointHealth EndpointHealthConfig `json:"endpointHealth"`
+
+	// Disclaimer appended to every answer
+	Footer FooterConfig `json:"footer"`
+
+	// Unicode normalization and character replacement of answers
+	Normalize NormalizeConfig `json:"normalize"`
+
+	// How prompt tokens are estimated for max_tokens sizing and the cost
+	// ceiling, see tokenEstimators
+	TokenEstimator string `json:"tokenEstimator"`
+
+	// Summaries of stored conversations for list previews
+	ConversationSummary ConversationSummaryConfig `json:"conversationSummary"`
+
+	// Capture of Azure exchanges for replay tests
+	Recorder RecorderConfig `json:"recorder"`
+
+	// Query expansion before grounded requests
+	QueryRewrite QueryRewriteConfig `json:"queryRewrite"`
+
+	// Rating of how well grounded answers are backed by their citations
+	Groundedness GroundednessConfig `json:"groundedness"`
+
+	// Answers confined to the retrieved documents
+	GroundedStrict GroundedStrictConfig `json:"groundedStrict"`
+
+	// Answering of double-submitted requests from the earlier answer
+	Dedup DedupConfig `json:"dedup"`
+
+	// Cap on the estimated input tokens of a chat request
+	PromptBudget PromptBudgetConfig `json:"promptBudget"`
+
+	// Validation of client-supplied messages
+	MessageRoles MessageRoleConfig `json:"messageRoles"`
+
+	// Flag answers in another language than the question
+	LanguageCheck LanguageCheckConfig `json:"languageCheck"`
+
+	// Follow-ups for answers that stop at max_tokens
+	Continuation ContinuationConfig `json:"continuation"`
+
+	// Headings, matched case-insensitively at the start of a line, that open
+	// the reference list in an answer; the last one present wins
+	ReferenceHeadings []string `json:"referenceHeadings"`
+
+	// What to do when a grounded answer has no reference list: "off",
+	// "context-only" to list Azure's citations instead, or "followup" to also
+	// ask the model for its sources when the request sets requireReferences
+	ReferenceFallback string `json:"referenceFallback"`
+
+	// Regular expressions, matched case-insensitively against the opening
+	// of an answer, that mark it as a refusal
+	RefusalPatterns []string `json:"refusalPatterns"`
+
+	// Ordered transforms applied to the main answer content
+	PostProcessors []PostProcessorConfig `json:"postProcessors"`
+
+	// Append-only record of answered requests
+	Audit AuditConfig `json:"audit"`
+
+	// Preflight completion sent at startup
+	Warmup WarmupConfig `json:"warmup"`
+
+	// Output filter masking PII and blocked words, applied after post-processing
+	Redaction RedactionConfig `json:"redaction"`
+}
+
+// Configuration values used when neither the config file nor the environment sets them
+func defaultConfig() *Config {
+	return &Config{
+		Features:                Features{Grounding: true, RequireJSONContentType: true},
+		ReferencesOnlyMaxTokens: 300,
+		Currency:                "USD",
+		ContextSafetyMargin:     256,
+		SnippetMaxChars:         300,
+		ReferenceTitleMaxChars:  200,
+		ReferenceAuthorMaxChars: 200,
+		UpstreamPayloadLogLimit: 8192,
+		ReferenceCacheEntries:   1000,
+		ReferenceCacheTTL:       time.Hour,
+		LinkCheckTimeout:        3 * time.Second,
+		MaxTokensCeiling:        4096,
+		StreamBufferEvents:      4096,
+		StreamResumeGrace:       60 * time.Second,
+		StreamHeartbeatInterval: 15 * time.Second,
+		StreamFlush:             flushImmediate,
+		StreamRetryAfter:        5 * time.Second,
+		AzureTimeout:            45 * time.Second,
+		StreamFirstTokenTimeout: 45 * time.Second,
+		StreamTimeout:           10 * time.Minute,
+		HistoryTurns:            10,
+		MaxHistoryTurns:         50,
+		ConversationMaxEntries:  10000,
+		ConversationTTL:         24 * time.Hour,
+		ConversationMaxBytes:    1 << 20,
+		SystemPrompt:            defaultSystemPrompt,
+		RefusalPatterns:         defaultRefusalPatterns,
+		ReferenceHeadings:       defaultReferenceHeadings,
+		TokenEstimator:          "pieces",
+		ReferenceFallback:       referenceFallbackOff,
+		UpstreamRetries:         1,
+		EmptyChoicesRetries:     1,
+		MaxDataSourcesBytes:     64 * 1024,
+		ContextDocuments:        ContextDocumentsConfig{MaxDocuments: 10, MaxBytes: 32 * 1024},
+		EndpointHealth:          EndpointHealthConfig{Decay: 0.2, LatencyTarget: 10 * time.Second, MinWeight: 0.05, BreakerCooldown: 30 * time.Second},
+		Footer:                  FooterConfig{Text: defaultFooterText},
+		LanguageCheck:           LanguageCheckConfig{Threshold: 0.6},
+		MessageRoles:            MessageRoleConfig{MaxMessages: 100},
+		QueryRewrite:            QueryRewriteConfig{MaxTokens: 100},
+		Groundedness:            GroundednessConfig{MaxTokens: 5},
+		GroundedStrict:          GroundedStrictConfig{SystemPrompt: defaultStrictSystemPrompt, Strictness: 5, NotFoundMessage: defaultNotFoundMessage},
+		Dedup:                   DedupConfig{Entries: 1000},
+		PromptBudget:            PromptBudgetConfig{Mode: promptBudgetTruncate, SummaryMaxTokens: 300},
+		ConversationSummary:     ConversationSummaryConfig{MaxTokens: 80},
+		Continuation:            ContinuationConfig{MaxIterations: 3, Entries: 1000, TTL: 15 * time.Minute},
+		Audit:                   AuditConfig{Buffer: 1024},
+		Redaction: RedactionConfig{
+			Builtins:    []string{"email", "phone", "ssn"},
+			Replacement: "[redacted]",
+		},
+		PromptContext: PromptContext{
+			DateFormat: "January 2, 2006",
+			Timezone:   "UTC",
+			Locale:     "en-US",
+		},
+	}
+}
+
+// Load configuration from the environment and the optional CONFIG_FILE
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config file: %w", err)
+		}
+	}
+
+	tlsMin, err := parseTLSVersion(envString("TLS_MIN_VERSION", "1.2"))
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Server = ServerConfig{
+		Addr:                envString("SERVER_ADDR", ":8080"),
+		ReadTimeout:         envDuration("SERVER_READ_TIMEOUT", 15*time.Second),
+		ReadHeaderTimeout:   envDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:        envDuration("SERVER_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:         envDuration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+		ShutdownTimeout:     envDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		StreamShutdownGrace: envDuration("STREAM_SHUTDOWN_GRACE", 10*time.Second),
+		TLSCertFile:         os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:          os.Getenv("TLS_KEY_FILE"),
+		TLSMinVersion:       tlsMin,
+		TrustedProxies:      trustedProxies,
+	}
+
+	if cfg.Server.StreamShutdownGrace >= cfg.Server.ShutdownTimeout {
+		return nil, fmt.Errorf("STREAM_SHUTDOWN_GRACE (%s) must be shorter than SHUTDOWN_TIMEOUT (%s)", cfg.Server.StreamShutdownGrace, cfg.Server.ShutdownTimeout)
+	}
+
+	cfg.AzureTimeout = envDuration("AZURE_TIMEOUT", cfg.AzureTimeout)
+	cfg.AzureTimeout = envDuration("AZURE_TIMEOUT_BLOCKING", cfg.AzureTimeout)
+	cfg.StreamFirstTokenTimeout = envDuration("AZURE_TIMEOUT_FIRST_TOKEN", cfg.StreamFirstTokenTimeout)
+	cfg.StreamTimeout = envDuration("AZURE_TIMEOUT_STREAMING", cfg.StreamTimeout)
+	if cfg.StreamFirstTokenTimeout < 0 || cfg.StreamTimeout < 0 {
+		return nil, fmt.Errorf("AZURE_TIMEOUT_FIRST_TOKEN and AZURE_TIMEOUT_STREAMING must not be negative")
+	}
+	if cfg.Server.WriteTimeout > 0 && cfg.AzureTimeout >= cfg.Server.WriteTimeout {
+		return nil, fmt.Errorf("AZURE_TIMEOUT_BLOCKING (%s) must be shorter than SERVER_WRITE_TIMEOUT (%s)", cfg.AzureTimeout, cfg.Server.WriteTimeout)
+	}
+
+	cfg.APIKey = os.Getenv("AZURE_API_KEY")
+	cfg.Endpoint = os.Getenv("AZURE_ENDPOINT")
+	cfg.AllowInsecureUpstream = envBool("ALLOW_INSECURE_UPSTREAM", false)
+	cfg.Search = SearchConfig{
+		Endpoint: os.Getenv("AZURE_SEARCH_ENDPOINT"),
+		Key:      os.Getenv("AZURE_SEARCH_KEY"),
+		Index:    os.Getenv("AZURE_SEARCH_INDEX"),
+		Filter:   os.Getenv("AZURE_SEARCH_FILTER"),
+
+		InstructSources: envBool("AZURE_SEARCH_INSTRUCT_SOURCES", false),
+	}
+	if v := os.Getenv("AZURE_SEARCH_ALLOWED_SOURCES"); v != "" {
+		for _, prefix := range strings.Split(v, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				cfg.Search.AllowedSources = append(cfg.Search.AllowedSources, prefix)
+			}
+		}
+	}
+	if v := os.Getenv("AZURE_SEARCH_DENIED_SOURCES"); v != "" {
+		for _, prefix := range strings.Split(v, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				cfg.Search.DeniedSources = append(cfg.Search.DeniedSources, prefix)
+			}
+		}
+	}
+	if v := os.Getenv("AZURE_SEARCH_FILTERABLE_FIELDS"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				cfg.Search.FilterableFields = append(cfg.Search.FilterableFields, field)
+			}
+		}
+	}
+	if v := os.Getenv("AZURE_SEARCH_SEMANTIC_CONFIGS"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				cfg.Search.SemanticConfigs = append(cfg.Search.SemanticConfigs, name)
+			}
+		}
+	}
+	if v := os.Getenv("REFERENCE_HEADINGS"); v != "" {
+		cfg.ReferenceHeadings = nil
+		for _, heading := range strings.Split(v, ",") {
+			if heading = strings.TrimSpace(heading); heading != "" {
+				cfg.ReferenceHeadings = append(cfg.ReferenceHeadings, heading)
+			}
+		}
+	}
+	cfg.ReferenceFallback = envString("REFERENCE_FALLBACK", cfg.ReferenceFallback)
+	cfg.Features.Grounding = envBool("GROUNDING_ENABLED", cfg.Features.Grounding)
+	cfg.Features.FallbackWithoutSearch = envBool("FALLBACK_WITHOUT_SEARCH", cfg.Features.FallbackWithoutSearch)
+	cfg.Features.StrictDecoding = envBool("STRICT_DECODING", cfg.Features.StrictDecoding)
+	cfg.Features.RequireJSONContentType = envBool("ENFORCE_JSON_CONTENT_TYPE", cfg.Features.RequireJSONContentType)
+	cfg.Features.CachedReferences = envBool("CACHED_REFERENCES", cfg.Features.CachedReferences)
+	cfg.Features.PromptFilterResults = envBool("PROMPT_FILTER_RESULTS", cfg.Features.PromptFilterResults)
+	cfg.Features.MetricsExemplars = envBool("METRICS_EXEMPLARS", cfg.Features.MetricsExemplars)
+	cfg.MaxDataSourcesBytes = envInt("MAX_DATA_SOURCES_BYTES", cfg.MaxDataSourcesBytes)
+	if cfg.MaxDataSourcesBytes < 0 {
+		return nil, fmt.Errorf("MAX_DATA_SOURCES_BYTES must not be negative, got %d", cfg.MaxDataSourcesBytes)
+	}
+	cfg.ContextDocuments.MaxDocuments = envInt("CONTEXT_MAX_DOCUMENTS", cfg.ContextDocuments.MaxDocuments)
+	cfg.ContextDocuments.MaxBytes = envInt("CONTEXT_MAX_BYTES", cfg.ContextDocuments.MaxBytes)
+	if cfg.ContextDocuments.MaxDocuments < 0 || cfg.ContextDocuments.MaxBytes < 0 {
+		return nil, fmt.Errorf("CONTEXT_MAX_DOCUMENTS and CONTEXT_MAX_BYTES must not be negative")
+	}
+	cfg.Footer.Enabled = envBool("ANSWER_FOOTER", cfg.Footer.Enabled)
+	cfg.Footer.Text = envString("ANSWER_FOOTER_TEXT", cfg.Footer.Text)
+	cfg.Normalize.Form = envString("NORMALIZE_FORM", cfg.Normalize.Form)
+	cfg.Normalize.Quotes = envBool("NORMALIZE_QUOTES", cfg.Normalize.Quotes)
+	cfg.Normalize.Dashes = envBool("NORMALIZE_DASHES", cfg.Normalize.Dashes)
+	cfg.EndpointHealth.Decay = envFloat("ENDPOINT_HEALTH_DECAY", cfg.EndpointHealth.Decay)
+	cfg.EndpointHealth.LatencyTarget = envDuration("ENDPOINT_HEALTH_LATENCY_TARGET", cfg.EndpointHealth.LatencyTarget)
+	cfg.EndpointHealth.MinWeight = envFloat("ENDPOINT_HEALTH_MIN_WEIGHT", cfg.EndpointHealth.MinWeight)
+	if cfg.EndpointHealth.Decay <= 0 || cfg.EndpointHealth.Decay > 1 {
+		return nil, fmt.Errorf("ENDPOINT_HEALTH_DECAY must be above 0 and at most 1, got %g", cfg.EndpointHealth.Decay)
+	}
+	cfg.EndpointHealth.BreakerFailures = envInt("ENDPOINT_BREAKER_FAILURES", cfg.EndpointHealth.BreakerFailures)
+	cfg.EndpointHealth.BreakerCooldown = envDuration("ENDPOINT_BREAKER_COOLDOWN", cfg.EndpointHealth.BreakerCooldown)
+	if cfg.EndpointHealth.BreakerFailures < 0 || cfg.EndpointHealth.BreakerCooldown <= 0 {
+		return nil, fmt.Errorf("ENDPOINT_BREAKER_FAILURES must not be negative and ENDPOINT_BREAKER_COOLDOWN must be positive")
+	}
+	if cfg.EndpointHealth.MinWeight <= 0 || cfg.EndpointHealth.MinWeight > 1 {
+		return nil, fmt.Errorf("ENDPOINT_HEALTH_MIN_WEIGHT must be above 0 and at most 1, got %g", cfg.EndpointHealth.MinWeight)
+	}
+	cfg.UpstreamRetries = envInt("UPSTREAM_RETRIES", cfg.UpstreamRetries)
+	if cfg.UpstreamRetries < 0 {
+		return nil, fmt.Errorf("UPSTREAM_RETRIES must not be negative, got %d", cfg.UpstreamRetries)
+	}
+	cfg.EmptyChoicesRetries = envInt("EMPTY_CHOICES_RETRIES", cfg.EmptyChoicesRetries)
+	if cfg.EmptyChoicesRetries < 0 {
+		return nil, fmt.Errorf("EMPTY_CHOICES_RETRIES must not be negative, got %d", cfg.EmptyChoicesRetries)
+	}
+	cfg.TokenEstimator = envString("TOKEN_ESTIMATOR", cfg.TokenEstimator)
+	cfg.ConversationSummary.Model = envString("CONVERSATION_SUMMARY_MODEL", cfg.ConversationSummary.Model)
+	cfg.ConversationSummary.MaxTokens = envInt("CONVERSATION_SUMMARY_MAX_TOKENS", cfg.ConversationSummary.MaxTokens)
+	if cfg.ConversationSummary.MaxTokens <= 0 {
+		return nil, fmt.Errorf("CONVERSATION_SUMMARY_MAX_TOKENS must be positive, got %d", cfg.ConversationSummary.MaxTokens)
+	}
+	cfg.Recorder.Dir = envString("RECORD_DIR", cfg.Recorder.Dir)
+	cfg.Recorder.Replay = envBool("REPLAY", cfg.Recorder.Replay)
+	if cfg.Recorder.Replay && cfg.Recorder.Dir == "" {
+		return nil, fmt.Errorf("REPLAY requires RECORD_DIR")
+	}
+	if cfg.Recorder.Dir != "" && !cfg.Recorder.Replay {
+		if err := os.MkdirAll(cfg.Recorder.Dir, 0o700); err != nil {
+			return nil, fmt.Errorf("creating RECORD_DIR: %w", err)
+		}
+	}
+	cfg.QueryRewrite.Enabled = envBool("QUERY_REWRITE", cfg.QueryRewrite.Enabled)
+	cfg.QueryRewrite.Model = envString("QUERY_REWRITE_MODEL", cfg.QueryRewrite.Model)
+	cfg.QueryRewrite.MaxTokens = envInt("QUERY_REWRITE_MAX_TOKENS", cfg.QueryRewrite.MaxTokens)
+	if cfg.QueryRewrite.MaxTokens <= 0 {
+		return nil, fmt.Errorf("QUERY_REWRITE_MAX_TOKENS must be positive, got %d", cfg.QueryRewrite.MaxTokens)
+	}
+	cfg.Groundedness.Enabled = envBool("GROUNDEDNESS_CHECK", cfg.Groundedness.Enabled)
+	cfg.Groundedness.Model = envString("GROUNDEDNESS_MODEL", cfg.Groundedness.Model)
+	cfg.Groundedness.MaxTokens = envInt("GROUNDEDNESS_MAX_TOKENS", cfg.Groundedness.MaxTokens)
+	if cfg.Groundedness.MaxTokens <= 0 {
+		return nil, fmt.Errorf("GROUNDEDNESS_MAX_TOKENS must be positive, got %d", cfg.Groundedness.MaxTokens)
+	}
+	cfg.GroundedStrict.Enabled = envBool("GROUNDED_STRICT", cfg.GroundedStrict.Enabled)
+	cfg.GroundedStrict.SystemPrompt = envString("GROUNDED_STRICT_SYSTEM_PROMPT", cfg.GroundedStrict.SystemPrompt)
+	cfg.GroundedStrict.Strictness = envInt("GROUNDED_STRICT_STRICTNESS", cfg.GroundedStrict.Strictness)
+	cfg.GroundedStrict.NotFoundMessage = envString("GROUNDED_STRICT_NOT_FOUND_MESSAGE", cfg.GroundedStrict.NotFoundMessage)
+	if cfg.GroundedStrict.Strictness < 1 || cfg.GroundedStrict.Strictness > 5 {
+		return nil, fmt.Errorf("GROUNDED_STRICT_STRICTNESS must be between 1 and 5, got %d", cfg.GroundedStrict.Strictness)
+	}
+	cfg.Dedup.Window = envDuration("DEDUP_WINDOW", cfg.Dedup.Window)
+	cfg.Dedup.Entries = envInt("DEDUP_MAX_ENTRIES", cfg.Dedup.Entries)
+	if cfg.Dedup.Window < 0 || cfg.Dedup.Entries <= 0 {
+		return nil, fmt.Errorf("DEDUP_WINDOW must not be negative and DEDUP_MAX_ENTRIES must be positive")
+	}
+	cfg.PromptBudget.MaxTokens = envInt("PROMPT_TOKEN_BUDGET", cfg.PromptBudget.MaxTokens)
+	cfg.PromptBudget.Mode = envString("PROMPT_BUDGET_MODE", cfg.PromptBudget.Mode)
+	cfg.PromptBudget.SummaryMaxTokens = envInt("PROMPT_BUDGET_SUMMARY_MAX_TOKENS", cfg.PromptBudget.SummaryMaxTokens)
+	if cfg.PromptBudget.MaxTokens < 0 || cfg.PromptBudget.SummaryMaxTokens <= 0 {
+		return nil, fmt.Errorf("PROMPT_TOKEN_BUDGET must not be negative and PROMPT_BUDGET_SUMMARY_MAX_TOKENS must be positive")
+	}
+	switch cfg.PromptBudget.Mode {
+	case promptBudgetTruncate, promptBudgetSummarize, promptBudgetReject:
+	default:
+		return nil, fmt.Errorf("PROMPT_BUDGET_MODE must be truncate, summarize or reject, got %q", cfg.PromptBudget.Mode)
+	}
+	cfg.MessageRoles.Strict = envBool("STRICT_MESSAGE_ROLES", cfg.MessageRoles.Strict)
+	cfg.MessageRoles.MaxMessages = envInt("MAX_HISTORY_MESSAGES", cfg.MessageRoles.MaxMessages)
+	if cfg.MessageRoles.MaxMessages < 0 {
+		return nil, fmt.Errorf("MAX_HISTORY_MESSAGES must not be negative, got %d", cfg.MessageRoles.MaxMessages)
+	}
+	cfg.LanguageCheck.Enabled = envBool("LANGUAGE_CHECK", cfg.LanguageCheck.Enabled)
+	cfg.LanguageCheck.Threshold = envFloat("LANGUAGE_CHECK_THRESHOLD", cfg.LanguageCheck.Threshold)
+	cfg.LanguageCheck.Retry = envBool("LANGUAGE_CHECK_RETRY", cfg.LanguageCheck.Retry)
+	if cfg.LanguageCheck.Threshold < 0 || cfg.LanguageCheck.Threshold > 1 {
+		return nil, fmt.Errorf("LANGUAGE_CHECK_THRESHOLD must be between 0 and 1, got %v", cfg.LanguageCheck.Threshold)
+	}
+	cfg.Continuation.AutoContinue = envBool("AUTO_CONTINUE", cfg.Continuation.AutoContinue)
+	cfg.Continuation.MaxIterations = envInt("AUTO_CONTINUE_MAX_ITERATIONS", cfg.Continuation.MaxIterations)
+	cfg.Continuation.Entries = envInt("CONTINUATION_ENTRIES", cfg.Continuation.Entries)
+	cfg.Continuation.TTL = envDuration("CONTINUATION_TTL", cfg.Continuation.TTL)
+	if cfg.Continuation.MaxIterations < 0 {
+		return nil, fmt.Errorf("AUTO_CONTINUE_MAX_ITERATIONS must not be negative, got %d", cfg.Continuation.MaxIterations)
+	}
+	if cfg.Continuation.Entries <= 0 {
+		return nil, fmt.Errorf("CONTINUATION_ENTRIES must be positive, got %d", cfg.Continuation.Entries)
+	}
+	cfg.ReferenceCacheEntries = envInt("REFERENCE_CACHE_ENTRIES", cfg.ReferenceCacheEntries)
+	cfg.ReferenceCacheTTL = envDuration("REFERENCE_CACHE_TTL", cfg.ReferenceCacheTTL)
+	if cfg.ReferenceCacheEntries <= 0 {
+		return nil, fmt.Errorf("REFERENCE_CACHE_ENTRIES must be positive, got %d", cfg.ReferenceCacheEntries)
+	}
+	cfg.DefaultModel = envString("AZURE_MODEL", cfg.DefaultModel)
+	if v := os.Getenv("DEFAULT_ALLOWED_MODELS"); v != "" {
+		cfg.DefaultAllowedModels = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				cfg.DefaultAllowedModels = append(cfg.DefaultAllowedModels, name)
+			}
+		}
+	}
+	cfg.DefaultPersona = envString("DEFAULT_PERSONA", cfg.DefaultPersona)
+	for name, target := range map[string]**float64{
+		"DEFAULT_TEMPERATURE": &cfg.Defaults.Temperature,
+		"DEFAULT_TOP_P":       &cfg.Defaults.TopP,
+	} {
+		if v := os.Getenv(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			*target = &f
+		}
+	}
+	cfg.Currency = envString("COST_CURRENCY", cfg.Currency)
+	cfg.MaxRequestCost = envFloat("MAX_REQUEST_COST", cfg.MaxRequestCost)
+	cfg.ContextSafetyMargin = envInt("CONTEXT_SAFETY_MARGIN", cfg.ContextSafetyMargin)
+	cfg.MaxTokensCeiling = envInt("MAX_TOKENS_CEILING", cfg.MaxTokensCeiling)
+	cfg.MaxReferencesPerSource = envInt("MAX_REFERENCES_PER_SOURCE", cfg.MaxReferencesPerSource)
+	cfg.SortReferencesByScore = envBool("SORT_REFERENCES_BY_SCORE", cfg.SortReferencesByScore)
+	cfg.ValidateReferenceLinks = envBool("VALIDATE_REFERENCE_LINKS", cfg.ValidateReferenceLinks)
+	cfg.LinkCheckTimeout = envDuration("LINK_CHECK_TIMEOUT", cfg.LinkCheckTimeout)
+	cfg.MaxResponseChars = envInt("MAX_RESPONSE_CHARS", cfg.MaxResponseChars)
+	cfg.SnippetMaxChars = envInt("SNIPPET_MAX_CHARS", cfg.SnippetMaxChars)
+	cfg.ReferencesOnlyMaxTokens = envInt("REFERENCES_ONLY_MAX_TOKENS", cfg.ReferencesOnlyMaxTokens)
+	cfg.StreamBufferEvents = envInt("STREAM_BUFFER_EVENTS", cfg.StreamBufferEvents)
+	cfg.StreamResumeGrace = envDuration("STREAM_RESUME_GRACE", cfg.StreamResumeGrace)
+	cfg.MaxConcurrentStreams = envInt("MAX_CONCURRENT_STREAMS", cfg.MaxConcurrentStreams)
+	cfg.StreamRetryAfter = envDuration("STREAM_RETRY_AFTER", cfg.StreamRetryAfter)
+	if cfg.MaxConcurrentStreams < 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_STREAMS must not be negative, got %d", cfg.MaxConcurrentStreams)
+	}
+	cfg.StreamHeartbeatInterval = envDuration("STREAM_HEARTBEAT_INTERVAL", cfg.StreamHeartbeatInterval)
+	cfg.StreamFlush = envString("STREAM_FLUSH", cfg.StreamFlush)
+	cfg.SystemPrompt = envString("SYSTEM_PROMPT", cfg.SystemPrompt)
+	cfg.PromptContext.DateFormat = envString("PROMPT_DATE_FORMAT", cfg.PromptContext.DateFormat)
+	cfg.PromptContext.Timezone = envString("PROMPT_TIMEZONE", cfg.PromptContext.Timezone)
+	cfg.PromptContext.Locale = envString("PROMPT_LOCALE", cfg.PromptContext.Locale)
+	cfg.PromptContext.OrgName = envString("PROMPT_ORG_NAME", cfg.PromptContext.OrgName)
+	cfg.PromptGuardrails.Prefix = envString("PROMPT_PREFIX", cfg.PromptGuardrails.Prefix)
+	cfg.PromptGuardrails.Suffix = envString("PROMPT_SUFFIX", cfg.PromptGuardrails.Suffix)
+	cfg.PromptGuardrails.Policy = envString("PROMPT_POLICY", cfg.PromptGuardrails.Policy)
+	cfg.DebugLogging = envBool("DEBUG_LOGGING", cfg.DebugLogging)
+	cfg.LogUpstreamPayload = envBool("LOG_UPSTREAM_PAYLOAD", cfg.LogUpstreamPayload)
+	cfg.UpstreamPayloadLogLimit = envInt("UPSTREAM_PAYLOAD_LOG_LIMIT", cfg.UpstreamPayloadLogLimit)
+	cfg.Audit.Sink = envString("AUDIT_SINK", cfg.Audit.Sink)
+	cfg.Audit.Path = envString("AUDIT_FILE", cfg.Audit.Path)
+	cfg.Audit.FullContent = envBool("AUDIT_FULL_CONTENT", cfg.Audit.FullContent)
+	cfg.Audit.Buffer = envInt("AUDIT_BUFFER", cfg.Audit.Buffer)
+	if cfg.Audit.Buffer <= 0 {
+		return nil, fmt.Errorf("AUDIT_BUFFER must be positive, got %d", cfg.Audit.Buffer)
+	}
+	cfg.Warmup.OnStart = envBool("WARMUP_ON_START", cfg.Warmup.OnStart)
+	cfg.Warmup.Required = envBool("WARMUP_REQUIRED", cfg.Warmup.Required)
+	cfg.Redaction.Enabled = envBool("REDACTION_ENABLED", cfg.Redaction.Enabled)
+	if v := os.Getenv("REDACTION_WORDS"); v != "" {
+		for _, word := range strings.Split(v, ",") {
+			if word = strings.TrimSpace(word); word != "" {
+				cfg.Redaction.Words = append(cfg.Redaction.Words, word)
+			}
+		}
+	}
+	cfg.HistoryTurns = envInt("HISTORY_TURNS", cfg.HistoryTurns)
+	cfg.MaxHistoryTurns = envInt("MAX_HISTORY_TURNS", cfg.MaxHistoryTurns)
+	cfg.ConversationMaxEntries = envInt("CONVERSATION_MAX_ENTRIES", cfg.ConversationMaxEntries)
+	cfg.ConversationTTL = envDuration("CONVERSATION_TTL", cfg.ConversationTTL)
+	cfg.ConversationMaxBytes = envInt("CONVERSATION_MAX_BYTES", cfg.ConversationMaxBytes)
+	if cfg.ConversationMaxEntries < 0 || cfg.ConversationTTL < 0 || cfg.ConversationMaxBytes < 0 {
+		return nil, fmt.Errorf("CONVERSATION_MAX_ENTRIES, CONVERSATION_TTL and CONVERSATION_MAX_BYTES must not be negative")
+	}
+	if cfg.HistoryTurns < 0 || cfg.HistoryTurns > cfg.MaxHistoryTurns {
+		return nil, fmt.Errorf("HISTORY_TURNS must be between 0 and MAX_HISTORY_TURNS (%d), got %d", cfg.MaxHistoryTurns, cfg.HistoryTurns)
+	}
+	if v := os.Getenv("AZURE_EXTRA_HEADERS"); v != "" {
+		extra, err := parseHeaderList(v)
+		if err != nil {
+			return nil, fmt.Errorf("AZURE_EXTRA_HEADERS: %w", err)
+		}
+		if cfg.UpstreamHeaders == nil {
+			cfg.UpstreamHeaders = make(map[string]string)
+		}
+		for name, value := range extra {
+			cfg.UpstreamHeaders[name] = value
+		}
+	}
+	if cfg.UpstreamHeaders, err = validateUpstreamHeaders(cfg.UpstreamHeaders); err != nil {
+		return nil, err
+	}
+	if cfg.ReferencesOnlyMaxTokens <= 0 {
+		return nil, fmt.Errorf("REFERENCES_ONLY_MAX_TOKENS must be positive, got %d", cfg.ReferencesOnlyMaxTokens)
+	}
+	if cfg.ContextSafetyMargin < 0 {
+		return nil, fmt.Errorf("CONTEXT_SAFETY_MARGIN must not be negative, got %d", cfg.ContextSafetyMargin)
+	}
+	if cfg.MaxTokensCeiling <= 0 {
+		return nil, fmt.Errorf("MAX_TOKENS_CEILING must be positive, got %d", cfg.MaxTokensCeiling)
+	}
+	if cfg.MaxReferencesPerSource < 0 {
+		return nil, fmt.Errorf("MAX_REFERENCES_PER_SOURCE must not be negative, got %d", cfg.MaxReferencesPerSource)
+	}
+	if cfg.MaxResponseChars < 0 {
+		return nil, fmt.Errorf("MAX_RESPONSE_CHARS must not be negative, got %d", cfg.MaxResponseChars)
+	}
+	if len(cfg.ReferenceHeadings) == 0 {
+		return nil, fmt.Errorf("at least one reference heading is required")
+	}
+	for _, heading := range cfg.ReferenceHeadings {
+		if strings.TrimSpace(heading) == "" {
+			return nil, fmt.Errorf("reference headings must not be blank")
+		}
+	}
+	switch cfg.ReferenceFallback {
+	case referenceFallbackOff, referenceFallbackContextOnly, referenceFallbackFollowUp:
+	default:
+		return nil, fmt.Errorf("REFERENCE_FALLBACK must be off, context-only or followup, got %q", cfg.ReferenceFallback)
+	}
+	if cfg.StreamHeartbeatInterval < 0 {
+		return nil, fmt.Errorf("STREAM_HEARTBEAT_INTERVAL must not be negative, got %v", cfg.StreamHeartbeatInterval)
+	}
+	if cfg.SnippetMaxChars <= 0 {
+		return nil, fmt.Errorf("SNIPPET_MAX_CHARS must be positive, got %d", cfg.SnippetMaxChars)
+	}
+	cfg.ReferenceTitleMaxChars = envInt("REFERENCE_TITLE_MAX_CHARS", cfg.ReferenceTitleMaxChars)
+	cfg.ReferenceAuthorMaxChars = envInt("REFERENCE_AUTHORS_MAX_CHARS", cfg.ReferenceAuthorMaxChars)
+	if cfg.ReferenceTitleMaxChars < 0 || cfg.ReferenceAuthorMaxChars < 0 {
+		return nil, fmt.Errorf("REFERENCE_TITLE_MAX_CHARS and REFERENCE_AUTHORS_MAX_CHARS must not be negative")
+	}
+	if cfg.StreamBufferEvents <= 0 {
+		return nil, fmt.Errorf("STREAM_BUFFER_EVENTS must be positive, got %d", cfg.StreamBufferEvents)
+	}
+
+	if err := cfg.checkEndpoints(os.Getenv("AZURE_API_VERSION"), os.Getenv("AZURE_DEFAULT_API_VERSION"), envBool("STRICT_ENDPOINT_VALIDATION", false)); err != nil {
+		return nil, err
+	}
+	if err := cfg.checkUpstreamSchemes(); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Models) > 0 {
+		if _, ok := cfg.Models[cfg.DefaultModel]; !ok {
+			return nil, fmt.Errorf("default model %q is not configured", cfg.DefaultModel)
+		}
+	}
+	if err := cfg.validateCostCeiling(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateAllowedModels(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateRoutingRules(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validatePersonas(); err != nil {
+		return nil, err
+	}
+	for name, profile := range cfg.ParamProfiles {
+		if err := profile.validate(); err != nil {
+			return nil, fmt.Errorf("param profile %q: %w", name, err)
+		}
+	}
+
+	for _, client := range cfg.Clients {
+		if client.Tenant == "" {
+			continue
+		}
+		if _, ok := cfg.Tenants[client.Tenant]; !ok {
+			return nil, fmt.Errorf("client %q references unknown tenant %q", client.Name, client.Tenant)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Resolve the search settings for a client, layering tenant overrides on
+// top of the global defaults. Values never come from the request body.
+func (c *Config) searchConfigFor(client *ClientConfig) SearchConfig {
+	search := c.Search
+	if client == nil || client.Tenant == "" {
+		return search
+	}
+
+	tenant := c.Tenants[client.Tenant].Search
+	if tenant.Endpoint != "" {
+		search.Endpoint = tenant.Endpoint
+	}
+	if tenant.Key != "" {
+		search.Key = tenant.Key
+	}
+	if tenant.Index != "" {
+		search.Index = tenant.Index
+		// Semantic configurations and fields belong to an index, so
+		// another index does not inherit the global settings
+		search.SemanticConfigs = tenant.SemanticConfigs
+		search.Filter = tenant.Filter
+		search.FilterableFields = tenant.FilterableFields
+	}
+	if len(tenant.SemanticConfigs) > 0 {
+		search.SemanticConfigs = tenant.SemanticConfigs
+	}
+	if tenant.Filter != "" {
+		search.Filter = tenant.Filter
+	}
+	if len(tenant.FilterableFields) > 0 {
+		search.FilterableFields = tenant.FilterableFields
+	}
+	if len(tenant.AllowedSources) > 0 {
+		search.AllowedSources = tenant.AllowedSources
+	}
+	if len(tenant.DeniedSources) > 0 {
+		search.DeniedSources = tenant.DeniedSources
+	}
+	if tenant.InstructSources {
+		search.InstructSources = true
+	}
+	return search
+}
+
+// Resolve the generation defaults for a request to model from client:
+// global, then model, then tenant, then client, each overriding the last
+func (c *Config) paramOverridesFor(client *ClientConfig, model ModelConfig) ParamOverrides {
+	o := c.Defaults.merge(model.Defaults)
+	if client != nil {
+		if client.Tenant != "" {
+			o = o.merge(c.Tenants[client.Tenant].Defaults)
+		}
+		o = o.merge(client.Defaults)
+	}
+	return o
+}
+
+// Pick the semantic configuration for a request, defaulting to "default".
+// Reports false when the name is not one the index is known to define.
+func (sc SearchConfig) selectSemanticConfig(name string) (string, bool) {
+	if name == "" || name == "default" {
+		return "default", true
+	}
+	for _, known := range sc.SemanticConfigs {
+		if name == known {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Read a boolean environment variable, falling back to def when unset or invalid
+func envBool(name string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Read a string environment variable, falling back to def when unset
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// Read an integer environment variable, falling back to def when unset or invalid
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Read a duration environment variable such as "30s", falling back to def when unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Map a TLS_MIN_VERSION value like "1.2" to its crypto/tls constant
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS_MIN_VERSION %q, use 1.2 or 1.3", v)
+}
+
+// Read a float environment variable, falling back to def when unset or invalid
+func envFloat(name string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Resolve the model for a request, falling back to the default model.
+// Reports false when the name is not a configured model.
+func (c *Config) modelFor(name string) (string, ModelConfig, bool) {
+	if name == "" {
+		name = c.DefaultModel
+	}
+	model, ok := c.Models[name]
+	if !ok && len(c.Models) > 0 {
+		return name, ModelConfig{}, false
+	}
+	if model.Endpoint == "" {
+		model.Endpoint = c.Endpoint
+	}
+	return name, model, true
+}
+
+// Reports whether client may use the named model
+func (c *Config) modelAllowed(client *ClientConfig, name string) bool {
+	allowed := c.DefaultAllowedModels
+	if client != nil && len(client.AllowedModels) > 0 {
+		allowed = client.AllowedModels
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, m := range allowed {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowlists may only name configured models, so a typo cannot lock a
+// client out silently
+func (c *Config) validateAllowedModels() error {
+	if len(c.Models) == 0 {
+		return nil
+	}
+	check := func(owner string, names []string) error {
+		for _, name := range names {
+			if _, ok := c.Models[name]; !ok {
+				return fmt.Errorf("%s allows unknown model %q", owner, name)
+			}
+		}
+		return nil
+	}
+	if err := check("defaultAllowedModels", c.DefaultAllowedModels); err != nil {
+		return err
+	}
+	for _, client := range c.Clients {
+		if err := check(fmt.Sprintf("client %q", client.Name), client.AllowedModels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A cost ceiling can only be enforced when every model it may apply to is priced
+func (c *Config) validateCostCeiling() error {
+	enabled := c.MaxRequestCost > 0
+	for _, client := range c.Clients {
+		if client.MaxRequestCost > 0 {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return nil
+	}
+
+	if len(c.Models) == 0 {
+		return fmt.Errorf("a request cost ceiling is configured but no priced models are")
+	}
+	for name, model := range c.Models {
+		if model.InputCostPer1K <= 0 || model.OutputCostPer1K <= 0 {
+			return fmt.Errorf("a request cost ceiling is configured but model %q has no inputCostPer1K/outputCostPer1K", name)
+		}
+	}
+	return nil
+}
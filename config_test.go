@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func tenantConfig() *Config {
+	cfg := defaultConfig()
+	cfg.Search = SearchConfig{Endpoint: "https://global.search", Key: "global-key", Index: "global-index"}
+	cfg.Tenants = map[string]TenantConfig{
+		"alpha": {Search: SearchConfig{Index: "alpha-index", Key: "alpha-key"}},
+		"beta":  {Search: SearchConfig{Endpoint: "https://beta.search", Index: "beta-index", Key: "beta-key"}},
+	}
+	cfg.Clients = map[string]ClientConfig{
+		"key-alpha": {Name: "a", Tenant: "alpha"},
+		"key-beta":  {Name: "b", Tenant: "beta"},
+		"key-none":  {Name: "n"},
+	}
+	return cfg
+}
+
+func TestSearchConfigFor(t *testing.T) {
+	cfg := tenantConfig()
+	alpha := cfg.Clients["key-alpha"]
+	beta := cfg.Clients["key-beta"]
+	none := cfg.Clients["key-none"]
+
+	tests := []struct {
+		name   string
+		client *ClientConfig
+		want   SearchConfig
+	}{
+		{"auth disabled", nil, cfg.Search},
+		{"client without tenant", &none, cfg.Search},
+		{"partial tenant override", &alpha, SearchConfig{Endpoint: "https://global.search", Key: "alpha-key", Index: "alpha-index"}},
+		{"full tenant override", &beta, SearchConfig{Endpoint: "https://beta.search", Key: "beta-key", Index: "beta-index"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.searchConfigFor(tt.client); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("searchConfigFor() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func searchParams(t *testing.T, payload map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	sources, ok := payload["data_sources"].([]interface{})
+	if !ok || len(sources) != 1 {
+		t.Fatalf("data_sources = %v", payload["data_sources"])
+	}
+	return sources[0].(map[string]interface{})["parameters"].(map[string]interface{})
+}
+
+func TestTenantsHitDifferentIndexes(t *testing.T) {
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, tenantConfig(), azure)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "X-API-Key", "key-alpha"))
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "X-API-Key", "key-beta"))
+
+	for i, want := range []SearchConfig{
+		{Endpoint: "https://global.search", Key: "alpha-key", Index: "alpha-index"},
+		{Endpoint: "https://beta.search", Key: "beta-key", Index: "beta-index"},
+	} {
+		params := searchParams(t, azure.payload(t, i))
+		auth := params["authentication"].(map[string]interface{})
+		if params["endpoint"] != want.Endpoint || params["index_name"] != want.Index || params["key"] != want.Key || auth["key"] != want.Key {
+			t.Errorf("request %d search parameters = %v, want %+v", i, params, want)
+		}
+	}
+}
+
+func TestTenantConfigIgnoresRequestBody(t *testing.T) {
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, tenantConfig(), azure)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","index_name":"evil","search":{"index":"evil"}}`, "X-API-Key", "key-alpha"))
+	if got := searchParams(t, azure.payload(t, 0))["index_name"]; got != "alpha-index" {
+		t.Fatalf("index_name = %v, want alpha-index", got)
+	}
+}
+
+func TestUnknownAPIKeyRejected(t *testing.T) {
+	_, front := newTestServer(t, tenantConfig(), &azureStub{content: "Answer."})
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "X-API-Key", "wrong")
+	readBody(t, resp)
+	if resp.StatusCode != 401 {
+		t.Fatalf("status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestSemanticConfigSelection(t *testing.T) {
+	cfg := tenantConfig()
+	cfg.Search.SemanticConfigs = []string{"faq", "legal"}
+	azure := &azureStub{content: "ok"}
+	_, front := newTestServer(t, cfg, azure)
+
+	tests := []struct {
+		key, body  string
+		wantStatus int
+		want       string
+	}{
+		{"key-none", `{"message":"hi"}`, http.StatusOK, "default"},
+		{"key-none", `{"message":"hi","semanticConfig":"legal"}`, http.StatusOK, "legal"},
+		{"key-none", `{"message":"hi","semanticConfig":"tuned"}`, http.StatusBadRequest, ""},
+		// alpha has its own index, which does not define the global configs
+		{"key-alpha", `{"message":"hi","semanticConfig":"legal"}`, http.StatusBadRequest, ""},
+	}
+	sent := 0
+	for _, tt := range tests {
+		resp := postJSON(t, front.URL+"/api/chat", tt.body, "X-API-Key", tt.key)
+		readBody(t, resp)
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d", tt.key, tt.body, resp.StatusCode, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusOK {
+			if got := searchParams(t, azure.payload(t, sent))["semantic_configuration"]; got != tt.want {
+				t.Errorf("%s: semantic_configuration = %v, want %s", tt.body, got, tt.want)
+			}
+			sent++
+		}
+	}
+}
+
+func TestModelAllowed(t *testing.T) {
+	cfg := &Config{
+		Models:               map[string]ModelConfig{"gpt-4o-mini": {}, "gpt-4o": {}, "o3": {}},
+		DefaultAllowedModels: []string{"gpt-4o-mini"},
+	}
+	premium := &ClientConfig{Name: "premium", AllowedModels: []string{"gpt-4o", "o3"}}
+	basic := &ClientConfig{Name: "basic"}
+
+	tests := []struct {
+		name   string
+		client *ClientConfig
+		model  string
+		want   bool
+	}{
+		{"premium allowed", premium, "o3", true},
+		{"premium not listed", premium, "gpt-4o-mini", false},
+		{"default allowed", basic, "gpt-4o-mini", true},
+		{"default denied", basic, "o3", false},
+		{"auth disabled uses default", nil, "gpt-4o", false},
+	}
+	for _, tt := range tests {
+		if got := cfg.modelAllowed(tt.client, tt.model); got != tt.want {
+			t.Errorf("%s: modelAllowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if !(&Config{}).modelAllowed(basic, "anything") {
+		t.Error("no allowlists should allow every model")
+	}
+
+	cfg.Clients = map[string]ClientConfig{"k": {Name: "typo", AllowedModels: []string{"gpt-5o"}}}
+	if err := cfg.validateAllowedModels(); err == nil {
+		t.Error("allowlist with an unknown model was accepted")
+	}
+}
+
+func TestChatRejectsDisallowedModel(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Models = map[string]ModelConfig{"gpt-4o-mini": {}, "o3": {Reasoning: true}}
+	cfg.DefaultModel = "gpt-4o-mini"
+	cfg.DefaultAllowedModels = []string{"gpt-4o-mini"}
+	cfg.Clients = map[string]ClientConfig{
+		"basic-key":   {Name: "basic"},
+		"premium-key": {Name: "premium", AllowedModels: []string{"gpt-4o-mini", "o3"}},
+	}
+	_, front := newTestServer(t, cfg, &azureStub{content: "ok"})
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","model":"o3"}`, "X-API-Key", "basic-key")
+	var got ErrorResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if resp.StatusCode != http.StatusForbidden || got.Code != "model_not_allowed" {
+		t.Errorf("basic key on o3: status=%d error=%+v", resp.StatusCode, got)
+	}
+	if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","model":"o3"}`, "X-API-Key", "premium-key"); resp.StatusCode != http.StatusOK {
+		t.Errorf("premium key on o3 status = %d", resp.StatusCode)
+	}
+	if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "X-API-Key", "basic-key"); resp.StatusCode != http.StatusOK {
+		t.Errorf("basic key on default model status = %d", resp.StatusCode)
+	}
+}
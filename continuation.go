@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Instruction sent after a truncated answer so the model picks it up again
+const continuePrompt = "Continue your previous answer exactly where it stopped. Do not repeat anything you already wrote."
+
+// ContinuationConfig controls answers that stop at max_tokens
+type ContinuationConfig struct {
+	// Keep calling Azure while it stops at max_tokens, up to MaxIterations
+	// extra calls, instead of handing the caller a continuation token
+	AutoContinue  bool `json:"autoContinue"`
+	MaxIterations int  `json:"maxIterations"`
+
+	// Continuation tokens kept, and how long one stays usable
+	Entries int           `json:"entries"`
+	TTL     time.Duration `json:"-"`
+}
+
+// continuation is a truncated answer waiting for a follow-up request
+type continuation struct {
+	client   string
+	model    string
+	endpoint string
+	data     map[string]interface{} // the original payload
+	partial  string                 // everything answered so far
+	grounded bool
+	at       time.Time
+}
+
+// continuationStore holds truncated answers by token. Tokens are single use.
+type continuationStore struct {
+	mu         sync.Mutex
+	entries    map[string]continuation
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+}
+
+func newContinuationStore(maxEntries int, ttl time.Duration) *continuationStore {
+	return &continuationStore{
+		entries:    make(map[string]continuation),
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		now:        time.Now,
+	}
+}
+
+// Store c and return its token. When full, expired entries are dropped
+// first and then the oldest one.
+func (cs *continuationStore) put(c continuation) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.entries) >= cs.maxEntries {
+		oldestToken, oldest := "", cs.now()
+		for token, e := range cs.entries {
+			if cs.now().Sub(e.at) > cs.ttl {
+				delete(cs.entries, token)
+				continue
+			}
+			if !e.at.After(oldest) {
+				oldestToken, oldest = token, e.at
+			}
+		}
+		if len(cs.entries) >= cs.maxEntries {
+			delete(cs.entries, oldestToken)
+		}
+	}
+	c.at = cs.now()
+	token := newCorrelationID()
+	cs.entries[token] = c
+	return token
+}
+
+// Remove and return the continuation for token
+func (cs *continuationStore) take(token string) (continuation, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.entries[token]
+	if !ok {
+		return continuation{}, false
+	}
+	delete(cs.entries, token)
+	if cs.now().Sub(c.at) > cs.ttl {
+		return continuation{}, false
+	}
+	return c, true
+}
+
+// Copy of an Azure payload asking the model to continue the partial answer
+func withContinuation(data map[string]interface{}, partial string) map[string]interface{} {
+	return withFollowUp(data, partial, continuePrompt)
+}
+
+// Copy of an Azure payload with the model's answer and a follow-up
+// instruction appended to the conversation
+func withFollowUp(data map[string]interface{}, answer, instruction string) map[string]interface{} {
+	next := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		next[k] = v
+	}
+	messages := append([]map[string]interface{}(nil), data["messages"].([]map[string]interface{})...)
+	next["messages"] = append(messages,
+		map[string]interface{}{"role": "assistant", "content": answer},
+		map[string]interface{}{"role": "user", "content": instruction},
+	)
+	return next
+}
+
+// Sum the token counts of two calls; nil when neither reported any
+func addUsage(a, b *AzureUsage) *AzureUsage {
+	if a == nil || b == nil {
+		if a == nil {
+			return b
+		}
+		return a
+	}
+	return &AzureUsage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+		TotalTokens:      a.TotalTokens + b.TotalTokens,
+	}
+}
+
+// Keep asking for more while Azure stops at max_tokens, joining the parts
+// into resp. A failed follow-up ends the loop with the answer so far, which
+// is still marked as truncated.
+func (s *Server) autoContinue(ctx context.Context, endpoint string, data map[string]interface{}, resp *AzureResponse) *AzureResponse {
+	choice := &resp.Choices[0]
+	for i := 0; i < s.cfg.Continuation.MaxIterations && choice.FinishReason == "length"; i++ {
+		next, err := s.callAzure(ctx, endpoint, withContinuation(data, choice.Message.Content))
+		if err != nil {
+			logf(ctx, "Auto-continue call %d failed, returning the truncated answer: %v", i+1, err)
+			break
+		}
+		choice.Message.Content += next.Choices[0].Message.Content
+		choice.FinishReason = next.Choices[0].FinishReason
+		resp.Usage = addUsage(resp.Usage, next.Usage)
+	}
+	return resp
+}
+
+// Answer a request carrying a continuationToken with the next part of the
+// truncated answer it refers to. Only the new part is returned; callers
+// append it to what they already have.
+func (s *Server) continueChat(w http.ResponseWriter, r *http.Request, chatRequest ChatRequest, version int) {
+	c, ok := s.continuations.take(chatRequest.ContinuationToken)
+	if !ok || c.client != clientName(r.Context()) {
+		http.Error(w, "Unknown or expired continuationToken", http.StatusNotFound)
+		return
+	}
+	_, model, _ := s.cfg.modelFor(c.model)
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.policyFor(c.endpoint).timeout)
+	defer cancel()
+	azureResponse, err := s.callAzure(ctx, c.endpoint, withContinuation(c.data, c.partial))
+	if err != nil {
+		ue := err.(*upstreamError)
+		logf(r.Context(), "Azure continuation request failed: %v", ue)
+		s.writeUpstreamError(w, r, ue)
+		return
+	}
+
+	message := azureResponse.Choices[0].Message
+	s.audit.record(r.Context(), c.model, continuePrompt, message.Content, azureResponse.Usage)
+	cost := requestCost(model, azureResponse.Usage, s.cfg.Currency)
+	s.spend.add(c.client, c.model, cost)
+
+	mainContent, references := parseResponseAndReferences(message.Content, s.headings)
+	chatResponse := ChatResponse{
+		Response:   s.redactor.redact(s.postProcess.apply(mainContent)),
+		References: references,
+		Grounded:   c.grounded,
+		Cost:       cost,
+
+		UpstreamRequestID: azureResponse.RequestID,
+	}
+	if azureResponse.Choices[0].FinishReason == "length" {
+		c.partial += message.Content
+		chatResponse.ContinuationToken = s.continuations.put(c)
+	}
+	writeChatResponse(w, r, chatResponse, version)
+}
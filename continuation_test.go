@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Azure stub that answers with parts in order, stopping at max_tokens on
+// all but the last
+func truncatingStub(parts ...string) *azureStub {
+	azure := &azureStub{}
+	calls := 0
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		finish := "length"
+		if calls == len(parts)-1 {
+			finish = "stop"
+		}
+		content := parts[min(calls, len(parts)-1)]
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"choices":[{"message":{"content":%q},"finish_reason":%q}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`, content, finish)
+	}
+	return azure
+}
+
+func TestContinuationStoreIsSingleUseAndExpires(t *testing.T) {
+	now := time.Now()
+	store := newContinuationStore(2, time.Minute)
+	store.now = func() time.Time { return now }
+
+	token := store.put(continuation{partial: "a"})
+	if c, ok := store.take(token); !ok || c.partial != "a" {
+		t.Fatalf("take = %+v, %v", c, ok)
+	}
+	if _, ok := store.take(token); ok {
+		t.Error("token was usable twice")
+	}
+
+	token = store.put(continuation{partial: "b"})
+	now = now.Add(2 * time.Minute)
+	if _, ok := store.take(token); ok {
+		t.Error("expired token was accepted")
+	}
+}
+
+func TestWithContinuationLeavesPayloadUntouched(t *testing.T) {
+	data := map[string]interface{}{"messages": []map[string]interface{}{{"role": "user", "content": "q"}}}
+	next := withContinuation(data, "partial")
+	if len(data["messages"].([]map[string]interface{})) != 1 {
+		t.Fatal("original payload was modified")
+	}
+	messages := next["messages"].([]map[string]interface{})
+	if len(messages) != 3 || messages[1]["content"] != "partial" || messages[2]["content"] != continuePrompt {
+		t.Errorf("messages = %v", messages)
+	}
+}
+
+func TestContinuationToken(t *testing.T) {
+	azure := truncatingStub("First half", " second half.\nReferences:\n1. Foo")
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	var first ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &first)
+	if first.Response != "First half" || first.ContinuationToken == "" {
+		t.Fatalf("first response = %+v, want a continuation token", first)
+	}
+
+	resp := postJSON(t, front.URL+"/api/chat", fmt.Sprintf(`{"continuationToken":%q}`, first.ContinuationToken))
+	var second ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &second)
+	if resp.StatusCode != http.StatusOK || second.Response != "second half." || second.ContinuationToken != "" || len(second.References) != 1 {
+		t.Fatalf("status=%d continuation = %+v", resp.StatusCode, second)
+	}
+	messages := azure.payload(t, 1)["messages"].([]interface{})
+	if partial := messages[len(messages)-2].(map[string]interface{}); partial["role"] != "assistant" || partial["content"] != "First half" {
+		t.Errorf("continuation did not send the partial answer: %v", partial)
+	}
+
+	resp = postJSON(t, front.URL+"/api/chat", fmt.Sprintf(`{"continuationToken":%q}`, first.ContinuationToken))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("reused token status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAutoContinue(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Continuation.AutoContinue = true
+	cfg.Continuation.MaxIterations = 1
+	_, front := newTestServer(t, cfg, truncatingStub("One", " two", " three."))
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &got)
+	if got.Response != "One two" || got.ContinuationToken == "" {
+		t.Fatalf("response = %+v, want two joined parts and a token for the rest", got)
+	}
+}
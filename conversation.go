@@ -0,0 +1,283 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Turn is one user message and the assistant's answer to it
+type Turn struct {
+	User      string    `json:"user"`
+	Assistant string    `json:"assistant"`
+	At        time.Time `json:"at"`
+}
+
+// errConversationOwner is returned for a conversation started by another
+// client
+var errConversationOwner = errors.New("conversation belongs to another client")
+
+// ConversationStore keeps the full transcript of each conversation. Each
+// conversation belongs to the client that started it; Load, Append and
+// Delete return errConversationOwner for anyone else.
+type ConversationStore interface {
+	// Load returns every turn of a conversation, oldest first
+	Load(owner, id string) ([]Turn, error)
+	// Append adds a turn to the end of a conversation, creating it for
+	// owner if needed
+	Append(owner, id string, turn Turn) error
+	// Delete forgets a conversation; deleting an unknown one is not an error
+	Delete(owner, id string) error
+}
+
+// memoryConversationStore is an in-process ConversationStore holding at
+// most maxEntries conversations. The least recently used one is evicted
+// to make room, and conversations unused for ttl expire. A conversation
+// whose turns serialize to more than maxBytes is compacted on Append.
+type memoryConversationStore struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List // of *conversationEntry, most recently used first
+	maxEntries int
+	maxBytes   int
+	ttl        time.Duration
+	now        func() time.Time
+	stats      ConversationStats
+}
+
+type conversationEntry struct {
+	id        string
+	owner     string // client name, empty without authentication
+	turns     []Turn
+	lastUsed  time.Time
+	compacted bool // turns were dropped or cut to fit maxBytes
+}
+
+// ConversationStats counts cache activity since startup
+type ConversationStats struct {
+	Entries   int   `json:"entries"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Expired   int64 `json:"expired"`
+
+	// Appends that had to drop or cut turns to stay under the size limit
+	Compactions int64 `json:"compactions"`
+}
+
+func newMemoryConversationStore(maxEntries, maxBytes int, ttl time.Duration) *memoryConversationStore {
+	return &memoryConversationStore{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		now:        time.Now,
+	}
+}
+
+// Return the live entry for id, dropping it if it has expired.
+// Callers must hold m.mu.
+func (m *memoryConversationStore) lookup(id string) *conversationEntry {
+	el, ok := m.entries[id]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*conversationEntry)
+	if m.ttl > 0 && m.now().Sub(entry.lastUsed) > m.ttl {
+		m.remove(el)
+		m.stats.Expired++
+		return nil
+	}
+	entry.lastUsed = m.now()
+	m.lru.MoveToFront(el)
+	return entry
+}
+
+// Callers must hold m.mu
+func (m *memoryConversationStore) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.entries, el.Value.(*conversationEntry).id)
+}
+
+func (m *memoryConversationStore) Load(owner, id string) ([]Turn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(id)
+	if entry == nil {
+		m.stats.Misses++
+		return nil, nil
+	}
+	if entry.owner != owner {
+		return nil, errConversationOwner
+	}
+	m.stats.Hits++
+	return append([]Turn(nil), entry.turns...), nil
+}
+
+func (m *memoryConversationStore) Append(owner, id string, turn Turn) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry := m.lookup(id); entry != nil {
+		if entry.owner != owner {
+			return errConversationOwner
+		}
+		entry.turns = append(entry.turns, turn)
+		m.compact(entry)
+		return nil
+	}
+
+	for m.maxEntries > 0 && m.lru.Len() >= m.maxEntries {
+		m.remove(m.lru.Back())
+		m.stats.Evictions++
+	}
+	entry := &conversationEntry{id: id, owner: owner, turns: []Turn{turn}, lastUsed: m.now()}
+	m.compact(entry)
+	m.entries[id] = m.lru.PushFront(entry)
+	return nil
+}
+
+// Drop the oldest turns until entry fits maxBytes. When the newest turn
+// alone is too big, its messages are cut to share the limit. Each turn is
+// measured once, and dropping one subtracts its size.
+// Callers must hold m.mu.
+func (m *memoryConversationStore) compact(entry *conversationEntry) {
+	if m.maxBytes <= 0 {
+		return
+	}
+	// The JSON array is "[", then each turn followed by "," or "]"
+	sizes := make([]int, len(entry.turns))
+	total := 1
+	for i, turn := range entry.turns {
+		sizes[i] = turnSize(turn)
+		total += sizes[i] + 1
+	}
+	if total <= m.maxBytes {
+		return
+	}
+	drop := 0
+	for drop < len(sizes)-1 && total > m.maxBytes {
+		total -= sizes[drop] + 1
+		drop++
+	}
+	entry.turns = entry.turns[drop:]
+	if last := &entry.turns[0]; total > m.maxBytes {
+		overhead := turnsSize([]Turn{{At: last.At}})
+		budget := max(m.maxBytes-overhead, 0)
+		last.User = cutToBytes(last.User, budget/2)
+		last.Assistant = cutToBytes(last.Assistant, budget-jsonStringLen(last.User))
+	}
+	entry.turns = append([]Turn(nil), entry.turns...)
+	entry.compacted = true
+	m.stats.Compactions++
+}
+
+// Reports whether a conversation has lost turns to the size limit
+func (m *memoryConversationStore) Compacted(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[id]
+	return ok && el.Value.(*conversationEntry).compacted
+}
+
+// Size of turns as stored, in bytes of JSON
+func turnsSize(turns []Turn) int {
+	b, _ := json.Marshal(turns)
+	return len(b)
+}
+
+// Size of one turn in bytes of JSON, without the array around it
+func turnSize(turn Turn) int {
+	b, _ := json.Marshal(turn)
+	return len(b)
+}
+
+// Bytes s takes up inside a JSON string literal
+func jsonStringLen(s string) int {
+	b, _ := json.Marshal(s)
+	return len(b) - 2
+}
+
+// Longest prefix of s, on a rune boundary, whose JSON encoding fits in n
+// bytes. Encoding never shrinks text, so the cut starts at n bytes and
+// backs off by the overshoot.
+func cutToBytes(s string, n int) string {
+	if len(s) > n {
+		s = s[:n]
+	}
+	for {
+		s = strings.ToValidUTF8(s, "")
+		excess := jsonStringLen(s) - n
+		if excess <= 0 {
+			return s
+		}
+		s = s[:max(len(s)-excess, 0)]
+	}
+}
+
+func (m *memoryConversationStore) Delete(owner, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[id]; ok {
+		if el.Value.(*conversationEntry).owner != owner {
+			return errConversationOwner
+		}
+		m.remove(el)
+	}
+	return nil
+}
+
+// Return a snapshot of the cache counters
+func (m *memoryConversationStore) Stats() ConversationStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	stats.Entries = m.lru.Len()
+	return stats
+}
+
+// Keep only the most recent n turns for the prompt. The store still holds
+// the full transcript.
+func historyWindow(turns []Turn, n int) []Turn {
+	if n <= 0 {
+		return nil
+	}
+	if len(turns) > n {
+		return turns[len(turns)-n:]
+	}
+	return turns
+}
+
+// Render turns as chat messages
+func historyMessages(turns []Turn) []map[string]interface{} {
+	messages := make([]map[string]interface{}, 0, 2*len(turns))
+	for _, t := range turns {
+		messages = append(messages,
+			map[string]interface{}{"role": "user", "content": t.User},
+			map[string]interface{}{"role": "assistant", "content": t.Assistant},
+		)
+	}
+	return messages
+}
+
+// Forget one of the caller's stored conversations
+func (s *Server) deleteConversationHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.conversations.Delete(clientName(r.Context()), mux.Vars(r)["id"])
+	if errors.Is(err, errConversationOwner) {
+		http.Error(w, "Unknown conversation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logf(r.Context(), "Failed to delete conversation: %v", err)
+		http.Error(w, "Failed to delete conversation", http.StatusInternalServerError)
+		return
+	}
+	s.summaries.invalidate(clientName(r.Context()), mux.Vars(r)["id"])
+	w.WriteHeader(http.StatusNoContent)
+}
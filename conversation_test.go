@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestHistoryWindow(t *testing.T) {
+	turns := []Turn{{User: "1"}, {User: "2"}, {User: "3"}}
+	for n, want := range map[int]int{0: 0, 2: 2, 3: 3, 10: 3} {
+		got := historyWindow(turns, n)
+		if len(got) != want {
+			t.Errorf("historyWindow(n=%d) has %d turns, want %d", n, len(got), want)
+		}
+		if want > 0 && got[len(got)-1].User != "3" {
+			t.Errorf("historyWindow(n=%d) dropped the newest turn", n)
+		}
+	}
+}
+
+func TestConversationHistorySlidingWindow(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.HistoryTurns = 2
+	azure := &azureStub{content: "Answer."}
+	srv, front := newTestServer(t, cfg, azure)
+
+	for i := 0; i < 4; i++ {
+		readBody(t, postJSON(t, front.URL+"/api/chat", fmt.Sprintf(`{"message":"q%d","conversationId":"c1"}`, i)))
+	}
+
+	// system + 2 history turns as 4 messages + the new user message
+	if got := len(azure.payload(t, 3)["messages"].([]interface{})); got != 6 {
+		t.Errorf("fourth request sent %d messages, want 6", got)
+	}
+	stored, _ := srv.conversations.Load("", "c1")
+	if len(stored) != 4 {
+		t.Errorf("store holds %d turns, want the full 4", len(stored))
+	}
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"q","conversationId":"c1","maxHistoryTurns":0}`))
+	if got := len(azure.payload(t, 4)["messages"].([]interface{})); got != 2 {
+		t.Errorf("maxHistoryTurns=0 sent %d messages, want 2", got)
+	}
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"q","conversationId":"c1","maxHistoryTurns":500}`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("maxHistoryTurns above the limit got status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestConversationRejectsOtherClient(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{
+		"key-a": {Name: "a"},
+		"key-b": {Name: "b"},
+	}
+	azure := &azureStub{content: "Answer."}
+	srv, front := newTestServer(t, cfg, azure)
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"secret","conversationId":"c1"}`, "X-API-Key", "key-a"))
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"what did I say?","conversationId":"c1"}`, "X-API-Key", "key-b")
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("other client status = %d, want 404", resp.StatusCode)
+	}
+	if len(azure.payloads) != 1 {
+		t.Errorf("Azure got %d requests, want the other client's turn rejected before it", len(azure.payloads))
+	}
+	if _, err := srv.conversations.Load("b", "c1"); err != errConversationOwner {
+		t.Errorf("Load by another client = %v, want errConversationOwner", err)
+	}
+	if err := srv.conversations.Append("b", "c1", Turn{User: "injected"}); err != errConversationOwner {
+		t.Errorf("Append by another client = %v, want errConversationOwner", err)
+	}
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"again","conversationId":"c1"}`, "X-API-Key", "key-a"))
+	if stored, _ := srv.conversations.Load("a", "c1"); len(stored) != 2 {
+		t.Errorf("owner's conversation holds %d turns, want 2", len(stored))
+	}
+}
+
+func TestMemoryConversationStoreLRUAndTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := newMemoryConversationStore(2, 0, time.Hour)
+	store.now = func() time.Time { return now }
+
+	store.Append("", "a", Turn{User: "1"})
+	store.Append("", "b", Turn{User: "2"})
+	store.Load("", "a") // a is now more recent than b
+	store.Append("", "c", Turn{User: "3"})
+
+	if turns, _ := store.Load("", "b"); turns != nil {
+		t.Error("least recently used conversation was not evicted")
+	}
+	if turns, _ := store.Load("", "a"); len(turns) != 1 {
+		t.Errorf("a has %d turns, want 1", len(turns))
+	}
+
+	now = now.Add(2 * time.Hour)
+	if turns, _ := store.Load("", "c"); turns != nil {
+		t.Error("expired conversation was returned")
+	}
+
+	want := ConversationStats{Entries: 1, Hits: 2, Misses: 2, Evictions: 1, Expired: 1}
+	if got := store.Stats(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestDeleteConversation(t *testing.T) {
+	srv, front := newTestServer(t, defaultConfig(), &azureStub{content: "Answer."})
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"q","conversationId":"c1"}`))
+
+	req, _ := http.NewRequest("DELETE", front.URL+"/api/conversations/c1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", resp.StatusCode)
+	}
+	if turns, _ := srv.conversations.Load("", "c1"); turns != nil {
+		t.Errorf("conversation still holds %d turns after delete", len(turns))
+	}
+}
+
+func TestDeleteConversationRejectsOtherClient(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{
+		"key-a": {Name: "a"},
+		"key-b": {Name: "b"},
+	}
+	srv, front := newTestServer(t, cfg, &azureStub{content: "Answer."})
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"q","conversationId":"c1"}`, "X-API-Key", "key-a"))
+
+	remove := func(key string) int {
+		req, _ := http.NewRequest("DELETE", front.URL+"/api/conversations/c1", nil)
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := remove("key-b"); status != http.StatusNotFound {
+		t.Fatalf("other client status = %d, want 404", status)
+	}
+	if turns, _ := srv.conversations.Load("a", "c1"); len(turns) != 1 {
+		t.Fatalf("owner's conversation holds %d turns after another client's delete, want 1", len(turns))
+	}
+	if status := remove("key-a"); status != http.StatusNoContent {
+		t.Errorf("owner status = %d, want 204", status)
+	}
+}
+
+func TestMemoryConversationStoreCompactsAtSizeLimit(t *testing.T) {
+	at := time.Unix(0, 0).UTC()
+	turns := []Turn{{User: "q1", Assistant: "a1", At: at}, {User: "q2", Assistant: "a2", At: at}}
+	limit := turnsSize(turns)
+
+	for _, tt := range []struct {
+		maxBytes      int
+		wantTurns     int
+		wantCompacted bool
+	}{
+		{limit, 2, false},
+		{limit - 1, 1, true},
+	} {
+		store := newMemoryConversationStore(10, tt.maxBytes, time.Hour)
+		for _, turn := range turns {
+			store.Append("", "c", turn)
+		}
+		stored, _ := store.Load("", "c")
+		if len(stored) != tt.wantTurns || store.Compacted("c") != tt.wantCompacted {
+			t.Errorf("maxBytes=%d: %d turns, compacted %v; want %d, %v", tt.maxBytes, len(stored), store.Compacted("c"), tt.wantTurns, tt.wantCompacted)
+		}
+		if stored[len(stored)-1].User != "q2" {
+			t.Errorf("maxBytes=%d dropped the newest turn", tt.maxBytes)
+		}
+	}
+}
+
+func TestMemoryConversationStoreKeepsNewestTurnsThatFit(t *testing.T) {
+	const maxBytes = 1000
+	store := newMemoryConversationStore(10, maxBytes, time.Hour)
+	var all []Turn
+	for i := 0; i < 60; i++ {
+		turn := Turn{User: strings.Repeat("q", i%7*10), Assistant: strings.Repeat("é", i%5*20), At: time.Unix(int64(i), 0).UTC()}
+		all = append(all, turn)
+		store.Append("", "c", turn)
+
+		stored, _ := store.Load("", "c")
+		kept := all[len(all)-len(stored):]
+		if size := turnsSize(stored); size > maxBytes || size != turnsSize(kept) {
+			t.Fatalf("after %d turns: stored %d bytes, want at most %d and the newest turns unchanged", i+1, size, maxBytes)
+		}
+		if len(stored) < len(all) && turnsSize(all[len(all)-len(stored)-1:]) <= maxBytes {
+			t.Fatalf("after %d turns: kept %d turns, but one more would still fit", i+1, len(stored))
+		}
+	}
+}
+
+func TestMemoryConversationStoreCutsOversizedTurn(t *testing.T) {
+	store := newMemoryConversationStore(10, 200, time.Hour)
+	store.Append("", "c", Turn{User: strings.Repeat("é\"", 500), Assistant: strings.Repeat("x", 500)})
+
+	stored, _ := store.Load("", "c")
+	if size := turnsSize(stored); size > 200 {
+		t.Errorf("stored size = %d, want at most 200", size)
+	}
+	if !utf8.ValidString(stored[0].User) || stored[0].User == "" || stored[0].Assistant == "" {
+		t.Errorf("turn was not cut cleanly: %+v", stored[0])
+	}
+	if got := store.Stats().Compactions; got != 1 {
+		t.Errorf("compactions = %d, want 1", got)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import "sync"
+
+// Estimate the worst-case cost of a request before it is sent: the prompt
+// plus the full max_tokens completion, priced at the model's rates.
+// Retrieved grounding documents are not known up front and are not counted.
+func estimateMaxCost(model ModelConfig, promptTokens, maxTokens int) float64 {
+	return float64(promptTokens)/1000*model.InputCostPer1K + float64(maxTokens)/1000*model.OutputCostPer1K
+}
+
+// Returns the per-request cost ceiling for a client, zero meaning unlimited
+func (c *Config) costCeilingFor(client *ClientConfig) float64 {
+	if client != nil && client.MaxRequestCost > 0 {
+		return client.MaxRequestCost
+	}
+	return c.MaxRequestCost
+}
+
+// Cost is the estimated price of a completed request
+type Cost struct {
+	Currency string  `json:"currency"`
+	Amount   float64 `json:"amount"`
+}
+
+// Price a completed request from the token usage Azure reported. Returns
+// nil when the model has no pricing or Azure reported no usage.
+func requestCost(model ModelConfig, usage *AzureUsage, currency string) *Cost {
+	if usage == nil || (model.InputCostPer1K == 0 && model.OutputCostPer1K == 0) {
+		return nil
+	}
+	amount := float64(usage.PromptTokens)/1000*model.InputCostPer1K + float64(usage.CompletionTokens)/1000*model.OutputCostPer1K
+	return &Cost{Currency: currency, Amount: amount}
+}
+
+// spendTracker totals request costs per client and per model
+type spendTracker struct {
+	mu       sync.Mutex
+	currency string
+	byClient map[string]float64
+	byModel  map[string]float64
+}
+
+// SpendReport is the running spend since startup
+type SpendReport struct {
+	Currency string             `json:"currency"`
+	Total    float64            `json:"total"`
+	ByClient map[string]float64 `json:"byClient"`
+	ByModel  map[string]float64 `json:"byModel"`
+}
+
+func newSpendTracker(currency string) *spendTracker {
+	return &spendTracker{currency: currency, byClient: make(map[string]float64), byModel: make(map[string]float64)}
+}
+
+func (t *spendTracker) add(client, model string, cost *Cost) {
+	if cost == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byClient[client] += cost.Amount
+	t.byModel[model] += cost.Amount
+}
+
+func (t *spendTracker) report() SpendReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := SpendReport{Currency: t.currency, ByClient: make(map[string]float64), ByModel: make(map[string]float64)}
+	for k, v := range t.byClient {
+		r.ByClient[k] = v
+		r.Total += v
+	}
+	for k, v := range t.byModel {
+		r.ByModel[k] = v
+	}
+	return r
+}
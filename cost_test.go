@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimateMaxCost(t *testing.T) {
+	model := ModelConfig{InputCostPer1K: 0.01, OutputCostPer1K: 0.03}
+	got := estimateMaxCost(model, 500, 2000)
+	if want := 0.005 + 0.06; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("estimateMaxCost = %v, want %v", got, want)
+	}
+}
+
+func TestValidateCostCeiling(t *testing.T) {
+	priced := map[string]ModelConfig{"gpt-4o": {InputCostPer1K: 0.01, OutputCostPer1K: 0.03}}
+	unpriced := map[string]ModelConfig{"gpt-4o": {InputCostPer1K: 0.01}}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"no ceiling", Config{}, false},
+		{"ceiling without models", Config{MaxRequestCost: 1}, true},
+		{"ceiling with unpriced model", Config{MaxRequestCost: 1, Models: unpriced}, true},
+		{"client ceiling with unpriced model", Config{Models: unpriced, Clients: map[string]ClientConfig{"k": {MaxRequestCost: 1}}}, true},
+		{"ceiling with priced models", Config{MaxRequestCost: 1, Models: priced}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validateCostCeiling(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	model := ModelConfig{InputCostPer1K: 0.01, OutputCostPer1K: 0.03}
+	got := requestCost(model, &AzureUsage{PromptTokens: 1200, CompletionTokens: 300}, "EUR")
+	if got == nil || got.Currency != "EUR" {
+		t.Fatalf("requestCost = %+v, want EUR cost", got)
+	}
+	if want := 0.012 + 0.009; math.Abs(got.Amount-want) > 1e-9 {
+		t.Fatalf("amount = %v, want %v", got.Amount, want)
+	}
+
+	if got := requestCost(ModelConfig{}, &AzureUsage{PromptTokens: 10}, "USD"); got != nil {
+		t.Errorf("unpriced model cost = %+v, want nil", got)
+	}
+	if got := requestCost(model, nil, "USD"); got != nil {
+		t.Errorf("cost without usage = %+v, want nil", got)
+	}
+}
+
+func TestSpendTracker(t *testing.T) {
+	tracker := newSpendTracker("USD")
+	tracker.add("alice", "gpt-4o", &Cost{Currency: "USD", Amount: 0.5})
+	tracker.add("alice", "gpt-4o-mini", &Cost{Currency: "USD", Amount: 0.25})
+	tracker.add("bob", "gpt-4o", &Cost{Currency: "USD", Amount: 1})
+	tracker.add("bob", "gpt-4o", nil)
+
+	r := tracker.report()
+	if math.Abs(r.Total-1.75) > 1e-9 {
+		t.Errorf("total = %v, want 1.75", r.Total)
+	}
+	if r.ByClient["alice"] != 0.75 || r.ByClient["bob"] != 1 {
+		t.Errorf("byClient = %v", r.ByClient)
+	}
+	if r.ByModel["gpt-4o"] != 1.5 || r.ByModel["gpt-4o-mini"] != 0.25 {
+		t.Errorf("byModel = %v", r.ByModel)
+	}
+}
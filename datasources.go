@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Check the assembled data_sources block against the configured size cap.
+// Returns the message for the caller when it is over.
+func (c *Config) checkDataSources(data map[string]interface{}) (string, bool) {
+	sources, ok := data["data_sources"].([]map[string]interface{})
+	if !ok || c.MaxDataSourcesBytes <= 0 {
+		return "", true
+	}
+	encoded, _ := json.Marshal(sources)
+	if len(encoded) > c.MaxDataSourcesBytes {
+		return fmt.Sprintf("The data sources block may be at most %d bytes, got %d", c.MaxDataSourcesBytes, len(encoded)), false
+	}
+	return "", true
+}
+
+// Reject a payload whose data_sources block is over the configured cap.
+// Reports false after writing the error.
+func (s *Server) limitDataSources(w http.ResponseWriter, r *http.Request, data map[string]interface{}) bool {
+	message, ok := s.cfg.checkDataSources(data)
+	if !ok {
+		s.writeError(w, r, http.StatusBadRequest, "data_sources_too_large", message, map[string]interface{}{
+			"maxDataSourcesBytes": s.cfg.MaxDataSourcesBytes,
+		})
+	}
+	return ok
+}
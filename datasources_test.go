@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckDataSources(t *testing.T) {
+	payload := map[string]interface{}{"data_sources": []map[string]interface{}{
+		{"type": "azure_search", "parameters": map[string]interface{}{"index_name": "docs"}},
+	}}
+
+	if _, ok := (&Config{MaxDataSourcesBytes: 1024}).checkDataSources(payload); !ok {
+		t.Error("small block rejected under a cap of 1024 bytes")
+	}
+	if _, ok := (&Config{MaxDataSourcesBytes: 50}).checkDataSources(map[string]interface{}{}); !ok {
+		t.Error("payload without data_sources rejected")
+	}
+	if msg, ok := (&Config{MaxDataSourcesBytes: 50}).checkDataSources(payload); ok || !strings.Contains(msg, "at most 50 bytes") {
+		t.Errorf("large block = %q, %v", msg, ok)
+	}
+	if _, ok := (&Config{}).checkDataSources(payload); !ok {
+		t.Error("block rejected with the cap disabled")
+	}
+}
+
+func TestDataSourcesCapReturns400(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxDataSourcesBytes = 10
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, cfg, azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	var got ErrorResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if resp.StatusCode != http.StatusBadRequest || got.Code != "data_sources_too_large" {
+		t.Fatalf("status=%d error=%+v", resp.StatusCode, got)
+	}
+	if len(azure.payloads) != 0 {
+		t.Error("request was sent to Azure")
+	}
+}
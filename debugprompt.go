@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Request header asking for the resolved prompts in the debug section
+const debugPromptHeader = "X-Debug-Prompt"
+
+// Reports whether the request asked for its resolved prompts and may see
+// them. Only admin clients may: without client authentication there are
+// none, so the header alone never exposes prompts.
+func debugPromptAllowed(r *http.Request) bool {
+	if r.Header.Get(debugPromptHeader) != "true" {
+		return false
+	}
+	client := clientFromContext(r.Context())
+	return client != nil && client.Admin
+}
+
+// Mask the configured credentials and the redaction patterns in a prompt
+// shown for debugging
+func (s *Server) redactPrompt(prompt string) string {
+	secrets := []string{s.cfg.APIKey, s.cfg.Search.Key}
+	for key := range s.cfg.Clients {
+		secrets = append(secrets, key)
+	}
+	for _, tenant := range s.cfg.Tenants {
+		secrets = append(secrets, tenant.Search.Key)
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			prompt = strings.ReplaceAll(prompt, secret, "[redacted]")
+		}
+	}
+	return s.redactor.redact(prompt)
+}
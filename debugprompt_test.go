@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugPromptForAdmins(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{
+		"admin-key": {Name: "ops", Admin: true},
+		"user-key":  {Name: "alice"},
+	}
+	cfg.SystemPrompt = "You are terse. Internal token: search-secret."
+	cfg.Search.Key = "search-secret"
+	_, front := newTestServer(t, cfg, &azureStub{content: "Hello."})
+
+	debug := func(key, body string) *ChatDebug {
+		t.Helper()
+		resp := postJSON(t, front.URL+"/api/chat", body, "X-API-Key", key, debugPromptHeader, "true")
+		var chat ChatResponse
+		if err := json.Unmarshal([]byte(readBody(t, resp)), &chat); err != nil {
+			t.Fatal(err)
+		}
+		return chat.Debug
+	}
+
+	d := debug("admin-key", `{"message":"What is Go?"}`)
+	if d == nil {
+		t.Fatal("admin response has no debug section")
+	}
+	if !strings.Contains(d.SystemPrompt, "You are terse.") || !strings.Contains(d.UserPrompt, "What is Go?") {
+		t.Errorf("debug prompts = %q / %q, want the resolved system and user prompts", d.SystemPrompt, d.UserPrompt)
+	}
+	if strings.Contains(d.SystemPrompt, "search-secret") || !strings.Contains(d.SystemPrompt, "[redacted]") {
+		t.Errorf("system prompt = %q, want the search key redacted", d.SystemPrompt)
+	}
+
+	if d := debug("user-key", `{"message":"What is Go?"}`); d != nil {
+		t.Errorf("non-admin debug = %+v, want no debug section", d)
+	}
+	if d := debug("user-key", `{"message":"What is Go?","debug":true}`); d == nil || d.SystemPrompt != "" || d.UserPrompt != "" {
+		t.Errorf("non-admin debug = %+v, want the usual section without prompts", d)
+	}
+}
+
+func TestDebugPromptNeedsClientAuth(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), &azureStub{content: "Hello."})
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","debug":true}`, debugPromptHeader, "true")
+	var chat ChatResponse
+	if err := json.Unmarshal([]byte(readBody(t, resp)), &chat); err != nil {
+		t.Fatal(err)
+	}
+	if chat.Debug == nil || chat.Debug.SystemPrompt != "" || chat.Debug.UserPrompt != "" {
+		t.Errorf("debug = %+v, want prompts omitted without an admin client", chat.Debug)
+	}
+}
+
+func TestDebugPromptIsNotDeduplicated(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{"admin-key": {Name: "ops", Admin: true}}
+	cfg.Dedup.Window = time.Minute
+	azure := &azureStub{content: "Hello."}
+	_, front := newTestServer(t, cfg, azure)
+
+	chat := func(headers ...string) ChatResponse {
+		var resp ChatResponse
+		json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, append([]string{"X-API-Key", "admin-key"}, headers...)...))), &resp)
+		return resp
+	}
+	chat()
+	if got := chat(debugPromptHeader, "true"); got.Deduplicated || got.Debug == nil || got.Debug.SystemPrompt == "" {
+		t.Errorf("debug prompt response = %+v, want a fresh answer with the prompts", got)
+	}
+	if got := chat(); !got.Deduplicated || got.Debug != nil {
+		t.Errorf("repeat without the flag = %+v, want the first answer without prompts", got)
+	}
+	if len(azure.payloads) != 2 {
+		t.Errorf("Azure got %d requests, want 2", len(azure.payloads))
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// DedupConfig controls the answering of double-submitted requests. Unlike
+// a client-chosen idempotency key this works on content alone: a client
+// repeating a blocking request with the same fingerprint within Window
+// gets the first request's answer, waiting for it if it is still in flight.
+type DedupConfig struct {
+	// Zero turns deduplication off
+	Window time.Duration `json:"-"`
+
+	// Requests remembered at once; beyond that new requests are not
+	// deduplicated until older ones expire
+	Entries int `json:"entries"`
+}
+
+// dedupEntry is a request being answered, or answered within the window
+type dedupEntry struct {
+	done chan struct{} // closed once resp is final
+	resp *ChatResponse // nil when the request did not produce an answer
+	at   time.Time     // when it finished
+}
+
+// dedupCache tracks recent blocking requests by content
+type dedupCache struct {
+	mu         sync.Mutex
+	entries    map[string]*dedupEntry
+	maxEntries int
+	window     time.Duration
+	now        func() time.Time
+}
+
+func newDedupCache(cfg DedupConfig) *dedupCache {
+	return &dedupCache{
+		entries:    make(map[string]*dedupEntry),
+		maxEntries: cfg.Entries,
+		window:     cfg.Window,
+		now:        time.Now,
+	}
+}
+
+// Find the entry for key. leader is true when the caller should answer
+// the request and then call finish, false when it should wait on the
+// returned entry. A nil entry means the cache is full and the request is
+// answered without deduplication.
+func (dc *dedupCache) begin(key string) (entry *dedupEntry, leader bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if e, ok := dc.entries[key]; ok {
+		if !dc.expired(e) {
+			return e, false
+		}
+		delete(dc.entries, key)
+	}
+	if len(dc.entries) >= dc.maxEntries {
+		for k, e := range dc.entries {
+			if dc.expired(e) {
+				delete(dc.entries, k)
+			}
+		}
+		if len(dc.entries) >= dc.maxEntries {
+			return nil, true
+		}
+	}
+	e := &dedupEntry{done: make(chan struct{})}
+	dc.entries[key] = e
+	return e, true
+}
+
+// Reports whether a finished entry has left the window. In-flight entries
+// never expire. Callers must hold dc.mu.
+func (dc *dedupCache) expired(e *dedupEntry) bool {
+	select {
+	case <-e.done:
+		return e.resp == nil || dc.now().Sub(e.at) > dc.window
+	default:
+		return false
+	}
+}
+
+// Publish the leader's answer, or nil when it failed, and wake the
+// requests waiting for it. A failed request is forgotten so a retry is
+// answered afresh.
+func (dc *dedupCache) finish(key string, entry *dedupEntry, resp *ChatResponse) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	entry.resp = resp
+	entry.at = dc.now()
+	close(entry.done)
+	if resp == nil && dc.entries[key] == entry {
+		delete(dc.entries, key)
+	}
+}
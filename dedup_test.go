@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDedupCacheWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	dc := newDedupCache(DedupConfig{Window: 2 * time.Second, Entries: 2})
+	dc.now = func() time.Time { return now }
+
+	entry, leader := dc.begin("a")
+	if !leader || entry == nil {
+		t.Fatal("first request did not lead")
+	}
+	if e, leader := dc.begin("a"); leader || e != entry {
+		t.Fatal("in-flight duplicate did not join the first request")
+	}
+	dc.finish("a", entry, &ChatResponse{Response: "answer"})
+
+	now = now.Add(2 * time.Second)
+	if e, leader := dc.begin("a"); leader || e.resp.Response != "answer" {
+		t.Error("duplicate at the end of the window was not deduplicated")
+	}
+	now = now.Add(time.Millisecond)
+	if _, leader := dc.begin("a"); !leader {
+		t.Error("request after the window was deduplicated")
+	}
+}
+
+func TestDedupCacheForgetsFailuresAndIsBounded(t *testing.T) {
+	dc := newDedupCache(DedupConfig{Window: time.Minute, Entries: 2})
+
+	entry, _ := dc.begin("failed")
+	dc.finish("failed", entry, nil)
+	if _, leader := dc.begin("failed"); !leader {
+		t.Error("retry of a failed request was deduplicated")
+	}
+
+	dc.begin("b")
+	if entry, leader := dc.begin("c"); entry != nil || !leader {
+		t.Error("a full cache still tracked a new request")
+	}
+}
+
+func TestChatDeduplicatesRepeatedRequests(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Dedup.Window = time.Minute
+	release := make(chan struct{})
+	received := make(chan struct{}, 10)
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"Answer."},"finish_reason":"stop"}]}`))
+	}
+	_, front := newTestServer(t, cfg, azure)
+
+	results := make(chan ChatResponse, 2)
+	send := func(body string) {
+		var got ChatResponse
+		json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", body))), &got)
+		results <- got
+	}
+	go send(`{"message":"hi"}`)
+	<-received
+	go send(`{ "message": "hi" }`)
+	time.Sleep(50 * time.Millisecond) // let the duplicate arrive while the first is in flight
+	close(release)
+
+	first, second := <-results, <-results
+	if first.Deduplicated == second.Deduplicated || first.Response != "Answer." || second.Response != "Answer." {
+		t.Errorf("responses = %+v, %+v; want one deduplicated copy", first, second)
+	}
+
+	send(`{"message":"hi"}`)
+	if got := <-results; !got.Deduplicated {
+		t.Error("repeat within the window was not deduplicated")
+	}
+	send(`{"message":"something else"}`)
+	if got := <-results; got.Deduplicated {
+		t.Error("a different message was deduplicated")
+	}
+	if n := len(azure.payloads); n != 2 {
+		t.Errorf("azure received %d requests, want 2", n)
+	}
+}
+
+func TestChatDedupSeparatesAnonymousCallers(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Dedup.Window = time.Minute
+	cfg.Server.TrustedProxies, _ = parseTrustedProxies("127.0.0.0/8, ::1")
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, cfg, azure)
+
+	send := func(ip string) (ChatResponse, string) {
+		resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "X-Forwarded-For", ip)
+		var got ChatResponse
+		json.Unmarshal([]byte(readBody(t, resp)), &got)
+		return got, resp.Header.Get(fingerprintHeader)
+	}
+	_, first := send("198.51.100.1")
+	other, otherFP := send("198.51.100.2")
+	if other.Deduplicated || otherFP == first {
+		t.Errorf("another anonymous caller got deduplicated = %v with fingerprint %s, want its own answer", other.Deduplicated, otherFP)
+	}
+	if again, fp := send("198.51.100.1"); !again.Deduplicated || fp != first {
+		t.Error("a repeat from the same anonymous caller was not deduplicated")
+	}
+	if n := len(azure.payloads); n != 2 {
+		t.Errorf("azure received %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Document is grounding material a caller retrieved itself and passes in
+// the request's context, in place of Azure Search
+type Document struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+	URL     string `json:"url,omitempty"`
+}
+
+// ContextDocumentsConfig caps the documents one request may pass in
+// context: their number, and their title, content and URL bytes together;
+// zero disables either
+type ContextDocumentsConfig struct {
+	MaxDocuments int `json:"maxDocuments"`
+	MaxBytes     int `json:"maxBytes"`
+}
+
+// Reject context documents over the configured caps. Reports false after
+// writing the error.
+func (s *Server) limitContextDocuments(w http.ResponseWriter, r *http.Request, docs []Document) bool {
+	limits := s.cfg.ContextDocuments
+	details := map[string]interface{}{"maxDocuments": limits.MaxDocuments, "maxBytes": limits.MaxBytes}
+	if limits.MaxDocuments > 0 && len(docs) > limits.MaxDocuments {
+		s.writeError(w, r, http.StatusBadRequest, "too_many_context_documents", fmt.Sprintf("Requests may pass at most %d context documents, got %d", limits.MaxDocuments, len(docs)), details)
+		return false
+	}
+	size := 0
+	for _, d := range docs {
+		size += len(d.Title) + len(d.Content) + len(d.URL)
+	}
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		s.writeError(w, r, http.StatusBadRequest, "context_documents_too_large", fmt.Sprintf("Context documents may be at most %d bytes together, got %d", limits.MaxBytes, size), details)
+		return false
+	}
+	return true
+}
+
+// Put the documents ahead of the prompt, numbered like Azure Search
+// citations so the usual [docN] markers and reference parsing apply
+func formatContextDocumentsPrompt(prompt string, docs []Document) string {
+	var b strings.Builder
+	b.WriteString("Answer using only the documents below, citing them with their [docN] markers.\n\n")
+	for i, d := range docs {
+		fmt.Fprintf(&b, "[doc%d] %s\n", i+1, d.Title)
+		if d.URL != "" {
+			fmt.Fprintf(&b, "URL: %s\n", d.URL)
+		}
+		fmt.Fprintf(&b, "%s\n\n", strings.TrimSpace(d.Content))
+	}
+	return b.String() + prompt
+}
+
+// The documents as the grounding citations Azure would have returned, so
+// they become the answer's references
+func contextDocumentCitations(docs []Document) []AzureCitation {
+	citations := make([]AzureCitation, len(docs))
+	for i, d := range docs {
+		citations[i] = AzureCitation{Title: d.Title, Content: d.Content, URL: d.URL}
+	}
+	return citations
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const contextRequest = `{"message":"What is Go?","reference_formats":["structured"],"context":[
+	{"title":"Go FAQ","content":"Go is a programming language.","url":"https://go.dev/doc/faq"},
+	{"title":"Tour","content":"Take the tour."}]}`
+
+func TestChatWithContextDocuments(t *testing.T) {
+	azure := &azureStub{content: "Go is a language [doc1]."}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", contextRequest))), &got)
+	payload := azure.payload(t, 0)
+	if _, ok := payload["data_sources"]; ok {
+		t.Error("payload still carries data_sources")
+	}
+	prompt := userMessage(payload)
+	if !strings.Contains(prompt, "[doc1] Go FAQ\nURL: https://go.dev/doc/faq\nGo is a programming language.") || !strings.Contains(prompt, "[doc2] Tour\nTake the tour.") {
+		t.Errorf("prompt does not carry the documents: %q", prompt)
+	}
+	if !got.Grounded || len(got.StructuredReferences) != 2 || got.StructuredReferences[0].Title != "Go FAQ" || got.StructuredReferences[0].URL != "https://go.dev/doc/faq" {
+		t.Errorf("response = %+v, want grounded with the documents as references", got)
+	}
+}
+
+func TestStreamWithContextDocuments(t *testing.T) {
+	azure := &azureStub{deltas: []string{"Go is a language [doc1]."}}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	body := strings.Replace(contextRequest, `"message"`, `"stream":true,"message"`, 1)
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", body)))
+	var references struct{ References []Reference }
+	var enriched EnhancedChatResponse
+	var done StreamDone
+	for _, e := range events {
+		switch e.Name {
+		case "references":
+			json.Unmarshal([]byte(e.Data), &references)
+		case "enriched":
+			json.Unmarshal([]byte(e.Data), &enriched)
+		case "done":
+			json.Unmarshal([]byte(e.Data), &done)
+		}
+	}
+	if len(references.References) != 2 || len(enriched.References) != 2 || !done.Grounded {
+		t.Errorf("references = %+v, enriched = %+v, done = %+v", references, enriched, done)
+	}
+	if _, ok := azure.payload(t, 0)["data_sources"]; ok {
+		t.Error("payload still carries data_sources")
+	}
+}
+
+func TestContextDocumentLimits(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ContextDocuments = ContextDocumentsConfig{MaxDocuments: 1, MaxBytes: 40}
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, cfg, azure)
+
+	tests := []struct{ body, code string }{
+		{contextRequest, "too_many_context_documents"},
+		{`{"message":"hi","context":[{"title":"Long","content":"` + strings.Repeat("x", 40) + `"}]}`, "context_documents_too_large"},
+	}
+	for _, tt := range tests {
+		resp := postJSON(t, front.URL+"/api/chat", tt.body)
+		var got ErrorResponse
+		json.Unmarshal([]byte(readBody(t, resp)), &got)
+		if resp.StatusCode != http.StatusBadRequest || got.Code != tt.code {
+			t.Errorf("status = %d code = %q, want 400 %s", resp.StatusCode, got.Code, tt.code)
+		}
+	}
+	if len(azure.payloads) != 0 {
+		t.Errorf("azure received %d requests, want none", len(azure.payloads))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+)
+
+// Path of an Azure OpenAI chat completions deployment URL
+var azureChatPathRegex = regexp.MustCompile(`^/openai/deployments/[^/]+/chat/completions/?$`)
+
+// Check that an Azure OpenAI endpoint looks like a chat completions URL:
+// https, a deployment path and an api-version query parameter. Returns
+// every problem found so they can be reported together.
+func validateAzureEndpoint(raw string) []string {
+	if raw == "" {
+		return []string{"endpoint is empty"}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return []string{fmt.Sprintf("endpoint does not parse: %v", err)}
+	}
+
+	var problems []string
+	if u.Scheme != "https" {
+		problems = append(problems, fmt.Sprintf("endpoint scheme is %q, expected https", u.Scheme))
+	}
+	if u.Host == "" {
+		problems = append(problems, "endpoint has no host")
+	}
+	if !azureChatPathRegex.MatchString(u.Path) {
+		problems = append(problems, fmt.Sprintf("endpoint path %q is not /openai/deployments/{deployment}/chat/completions", u.Path))
+	}
+	if u.Query().Get("api-version") == "" {
+		problems = append(problems, "endpoint is missing the api-version query parameter")
+	}
+	return problems
+}
+
+// Append api-version to an endpoint that does not already carry one
+func withDefaultAPIVersion(raw, version string) string {
+	if version == "" {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Query().Get("api-version") != "" {
+		return raw
+	}
+	q := u.Query()
+	q.Set("api-version", version)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Set api-version on an endpoint, replacing any version already present
+func withAPIVersion(raw, version string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("api-version", version)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Apply the api-version settings to every configured Azure endpoint and
+// validate them, failing when strict is set and warning otherwise.
+// apiVersion, when set, overrides the version in every endpoint;
+// defaultAPIVersion only fills in endpoints that have none.
+func (c *Config) checkEndpoints(apiVersion, defaultAPIVersion string, strict bool) error {
+	check := func(name, endpoint string) (string, error) {
+		if endpoint != "" && apiVersion != "" {
+			overridden, err := withAPIVersion(endpoint, apiVersion)
+			if err != nil {
+				return endpoint, fmt.Errorf("%s: endpoint does not parse: %w", name, err)
+			}
+			endpoint = overridden
+		}
+		if endpoint != "" {
+			endpoint = withDefaultAPIVersion(endpoint, defaultAPIVersion)
+		}
+		for _, problem := range validateAzureEndpoint(endpoint) {
+			if strict {
+				return endpoint, fmt.Errorf("%s: %s", name, problem)
+			}
+			log.Printf("WARNING: %s: %s", name, problem)
+		}
+		return endpoint, nil
+	}
+
+	var err error
+	if c.Endpoint, err = check("AZURE_ENDPOINT", c.Endpoint); err != nil {
+		return err
+	}
+	for name, model := range c.Models {
+		if model.Endpoint != "" {
+			if model.Endpoint, err = check("model "+name, model.Endpoint); err != nil {
+				return err
+			}
+		}
+		for i, replica := range model.Replicas {
+			if model.Replicas[i], err = check(fmt.Sprintf("model %s replica %d", name, i+1), replica); err != nil {
+				return err
+			}
+		}
+		c.Models[name] = model
+	}
+	return nil
+}
+
+// Reports an error unless raw is an https URL, so the API key is never
+// sent in the clear
+func requireHTTPS(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("endpoint does not parse: %v", err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("endpoint scheme is %q, only https is allowed", u.Scheme)
+	}
+	return nil
+}
+
+// Every configured upstream URL that is sent credentials, by setting name
+func (c *Config) upstreamEndpoints() map[string]string {
+	endpoints := map[string]string{
+		"AZURE_ENDPOINT":        c.Endpoint,
+		"AZURE_SEARCH_ENDPOINT": c.Search.Endpoint,
+	}
+	for name, model := range c.Models {
+		endpoints["model "+name] = model.Endpoint
+		for i, replica := range model.Replicas {
+			endpoints[fmt.Sprintf("model %s replica %d", name, i+1)] = replica
+		}
+	}
+	for name, tenant := range c.Tenants {
+		endpoints["tenant "+name+" search"] = tenant.Search.Endpoint
+	}
+	return endpoints
+}
+
+// Refuse non-https upstream URLs at startup, unless AllowInsecureUpstream
+// is set for local testing, which is warned about loudly
+func (c *Config) checkUpstreamSchemes() error {
+	if c.AllowInsecureUpstream {
+		log.Printf("WARNING: ALLOW_INSECURE_UPSTREAM is set, API keys may be sent over plain HTTP. Never use this outside local testing.")
+		return nil
+	}
+	for name, endpoint := range c.upstreamEndpoints() {
+		if endpoint == "" {
+			continue
+		}
+		if err := requireHTTPS(endpoint); err != nil {
+			return fmt.Errorf("%s: %v (set ALLOW_INSECURE_UPSTREAM for local testing only)", name, err)
+		}
+	}
+	return nil
+}
+
+// Check the chat URL and any search endpoints in data_sources before a
+// request carrying credentials is sent to them
+func checkPayloadSchemes(endpoint string, data map[string]interface{}) error {
+	if err := requireHTTPS(endpoint); err != nil {
+		return err
+	}
+	sources, _ := data["data_sources"].([]map[string]interface{})
+	for _, source := range sources {
+		params, _ := source["parameters"].(map[string]interface{})
+		if searchEndpoint, ok := params["endpoint"].(string); ok && searchEndpoint != "" {
+			if err := requireHTTPS(searchEndpoint); err != nil {
+				return fmt.Errorf("search %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidateAzureEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		problems int
+	}{
+		{"https://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions?api-version=2024-06-01", 0},
+		{"https://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions", 1},
+		{"http://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions?api-version=2024-06-01", 1},
+		{"https://res.openai.azure.com/?api-version=2024-06-01", 1},
+		{"https://res.openai.azure.com", 2},
+		{"", 1},
+	}
+	for _, tt := range tests {
+		if got := validateAzureEndpoint(tt.endpoint); len(got) != tt.problems {
+			t.Errorf("validateAzureEndpoint(%q) = %v, want %d problems", tt.endpoint, got, tt.problems)
+		}
+	}
+}
+
+func TestWithDefaultAPIVersion(t *testing.T) {
+	base := "https://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions"
+	if got := withDefaultAPIVersion(base, "2024-06-01"); got != base+"?api-version=2024-06-01" {
+		t.Errorf("missing version not appended: %s", got)
+	}
+	existing := base + "?api-version=2023-05-15"
+	if got := withDefaultAPIVersion(existing, "2024-06-01"); got != existing {
+		t.Errorf("existing version overwritten: %s", got)
+	}
+	if got := withDefaultAPIVersion(base, ""); got != base {
+		t.Errorf("empty default changed endpoint: %s", got)
+	}
+}
+
+func TestCheckEndpointsStrict(t *testing.T) {
+	cfg := &Config{Endpoint: "https://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions"}
+	if err := cfg.checkEndpoints("", "", true); err == nil {
+		t.Fatal("strict validation accepted an endpoint without api-version")
+	}
+	if err := cfg.checkEndpoints("", "2024-06-01", true); err != nil {
+		t.Fatalf("default api-version should satisfy validation: %v", err)
+	}
+}
+
+func TestCheckEndpointsAPIVersionOverride(t *testing.T) {
+	base := "https://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions"
+	cfg := &Config{
+		Endpoint: base + "?api-version=2023-05-15",
+		Models: map[string]ModelConfig{
+			"mini": {Endpoint: "https://res.openai.azure.com/openai/deployments/mini/chat/completions"},
+		},
+	}
+	if err := cfg.checkEndpoints("2024-10-21", "2024-06-01", true); err != nil {
+		t.Fatal(err)
+	}
+	if want := base + "?api-version=2024-10-21"; cfg.Endpoint != want {
+		t.Errorf("Endpoint = %s, want %s", cfg.Endpoint, want)
+	}
+	if got := cfg.Models["mini"].Endpoint; got != "https://res.openai.azure.com/openai/deployments/mini/chat/completions?api-version=2024-10-21" {
+		t.Errorf("model endpoint = %s", got)
+	}
+}
+
+func TestCheckUpstreamSchemes(t *testing.T) {
+	secure := "https://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions"
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"all https", Config{Endpoint: secure, Search: SearchConfig{Endpoint: "https://s.search.windows.net"}}, false},
+		{"http chat", Config{Endpoint: "http://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions"}, true},
+		{"http model", Config{Endpoint: secure, Models: map[string]ModelConfig{"mini": {Endpoint: "http://localhost:8080"}}}, true},
+		{"http search", Config{Endpoint: secure, Search: SearchConfig{Endpoint: "http://s.search.windows.net"}}, true},
+		{"http tenant search", Config{Endpoint: secure, Tenants: map[string]TenantConfig{"acme": {Search: SearchConfig{Endpoint: "http://acme.search.windows.net"}}}}, true},
+		{"escape hatch", Config{Endpoint: "http://localhost:8080", AllowInsecureUpstream: true}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.checkUpstreamSchemes(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPostAzureRefusesPlainHTTP(t *testing.T) {
+	azure := &azureStub{content: "Answer."}
+	srv, front := newTestServer(t, defaultConfig(), azure)
+	srv.cfg.AllowInsecureUpstream = false
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", resp.StatusCode)
+	}
+	if len(azure.payloads) != 0 {
+		t.Error("the request was sent over plain HTTP")
+	}
+
+	data := map[string]interface{}{"data_sources": []map[string]interface{}{{"parameters": map[string]interface{}{"endpoint": "http://s.search.windows.net"}}}}
+	if err := checkPayloadSchemes("https://res.openai.azure.com/x", data); err == nil {
+		t.Error("an http search endpoint in data_sources was accepted")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// endpointPolicy is the timeout and retries of the Azure calls to one
+// endpoint
+type endpointPolicy struct {
+	timeout             time.Duration
+	retries             int
+	emptyChoicesRetries int
+}
+
+// The policy of endpoints no model overrides it for
+func (c *Config) defaultEndpointPolicy() endpointPolicy {
+	return endpointPolicy{timeout: c.AzureTimeout, retries: c.UpstreamRetries, emptyChoicesRetries: c.EmptyChoicesRetries}
+}
+
+// Resolve the policy of every model endpoint with an override, falling
+// back to the global settings for what a model leaves unset. Models
+// sharing an endpoint must agree on its policy.
+func (c *Config) endpointPolicies() (map[string]endpointPolicy, error) {
+	policies := make(map[string]endpointPolicy)
+	owners := make(map[string]string)
+	for name := range c.Models {
+		_, model, _ := c.modelFor(name)
+		if model.Timeout == "" && model.UpstreamRetries == nil && model.EmptyChoicesRetries == nil {
+			continue
+		}
+		p := c.defaultEndpointPolicy()
+		if model.Timeout != "" {
+			timeout, err := time.ParseDuration(model.Timeout)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("model %q: timeout must be a positive duration such as 90s, got %q", name, model.Timeout)
+			}
+			if c.Server.WriteTimeout > 0 && timeout >= c.Server.WriteTimeout {
+				return nil, fmt.Errorf("model %q: timeout (%s) must be shorter than SERVER_WRITE_TIMEOUT (%s)", name, timeout, c.Server.WriteTimeout)
+			}
+			p.timeout = timeout
+		}
+		if model.UpstreamRetries != nil {
+			p.retries = *model.UpstreamRetries
+		}
+		if model.EmptyChoicesRetries != nil {
+			p.emptyChoicesRetries = *model.EmptyChoicesRetries
+		}
+		if p.retries < 0 || p.emptyChoicesRetries < 0 {
+			return nil, fmt.Errorf("model %q: retries must not be negative", name)
+		}
+		for _, endpoint := range model.endpoints() {
+			if other, ok := owners[endpoint]; ok && policies[endpoint] != p {
+				return nil, fmt.Errorf("models %q and %q share an endpoint but set different timeouts or retries", other, name)
+			}
+			policies[endpoint] = p
+			owners[endpoint] = name
+		}
+	}
+	return policies, nil
+}
+
+// The timeout and retries for calls to endpoint
+func (s *Server) policyFor(endpoint string) endpointPolicy {
+	if p, ok := s.endpointPolicies[endpoint]; ok {
+		return p
+	}
+	return s.cfg.defaultEndpointPolicy()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func intPtr(n int) *int { return &n }
+
+func TestEndpointTimeoutOverride(t *testing.T) {
+	sleepy := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"Slow answer."}}]}`))
+	}
+	fallback := httptest.NewServer(http.HandlerFunc(sleepy))
+	t.Cleanup(fallback.Close)
+
+	cfg := defaultConfig()
+	cfg.AzureTimeout = 50 * time.Millisecond
+	cfg.DefaultModel = "primary"
+	cfg.Models = map[string]ModelConfig{
+		"primary":  {},
+		"fallback": {Endpoint: fallback.URL, Timeout: "2s"},
+	}
+	_, front := newTestServer(t, cfg, &azureStub{handler: sleepy})
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("primary status = %d, want 504 after the global timeout", resp.StatusCode)
+	}
+	resp = postJSON(t, front.URL+"/api/chat", `{"message":"hi","model":"fallback"}`)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, "Slow answer.") {
+		t.Errorf("fallback status = %d body = %s, want its longer timeout to let it answer", resp.StatusCode, body)
+	}
+}
+
+func TestEndpointRetryOverride(t *testing.T) {
+	empty := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[]}`))
+	}
+	fallback := &azureStub{handler: empty}
+	fallbackServer := httptest.NewServer(fallback)
+	t.Cleanup(fallbackServer.Close)
+
+	cfg := defaultConfig()
+	cfg.EmptyChoicesRetries = 0
+	cfg.DefaultModel = "primary"
+	cfg.Models = map[string]ModelConfig{
+		"primary":  {},
+		"fallback": {Endpoint: fallbackServer.URL, EmptyChoicesRetries: intPtr(2)},
+	}
+	primary := &azureStub{handler: empty}
+	_, front := newTestServer(t, cfg, primary)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","model":"fallback"}`))
+	if len(primary.payloads) != 1 || len(fallback.payloads) != 3 {
+		t.Errorf("primary got %d calls, fallback %d; want 1 and 3", len(primary.payloads), len(fallback.payloads))
+	}
+}
+
+func TestEndpointPoliciesValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		models map[string]ModelConfig
+	}{
+		{"bad timeout", map[string]ModelConfig{"a": {Endpoint: "https://a", Timeout: "soon"}}},
+		{"timeout over write timeout", map[string]ModelConfig{"a": {Endpoint: "https://a", Timeout: "10m"}}},
+		{"negative retries", map[string]ModelConfig{"a": {Endpoint: "https://a", UpstreamRetries: intPtr(-1)}}},
+		{"shared endpoint disagrees", map[string]ModelConfig{
+			"a": {Endpoint: "https://a", Timeout: "10s"},
+			"b": {Endpoint: "https://a", Timeout: "20s"},
+		}},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.Server.WriteTimeout = time.Minute
+		cfg.Models = tt.models
+		if _, err := cfg.endpointPolicies(); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.Models = map[string]ModelConfig{"a": {Endpoint: "https://a", UpstreamRetries: intPtr(4)}}
+	policies, err := cfg.endpointPolicies()
+	if p := policies["https://a"]; err != nil || p.retries != 4 || p.timeout != cfg.AzureTimeout || p.emptyChoicesRetries != cfg.EmptyChoicesRetries {
+		t.Errorf("policy = %+v, %v; want the override over the global defaults", p, err)
+	}
+}
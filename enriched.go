@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Key identifying references to the same document: the URL without its
+// scheme, "www.", fragment or trailing slash, else the lowercased title
+func referenceDedupKey(ref Reference) string {
+	if u, err := url.Parse(ref.URL); err == nil && u.Hostname() != "" {
+		host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+		return host + strings.TrimSuffix(u.EscapedPath(), "/") + "?" + u.RawQuery
+	}
+	return "title:" + strings.ToLower(strings.TrimSpace(ref.Title))
+}
+
+// Drop references to a document already listed, keeping the first
+func dedupeReferences(refs []Reference) []Reference {
+	seen := make(map[string]bool, len(refs))
+	kept := refs[:0:0]
+	for _, ref := range refs {
+		key := referenceDedupKey(ref)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, ref)
+	}
+	return kept
+}
+
+// Send a HEAD request to each reference's URL and record whether it
+// answered below 400. Links still unanswered when ctx ends count as broken.
+func checkReferenceLinks(ctx context.Context, client *http.Client, refs []Reference) {
+	var wg sync.WaitGroup
+	for i := range refs {
+		if refs[i].URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(ref *Reference) {
+			defer wg.Done()
+			ok := false
+			if req, err := http.NewRequestWithContext(ctx, http.MethodHead, ref.URL, nil); err == nil {
+				if resp, err := client.Do(req); err == nil {
+					resp.Body.Close()
+					ok = resp.StatusCode < 400
+				}
+			}
+			ref.LinkOK = &ok
+		}(&refs[i])
+	}
+	wg.Wait()
+}
+
+// Build the payload of the streaming "enriched" event: the structured
+// references the blocking route would return, deduplicated, per-source
+// capped and optionally link checked. The answer text is left out since
+// the client already has it from the token events.
+func (s *Server) enrichedResponse(ctx context.Context, refs []Reference) EnhancedChatResponse {
+	refs = s.limitReferenceFields(dedupeReferences(refs))
+	if s.cfg.SortReferencesByScore {
+		sortReferencesByScore(refs)
+	}
+	refs, _ = capReferencesPerSource(refs, s.cfg.MaxReferencesPerSource)
+	if s.cfg.ValidateReferenceLinks {
+		ctx, cancel := context.WithTimeout(ctx, s.cfg.LinkCheckTimeout)
+		defer cancel()
+		checkReferenceLinks(ctx, http.DefaultClient, refs)
+	}
+	if refs == nil {
+		refs = []Reference{}
+	}
+	return EnhancedChatResponse{References: refs}
+}
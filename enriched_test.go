@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDedupeReferences(t *testing.T) {
+	refs := dedupeReferences([]Reference{
+		{Title: "Guide", URL: "https://example.com/guide"},
+		{Title: "Guide again", URL: "http://www.example.com/guide/#setup"},
+		{Title: "Other page", URL: "https://example.com/guide?page=2"},
+		{Title: "Untitled Book"},
+		{Title: "untitled book "},
+	})
+	if len(refs) != 3 || refs[0].Title != "Guide" || refs[1].Title != "Other page" || refs[2].Title != "Untitled Book" {
+		t.Errorf("deduplicated = %+v", refs)
+	}
+}
+
+func TestCheckReferenceLinks(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	refs := []Reference{{URL: site.URL + "/ok"}, {URL: site.URL + "/gone"}, {Title: "No link"}}
+	checkReferenceLinks(context.Background(), http.DefaultClient, refs)
+	if refs[0].LinkOK == nil || !*refs[0].LinkOK {
+		t.Errorf("reachable link = %v, want true", refs[0].LinkOK)
+	}
+	if refs[1].LinkOK == nil || *refs[1].LinkOK {
+		t.Errorf("missing link = %v, want false", refs[1].LinkOK)
+	}
+	if refs[2].LinkOK != nil {
+		t.Errorf("reference without a URL was checked")
+	}
+}
+
+func TestStreamEmitsEnrichedBeforeDone(t *testing.T) {
+	azure := &azureStub{deltas: []string{"Answer.\nReferences:\n", "1. Guide https://example.com/guide\n", "2. Guide copy https://www.example.com/guide/\n", "3. Smith (2020). A Book."}}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)))
+	names := eventNames(events)
+	if len(names) < 2 || names[len(names)-2] != "enriched" || names[len(names)-1] != "done" {
+		t.Fatalf("events = %v, want enriched then done last", names)
+	}
+
+	var enriched EnhancedChatResponse
+	if err := json.Unmarshal([]byte(events[len(events)-2].Data), &enriched); err != nil {
+		t.Fatal(err)
+	}
+	if enriched.Response != "" {
+		t.Errorf("enriched repeats the streamed text: %q", enriched.Response)
+	}
+	if len(enriched.References) != 2 || enriched.References[0].URL != "https://example.com/guide" || enriched.References[1].Year != "2020" {
+		t.Errorf("references = %+v", enriched.References)
+	}
+}
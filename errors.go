@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+type ErrorResponse struct {
+	Error   string                 `json:"error"`
+	Code    string                 `json:"code,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// ErrorTemplate replaces the structured error body for one error code.
+// Strings in Body may contain {{message}}, {{code}}, {{status}} and
+// {{requestId}}; a string that is exactly "{{details}}" becomes the
+// error's details object.
+type ErrorTemplate struct {
+	// Status to send instead of the error's own, zero keeps it
+	Status int             `json:"status,omitempty"`
+	Body   json.RawMessage `json:"body"`
+}
+
+var errorPlaceholderRegex = regexp.MustCompile(`\{\{(\w+)\}\}`)
+
+var errorPlaceholders = map[string]bool{"message": true, "code": true, "status": true, "requestId": true, "details": true}
+
+// errorTemplates holds the configured templates with their bodies decoded
+type errorTemplates map[string]errorTemplate
+
+type errorTemplate struct {
+	status int
+	body   interface{}
+}
+
+// Decode and check every template, so a bad one fails startup rather than
+// the first error it should render
+func newErrorTemplates(configs map[string]ErrorTemplate) (errorTemplates, error) {
+	templates := make(errorTemplates, len(configs))
+	for code, tc := range configs {
+		if tc.Status != 0 && (tc.Status < 400 || tc.Status > 599) {
+			return nil, fmt.Errorf("error template %q: status must be between 400 and 599, got %d", code, tc.Status)
+		}
+		var body interface{}
+		if err := json.Unmarshal(tc.Body, &body); err != nil {
+			return nil, fmt.Errorf("error template %q: body is not valid JSON: %w", code, err)
+		}
+		if err := checkPlaceholders(body); err != nil {
+			return nil, fmt.Errorf("error template %q: %w", code, err)
+		}
+		templates[code] = errorTemplate{status: tc.Status, body: body}
+	}
+	return templates, nil
+}
+
+func checkPlaceholders(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		for _, m := range errorPlaceholderRegex.FindAllStringSubmatch(v, -1) {
+			if !errorPlaceholders[m[1]] {
+				return fmt.Errorf("unknown placeholder {{%s}}", m[1])
+			}
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			if err := checkPlaceholders(e); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if err := checkPlaceholders(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Copy of a template body with the placeholders filled in. Values are
+// substituted into decoded strings, so they are escaped when encoded.
+func renderErrorBody(v interface{}, values map[string]string, details map[string]interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if v == "{{details}}" {
+			return details
+		}
+		return errorPlaceholderRegex.ReplaceAllStringFunc(v, func(m string) string {
+			return values[m[2:len(m)-2]]
+		})
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = renderErrorBody(e, values, details)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = renderErrorBody(e, values, details)
+		}
+		return out
+	}
+	return v
+}
+
+// Write a structured JSON error response, in the configured template for
+// its code when there is one
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, details map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	tmpl, ok := s.errorTemplates[code]
+	if !ok {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Error:   message,
+			Code:    code,
+			Details: details,
+		})
+		return
+	}
+
+	if tmpl.status != 0 {
+		status = tmpl.status
+	}
+	values := map[string]string{
+		"message":   message,
+		"code":      code,
+		"status":    strconv.Itoa(status),
+		"requestId": CorrelationID(r.Context()),
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(renderErrorBody(tmpl.body, values, details))
+}
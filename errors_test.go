@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewErrorTemplatesValidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    ErrorTemplate
+		wantErr bool
+	}{
+		{"valid", ErrorTemplate{Status: 400, Body: json.RawMessage(`{"fault":{"text":"{{message}}","id":"{{requestId}}"}}`)}, false},
+		{"invalid json", ErrorTemplate{Body: json.RawMessage(`{"fault":`)}, true},
+		{"unknown placeholder", ErrorTemplate{Body: json.RawMessage(`{"fault":"{{reason}}"}`)}, true},
+		{"bad status", ErrorTemplate{Status: 200, Body: json.RawMessage(`{}`)}, true},
+	}
+	for _, tt := range tests {
+		if _, err := newErrorTemplates(map[string]ErrorTemplate{"x": tt.tmpl}); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWriteErrorUsesTemplate(t *testing.T) {
+	templates, err := newErrorTemplates(map[string]ErrorTemplate{
+		"cost_limit_exceeded": {Status: 429, Body: json.RawMessage(`{"errors":[{"status":"{{status}}","title":"{{message}}","meta":"{{details}}","ref":"req {{requestId}}"}]}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{errorTemplates: templates}
+
+	r := httptest.NewRequest("POST", "/api/chat", nil)
+	r = r.WithContext(context.WithValue(r.Context(), correlationContextKey, "abc"))
+	rec := httptest.NewRecorder()
+	s.writeError(rec, r, http.StatusPaymentRequired, "cost_limit_exceeded", `Budget "exceeded"`, map[string]interface{}{"limit": 1.0})
+	if rec.Code != 429 {
+		t.Errorf("status = %d, want 429", rec.Code)
+	}
+	want := `{"errors":[{"meta":{"limit":1},"ref":"req abc","status":"429","title":"Budget \"exceeded\""}]}` + "\n"
+	if rec.Body.String() != want {
+		t.Errorf("body = %s, want %s", rec.Body.String(), want)
+	}
+
+	rec = httptest.NewRecorder()
+	s.writeError(rec, r, http.StatusUnprocessableEntity, "schema_violation", "Bad", nil)
+	var got ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if rec.Code != http.StatusUnprocessableEntity || got.Code != "schema_violation" || got.Error != "Bad" {
+		t.Errorf("untemplated error = %d %+v", rec.Code, got)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "sort"
+
+// Azure content filter verdict for one category
+type AzureContentFilterResult struct {
+	Filtered bool   `json:"filtered"`
+	Severity string `json:"severity,omitempty"`
+	// Set for detection categories such as jailbreak, which have no severity
+	Detected *bool `json:"detected,omitempty"`
+}
+
+// Content filter verdicts Azure reports for one prompt of a request
+type AzurePromptFilterResult struct {
+	PromptIndex          int                                 `json:"prompt_index"`
+	ContentFilterResults map[string]AzureContentFilterResult `json:"content_filter_results"`
+}
+
+// PromptFilterResult is one input category Azure's safety system checked
+type PromptFilterResult struct {
+	PromptIndex int    `json:"promptIndex"`
+	Category    string `json:"category"`
+	Severity    string `json:"severity,omitempty"`
+	Filtered    bool   `json:"filtered"`
+	Detected    *bool  `json:"detected,omitempty"`
+}
+
+// Flatten Azure's prompt filter results into one entry per category,
+// ordered by prompt and category. Returns nil when there are none.
+func promptFilterResults(results []AzurePromptFilterResult) []PromptFilterResult {
+	var out []PromptFilterResult
+	for _, r := range results {
+		for category, verdict := range r.ContentFilterResults {
+			out = append(out, PromptFilterResult{
+				PromptIndex: r.PromptIndex,
+				Category:    category,
+				Severity:    verdict.Severity,
+				Filtered:    verdict.Filtered,
+				Detected:    verdict.Detected,
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].PromptIndex != out[j].PromptIndex {
+			return out[i].PromptIndex < out[j].PromptIndex
+		}
+		return out[i].Category < out[j].Category
+	})
+	return out
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+const promptFilterResponse = `{"choices":[{"message":{"content":"Answer."},"finish_reason":"stop"}],` +
+	`"prompt_filter_results":[{"prompt_index":0,"content_filter_results":{` +
+	`"violence":{"filtered":false,"severity":"low"},` +
+	`"hate":{"filtered":true,"severity":"medium"},` +
+	`"jailbreak":{"filtered":false,"detected":true}}}]}`
+
+func TestPromptFilterResults(t *testing.T) {
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(promptFilterResponse))
+	}
+
+	_, front := newTestServer(t, defaultConfig(), azure)
+	var lean ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &lean)
+	if lean.PromptFilterResults != nil {
+		t.Errorf("promptFilterResults without the feature = %+v", lean.PromptFilterResults)
+	}
+
+	cfg := defaultConfig()
+	cfg.Features.PromptFilterResults = true
+	_, front = newTestServer(t, cfg, azure)
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &got)
+
+	results := got.PromptFilterResults
+	if len(results) != 3 {
+		t.Fatalf("promptFilterResults = %+v, want 3 categories", results)
+	}
+	if r := results[0]; r.Category != "hate" || r.Severity != "medium" || !r.Filtered {
+		t.Errorf("first result = %+v, want filtered hate at medium", r)
+	}
+	if r := results[1]; r.Category != "jailbreak" || r.Detected == nil || !*r.Detected || r.Severity != "" {
+		t.Errorf("second result = %+v, want detected jailbreak", r)
+	}
+	if r := results[2]; r.Category != "violence" || r.Severity != "low" || r.Filtered {
+		t.Errorf("third result = %+v, want unfiltered violence at low", r)
+	}
+}
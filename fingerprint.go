@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Response header carrying the request fingerprint
+const fingerprintHeader = "X-Request-Fingerprint"
+
+// Lowercase text and collapse its whitespace runs to single spaces
+func normalizeFingerprintText(text string) string {
+	return strings.ToLower(strings.Join(strings.Fields(text), " "))
+}
+
+// Fingerprint of a chat request, equal for requests that ask the same
+// thing. The rules, which must stay stable since clients compare
+// fingerprints across releases:
+//   - the message and the content of client messages are lowercased and
+//     their whitespace collapsed
+//   - the model is the resolved one, so an omitted model and the default
+//     model's name match
+//   - every other field is kept as decoded, with object keys sorted, so
+//     field order and spacing in the body do not matter
+//   - stream is left out, the same question streamed or not is the same
+//   - the calling client, from fingerprintCaller, and the negotiated
+//     envelope version are included
+//   - an admin's X-Debug-Prompt flag is included only when set, so answers
+//     carrying the prompts are never shared with other requests and
+//     fingerprints without it are unchanged
+//
+// The result is the hex SHA-256 of that canonical JSON, and is also the
+// dedup key.
+func requestFingerprint(caller string, debugPrompt bool, version int, model string, req ChatRequest) string {
+	req.Message = normalizeFingerprintText(req.Message)
+	req.Model = model
+	req.Stream = false
+	messages := make([]ChatMessage, len(req.Messages))
+	for i, m := range req.Messages {
+		messages[i] = ChatMessage{Role: m.Role, Content: normalizeFingerprintText(m.Content)}
+	}
+	req.Messages = messages
+
+	// Round-trip through a map, which encoding/json writes with sorted keys
+	var fields map[string]interface{}
+	body, _ := json.Marshal(req)
+	json.Unmarshal(body, &fields)
+	fields["_client"] = caller
+	fields["_version"] = version
+	if debugPrompt {
+		fields["_debugPrompt"] = true
+	}
+	canonical, _ := json.Marshal(fields)
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// The caller a fingerprint belongs to: the client name, or the client IP
+// without authentication, so anonymous callers never share dedup entries
+func fingerprintCaller(r *http.Request) string {
+	if name := clientName(r.Context()); name != "" {
+		return name
+	}
+	return "ip:" + ClientIP(r)
+}
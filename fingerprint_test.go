@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func fingerprintOf(t *testing.T, body string) string {
+	t.Helper()
+	var req ChatRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	model := req.Model
+	if model == "" {
+		model = "gpt-4o"
+	}
+	return requestFingerprint("alice", false, latestResponseVersion, model, req)
+}
+
+func TestRequestFingerprintEqualRequests(t *testing.T) {
+	base := fingerprintOf(t, `{"message":"What is Go?","temperature":0.2,"searchFilters":{"a":"1","b":"2"}}`)
+	for _, body := range []string{
+		`{"message":"  what   is\tgo? ","temperature":0.2,"searchFilters":{"a":"1","b":"2"}}`,
+		`{"searchFilters":{"b":"2","a":"1"},"temperature":0.2,"message":"WHAT IS GO?"}`,
+		`{"message":"What is Go?","temperature":0.2,"searchFilters":{"a":"1","b":"2"},"model":"gpt-4o"}`,
+		`{"message":"What is Go?","temperature":0.2,"searchFilters":{"a":"1","b":"2"},"stream":true}`,
+	} {
+		if got := fingerprintOf(t, body); got != base {
+			t.Errorf("%s: fingerprint differs from the equal base request", body)
+		}
+	}
+}
+
+func TestRequestFingerprintDifferentRequests(t *testing.T) {
+	base := `{"message":"What is Go?","temperature":0.2}`
+	seen := map[string]string{fingerprintOf(t, base): base}
+	for _, body := range []string{
+		`{"message":"What is Rust?","temperature":0.2}`,
+		`{"message":"What is Go?","temperature":0.3}`,
+		`{"message":"What is Go?","temperature":0.2,"model":"gpt-4o-mini"}`,
+		`{"message":"What is Go?","temperature":0.2,"format":"table"}`,
+		`{"message":"What is Go?","temperature":0.2,"messages":[{"role":"user","content":"earlier"}]}`,
+	} {
+		fp := fingerprintOf(t, body)
+		if other, ok := seen[fp]; ok {
+			t.Errorf("%s and %s share a fingerprint", body, other)
+		}
+		seen[fp] = body
+	}
+
+	var req ChatRequest
+	json.Unmarshal([]byte(base), &req)
+	if requestFingerprint("alice", false, 1, "gpt-4o", req) == requestFingerprint("bob", false, 1, "gpt-4o", req) {
+		t.Error("different clients share a fingerprint")
+	}
+	if requestFingerprint("ops", false, 1, "gpt-4o", req) == requestFingerprint("ops", true, 1, "gpt-4o", req) {
+		t.Error("a debug prompt request shares a fingerprint with a normal one")
+	}
+}
+
+func TestChatSendsFingerprint(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), &azureStub{content: "Answer.", deltas: []string{"Answer."}})
+
+	blocking := postJSON(t, front.URL+"/api/chat", `{"message":"Hi there","debug":true}`)
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, blocking)), &got)
+	fp := blocking.Header.Get(fingerprintHeader)
+	if len(fp) != 64 || got.Debug == nil || got.Debug.Fingerprint != fp {
+		t.Errorf("header = %q, debug = %+v; want a sha256 hex fingerprint in both", fp, got.Debug)
+	}
+
+	again := postJSON(t, front.URL+"/api/chat", `{"debug":true,"message":"hi  THERE"}`)
+	readBody(t, again)
+	streamed := postJSON(t, front.URL+"/api/chat", `{"message":"hi there","debug":true,"stream":true}`)
+	readBody(t, streamed)
+	if again.Header.Get(fingerprintHeader) != fp || streamed.Header.Get(fingerprintHeader) != fp {
+		t.Errorf("equal requests got fingerprints %q and %q, want %q", again.Header.Get(fingerprintHeader), streamed.Header.Get(fingerprintHeader), fp)
+	}
+}
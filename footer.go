@@ -0,0 +1,39 @@
+package main
+
+// FooterConfig appends a disclaimer to every answer, after its references
+// are parsed out so it never reads as one
+type FooterConfig struct {
+	Enabled bool   `json:"enabled"`
+	Text    string `json:"text"`
+}
+
+const defaultFooterText = "AI-generated; verify important information."
+
+// The footer for a request: the persona's, else the client's tenant's,
+// else the configured one. An empty override turns the footer off for that
+// persona or tenant.
+func (s *Server) footerFor(client *ClientConfig, p *persona) string {
+	if !s.cfg.Footer.Enabled {
+		return ""
+	}
+	if p != nil && p.footer != nil {
+		return *p.footer
+	}
+	if client != nil {
+		if tenant, ok := s.cfg.Tenants[client.Tenant]; ok && tenant.Footer != nil {
+			return *tenant.Footer
+		}
+	}
+	return s.cfg.Footer.Text
+}
+
+// Append footer to an answer on its own paragraph
+func withFooter(content, footer string) string {
+	if footer == "" {
+		return content
+	}
+	if content == "" {
+		return footer
+	}
+	return content + "\n\n" + footer
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFooterAfterReferenceParsing(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Footer.Enabled = true
+	_, front := newTestServer(t, cfg, &azureStub{content: "Go is a language [doc1].\nReferences:\n1. Go spec"})
+
+	var chat ChatResponse
+	if err := json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"What is Go?"}`))), &chat); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Go is a language [doc1].\n\n" + defaultFooterText; chat.Response != want {
+		t.Errorf("response = %q, want %q", chat.Response, want)
+	}
+	if !reflect.DeepEqual(chat.References, []string{"1. Go spec"}) {
+		t.Errorf("references = %q, want the footer kept out of them", chat.References)
+	}
+}
+
+func TestFooterDisabledByDefault(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), &azureStub{content: "Hello."})
+
+	body := readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+	if strings.Contains(body, defaultFooterText) {
+		t.Errorf("body = %s, want no footer unless enabled", body)
+	}
+}
+
+func TestFooterPersonaAndTenantOverrides(t *testing.T) {
+	legal, none := "Not legal advice.", ""
+	cfg := defaultConfig()
+	cfg.Footer.Enabled = true
+	cfg.Personas = map[string]PersonaConfig{"lawyer": {SystemPrompt: "Be precise.", Footer: &legal}}
+	cfg.Tenants = map[string]TenantConfig{"internal": {Footer: &none}}
+	cfg.Clients = map[string]ClientConfig{
+		"staff-key":  {Name: "staff", Tenant: "internal"},
+		"public-key": {Name: "public"},
+	}
+	_, front := newTestServer(t, cfg, &azureStub{content: "Hello."})
+
+	for _, tt := range []struct {
+		key, body, want string
+	}{
+		{"public-key", `{"message":"hi"}`, "Hello.\n\n" + defaultFooterText},
+		{"public-key", `{"message":"hi","persona":"lawyer"}`, "Hello.\n\nNot legal advice."},
+		{"staff-key", `{"message":"hi"}`, "Hello."},
+		{"staff-key", `{"message":"hi","persona":"lawyer"}`, "Hello.\n\nNot legal advice."},
+	} {
+		var chat ChatResponse
+		if err := json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", tt.body, "X-API-Key", tt.key))), &chat); err != nil {
+			t.Fatal(err)
+		}
+		if chat.Response != tt.want {
+			t.Errorf("%s %s: response = %q, want %q", tt.key, tt.body, chat.Response, tt.want)
+		}
+	}
+}
+
+func TestStreamFooterEvent(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Footer.Enabled = true
+	_, front := newTestServer(t, cfg, streamStub())
+
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)))
+	names := eventNames(events)
+	if len(names) < 2 || names[len(names)-2] != "footer" || names[len(names)-1] != "done" {
+		t.Fatalf("events = %v, want footer right before done", names)
+	}
+	var footer map[string]string
+	json.Unmarshal([]byte(events[len(events)-2].Data), &footer)
+	if footer["footer"] != defaultFooterText {
+		t.Errorf("footer event = %v, want the configured text", footer)
+	}
+	var done StreamDone
+	json.Unmarshal([]byte(events[len(events)-1].Data), &done)
+	if done.Response != "Hello world.\n\n"+defaultFooterText || !reflect.DeepEqual(done.References, []string{"1. Foo", "2. Bar"}) {
+		t.Errorf("done = %+v, want the footer after the answer and the references intact", done)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import "fmt"
+
+// Instruction added to the prompt for each answer format a request may set
+// with format. The references are still asked for as a list after the
+// answer so they parse the same whatever the format.
+var answerFormatInstructions = map[string]string{
+	"prose":    "Write the answer as plain paragraphs of prose, without bullet points, tables or headings.",
+	"bullets":  "Write the answer as a concise bulleted list, one point per bullet.",
+	"table":    "Write the answer as a Markdown table with a header row, using | to separate columns, and keep any explanation outside the table short.",
+	"markdown": "Write the answer in Markdown, using headings, lists, tables and emphasis where they help.",
+}
+
+// Reports whether format is empty or one of the answer formats
+func validAnswerFormat(format string) bool {
+	if format == "" {
+		return true
+	}
+	_, ok := answerFormatInstructions[format]
+	return ok
+}
+
+// Ask for the answer in format. Without one the reference request prompt
+// already asks for prose and is left as it is.
+func formatAnswerFormatPrompt(prompt, format string) string {
+	if format == "" {
+		return prompt
+	}
+	return fmt.Sprintf(`%s
+
+%s Whatever the format, end with the numbered list of references under a "References:" heading.`, prompt, answerFormatInstructions[format])
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChatAnswerFormatInstruction(t *testing.T) {
+	azure := &azureStub{content: "| A | B |\n|---|---|\n| 1 | 2 |\n\nReferences:\n1. Foo"}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	for i, format := range []string{"prose", "bullets", "table", "markdown"} {
+		var got ChatResponse
+		json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","format":"`+format+`"}`))), &got)
+		prompt := userMessage(azure.payload(t, i))
+		if !strings.Contains(prompt, answerFormatInstructions[format]) || !strings.Contains(prompt, `"References:" heading`) {
+			t.Errorf("%s: prompt = %q", format, prompt)
+		}
+		if !reflect.DeepEqual(got.References, []string{"1. Foo"}) {
+			t.Errorf("%s: references = %q", format, got.References)
+		}
+	}
+	if !strings.Contains(answerFormatInstructions["table"], "Markdown table") {
+		t.Errorf("table instruction does not ask for a Markdown table")
+	}
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+	if prompt := userMessage(azure.payload(t, 4)); strings.Contains(prompt, "Whatever the format") {
+		t.Errorf("prompt without format carries a format instruction: %q", prompt)
+	}
+}
+
+func TestChatRejectsUnknownFormat(t *testing.T) {
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","format":"haiku"}`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest || len(azure.payloads) != 0 {
+		t.Errorf("status = %d after %d Azure calls, want 400 before any", resp.StatusCode, len(azure.payloads))
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// streamEvent is a server-sent event buffered for replay
+type streamEvent struct {
+	Seq  int
+	Name string
+	Data json.RawMessage
+}
+
+// generation is one streaming completion. Events are buffered so that a
+// client whose connection drops can reconnect with Last-Event-ID and
+// receive everything it missed.
+type generation struct {
+	ID        string
+	Client    string
+	Model     string
+	StartedAt time.Time
+
+	mu      sync.Mutex
+	events  []streamEvent
+	dropped int // events discarded from the front of the buffer
+	max     int
+	done    bool
+	notify  chan struct{}
+	cancel  context.CancelFunc
+}
+
+// Append an event and wake any waiting readers
+func (g *generation) emit(name string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done {
+		return
+	}
+	g.events = append(g.events, streamEvent{Seq: g.lastSeq() + 1, Name: name, Data: payload})
+	if len(g.events) > g.max {
+		g.events = g.events[1:]
+		g.dropped++
+	}
+	close(g.notify)
+	g.notify = make(chan struct{})
+}
+
+// Return the buffered events after seq, whether the generation has
+// finished, and a channel closed on the next emit. ok is false when events
+// after seq have already been dropped from the buffer.
+func (g *generation) after(seq int) (events []streamEvent, done bool, wait <-chan struct{}, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if seq < g.dropped {
+		return nil, g.done, g.notify, false
+	}
+	if seq > g.lastSeq() {
+		seq = g.lastSeq()
+	}
+	events = append(events, g.events[seq-g.dropped:]...)
+	return events, g.done, g.notify, true
+}
+
+// Sequence number of the newest event, zero before the first emit.
+// Callers must hold g.mu.
+func (g *generation) lastSeq() int {
+	return g.dropped + len(g.events)
+}
+
+// Reports whether seq can be resumed from: it must not be newer than the
+// latest event.
+func (g *generation) validSeq(seq int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return seq >= 0 && seq <= g.lastSeq()
+}
+
+func (g *generation) finish() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done {
+		return
+	}
+	g.done = true
+	close(g.notify)
+	g.notify = make(chan struct{})
+}
+
+// generationRegistry tracks streaming generations and keeps finished ones
+// around for a grace period so late reconnects can still replay them.
+type generationRegistry struct {
+	mu        sync.Mutex
+	gens      map[string]*generation
+	maxEvents int
+	grace     time.Duration
+
+	// Upstream streams reserved or running, capped at maxActive when set
+	running   int
+	maxActive int
+}
+
+func newGenerationRegistry(maxEvents int, grace time.Duration, maxActive int) *generationRegistry {
+	return &generationRegistry{
+		gens:      make(map[string]*generation),
+		maxEvents: maxEvents,
+		grace:     grace,
+		maxActive: maxActive,
+	}
+}
+
+// Claim a slot for a new stream, reporting false when all are taken. The
+// slot is returned by finish, or by release if no generation starts.
+func (reg *generationRegistry) reserve() bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.maxActive > 0 && reg.running >= reg.maxActive {
+		return false
+	}
+	reg.running++
+	return true
+}
+
+func (reg *generationRegistry) release() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.running--
+}
+
+// Number of streams holding a slot, and the cap
+func (reg *generationRegistry) usage() (int, int) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.running, reg.maxActive
+}
+
+// Register a new generation of model owned by client
+func (reg *generationRegistry) start(client, model string, cancel context.CancelFunc) *generation {
+	g := &generation{
+		ID:        newCorrelationID(),
+		Client:    client,
+		Model:     model,
+		StartedAt: time.Now(),
+		max:       reg.maxEvents,
+		notify:    make(chan struct{}),
+		cancel:    cancel,
+	}
+	reg.mu.Lock()
+	reg.gens[g.ID] = g
+	reg.mu.Unlock()
+	return g
+}
+
+func (reg *generationRegistry) get(id string) (*generation, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	g, ok := reg.gens[id]
+	return g, ok
+}
+
+// generationInfo describes an in-flight generation for the admin API
+type generationInfo struct {
+	ID        string    `json:"id"`
+	Client    string    `json:"client"`
+	Model     string    `json:"model"`
+	StartedAt time.Time `json:"startedAt"`
+	Events    int       `json:"events"`
+}
+
+// List the generations that have not finished yet, oldest first
+func (reg *generationRegistry) active() []generationInfo {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	infos := make([]generationInfo, 0, len(reg.gens))
+	for _, g := range reg.gens {
+		g.mu.Lock()
+		if !g.done {
+			infos = append(infos, generationInfo{ID: g.ID, Client: g.Client, Model: g.Model, StartedAt: g.StartedAt, Events: g.lastSeq()})
+		}
+		g.mu.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	return infos
+}
+
+// Mark a generation finished, free its slot and expire it after the
+// grace period
+func (reg *generationRegistry) finish(g *generation) {
+	g.finish()
+	g.cancel()
+	reg.release()
+	time.AfterFunc(reg.grace, func() {
+		reg.mu.Lock()
+		delete(reg.gens, g.ID)
+		reg.mu.Unlock()
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerationAfterReplaysFromSeq(t *testing.T) {
+	reg := newGenerationRegistry(10, time.Minute, 0)
+	g := reg.start("", "", func() {})
+	for i := 0; i < 3; i++ {
+		g.emit("token", i)
+	}
+
+	events, done, _, ok := g.after(1)
+	if !ok || done {
+		t.Fatalf("after(1) ok=%v done=%v, want ok and not done", ok, done)
+	}
+	if len(events) != 2 || events[0].Seq != 2 || events[1].Seq != 3 {
+		t.Fatalf("after(1) = %+v, want seqs 2 and 3", events)
+	}
+}
+
+func TestGenerationBufferOverflowDropsOldest(t *testing.T) {
+	reg := newGenerationRegistry(2, time.Minute, 0)
+	g := reg.start("", "", func() {})
+	for i := 0; i < 5; i++ {
+		g.emit("token", i)
+	}
+
+	if _, _, _, ok := g.after(1); ok {
+		t.Fatal("after(1) should report dropped events")
+	}
+	events, _, _, ok := g.after(3)
+	if !ok || len(events) != 2 || events[0].Seq != 4 {
+		t.Fatalf("after(3) = %+v ok=%v, want seqs 4 and 5", events, ok)
+	}
+}
+
+func TestGenerationValidSeq(t *testing.T) {
+	reg := newGenerationRegistry(10, time.Minute, 0)
+	g := reg.start("", "", func() {})
+	g.emit("token", 1)
+
+	for seq, want := range map[int]bool{-1: false, 0: true, 1: true, 2: false, 999: false} {
+		if got := g.validSeq(seq); got != want {
+			t.Errorf("validSeq(%d) = %v, want %v", seq, got, want)
+		}
+	}
+}
+
+func TestGenerationFinishWakesReaders(t *testing.T) {
+	reg := newGenerationRegistry(10, time.Minute, 0)
+	g := reg.start("", "", func() {})
+	_, _, wait, _ := g.after(0)
+
+	reg.finish(g)
+	select {
+	case <-wait:
+	case <-time.After(time.Second):
+		t.Fatal("finish did not wake waiting readers")
+	}
+	if _, done, _, _ := g.after(0); !done {
+		t.Fatal("generation not reported done after finish")
+	}
+}
+
+func TestGenerationExpiresAfterGrace(t *testing.T) {
+	reg := newGenerationRegistry(10, 20*time.Millisecond, 0)
+	g := reg.start("", "", func() {})
+	reg.finish(g)
+
+	if _, ok := reg.get(g.ID); !ok {
+		t.Fatal("finished generation should be resumable during the grace period")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := reg.get(g.ID); ok {
+		t.Fatal("generation still registered after the grace period")
+	}
+}
+
+func TestGenerationRegistryCapsRunningStreams(t *testing.T) {
+	reg := newGenerationRegistry(10, time.Minute, 1)
+	if !reg.reserve() {
+		t.Fatal("first reserve failed")
+	}
+	if reg.reserve() {
+		t.Fatal("reserve succeeded over the cap")
+	}
+	g := reg.start("alice", "gpt-4o", func() {})
+	reg.finish(g)
+	if active, limit := reg.usage(); active != 0 || limit != 1 {
+		t.Errorf("usage after finish = %d, %d", active, limit)
+	}
+	if !reg.reserve() {
+		t.Error("reserve failed after the stream finished")
+	}
+}
@@ -3,6 +3,7 @@ module azure-openai-chat-backend
 go 1.23.3
 
 require (
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/gorilla/mux v1.8.1
+	github.com/joho/godotenv v1.5.1
+	golang.org/x/text v0.28.0
 )
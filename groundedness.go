@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GroundednessConfig controls the groundedness rating of grounded answers
+type GroundednessConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Model from Models that rates answers against their sources. Empty
+	// rates by the share of sentences carrying a citation marker, which
+	// costs no extra call.
+	Model string `json:"model"`
+
+	// Completion budget for a model rating
+	MaxTokens int `json:"maxTokens"`
+}
+
+// GroundednessChecker rates how much of an answer its grounding citations
+// back up, from 0 for none to 1 for all of it
+type GroundednessChecker interface {
+	Score(ctx context.Context, answer string, citations []AzureCitation) (float64, error)
+}
+
+var (
+	// Citation markers right after a sentence's full stop, moved before it
+	// so they count for that sentence
+	trailingMarkerRegex = regexp.MustCompile(`([.!?])((?:\s*\[(?:doc)?\d+(?:\s*,\s*(?:doc)?\d+)*\])+)`)
+	sentenceEndRegex    = regexp.MustCompile(`[.!?]+(?:\s+|$)|\n+`)
+)
+
+// Split text into sentences, each keeping the markers that cite it
+func splitSentences(text string) []string {
+	text = trailingMarkerRegex.ReplaceAllString(text, "$2$1")
+	var sentences []string
+	start := 0
+	for _, loc := range sentenceEndRegex.FindAllStringIndex(text, -1) {
+		if s := strings.TrimSpace(text[start:loc[1]]); s != "" {
+			sentences = append(sentences, s)
+		}
+		start = loc[1]
+	}
+	if s := strings.TrimSpace(text[start:]); s != "" {
+		sentences = append(sentences, s)
+	}
+	return sentences
+}
+
+// citationChecker scores an answer by the share of its sentences that
+// carry an inline citation marker
+type citationChecker struct{}
+
+func (citationChecker) Score(ctx context.Context, answer string, citations []AzureCitation) (float64, error) {
+	sentences := splitSentences(answer)
+	if len(sentences) == 0 {
+		return 0, nil
+	}
+	cited := 0
+	for _, s := range sentences {
+		if inlineMarkerRegex.MatchString(s) {
+			cited++
+		}
+	}
+	return float64(cited) / float64(len(sentences)), nil
+}
+
+const groundednessPrompt = `Rate how much of the answer below is supported by the numbered sources. Reply with a single number from 0 (nothing is supported) to 1 (everything is supported) and nothing else.`
+
+// modelChecker asks a chat model to rate the answer against its sources
+type modelChecker struct {
+	s         *Server
+	model     ModelConfig
+	maxTokens int
+}
+
+func newModelChecker(s *Server, cfg GroundednessConfig) (*modelChecker, error) {
+	name, model, ok := s.cfg.modelFor(cfg.Model)
+	if !ok {
+		return nil, fmt.Errorf("groundedness model %q is not configured", name)
+	}
+	return &modelChecker{s: s, model: model, maxTokens: cfg.MaxTokens}, nil
+}
+
+func (mc *modelChecker) Score(ctx context.Context, answer string, citations []AzureCitation) (float64, error) {
+	var sources strings.Builder
+	for i, c := range citations {
+		fmt.Fprintf(&sources, "[doc%d] %s\n%s\n\n", i+1, c.Title, c.Content)
+	}
+	data := map[string]interface{}{
+		"messages": []map[string]interface{}{
+			{"role": "system", "content": groundednessPrompt},
+			{"role": "user", "content": fmt.Sprintf("Sources:\n%s\nAnswer:\n%s", sources.String(), answer)},
+		},
+	}
+	applyParams(data, GenerationParams{MaxTokens: mc.maxTokens, TopP: 1}, mc.model)
+	ctx, cancel := context.WithTimeout(ctx, mc.s.policyFor(mc.model.Endpoint).timeout)
+	defer cancel()
+	resp, err := mc.s.callAzure(ctx, mc.model.Endpoint, data)
+	if err != nil {
+		return 0, err
+	}
+	reply := strings.TrimSpace(resp.Choices[0].Message.Content)
+	score, err := strconv.ParseFloat(strings.TrimSuffix(reply, "."), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, fmt.Errorf("groundedness model replied %q, not a number", reply)
+	}
+	return min(max(score, 0), 1), nil
+}
+
+// Bucket a groundedness score for display
+func groundednessLevel(score float64) string {
+	switch {
+	case score >= 0.8:
+		return "high"
+	case score >= 0.5:
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+// Rate a grounded answer, returning nil when ratings are off or fail
+func (s *Server) rateGroundedness(ctx context.Context, answer string, grounding *AzureMessageContext) *float64 {
+	if s.groundedness == nil {
+		return nil
+	}
+	var citations []AzureCitation
+	if grounding != nil {
+		citations = grounding.Citations
+	}
+	score, err := s.groundedness.Score(ctx, answer, citations)
+	if err != nil {
+		logf(ctx, "Groundedness check failed, omitting the score: %v", err)
+		return nil
+	}
+	return &score
+}
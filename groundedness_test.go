@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type stubChecker struct {
+	score   float64
+	err     error
+	answers []string
+}
+
+func (sc *stubChecker) Score(ctx context.Context, answer string, citations []AzureCitation) (float64, error) {
+	sc.answers = append(sc.answers, answer)
+	return sc.score, sc.err
+}
+
+func TestSplitSentencesKeepsTrailingMarkers(t *testing.T) {
+	got := splitSentences("Go has generics [doc1]. They were added in 1.18.[doc2] Nobody knows why!\nAnother line")
+	want := []string{"Go has generics [doc1].", "They were added in 1.18[doc2].", "Nobody knows why!", "Another line"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitSentences = %q, want %q", got, want)
+	}
+}
+
+func TestCitationCheckerScoresCitedShare(t *testing.T) {
+	tests := []struct {
+		answer string
+		want   float64
+	}{
+		{"", 0},
+		{"One [doc1]. Two [doc2].", 1},
+		{"One [doc1]. Two. Three [1, 2]. Four.", 0.5},
+		{"Nothing cited here. Or here.", 0},
+	}
+	for _, tt := range tests {
+		got, _ := citationChecker{}.Score(context.Background(), tt.answer, nil)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Score(%q) = %v, want %v", tt.answer, got, tt.want)
+		}
+	}
+}
+
+func TestGroundednessLevel(t *testing.T) {
+	for score, want := range map[float64]string{0: "low", 0.49: "low", 0.5: "medium", 0.79: "medium", 0.8: "high", 1: "high"} {
+		if got := groundednessLevel(score); got != want {
+			t.Errorf("groundednessLevel(%v) = %q, want %q", score, got, want)
+		}
+	}
+}
+
+func TestChatReportsGroundedness(t *testing.T) {
+	t.Run("stubbed check", func(t *testing.T) {
+		srv, front := newTestServer(t, defaultConfig(), &azureStub{content: "Answer [doc1].\nReferences:\n1. Foo"})
+		checker := &stubChecker{score: 0.6}
+		srv.groundedness = checker
+
+		var got ChatResponse
+		json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &got)
+		if got.GroundednessScore == nil || *got.GroundednessScore != 0.6 || got.Groundedness != "medium" {
+			t.Errorf("groundedness = %v, %q", got.GroundednessScore, got.Groundedness)
+		}
+		if len(checker.answers) != 1 || checker.answers[0] != "Answer [doc1]." {
+			t.Errorf("checker got %q, want the answer without references", checker.answers)
+		}
+	})
+	t.Run("failed check", func(t *testing.T) {
+		srv, front := newTestServer(t, defaultConfig(), &azureStub{content: "Answer."})
+		srv.groundedness = &stubChecker{err: errors.New("boom")}
+
+		var got ChatResponse
+		json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &got)
+		if got.GroundednessScore != nil || got.Groundedness != "" {
+			t.Errorf("groundedness after a failed check = %v, %q", got.GroundednessScore, got.Groundedness)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		_, front := newTestServer(t, defaultConfig(), &azureStub{content: "Answer."})
+		var got ChatResponse
+		json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &got)
+		if got.GroundednessScore != nil {
+			t.Errorf("groundedness reported without the check enabled")
+		}
+	})
+}
+
+func TestModelChecker(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Groundedness.Enabled = true
+	cfg.Models = map[string]ModelConfig{"gpt-4o": {}, "mini": {}}
+	cfg.DefaultModel = "gpt-4o"
+	cfg.Groundedness.Model = "mini"
+	azure := &azureStub{content: " 0.9\n"}
+	srv, _ := newTestServer(t, cfg, azure)
+
+	score, err := srv.groundedness.Score(context.Background(), "Answer [doc1].", []AzureCitation{{Title: "Foo", Content: "Foo text"}})
+	if err != nil || score != 0.9 {
+		t.Fatalf("Score = %v, %v; want 0.9", score, err)
+	}
+	if payload := azure.payload(t, 0); payload["data_sources"] != nil || payload["max_tokens"] != float64(5) {
+		t.Errorf("rating payload = %v, want a small ungrounded completion", payload)
+	}
+
+	azure.content = "mostly"
+	if _, err := srv.groundedness.Score(context.Background(), "Answer.", nil); err == nil {
+		t.Error("a non-numeric rating was accepted")
+	}
+}
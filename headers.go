@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RFC 7230 token characters allowed in a header name
+var headerNameRegex = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// Headers the server sets itself on Azure requests and never lets config override
+var reservedUpstreamHeaders = map[string]bool{
+	"Api-Key":                true,
+	"Authorization":          true,
+	"Content-Type":           true,
+	"Content-Length":         true,
+	"Host":                   true,
+	"X-Correlation-Id":       true,
+	"X-Ms-Client-Request-Id": true,
+}
+
+// Parse AZURE_EXTRA_HEADERS, a comma-separated list of Name=value pairs
+func parseHeaderList(v string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("header %q is not Name=value", pair)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// Validate the configured extra upstream headers, returning them in
+// canonical form. Reserved headers are dropped with a warning.
+func validateUpstreamHeaders(headers map[string]string) (map[string]string, error) {
+	valid := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !headerNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid upstream header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("upstream header %q has a line break in its value", name)
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if reservedUpstreamHeaders[canonical] {
+			log.Printf("WARNING: ignoring reserved upstream header %q", name)
+			continue
+		}
+		valid[canonical] = value
+	}
+	return valid, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateUpstreamHeaders(t *testing.T) {
+	got, err := validateUpstreamHeaders(map[string]string{
+		"x-ms-oai-preview": "on",
+		"api-key":          "stolen",
+		"Content-Type":     "text/plain",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"X-Ms-Oai-Preview": "on"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("validated = %v, want %v", got, want)
+	}
+
+	for _, bad := range []map[string]string{
+		{"bad header": "x"},
+		{"X-Ok": "a\r\nInjected: 1"},
+	} {
+		if _, err := validateUpstreamHeaders(bad); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+}
+
+func TestParseHeaderList(t *testing.T) {
+	got, err := parseHeaderList("x-a=1, x-b = two ,")
+	if err != nil || !reflect.DeepEqual(got, map[string]string{"x-a": "1", "x-b": "two"}) {
+		t.Fatalf("parseHeaderList = %v, %v", got, err)
+	}
+	if _, err := parseHeaderList("novalue"); err == nil {
+		t.Fatal("accepted a pair without =")
+	}
+}
+
+func TestUpstreamHeadersSentToAzure(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.APIKey = "real-key"
+	cfg.UpstreamHeaders = map[string]string{"X-Ms-Oai-Preview": "on"}
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, cfg, azure)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+	azure.mu.Lock()
+	h := azure.headers[0]
+	azure.mu.Unlock()
+	if h.Get("X-Ms-Oai-Preview") != "on" || h.Get("api-key") != "real-key" {
+		t.Fatalf("upstream headers = %v", h)
+	}
+}
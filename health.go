@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointHealthConfig shapes the rolling health scores that weigh the
+// choice between a model's endpoint and its replicas
+type EndpointHealthConfig struct {
+	// Weight of the latest call in the rolling success rate and latency,
+	// from 0 to 1; higher forgets faster
+	Decay float64 `json:"decay"`
+
+	// Latency up to which an endpoint loses no score; slower endpoints
+	// score in proportion
+	LatencyTarget time.Duration `json:"-"`
+
+	// Least selection weight of an endpoint however unhealthy, so it keeps
+	// getting the odd request and can recover
+	MinWeight float64 `json:"minWeight"`
+
+	// Consecutive failures that open an endpoint's breaker, zero for no
+	// breaker. An open endpoint gets no request until BreakerCooldown has
+	// passed, then is tried again and reopens on its next failure.
+	BreakerFailures int           `json:"breakerFailures"`
+	BreakerCooldown time.Duration `json:"-"`
+}
+
+// endpointHealth is the rolling record of calls to one endpoint
+type endpointHealth struct {
+	successRate float64
+	latency     float64 // seconds
+	requests    uint64
+	failures    uint64
+
+	consecutiveFailures int
+	openUntil           time.Time // zero while the breaker is closed
+}
+
+// healthTracker scores every endpoint the server calls and picks among a
+// model's endpoints by score
+type healthTracker struct {
+	cfg EndpointHealthConfig
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointHealth
+	random    func() float64
+	now       func() time.Time
+}
+
+func newHealthTracker(cfg EndpointHealthConfig) *healthTracker {
+	return &healthTracker{cfg: cfg, endpoints: make(map[string]*endpointHealth), random: rand.Float64, now: time.Now}
+}
+
+// Record a call to endpoint. Unknown endpoints start healthy, so the first
+// failure already counts against a perfect record.
+func (h *healthTracker) observe(endpoint string, ok bool, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, found := h.endpoints[endpoint]
+	if !found {
+		e = &endpointHealth{successRate: 1, latency: latency.Seconds()}
+		h.endpoints[endpoint] = e
+	}
+	success := 0.0
+	if ok {
+		success = 1
+		e.consecutiveFailures = 0
+		e.openUntil = time.Time{}
+	} else {
+		e.failures++
+		e.consecutiveFailures++
+		if h.cfg.BreakerFailures > 0 && e.consecutiveFailures >= h.cfg.BreakerFailures {
+			e.openUntil = h.now().Add(h.cfg.BreakerCooldown)
+		}
+	}
+	e.requests++
+	e.successRate += h.cfg.Decay * (success - e.successRate)
+	e.latency += h.cfg.Decay * (latency.Seconds() - e.latency)
+}
+
+// Score from 0 to 1: the success rate, scaled down by how far the latency
+// runs over the target. Call with h.mu held.
+func (h *healthTracker) score(e *endpointHealth) float64 {
+	if e == nil {
+		return 1
+	}
+	score := e.successRate
+	if target := h.cfg.LatencyTarget.Seconds(); target > 0 && e.latency > target {
+		score *= target / e.latency
+	}
+	return score
+}
+
+// The endpoint of a resolved model followed by its replicas
+func (m ModelConfig) endpoints() []string {
+	return append([]string{m.Endpoint}, m.Replicas...)
+}
+
+// The endpoints whose breaker is closed, or has cooled down. When there
+// are none, also reports how long until the first one may be tried again.
+func (h *healthTracker) available(endpoints []string) ([]string, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	var up []string
+	var wait time.Duration
+	for _, endpoint := range endpoints {
+		e := h.endpoints[endpoint]
+		if e == nil || !now.Before(e.openUntil) {
+			up = append(up, endpoint)
+			continue
+		}
+		if left := e.openUntil.Sub(now); wait == 0 || left < wait {
+			wait = left
+		}
+	}
+	if len(up) > 0 {
+		return up, 0
+	}
+	return nil, wait
+}
+
+// Pick one of endpoints at random, weighted by health score with
+// MinWeight as the floor
+func (h *healthTracker) pick(endpoints []string) string {
+	if len(endpoints) == 1 {
+		return endpoints[0]
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	weights := make([]float64, len(endpoints))
+	total := 0.0
+	for i, endpoint := range endpoints {
+		weights[i] = h.score(h.endpoints[endpoint])
+		if weights[i] < h.cfg.MinWeight {
+			weights[i] = h.cfg.MinWeight
+		}
+		total += weights[i]
+	}
+	at := h.random() * total
+	for i, w := range weights {
+		if at < w {
+			return endpoints[i]
+		}
+		at -= w
+	}
+	return endpoints[len(endpoints)-1]
+}
+
+// EndpointHealthReport is the health of one endpoint on the admin API
+type EndpointHealthReport struct {
+	Endpoint       string  `json:"endpoint"`
+	Score          float64 `json:"score"`
+	SuccessRate    float64 `json:"successRate"`
+	LatencySeconds float64 `json:"latencySeconds"`
+	Requests       uint64  `json:"requests"`
+	Failures       uint64  `json:"failures"`
+	CircuitOpen    bool    `json:"circuitOpen,omitempty"`
+}
+
+// The health of every endpoint called so far, by endpoint
+func (h *healthTracker) report() []EndpointHealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	report := make([]EndpointHealthReport, 0, len(h.endpoints))
+	for endpoint, e := range h.endpoints {
+		report = append(report, EndpointHealthReport{
+			Endpoint:       endpoint,
+			Score:          h.score(e),
+			SuccessRate:    e.successRate,
+			LatencySeconds: e.latency,
+			Requests:       e.requests,
+			Failures:       e.failures,
+			CircuitOpen:    now.Before(e.openUntil),
+		})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Endpoint < report[j].Endpoint })
+	return report
+}
+
+// Write the health scores in the Prometheus text format, or in OpenMetrics,
+// where a counter family is declared without the _total of its samples
+func (h *healthTracker) write(w *strings.Builder, openMetrics bool) {
+	report := h.report()
+	if len(report) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "# HELP azure_endpoint_health_score Rolling health of an Azure endpoint, from 0 to 1.")
+	fmt.Fprintln(w, "# TYPE azure_endpoint_health_score gauge")
+	for _, e := range report {
+		fmt.Fprintf(w, "azure_endpoint_health_score{endpoint=%q} %g\n", e.Endpoint, e.Score)
+	}
+	counters := []struct {
+		name, help string
+		value      func(EndpointHealthReport) uint64
+	}{
+		{"azure_endpoint_requests", "Calls to an Azure endpoint since startup.", func(e EndpointHealthReport) uint64 { return e.Requests }},
+		{"azure_endpoint_failures", "Failed calls to an Azure endpoint since startup.", func(e EndpointHealthReport) uint64 { return e.Failures }},
+	}
+	for _, c := range counters {
+		family := c.name + "_total"
+		if openMetrics {
+			family = c.name
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", family, c.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", family)
+		for _, e := range report {
+			fmt.Fprintf(w, "%s_total{endpoint=%q} %d\n", c.name, e.Endpoint, c.value(e))
+		}
+	}
+}
+
+// Reports whether an Azure response speaks for a healthy endpoint: server
+// errors and throttling count against it, other client errors are the
+// request's fault
+func healthyStatus(status int) bool {
+	return status < 500 && status != http.StatusTooManyRequests
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Share of n picks between a and b that went to b
+func pickShare(h *healthTracker, n int) float64 {
+	picked := 0
+	for i := 0; i < n; i++ {
+		if h.pick([]string{"https://a", "https://b"}) == "https://b" {
+			picked++
+		}
+	}
+	return float64(picked) / float64(n)
+}
+
+func TestHealthFailuresLowerSelection(t *testing.T) {
+	h := newHealthTracker(defaultConfig().EndpointHealth)
+	h.random = rand.New(rand.NewSource(1)).Float64
+
+	if share := pickShare(h, 2000); share < 0.45 || share > 0.55 {
+		t.Fatalf("healthy share = %.2f, want about half", share)
+	}
+	for i := 0; i < 10; i++ {
+		h.observe("https://a", true, time.Second)
+		h.observe("https://b", false, time.Second)
+	}
+	failing := pickShare(h, 2000)
+	if failing > 0.15 {
+		t.Errorf("share after failures = %.2f, want the failing endpoint mostly avoided", failing)
+	}
+	if failing == 0 {
+		t.Error("failing endpoint was never picked, want MinWeight to keep it in rotation")
+	}
+	for i := 0; i < 20; i++ {
+		h.observe("https://b", true, time.Second)
+	}
+	if share := pickShare(h, 2000); share < 0.45 {
+		t.Errorf("share after recovery = %.2f, want about half again", share)
+	}
+}
+
+func TestHealthSlowEndpointScoresLower(t *testing.T) {
+	h := newHealthTracker(EndpointHealthConfig{Decay: 1, LatencyTarget: 2 * time.Second, MinWeight: 0.05})
+	h.observe("https://fast", true, time.Second)
+	h.observe("https://slow", true, 8*time.Second)
+
+	scores := map[string]float64{}
+	for _, e := range h.report() {
+		scores[e.Endpoint] = e.Score
+	}
+	if scores["https://fast"] != 1 || scores["https://slow"] != 0.25 {
+		t.Errorf("scores = %v, want 1 under the latency target and 0.25 at four times it", scores)
+	}
+}
+
+func TestHealthyStatus(t *testing.T) {
+	for status, want := range map[int]bool{200: true, 400: true, 404: true, 429: false, 500: false, 503: false} {
+		if got := healthyStatus(status); got != want {
+			t.Errorf("healthyStatus(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestReplicaSelectionAvoidsFailingEndpoint(t *testing.T) {
+	failing := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}}
+	failingServer := httptest.NewServer(failing)
+	t.Cleanup(failingServer.Close)
+
+	cfg := defaultConfig()
+	cfg.UpstreamRetries = 0
+	cfg.DefaultModel = "gpt"
+	cfg.Models = map[string]ModelConfig{"gpt": {Replicas: []string{failingServer.URL}}}
+	healthy := &azureStub{content: "Hello."}
+	srv, front := newTestServer(t, cfg, healthy)
+	srv.health.random = rand.New(rand.NewSource(1)).Float64
+
+	for i := 0; i < 40; i++ {
+		readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+	}
+	if n := len(failing.payloads); n == 0 || n > 12 {
+		t.Errorf("failing replica got %d of 40 requests, want a few before it is deprioritized", n)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.endpointHealthHandler(rec, httptest.NewRequest("GET", "/admin/endpoints/health", nil))
+	var report []EndpointHealthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	scores := map[string]float64{}
+	for _, e := range report {
+		scores[e.Endpoint] = e.Score
+	}
+	if len(scores) != 2 || scores[failingServer.URL] >= 0.5 || scores[cfg.Endpoint] != 1 {
+		t.Errorf("health report = %+v, want the failing replica scored low and the other at 1", report)
+	}
+
+	resp, err := http.Get(front.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, `azure_endpoint_health_score{endpoint="`+failingServer.URL+`"}`) {
+		t.Errorf("metrics lack the replica's health score:\n%s", body)
+	}
+}
+
+func TestBreakerOpensAndCoolsDown(t *testing.T) {
+	now := time.Now()
+	h := newHealthTracker(EndpointHealthConfig{Decay: 0.2, MinWeight: 0.05, BreakerFailures: 2, BreakerCooldown: 30 * time.Second})
+	h.now = func() time.Time { return now }
+	endpoints := []string{"https://a", "https://b"}
+
+	h.observe("https://a", false, time.Second)
+	if up, _ := h.available(endpoints); len(up) != 2 {
+		t.Fatalf("available = %v after one failure, want both", up)
+	}
+	h.observe("https://a", false, time.Second)
+	if up, _ := h.available(endpoints); !reflect.DeepEqual(up, []string{"https://b"}) {
+		t.Fatalf("available = %v, want a's breaker open", up)
+	}
+	now = now.Add(10 * time.Second)
+	h.observe("https://b", false, time.Second)
+	h.observe("https://b", false, time.Second)
+	up, wait := h.available(endpoints)
+	if len(up) != 0 || wait != 20*time.Second {
+		t.Fatalf("available = %v, wait %s, want none until a cools down in 20s", up, wait)
+	}
+	now = now.Add(20 * time.Second)
+	if up, _ := h.available(endpoints); !reflect.DeepEqual(up, []string{"https://a"}) {
+		t.Errorf("available = %v, want a tried again after its cooldown", up)
+	}
+}
+
+func TestAllBreakersOpenFailsFast(t *testing.T) {
+	replica := &azureStub{content: "Hello."}
+	replicaServer := httptest.NewServer(replica)
+	t.Cleanup(replicaServer.Close)
+
+	cfg := defaultConfig()
+	cfg.EndpointHealth.BreakerFailures = 1
+	cfg.DefaultModel = "gpt"
+	cfg.Models = map[string]ModelConfig{"gpt": {Replicas: []string{replicaServer.URL}}}
+	azure := &azureStub{content: "Hello."}
+	srv, front := newTestServer(t, cfg, azure)
+	srv.health.observe(cfg.Endpoint, false, time.Second)
+	srv.health.observe(replicaServer.URL, false, time.Second)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	var body ErrorResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &body)
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Code != "all_upstreams_unavailable" {
+		t.Errorf("status = %d code = %q, want 503 all_upstreams_unavailable", resp.StatusCode, body.Code)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want the breaker cooldown", got)
+	}
+	if len(azure.payloads)+len(replica.payloads) != 0 {
+		t.Error("an upstream was called while every breaker was open")
+	}
+}
+
+// Check that every sample in a metrics body belongs to a declared family:
+// in the text format a sample is named exactly as its family, in
+// OpenMetrics a counter's samples add _total to the family name. Histogram
+// samples add _bucket, _sum or _count in both.
+func checkMetricFamilies(t *testing.T, body string, openMetrics bool) map[string]string {
+	t.Helper()
+	types := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, _, _ := strings.Cut(line, "{")
+		name, _, _ = strings.Cut(name, " ")
+		family, declared := name, false
+		for _, suffix := range []string{"", "_total", "_bucket", "_sum", "_count"} {
+			base, ok := strings.CutSuffix(name, suffix)
+			if !ok {
+				continue
+			}
+			switch kind := types[base]; {
+			case suffix == "" && kind != "" && !(openMetrics && kind == "counter"):
+				family, declared = base, true
+			case suffix == "_total" && kind == "counter" && openMetrics:
+				family, declared = base, true
+			case suffix != "" && suffix != "_total" && kind == "histogram":
+				family, declared = base, true
+			}
+		}
+		if !declared {
+			t.Errorf("openMetrics=%v: sample %q has no matching TYPE line", openMetrics, family)
+		}
+	}
+	return types
+}
+
+func TestHealthMetricsFormats(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Features.MetricsExemplars = true
+	srv, front := newTestServer(t, cfg, &azureStub{content: "Answer."})
+	srv.health.observe(cfg.Endpoint, true, time.Second)
+	srv.health.observe(cfg.Endpoint, false, time.Second)
+
+	_, text := scrape(t, front.URL, "")
+	types := checkMetricFamilies(t, text, false)
+	if types["azure_endpoint_requests_total"] != "counter" || types["azure_endpoint_failures_total"] != "counter" {
+		t.Errorf("text format types = %v, want the counters declared with _total", types)
+	}
+	if !strings.Contains(text, `azure_endpoint_failures_total{endpoint="`+cfg.Endpoint+`"} 1`) {
+		t.Errorf("text format lacks the failure count:\n%s", text)
+	}
+
+	_, om := scrape(t, front.URL, "application/openmetrics-text; version=1.0.0")
+	types = checkMetricFamilies(t, strings.TrimSuffix(om, "# EOF\n"), true)
+	if types["azure_endpoint_requests"] != "counter" || types["azure_endpoint_failures"] != "counter" {
+		t.Errorf("OpenMetrics types = %v, want the bare counter families", types)
+	}
+	if !strings.Contains(om, `azure_endpoint_requests_total{endpoint="`+cfg.Endpoint+`"} 2`) {
+		t.Errorf("OpenMetrics lacks the request count:\n%s", om)
+	}
+}
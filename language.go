@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// LanguageCheckConfig flags answers written in a different language than
+// the question
+type LanguageCheckConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Share of the answer's language signal the other language must hold
+	// before it counts as a mismatch, from 0 to 1
+	Threshold float64 `json:"threshold"`
+
+	// Ask once more with an explicit language instruction on a mismatch
+	Retry bool `json:"retry"`
+}
+
+// Frequent function words, enough to tell Latin-script languages apart
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "of", "to", "in", "that", "it", "for", "with", "this", "you", "what", "how", "was", "be", "on", "not", "or"},
+	"es": {"el", "la", "los", "las", "y", "es", "son", "de", "que", "en", "por", "para", "con", "una", "un", "del", "se", "como", "qué", "cómo"},
+	"fr": {"le", "la", "les", "et", "est", "sont", "de", "des", "que", "dans", "pour", "avec", "une", "un", "du", "ce", "qui", "pas", "vous", "comment"},
+	"de": {"der", "die", "das", "und", "ist", "sind", "zu", "den", "mit", "für", "ein", "eine", "nicht", "von", "auf", "wie", "was", "ich", "sie", "auch"},
+	"it": {"il", "lo", "gli", "e", "è", "sono", "di", "che", "per", "con", "una", "uno", "del", "della", "non", "come", "cosa", "questo", "nel", "anche"},
+	"pt": {"o", "os", "as", "e", "é", "são", "de", "que", "em", "para", "com", "uma", "um", "do", "da", "não", "como", "você", "isso", "mais"},
+	"nl": {"de", "het", "een", "en", "is", "zijn", "van", "dat", "op", "voor", "met", "niet", "ook", "wat", "hoe", "ik", "je", "er", "aan", "bij"},
+}
+
+var languageNames = map[string]string{
+	"en": "English", "es": "Spanish", "fr": "French", "de": "German", "it": "Italian",
+	"pt": "Portuguese", "nl": "Dutch", "zh": "Chinese", "ja": "Japanese", "ko": "Korean",
+	"ru": "Russian", "ar": "Arabic", "el": "Greek", "he": "Hebrew", "hi": "Hindi", "th": "Thai",
+}
+
+// Languages identified by their script alone
+var scriptLanguages = []struct {
+	lang   string
+	script *unicode.RangeTable
+}{
+	{"ko", unicode.Hangul},
+	{"ru", unicode.Cyrillic},
+	{"ar", unicode.Arabic},
+	{"el", unicode.Greek},
+	{"he", unicode.Hebrew},
+	{"hi", unicode.Devanagari},
+	{"th", unicode.Thai},
+}
+
+var stopwordLanguages = func() map[string][]string {
+	index := make(map[string][]string)
+	for lang, words := range languageStopwords {
+		for _, w := range words {
+			index[w] = append(index[w], lang)
+		}
+	}
+	return index
+}()
+
+// Guess the dominant language of text as a two-letter code, with the share
+// of the language signal behind the guess. Returns "" when there is too
+// little signal to tell.
+func detectLanguage(text string) (string, float64) {
+	counts := make(map[string]int)
+	letters, han, kana := 0, 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r):
+			kana++
+		default:
+			for _, sl := range scriptLanguages {
+				if unicode.Is(sl.script, r) {
+					counts[sl.lang]++
+					break
+				}
+			}
+		}
+	}
+	// Japanese mixes kanji with kana, Chinese has no kana
+	if kana > 0 {
+		counts["ja"] += han + kana
+	} else {
+		counts["zh"] += han
+	}
+
+	if letters > 0 {
+		best, n := "", 0
+		for lang, c := range counts {
+			if c > n {
+				best, n = lang, c
+			}
+		}
+		if share := float64(n) / float64(letters); share > 0.5 {
+			return best, share
+		}
+	}
+
+	// Latin script: vote with function words, the share being how many of
+	// them the winning language uses
+	votes := make(map[string]int)
+	total := 0
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		langs := stopwordLanguages[word]
+		for _, lang := range langs {
+			votes[lang]++
+		}
+		if len(langs) > 0 {
+			total++
+		}
+	}
+	best, n := "", 0
+	for lang, c := range votes {
+		if c > n || (c == n && lang < best) {
+			best, n = lang, c
+		}
+	}
+	if n < 2 {
+		return "", 0
+	}
+	return best, float64(n) / float64(total)
+}
+
+// Primary subtag of a language tag, e.g. "pt" for "pt-BR"
+func primaryLanguage(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	return tag
+}
+
+// Reports whether answer is confidently in a language other than want
+func (lc LanguageCheckConfig) mismatch(want, answer string) bool {
+	got, share := detectLanguage(answer)
+	return got != "" && got != want && share >= lc.Threshold
+}
+
+// Follow-up asking the model to answer again in the expected language
+func formatLanguageRetryPrompt(lang string) string {
+	name := languageNames[lang]
+	if name == "" {
+		name = fmt.Sprintf("the language with code %q", lang)
+	}
+	return fmt.Sprintf("Your answer was not written in %s. Rewrite the complete answer, including the references section, in %s only.", name, name)
+}
+
+// Compare the language of an answer with the one asked for, or else the
+// one the message is written in. On a mismatch with Retry set, ask once
+// more and return that answer instead. Reports whether the returned answer
+// still mismatches.
+func (s *Server) checkLanguage(ctx context.Context, requested, message, endpoint string, data map[string]interface{}, resp *AzureResponse) (*AzureResponse, bool) {
+	lc := s.cfg.LanguageCheck
+	want := primaryLanguage(requested)
+	if want == "" {
+		want, _ = detectLanguage(message)
+	}
+	if want == "" {
+		return resp, false
+	}
+
+	content := resp.Choices[0].Message.Content
+	mainContent, _ := parseResponseAndReferences(content, s.headings)
+	if !lc.mismatch(want, mainContent) {
+		return resp, false
+	}
+	if !lc.Retry {
+		return resp, true
+	}
+
+	logf(ctx, "Answer is not in %q, retrying once", want)
+	retry, err := s.callAzure(ctx, endpoint, withFollowUp(data, content, formatLanguageRetryPrompt(want)))
+	if err != nil {
+		logf(ctx, "Language retry failed, keeping the first answer: %v", err)
+		return resp, true
+	}
+	retry.Usage = addUsage(resp.Usage, retry.Usage)
+	if retry.Choices[0].Message.Context == nil {
+		retry.Choices[0].Message.Context = resp.Choices[0].Message.Context
+	}
+	mainContent, _ = parseResponseAndReferences(retry.Choices[0].Message.Content, s.headings)
+	return retry, lc.mismatch(want, mainContent)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"What is the capital of France and how big is it?", "en"},
+		{"¿Cuál es la capital de Francia y cómo es la ciudad?", "es"},
+		{"Quelle est la capitale de la France et comment est la ville ?", "fr"},
+		{"Was ist die Hauptstadt von Frankreich und wie groß ist sie?", "de"},
+		{"Какая столица у Франции?", "ru"},
+		{"フランスの首都はどこですか", "ja"},
+		{"法国的首都是哪里", "zh"},
+		{"Paris", ""},
+	}
+	for _, tt := range tests {
+		if got, _ := detectLanguage(tt.text); got != tt.want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLanguageMismatchThreshold(t *testing.T) {
+	spanish := "La capital de Francia es París, que es la ciudad más grande del país."
+	if !(LanguageCheckConfig{Threshold: 0.6}).mismatch("en", spanish) {
+		t.Error("Spanish answer to an English question was not flagged")
+	}
+	if (LanguageCheckConfig{Threshold: 0.6}).mismatch("es", spanish) {
+		t.Error("Spanish answer to a Spanish question was flagged")
+	}
+	if (LanguageCheckConfig{Threshold: 1}).mismatch("en", "The answer is la capital de Francia.") {
+		t.Error("mixed answer below the threshold was flagged")
+	}
+}
+
+func TestLanguageCheckRetry(t *testing.T) {
+	answers := []string{"La capital de Francia es París y es la ciudad más grande.", "The capital of France is Paris and it is the largest city."}
+	azure := &azureStub{}
+	calls := 0
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"choices":[{"message":{"content":%q}}]}`, answers[min(calls, 1)])
+		calls++
+	}
+	cfg := defaultConfig()
+	cfg.LanguageCheck = LanguageCheckConfig{Enabled: true, Threshold: 0.6}
+	_, front := newTestServer(t, cfg, azure)
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"What is the capital of France?"}`))), &got)
+	if !got.LanguageMismatch || calls != 1 {
+		t.Fatalf("without retry: mismatch=%v calls=%d", got.LanguageMismatch, calls)
+	}
+
+	cfg.LanguageCheck.Retry = true
+	calls = 0
+	var retried ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"What is the capital of France?"}`))), &retried)
+	if retried.LanguageMismatch || calls != 2 || retried.Response != answers[1] {
+		t.Fatalf("with retry: response=%+v calls=%d", retried, calls)
+	}
+}
@@ -1,21 +1,118 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
 type ChatRequest struct {
-	Message string `json:"message"`
+	Message    string `json:"message"`
+	Model      string `json:"model,omitempty"`
+	Stream     bool   `json:"stream,omitempty"`
+	IncludeRaw bool   `json:"includeRaw,omitempty"`
+
+	// Free-form priority, e.g. "high", that routing rules can match on
+	Priority string `json:"priority,omitempty"`
+
+	// Continue a stored conversation; MaxHistoryTurns overrides how many
+	// of its most recent turns are sent to the model
+	ConversationID  string `json:"conversationId,omitempty"`
+	MaxHistoryTurns *int   `json:"maxHistoryTurns,omitempty"`
+
+	// Earlier user and assistant messages, sent after any stored turns
+	Messages []ChatMessage `json:"messages,omitempty"`
+
+	// Reference renderings to include in a blocking response, any of
+	// "strings", "structured" and "bibtex"; defaults to strings only
+	ReferenceFormats []string `json:"reference_formats,omitempty"`
+
+	// "low", "medium" or "high"; only accepted for reasoning models
+	ReasoningEffort string `json:"reasoningEffort,omitempty"`
+
+	// Named parameter preset from config, applied over the configured
+	// defaults and under the explicit overrides below
+	ParamProfile string `json:"paramProfile,omitempty"`
+
+	// Sampling overrides for this request, over every configured default
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"topP,omitempty"`
+
+	// Repetition penalties from -2 to 2; 0 disables them. Dropped for
+	// models that do not support penalties.
+	FrequencyPenalty *float64 `json:"frequencyPenalty,omitempty"`
+	PresencePenalty  *float64 `json:"presencePenalty,omitempty"`
+
+	// Renumber inline [n] markers to match the returned references and
+	// include a citationMap from marker to structured reference
+	InlineCitations bool `json:"inlineCitations,omitempty"`
+
+	// "appearance" orders and renumbers references by first inline
+	// marker; the default "model" keeps the order of the model's list
+	ReferenceOrder string `json:"referenceOrder,omitempty"`
+
+	// Semantic configuration for search ranking, from the index's allowlist
+	SemanticConfig string `json:"semanticConfig,omitempty"`
+
+	// JSON Schema the answer must match; switches Azure to json_object mode
+	// and returns the validated object as data
+	ResponseSchema json.RawMessage `json:"responseSchema,omitempty"`
+
+	// Token from a truncated answer; the request then returns the next
+	// part of that answer and its other fields are ignored
+	ContinuationToken string `json:"continuationToken,omitempty"`
+
+	// Restrict grounding to documents whose fields equal these values;
+	// fields must be on the index's filterable list
+	SearchFilters map[string]string `json:"searchFilters,omitempty"`
+
+	// Language the answer should be in, e.g. "en"; detected from the
+	// message when empty and the language check is enabled
+	Language string `json:"language,omitempty"`
+
+	// Include diagnostics such as the prompt token estimate in the response
+	Debug bool `json:"debug,omitempty"`
+
+	// Configured persona to answer as, instead of the default system prompt
+	Persona string `json:"persona,omitempty"`
+
+	// Attach the matched excerpt of each grounding citation to structured references
+	IncludeSnippets bool `json:"include_snippets,omitempty"`
+
+	// Ask the model for its sources when a grounded answer lists none,
+	// if the referenceFallback mode is followup
+	RequireReferences bool `json:"requireReferences,omitempty"`
+
+	// Ask for follow-up questions, returned as relatedQuestions
+	IncludeRelated bool `json:"include_related,omitempty"`
+
+	// Structure of the answer: prose (the default), bullets, table or
+	// markdown
+	Format string `json:"format,omitempty"`
+
+	// "before" asks for the references ahead of the answer and returns them
+	// first; the default "after" keeps them at the end
+	ReferencesPosition string `json:"referencesPosition,omitempty"`
+
+	// Documents to ground on instead of Azure Search, for callers doing
+	// their own retrieval
+	Context []Document `json:"context,omitempty"`
 }
 
 type Reference struct {
@@ -25,22 +122,125 @@ type Reference struct {
 	Year       string `json:"year,omitempty"`
 	URL        string `json:"url,omitempty"`
 	AccessDate string `json:"accessDate,omitempty"`
+
+	// Grounding excerpt and its location in the index, only filled in
+	// when the request sets include_snippets
+	Snippet  string `json:"snippet,omitempty"`
+	Filepath string `json:"filepath,omitempty"`
+	ChunkID  string `json:"chunkId,omitempty"`
+
+	// Retrieval relevance of a grounding citation, when Azure reports one
+	Score *float64 `json:"score,omitempty"`
+
+	// Search index a grounding citation was retrieved from
+	SearchIndex string `json:"searchIndex,omitempty"`
+
+	// Whether the URL answered a HEAD request, when links are checked
+	LinkOK *bool `json:"linkOk,omitempty"`
 }
 
 type EnhancedChatResponse struct {
-	Response   string      `json:"response"`
+	Response   string      `json:"response,omitempty"`
 	References []Reference `json:"references"`
 	MainPoints []string    `json:"mainPoints,omitempty"`
+	RawContent string      `json:"rawContent,omitempty"`
+
+	// Follow-up questions, when the request set include_related
+	RelatedQuestions []string `json:"relatedQuestions,omitempty"`
 }
 
 type ChatResponse struct {
+	// Envelope version of this body, as negotiated with Accept-Version
+	SchemaVersion int `json:"schemaVersion"`
+
 	Response   string   `json:"response"`
 	References []string `json:"references,omitempty"`
+	Grounded   bool     `json:"grounded"`
+	Warnings   []string `json:"warnings,omitempty"`
+	RawContent string   `json:"rawContent,omitempty"`
+
+	// Set when the model declined to answer; references are not parsed then
+	Refused       bool   `json:"refused,omitempty"`
+	RefusalReason string `json:"refusalReason,omitempty"`
+
+	// Estimated price from the reported usage, omitted for unpriced models
+	Cost *Cost `json:"cost,omitempty"`
+
+	// Azure's safety verdicts on the prompt, when Features.PromptFilterResults
+	PromptFilterResults []PromptFilterResult `json:"promptFilterResults,omitempty"`
+
+	// Set when the answer was cut to MaxResponseChars for display
+	TruncatedDisplay bool `json:"truncatedDisplay,omitempty"`
+
+	// Set when the language check found the answer in another language
+	LanguageMismatch bool `json:"languageMismatch,omitempty"`
+
+	// Follow-up questions, when the request set include_related
+	RelatedQuestions []string `json:"relatedQuestions,omitempty"`
+
+	// Set when this is the answer to an identical request sent moments
+	// earlier, returned without a new Azure call
+	Deduplicated bool `json:"deduplicated,omitempty"`
+
+	// Azure's ID for the request that produced the answer, to quote to
+	// Azure support
+	UpstreamRequestID string `json:"upstreamRequestId,omitempty"`
+
+	// Share of a grounded answer backed by its citations, from 0 to 1, and
+	// its bucket "low", "medium" or "high"; only with Groundedness.Enabled
+	GroundednessScore *float64 `json:"groundednessScore,omitempty"`
+	Groundedness      string   `json:"groundedness,omitempty"`
+
+	// Set when the answer stopped at max_tokens; send it back as
+	// continuationToken to get the rest
+	ContinuationToken string `json:"continuationToken,omitempty"`
+
+	// Marker number to reference, when the request set inlineCitations
+	CitationMap map[string]Reference `json:"citationMap,omitempty"`
+
+	// Validated answer object when the request set responseSchema
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// References dropped by the per-source cap
+	CollapsedReferences int `json:"collapsedReferences,omitempty"`
+
+	// Only present when requested through reference_formats
+	StructuredReferences []Reference `json:"structuredReferences,omitempty"`
+	BibTeX               string      `json:"bibtex,omitempty"`
+
+	// Diagnostics, only present when the request set debug
+	Debug *ChatDebug `json:"debug,omitempty"`
+
+	// Write the references ahead of the answer, see referencesPosition
+	referencesFirst bool
+}
+
+// ChatDebug describes how a request was assembled
+type ChatDebug struct {
+	// Estimated tokens of the assembled prompt, excluding grounding documents
+	PromptTokens   int    `json:"promptTokens"`
+	TokenEstimator string `json:"tokenEstimator"`
+
+	// The request fingerprint, also sent as X-Request-Fingerprint
+	Fingerprint string `json:"fingerprint"`
+
+	// The resolved system and user prompts, credentials redacted. Only
+	// for admin clients that send X-Debug-Prompt.
+	SystemPrompt string `json:"systemPrompt,omitempty"`
+	UserPrompt   string `json:"userPrompt,omitempty"`
+}
+
+type ReferencesResponse struct {
+	References          []Reference `json:"references"`
+	Grounded            bool        `json:"grounded"`
+	Warnings            []string    `json:"warnings,omitempty"`
+	CollapsedReferences int         `json:"collapsedReferences,omitempty"`
 }
 
 type ChatChoice struct {
 	Message struct {
-		Content string `json:"content"`
+		Content string               `json:"content"`
+		Context *AzureMessageContext `json:"context,omitempty"`
 	} `json:"message"`
 	Index        int    `json:"index"`
 	FinishReason string `json:"finish_reason"`
@@ -52,6 +252,34 @@ type AzureResponse struct {
 	Created int64        `json:"created"`
 	Model   string       `json:"model"`
 	Choices []ChatChoice `json:"choices"`
+	Usage   *AzureUsage  `json:"usage,omitempty"`
+
+	PromptFilterResults []AzurePromptFilterResult `json:"prompt_filter_results,omitempty"`
+
+	// From the apim-request-id or x-ms-request-id response header
+	RequestID string `json:"-"`
+}
+
+// Token counts as reported by Azure
+type AzureUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Token counts as returned to our callers
+type TokenUsage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	TotalTokens      int `json:"totalTokens"`
+}
+
+func (u AzureUsage) toTokenUsage() TokenUsage {
+	return TokenUsage{
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		TotalTokens:      u.TotalTokens,
+	}
 }
 
 // Helper function to format the prompt
@@ -67,15 +295,62 @@ Please provide a detailed response with references. Include:
 Format references using a standard academic format.`, message)
 }
 
-// Parse the response to separate content and references
-func parseResponseAndReferences(content string) (string, []string) {
-	parts := strings.Split(content, "References:")
-	if len(parts) < 2 {
+// Prompt used when the caller only wants sources, not an answer
+func formatReferencesOnlyPrompt(message string) string {
+	return fmt.Sprintf(`%s
+
+Do not answer the question. Only list the sources relevant to it as a numbered list under a "References:" heading, using a standard academic format.`, message)
+}
+
+// Section headings the model may put above its reference list
+var defaultReferenceHeadings = []string{"References", "Sources", "Bibliography"}
+
+// referenceHeadings finds the heading that opens the reference section. A
+// heading must start its line, may carry Markdown heading or bold markers,
+// and is either followed by a colon or alone on its line, so the word in
+// running prose does not split the answer.
+type referenceHeadings struct {
+	re *regexp.Regexp
+}
+
+func newReferenceHeadings(headings []string) *referenceHeadings {
+	quoted := make([]string, len(headings))
+	for i, h := range headings {
+		quoted[i] = regexp.QuoteMeta(strings.TrimSpace(h))
+	}
+	return &referenceHeadings{re: regexp.MustCompile(`(?im)^[ \t]*(?:#{1,6}[ \t]*)?(?:\*\*|__)?(?:` +
+		strings.Join(quoted, "|") + `)(?:\*\*|__)?(?::(?:\*\*|__)?|[ \t]*$)`)}
+}
+
+// Offsets of the last heading in content, or -1, -1 when there is none
+func (h *referenceHeadings) last(content string) (int, int) {
+	matches := h.re.FindAllStringIndex(content, -1)
+	if len(matches) == 0 {
+		return -1, -1
+	}
+	m := matches[len(matches)-1]
+	return m[0], m[1]
+}
+
+// Offsets of the first heading in content, or -1, -1 when there is none
+func (h *referenceHeadings) first(content string) (int, int) {
+	m := h.re.FindStringIndex(content)
+	if m == nil {
+		return -1, -1
+	}
+	return m[0], m[1]
+}
+
+// Parse the response to separate content and references, splitting at the
+// last reference heading
+func parseResponseAndReferences(content string, headings *referenceHeadings) (string, []string) {
+	start, end := headings.last(content)
+	if start < 0 {
 		return content, nil
 	}
 
-	mainContent := strings.TrimSpace(parts[0])
-	referencesText := strings.TrimSpace(parts[1])
+	mainContent := strings.TrimSpace(content[:start])
+	referencesText := strings.TrimSpace(content[end:])
 
 	// Parse references into a slice
 	var references []string
@@ -88,22 +363,169 @@ func parseResponseAndReferences(content string) (string, []string) {
 	return mainContent, references
 }
 
-func chatHandler(w http.ResponseWriter, r *http.Request) {
-	var chatRequest ChatRequest
-	err := json.NewDecoder(r.Body).Decode(&chatRequest)
+type Server struct {
+	cfg            *Config
+	client         AzureClient
+	generations    *generationRegistry
+	postProcess    postProcessChain
+	conversations  ConversationStore
+	summaries      *summaryCache
+	systemPrompt   *systemPromptTemplate
+	personas       map[string]*persona
+	headings       *referenceHeadings
+	redactor       *redactor
+	refusals       *refusalDetector
+	audit          *auditLogger
+	spend          *spendTracker
+	continuations  *continuationStore
+	tokens         TokenEstimator
+	errorTemplates errorTemplates
+	flush          flushPolicy
+
+	// Timeouts and retries of the endpoints whose models override them
+	endpointPolicies map[string]endpointPolicy
+
+	// Rolling health of every Azure endpoint called, which weighs the
+	// choice among a model's replicas
+	health *healthTracker
+
+	// Expands queries before grounded requests, nil unless QueryRewrite.Enabled
+	rewriter QueryRewriter
+
+	// Rates grounded answers, nil unless Groundedness.Enabled
+	groundedness GroundednessChecker
+
+	// System prompt of grounded requests, nil unless GroundedStrict.Enabled
+	strictPrompt *systemPromptTemplate
+
+	// Rewrites answer text, nil unless a Normalize transform is set
+	normalizer *textNormalizer
+
+	// Recent blocking requests by content, nil unless Dedup.Window is set
+	dedup *dedupCache
+
+	// Sources per grounded query, nil unless Features.CachedReferences
+	referenceCache *referenceCache
+
+	// Request latency per route, served on /metrics
+	metrics *latencyMetrics
+
+	// SSE responses in flight, drained on shutdown
+	streams *streamTracker
+
+	// Cleared until the startup warm-up succeeds when it is required
+	ready atomic.Bool
+}
+
+func NewServer(cfg *Config) (*Server, error) {
+	postProcess, err := newPostProcessChain(cfg.PostProcessors)
 	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+		return nil, err
+	}
+	systemPrompt, err := newSystemPromptTemplate(cfg.SystemPrompt, cfg.PromptContext)
+	if err != nil {
+		return nil, err
 	}
+	personas, err := newPersonas(cfg.Personas, cfg.PromptContext)
+	if err != nil {
+		return nil, err
+	}
+	errorTemplates, err := newErrorTemplates(cfg.ErrorTemplates)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newTokenEstimator(cfg.TokenEstimator)
+	if err != nil {
+		return nil, err
+	}
+	redactor, err := newRedactor(cfg.Redaction)
+	if err != nil {
+		return nil, err
+	}
+	refusals, err := newRefusalDetector(cfg.RefusalPatterns)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := newAuditLogger(cfg.Audit)
+	if err != nil {
+		return nil, err
+	}
+	flush, err := parseFlushPolicy(cfg.StreamFlush)
+	if err != nil {
+		return nil, err
+	}
+	endpointPolicies, err := cfg.endpointPolicies()
+	if err != nil {
+		return nil, err
+	}
+	normalizer, err := newTextNormalizer(cfg.Normalize)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		cfg:            cfg,
+		client:         newAzureClient(cfg.Recorder),
+		generations:    newGenerationRegistry(cfg.StreamBufferEvents, cfg.StreamResumeGrace, cfg.MaxConcurrentStreams),
+		postProcess:    postProcess,
+		conversations:  newMemoryConversationStore(cfg.ConversationMaxEntries, cfg.ConversationMaxBytes, cfg.ConversationTTL),
+		summaries:      newSummaryCache(cfg.ConversationMaxEntries),
+		metrics:        newLatencyMetrics(),
+		systemPrompt:   systemPrompt,
+		personas:       personas,
+		headings:       newReferenceHeadings(cfg.ReferenceHeadings),
+		redactor:       redactor,
+		refusals:       refusals,
+		audit:          audit,
+		spend:          newSpendTracker(cfg.Currency),
+		tokens:         tokens,
+		errorTemplates: errorTemplates,
+		flush:          flush,
+		continuations:  newContinuationStore(cfg.Continuation.Entries, cfg.Continuation.TTL),
+		streams:        newStreamTracker(),
 
-	apiKey := os.Getenv("AZURE_API_KEY")
-	endpoint := os.Getenv("AZURE_ENDPOINT")
+		endpointPolicies: endpointPolicies,
+		health:           newHealthTracker(cfg.EndpointHealth),
+		normalizer:       normalizer,
+	}
+	if name, _, ok := cfg.modelFor(cfg.ConversationSummary.Model); !ok {
+		return nil, fmt.Errorf("conversation summary model %q is not configured", name)
+	}
+	if cfg.QueryRewrite.Enabled {
+		rewriter, err := newModelRewriter(s, cfg.QueryRewrite)
+		if err != nil {
+			return nil, err
+		}
+		s.rewriter = rewriter
+	}
+	if cfg.Dedup.Window > 0 {
+		s.dedup = newDedupCache(cfg.Dedup)
+	}
+	if cfg.GroundedStrict.Enabled {
+		strictPrompt, err := newSystemPromptTemplate(cfg.GroundedStrict.SystemPrompt, cfg.PromptContext)
+		if err != nil {
+			return nil, fmt.Errorf("grounded strict mode: %w", err)
+		}
+		s.strictPrompt = strictPrompt
+	}
+	if cfg.Groundedness.Enabled {
+		s.groundedness = citationChecker{}
+		if cfg.Groundedness.Model != "" {
+			checker, err := newModelChecker(s, cfg.Groundedness)
+			if err != nil {
+				return nil, err
+			}
+			s.groundedness = checker
+		}
+	}
+	if cfg.Features.CachedReferences {
+		s.referenceCache = newReferenceCache(cfg.ReferenceCacheEntries, cfg.ReferenceCacheTTL)
+	}
+	s.ready.Store(!(cfg.Warmup.OnStart && cfg.Warmup.Required))
+	return s, nil
+}
 
-	data := map[string]interface{}{
-		"messages": []map[string]interface{}{
-			{
-				"role": "system",
-				"content": `You are a helpful assistant that provides detailed, accurate information with references.
+// Default system prompt template, see PromptContext for the placeholders
+const defaultSystemPrompt = `You are a helpful assistant that provides detailed, accurate information with references.
             When providing information:
             1. Include relevant citations and sources
             2. Use a consistent citation format
@@ -112,92 +534,674 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
             5. Format your response as follows:
                 - Main answer
                 - Supporting details
-                - References (numbered list)`,
-			},
-			{
-				"role":    "user",
-				"content": formatPromptWithReferenceRequest(chatRequest.Message),
-			},
+                - References (numbered list)
+            Today's date is {{.Date}}. Use it for access dates and when judging how recent information is.`
+
+// Build the Azure OpenAI request body for a user prompt grounded on the given search index
+func buildChatPayload(system, prompt string, history []map[string]interface{}, search SearchConfig, params GenerationParams, model ModelConfig) map[string]interface{} {
+	messages := []map[string]interface{}{
+		{
+			"role":    "system",
+			"content": system,
 		},
+	}
+	messages = append(messages, history...)
+	messages = append(messages, map[string]interface{}{
+		"role":    "user",
+		"content": prompt,
+	})
+
+	data := map[string]interface{}{
+		"messages": messages,
 		"data_sources": []map[string]interface{}{ // Changed from extra_body to dataSources
 			{
 				"type": "azure_search",
 				"parameters": map[string]interface{}{
-					"endpoint":               os.Getenv("AZURE_SEARCH_ENDPOINT"),
-					"key":                    os.Getenv("AZURE_SEARCH_KEY"),
-					"index_name":             os.Getenv("AZURE_SEARCH_INDEX"),
+					"endpoint":               search.Endpoint,
+					"key":                    search.Key,
+					"index_name":             search.Index,
 					"query_type":             "simple",
-					"semantic_configuration": "default",
+					"semantic_configuration": search.SemanticConfig,
 					"role_information":       "You are an AI assistant that helps people with questions using the provided documentation.",
-					"filter":                 nil,
+					"filter":                 searchFilter(search.Filter),
 					"strictness":             3,
 					"authentication": map[string]interface{}{
 						"type": "api_key",
-						"key":  os.Getenv("AZURE_SEARCH_KEY"),
+						"key":  search.Key,
 					},
 				},
 			},
 		},
-		"max_tokens":        2000,
-		"temperature":       0.9,
-		"top_p":             0.95,
-		"frequency_penalty": 0.5,
-		"presence_penalty":  0.5,
+	}
+	applyParams(data, params, model)
+	return data
+}
+
+// The data source filter parameter, null when there is no filter
+func searchFilter(filter string) interface{} {
+	if filter == "" {
+		return nil
+	}
+	return filter
+}
+
+// POST /api/chat answers with JSON, or with server-sent events when the
+// request sets "stream": true
+func (s *Server) chatHandler(w http.ResponseWriter, r *http.Request) {
+	s.chat(w, r, false)
+}
+
+// POST /api/chat/stream always answers with server-sent events, whatever
+// the request's "stream" field says
+func (s *Server) chatStreamHandler(w http.ResponseWriter, r *http.Request) {
+	s.chat(w, r, true)
+}
+
+// Shared implementation of the chat routes
+func (s *Server) chat(w http.ResponseWriter, r *http.Request, alwaysStream bool) {
+	version, err := responseVersion(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusNotAcceptable, "unsupported_version", err.Error(), nil)
+		return
 	}
 
-	jsonData, err := json.Marshal(data)
+	var chatRequest ChatRequest
+	decoder := json.NewDecoder(r.Body)
+	if s.cfg.Features.StrictDecoding {
+		decoder.DisallowUnknownFields()
+	}
+	err = decoder.Decode(&chatRequest)
 	if err != nil {
-		http.Error(w, "Failed to marshal request data", http.StatusInternalServerError)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if chatRequest.ContinuationToken != "" {
+		if alwaysStream || chatRequest.Stream {
+			http.Error(w, "continuationToken is only supported on blocking requests", http.StatusBadRequest)
+			return
+		}
+		s.continueChat(w, r, chatRequest, version)
+		return
+	}
+
+	client := clientFromContext(r.Context())
+	routed := s.cfg.routeModel(client, chatRequest)
+	if routed != chatRequest.Model {
+		logf(r.Context(), "Routing rules sent the request to model %q", routed)
+	}
+	modelName, model, ok := s.cfg.modelFor(routed)
+	if !ok {
+		http.Error(w, "Unknown model", http.StatusBadRequest)
 		return
 	}
+	if !s.cfg.modelAllowed(client, modelName) {
+		s.writeError(w, r, http.StatusForbidden, "model_not_allowed", fmt.Sprintf("This API key may not use model %q", modelName), nil)
+		return
+	}
+	endpoints, wait := s.health.available(model.endpoints())
+	if len(endpoints) == 0 {
+		logf(r.Context(), "Every endpoint of model %q is circuit-open, failing fast: %s", modelName, strings.Join(model.endpoints(), ", "))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		s.writeError(w, r, http.StatusServiceUnavailable, "all_upstreams_unavailable", "Every upstream endpoint for this model is unavailable, retry later", nil)
+		return
+	}
+	if len(model.Replicas) > 0 {
+		model.Endpoint = s.health.pick(endpoints)
+		debugf(r.Context(), s.cfg.DebugLogging, "Sending model %q to %s", modelName, model.Endpoint)
+	}
 
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
+	persona, ok := s.personaFor(chatRequest.Persona)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown persona %q", chatRequest.Persona), http.StatusBadRequest)
+		return
+	}
+	grounding := persona.groundingEnabled(s.cfg.Features.Grounding)
+	footer := s.footerFor(client, persona)
+
+	formats, err := parseReferenceFormats(chatRequest.ReferenceFormats)
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if o := chatRequest.ReferenceOrder; o != "" && o != "model" && o != "appearance" {
+		http.Error(w, "referenceOrder must be model or appearance", http.StatusBadRequest)
+		return
+	}
+	if !validAnswerFormat(chatRequest.Format) {
+		http.Error(w, "format must be prose, bullets, table or markdown", http.StatusBadRequest)
+		return
+	}
+	if !validReferencesPosition(chatRequest.ReferencesPosition) {
+		http.Error(w, "referencesPosition must be before or after", http.StatusBadRequest)
+		return
+	}
+	referencesFirst := chatRequest.ReferencesPosition == referencesBefore
+	documents := chatRequest.Context
+	if len(documents) > 0 && !s.limitContextDocuments(w, r, documents) {
+		return
+	}
+
+	if chatRequest.ReasoningEffort != "" {
+		if !validReasoningEffort(chatRequest.ReasoningEffort) {
+			http.Error(w, "reasoningEffort must be low, medium or high", http.StatusBadRequest)
+			return
+		}
+		if !model.Reasoning {
+			http.Error(w, "reasoningEffort is only supported for reasoning models", http.StatusBadRequest)
+			return
+		}
+	}
+
+	requestOverrides := ParamOverrides{
+		Temperature:      chatRequest.Temperature,
+		TopP:             chatRequest.TopP,
+		FrequencyPenalty: chatRequest.FrequencyPenalty,
+		PresencePenalty:  chatRequest.PresencePenalty,
+	}
+	if err := requestOverrides.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("api-key", apiKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	var schema *jsonSchema
+	if len(chatRequest.ResponseSchema) > 0 {
+		if schema, err = compileSchema(chatRequest.ResponseSchema); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	search := s.cfg.searchConfigFor(client)
+	semantic, ok := search.selectSemanticConfig(chatRequest.SemanticConfig)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown semanticConfig %q", chatRequest.SemanticConfig), http.StatusBadRequest)
+		return
+	}
+	search.SemanticConfig = semantic
+	if search.Filter, err = search.compileFilter(chatRequest.SearchFilters); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	overrides := s.cfg.paramOverridesFor(client, model)
+	if persona != nil {
+		overrides = overrides.merge(persona.defaults)
+	}
+	if chatRequest.ParamProfile != "" {
+		profile, ok := s.cfg.ParamProfiles[chatRequest.ParamProfile]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown paramProfile %q", chatRequest.ParamProfile), http.StatusBadRequest)
+			return
+		}
+		overrides = overrides.merge(profile)
+	}
+	overrides = overrides.merge(requestOverrides)
+	params := defaultParams.with(overrides)
+	logf(r.Context(), "Resolved temperature %v, top_p %v, penalties %v/%v for client %q", params.Temperature, params.TopP, params.FrequencyPenalty, params.PresencePenalty, clientName(r.Context()))
+	referencesOnly := r.URL.Query().Get("references_only") == "true"
+	if alwaysStream {
+		if referencesOnly {
+			http.Error(w, "references_only is not available on the streaming route", http.StatusBadRequest)
+			return
+		}
+		chatRequest.Stream = true
+	}
+	if schema != nil && (chatRequest.Stream || referencesOnly) {
+		http.Error(w, "responseSchema cannot be combined with streaming or references_only", http.StatusBadRequest)
+		return
+	}
+
+	debugPrompt := debugPromptAllowed(r)
+	fingerprint := requestFingerprint(fingerprintCaller(r), debugPrompt, version, modelName, chatRequest)
+	w.Header().Set(fingerprintHeader, fingerprint)
+	respond := func(resp ChatResponse) { writeChatResponse(w, r, resp, version) }
+	if s.dedup != nil && !chatRequest.Stream && !referencesOnly {
+		entry, leader := s.dedup.begin(fingerprint)
+		if !leader {
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.resp != nil {
+				logf(r.Context(), "Answering a repeated request with the earlier answer")
+				resp := *entry.resp
+				resp.Deduplicated = true
+				resp.Cost = nil
+				respond(resp)
+				return
+			}
+			// The first request failed; answer this one afresh
+		} else if entry != nil {
+			var answered *ChatResponse
+			defer func() { s.dedup.finish(fingerprint, entry, answered) }()
+			respond = func(resp ChatResponse) {
+				answered = &resp
+				writeChatResponse(w, r, resp, version)
+			}
+		}
+	}
+	if referencesOnly && !grounding {
+		http.Error(w, "references_only requires search grounding, which is disabled", http.StatusBadRequest)
+		return
+	}
+	// Reasoning models spend completion tokens on hidden reasoning, so a
+	// small budget can leave no visible output; keep their normal limit.
+	if referencesOnly && !model.Reasoning {
+		params.MaxTokens = s.cfg.ReferencesOnlyMaxTokens
+	}
+
+	var history []Turn
+	if chatRequest.ConversationID != "" {
+		turns := s.cfg.HistoryTurns
+		if chatRequest.MaxHistoryTurns != nil {
+			turns = *chatRequest.MaxHistoryTurns
+			if turns < 0 || turns > s.cfg.MaxHistoryTurns {
+				http.Error(w, fmt.Sprintf("maxHistoryTurns must be between 0 and %d", s.cfg.MaxHistoryTurns), http.StatusBadRequest)
+				return
+			}
+		}
+		stored, err := s.conversations.Load(clientName(r.Context()), chatRequest.ConversationID)
+		if errors.Is(err, errConversationOwner) {
+			http.Error(w, "Unknown conversation", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logf(r.Context(), "Failed to load conversation: %v", err)
+			http.Error(w, "Failed to load conversation", http.StatusInternalServerError)
+			return
+		}
+		history = historyWindow(stored, turns)
+	}
+	clientMessages, dropped, err := s.cfg.MessageRoles.sanitize(chatRequest.Messages)
 	if err != nil {
-		http.Error(w, "Failed to send request to Azure OpenAI", http.StatusInternalServerError)
+		s.writeError(w, r, http.StatusBadRequest, "invalid_role", err.Error(), nil)
 		return
 	}
-	defer resp.Body.Close()
+	if dropped > 0 {
+		logf(r.Context(), "Dropped %d client messages with disallowed roles", dropped)
+	}
+	prior := capHistoryMessages(append(historyMessages(history), clientMessages...), s.cfg.MessageRoles.MaxMessages)
 
-	body, err := ioutil.ReadAll(resp.Body)
+	systemPrompt := s.systemPrompt
+	if persona != nil {
+		systemPrompt = persona.systemPrompt
+	}
+	strict := grounding && s.strictPrompt != nil
+	if strict {
+		systemPrompt = s.strictPrompt
+	}
+	system, err := systemPrompt.render(time.Now())
 	if err != nil {
-		http.Error(w, "Failed to read response from Azure OpenAI", http.StatusInternalServerError)
+		logf(r.Context(), "%v", err)
+		http.Error(w, "Failed to build system prompt", http.StatusInternalServerError)
+		return
+	}
+	if instruction := search.sourceInstruction(); grounding && instruction != "" {
+		system += "\n\n" + instruction
+	}
+
+	prompt := formatPromptWithReferenceRequest(chatRequest.Message)
+	if referencesOnly {
+		prompt = formatReferencesOnlyPrompt(chatRequest.Message)
+	}
+	if schema != nil {
+		prompt = formatSchemaPrompt(chatRequest.Message, chatRequest.ResponseSchema)
+	}
+	if schema == nil && !referencesOnly {
+		prompt = formatAnswerFormatPrompt(prompt, chatRequest.Format)
+		if chatRequest.IncludeRelated {
+			prompt = formatRelatedQuestionsPrompt(prompt)
+		}
+		if referencesFirst {
+			prompt = formatReferencesFirstPrompt(prompt)
+		}
+	}
+	if len(documents) > 0 {
+		prompt = formatContextDocumentsPrompt(prompt, documents)
+	} else if grounding && schema == nil {
+		if query := s.rewriteQuery(r.Context(), chatRequest.Message); query != "" {
+			prompt = formatSearchQueryHint(prompt, query)
+		}
+	}
+	prompt = s.cfg.PromptGuardrails.wrap(prompt)
+	debugf(r.Context(), s.cfg.DebugLogging, "User prompt: %s", prompt)
+
+	data := buildChatPayload(system, prompt, prior, search, params, model)
+	if !grounding || len(documents) > 0 {
+		delete(data, "data_sources")
+	}
+	if strict {
+		s.cfg.GroundedStrict.apply(data)
+	}
+	if !s.limitDataSources(w, r, data) {
+		return
+	}
+	if chatRequest.ReasoningEffort != "" {
+		data["reasoning_effort"] = chatRequest.ReasoningEffort
+	}
+	if schema != nil {
+		data["response_format"] = map[string]interface{}{"type": "json_object"}
+	}
+
+	if !s.fitPromptBudget(w, r, data, len(prior)) {
 		return
 	}
+	promptTokens := estimateMessagesTokens(s.tokens, data["messages"].([]map[string]interface{}))
+	if model.ContextWindow > 0 && overrides.MaxTokens == nil && !(referencesOnly && !model.Reasoning) {
+		maxTokens, ok := autoMaxTokens(model.ContextWindow, promptTokens, s.cfg.ContextSafetyMargin, s.cfg.MaxTokensCeiling)
+		if !ok {
+			s.writeError(w, r, http.StatusBadRequest, "context_window_exceeded", "The prompt leaves no room for a completion in the model's context window", map[string]interface{}{
+				"model":         modelName,
+				"promptTokens":  promptTokens,
+				"contextWindow": model.ContextWindow,
+			})
+			return
+		}
+		logf(r.Context(), "Sized max_tokens to %d for %d prompt tokens in a %d token window", maxTokens, promptTokens, model.ContextWindow)
+		params.MaxTokens = maxTokens
+		applyParams(data, params, model)
+	}
+
+	if ceiling := s.cfg.costCeilingFor(client); ceiling > 0 {
+		estimate := estimateMaxCost(model, promptTokens, params.MaxTokens)
+		if estimate > ceiling {
+			s.writeError(w, r, http.StatusPaymentRequired, "cost_limit_exceeded", "Estimated request cost exceeds the allowed budget", map[string]interface{}{
+				"model":         modelName,
+				"promptTokens":  promptTokens,
+				"maxTokens":     params.MaxTokens,
+				"estimatedCost": estimate,
+				"limit":         ceiling,
+			})
+			return
+		}
+	}
 
-	log.Printf("Raw response from Azure: %s", string(body))
+	referenceKey := referenceCacheKey(search, chatRequest.Message)
 
-	var azureResponse AzureResponse
-	err = json.Unmarshal(body, &azureResponse)
+	// Audit an answer, remember its sources, and for normal chat turns
+	// store it in the conversation
+	finishTurn := func(res turnResult) {
+		s.audit.record(r.Context(), modelName, chatRequest.Message, res.Content, res.Usage)
+		s.spend.add(clientName(r.Context()), modelName, requestCost(model, res.Usage, s.cfg.Currency))
+		if s.referenceCache != nil && res.Grounded && len(documents) == 0 {
+			s.referenceCache.put(referenceKey, res.References)
+		}
+		if referencesOnly || chatRequest.ConversationID == "" {
+			return
+		}
+		turn := Turn{User: chatRequest.Message, Assistant: res.Content, At: time.Now()}
+		if err := s.conversations.Append(clientName(r.Context()), chatRequest.ConversationID, turn); err != nil {
+			logf(r.Context(), "Failed to save conversation turn: %v", err)
+		}
+		s.summaries.invalidate(clientName(r.Context()), chatRequest.ConversationID)
+	}
+
+	if chatRequest.Stream && !referencesOnly {
+		var cached []Reference
+		if s.referenceCache != nil && data["data_sources"] != nil {
+			cached, _ = s.referenceCache.get(referenceKey)
+		}
+		opts := streamOptions{related: chatRequest.IncludeRelated, referencesFirst: referencesFirst, footer: footer}
+		if len(documents) > 0 {
+			opts.documentCitations = contextDocumentCitations(documents)
+		}
+		s.streamChat(w, r, modelName, model.Endpoint, data, search, cached, opts, finishTurn)
+		return
+	}
+
+	// One deadline covers the search fallback retry too, so the response is
+	// always written before the server's WriteTimeout closes the connection
+	ctx, cancel := context.WithTimeout(r.Context(), s.policyFor(model.Endpoint).timeout)
+	defer cancel()
+
+	var azureResponse *AzureResponse
+	grounded, warnings, err := s.withSearchFallback(ctx, data, func() error {
+		var err error
+		azureResponse, err = s.callAzure(ctx, model.Endpoint, data)
+		return err
+	})
 	if err != nil {
-		log.Printf("Unmarshal error: %v", err)
-		http.Error(w, "Failed to unmarshal response data", http.StatusInternalServerError)
+		ue := err.(*upstreamError)
+		logf(r.Context(), "Azure request failed: %v", ue)
+		s.writeUpstreamError(w, r, ue)
+		return
+	}
+	if schema == nil && s.cfg.Continuation.AutoContinue {
+		azureResponse = s.autoContinue(ctx, model.Endpoint, data, azureResponse)
+	}
+	languageMismatch := false
+	if schema == nil && !referencesOnly && s.cfg.LanguageCheck.Enabled {
+		azureResponse, languageMismatch = s.checkLanguage(ctx, chatRequest.Language, chatRequest.Message, model.Endpoint, data, azureResponse)
+	}
+
+	choice := &azureResponse.Choices[0]
+	if choice.Message.Context != nil {
+		search.labelCitations(choice.Message.Context.Citations)
+	}
+	search.filterMessageCitations(r.Context(), &choice.Message.Content, choice.Message.Context)
+	if len(documents) > 0 {
+		grounded = true
+		choice.Message.Context = &AzureMessageContext{Citations: contextDocumentCitations(documents)}
+	}
+	message := choice.Message
+	if schema != nil {
+		// Validate what the caller will see, so redact before checking
+		content := s.redactor.redact(message.Content)
+		parsed, violations := schema.validateContent(content)
+		if len(violations) > 0 {
+			logf(r.Context(), "Response failed schema validation, retrying once: %v", violations)
+			data["messages"] = append(data["messages"].([]map[string]interface{}),
+				map[string]interface{}{"role": "assistant", "content": message.Content},
+				map[string]interface{}{"role": "user", "content": formatSchemaRetryPrompt(violations)},
+			)
+			retry, err := s.callAzure(ctx, model.Endpoint, data)
+			if err != nil {
+				ue := err.(*upstreamError)
+				logf(r.Context(), "Azure schema retry failed: %v", ue)
+				s.writeUpstreamError(w, r, ue)
+				return
+			}
+			azureResponse = retry
+			content = s.redactor.redact(retry.Choices[0].Message.Content)
+			parsed, violations = schema.validateContent(content)
+		}
+		if len(violations) > 0 {
+			s.writeError(w, r, http.StatusUnprocessableEntity, "schema_violation", "The model's answer does not match responseSchema", map[string]interface{}{
+				"violations": violations,
+			})
+			return
+		}
+		finishTurn(turnResult{Content: content, Usage: azureResponse.Usage})
+		respond(ChatResponse{
+			Response: content,
+			Data:     parsed,
+			Grounded: grounded,
+			Warnings: warnings,
+			Cost:     requestCost(model, azureResponse.Usage, s.cfg.Currency),
+
+			UpstreamRequestID: azureResponse.RequestID,
+		})
 		return
 	}
 
-	if len(azureResponse.Choices) == 0 {
-		http.Error(w, "No response choices returned", http.StatusInternalServerError)
+	if strict && grounded && !referencesOnly && strictNotFound(message.Context) {
+		logf(r.Context(), "No document cited in strict grounding mode, answering not found")
+		notFound := s.cfg.GroundedStrict.NotFoundMessage
+		finishTurn(turnResult{Content: notFound, Usage: azureResponse.Usage})
+		respond(ChatResponse{
+			Response: withFooter(notFound, footer),
+			Warnings: warnings,
+			Cost:     requestCost(model, azureResponse.Usage, s.cfg.Currency),
+
+			UpstreamRequestID: azureResponse.RequestID,
+		})
 		return
 	}
 
-	responseContent := azureResponse.Choices[0].Message.Content
-	mainContent, references := parseResponseAndReferences(responseContent)
+	responseContent := message.Content
+	if referencesFirst {
+		responseContent = moveLeadingReferences(responseContent, s.headings)
+	}
+	refused, refusalReason := s.refusals.detect(responseContent, azureResponse.Choices[0].FinishReason)
+	mainContent, references, related := responseContent, []string(nil), []string(nil)
+	if !refused {
+		if chatRequest.IncludeRelated {
+			mainContent, related = splitRelatedQuestions(mainContent, s.headings)
+		}
+		mainContent, references = parseResponseAndReferences(mainContent, s.headings)
+		if len(references) == 0 && grounded && !referencesOnly {
+			references = s.fallbackReferences(ctx, chatRequest.RequireReferences, model.Endpoint, data, azureResponse)
+		}
+	}
+	mainContent = withFooter(s.normalizer.normalize(s.redactor.redact(s.postProcess.apply(mainContent))), footer)
+	result := turnResult{Content: responseContent, Usage: azureResponse.Usage, Grounded: grounded}
+	if !refused {
+		result.References = extractReferences(message.Context, references, 0)
+	}
+	finishTurn(result)
+
+	snippetChars := 0
+	if chatRequest.IncludeSnippets {
+		snippetChars = s.cfg.SnippetMaxChars
+	}
+	perSource := s.cfg.MaxReferencesPerSource
+	references, collapsed := capReferenceLinesPerSource(references, perSource)
+	if referencesOnly {
+		extracted := s.limitReferenceFields(extractReferences(message.Context, references, snippetChars))
+		if s.cfg.SortReferencesByScore {
+			sortReferencesByScore(extracted)
+		}
+		structured, n := capReferencesPerSource(extracted, perSource)
+		writeJSON(w, r, ReferencesResponse{
+			References:          structured,
+			Grounded:            grounded,
+			Warnings:            warnings,
+			CollapsedReferences: collapsed + n,
+		})
+		return
+	}
 
 	chatResponse := ChatResponse{
-		Response:   mainContent,
-		References: references,
+		Response:            mainContent,
+		Grounded:            grounded,
+		Warnings:            warnings,
+		CollapsedReferences: collapsed,
+		Refused:             refused,
+		RefusalReason:       refusalReason,
+		LanguageMismatch:    languageMismatch,
+		RelatedQuestions:    related,
+		Cost:                requestCost(model, azureResponse.Usage, s.cfg.Currency),
+		UpstreamRequestID:   azureResponse.RequestID,
+		referencesFirst:     referencesFirst,
+	}
+	if formats.strings {
+		chatResponse.References = references
+	}
+	if grounded && !refused {
+		if score := s.rateGroundedness(ctx, mainContent, message.Context); score != nil {
+			chatResponse.GroundednessScore = score
+			chatResponse.Groundedness = groundednessLevel(*score)
+		}
+	}
+	if !refused && azureResponse.Choices[0].FinishReason == "length" {
+		chatResponse.ContinuationToken = s.continuations.put(continuation{
+			client:   clientName(r.Context()),
+			model:    modelName,
+			endpoint: model.Endpoint,
+			data:     data,
+			partial:  responseContent,
+			grounded: grounded,
+		})
+	}
+	// Without inline markers there is no appearance order, so the model's
+	// order and numbering stand
+	byAppearance := chatRequest.ReferenceOrder == "appearance" && inlineMarkerRegex.MatchString(chatResponse.Response)
+	var ordered []citationSource // set when references were renumbered
+	if (chatRequest.InlineCitations || byAppearance) && !refused {
+		content, sources := renumberCitations(chatResponse.Response, citationSources(message.Context, references))
+		aligned, citationMap := citationOutput(sources)
+		chatResponse.Response = content
+		if chatRequest.InlineCitations {
+			chatResponse.CitationMap = citationMap
+		}
+		if formats.strings {
+			chatResponse.References = aligned
+		}
+		ordered = sources
+	}
+	// Cut after renumbering so the markers that remain match the references
+	chatResponse.Response, chatResponse.TruncatedDisplay = truncateResponse(chatResponse.Response, s.cfg.MaxResponseChars)
+	if formats.structured || formats.bibtex {
+		extracted := s.limitReferenceFields(extractReferences(message.Context, references, snippetChars))
+		if ordered != nil {
+			extracted = reorderReferences(extracted, ordered)
+		} else if s.cfg.SortReferencesByScore {
+			sortReferencesByScore(extracted)
+		}
+		structured, n := capReferencesPerSource(extracted, perSource)
+		chatResponse.CollapsedReferences += n
+		if formats.structured {
+			chatResponse.StructuredReferences = structured
+		}
+		if formats.bibtex {
+			chatResponse.BibTeX = formatBibTeX(structured)
+		}
+	}
+	if chatRequest.IncludeRaw {
+		chatResponse.RawContent = s.redactor.redact(responseContent)
+	}
+	if s.cfg.Features.PromptFilterResults {
+		chatResponse.PromptFilterResults = promptFilterResults(azureResponse.PromptFilterResults)
+	}
+	if chatRequest.Debug || debugPrompt {
+		chatResponse.Debug = &ChatDebug{PromptTokens: promptTokens, TokenEstimator: s.tokens.Name(), Fingerprint: fingerprint}
+	}
+	if debugPrompt {
+		chatResponse.Debug.SystemPrompt = s.redactPrompt(system)
+		chatResponse.Debug.UserPrompt = s.redactPrompt(prompt)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(chatResponse)
+	respond(chatResponse)
+}
+
+// Middleware every route runs, outermost first: the correlation ID and
+// client IP, so every log line below carries them, including a recovered
+// panic's; recovery; the request log; and latency metrics
+func (s *Server) baseMiddleware() Middleware {
+	return Chain(correlationMiddleware, clientIPMiddleware(s.cfg.Server.TrustedProxies), recoveryMiddleware, requestLogMiddleware, s.metrics.middleware)
+}
+
+// Build the router with every route and middleware the server exposes.
+//
+// Routes add per-route authentication and request checks such as the JSON
+// Content-Type inside the base middleware, then the handler. Routes pick
+// the stack they need, so probes skip authentication. CORS and rate
+// limiting are not implemented; CORS would go between the request log and
+// authentication so preflight requests never need a key, and rate limiting
+// after authentication so it can key on the client.
+func (s *Server) routes() *mux.Router {
+	base := s.baseMiddleware()
+	client := Chain(base, s.clientAuth)
+	admin := Chain(base, s.adminAuth)
+	chat := Chain(client, s.requireJSON)
+
+	r := mux.NewRouter()
+	r.Handle("/api/chat", chat(http.HandlerFunc(s.chatHandler))).Methods("POST")
+	r.Handle("/api/chat/stream", chat(http.HandlerFunc(s.chatStreamHandler))).Methods("POST")
+	r.Handle("/api/chat/stream/{id}", client(http.HandlerFunc(s.resumeStreamHandler))).Methods("GET")
+	r.Handle("/api/conversations/{id}", client(http.HandlerFunc(s.deleteConversationHandler))).Methods("DELETE")
+	r.Handle("/api/conversations/{id}/summary", client(http.HandlerFunc(s.conversationSummaryHandler))).Methods("GET")
+	r.Handle("/readyz", base(http.HandlerFunc(s.readyHandler))).Methods("GET")
+	r.Handle("/metrics", base(http.HandlerFunc(s.metricsHandler))).Methods("GET")
+	r.Handle("/admin/features", admin(http.HandlerFunc(s.featuresHandler))).Methods("GET")
+	r.Handle("/admin/conversations/stats", admin(http.HandlerFunc(s.conversationStatsHandler))).Methods("GET")
+	r.Handle("/admin/endpoints/health", admin(http.HandlerFunc(s.endpointHealthHandler))).Methods("GET")
+	r.Handle("/admin/streams", admin(http.HandlerFunc(s.streamStatsHandler))).Methods("GET")
+	r.Handle("/admin/spend", admin(http.HandlerFunc(s.spendHandler))).Methods("GET")
+	r.Handle("/admin/generations", admin(http.HandlerFunc(s.generationsHandler))).Methods("GET")
+	r.Handle("/admin/generations/{id}/cancel", admin(http.HandlerFunc(s.cancelGenerationHandler))).Methods("POST")
+	return r
 }
 
 func main() {
@@ -205,10 +1209,68 @@ func main() {
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
+	if selfTestRequested(os.Args[1:]) {
+		os.Exit(selfTest(context.Background(), os.Stdout))
+	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/api/chat", chatHandler).Methods("POST")
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		log.Fatalf("Error creating server: %v", err)
+	}
+	log.Printf("Features: %+v", cfg.Features)
+	if cfg.Warmup.OnStart {
+		go srv.runWarmup(context.Background())
+	}
 
-	log.Println("Server started at :8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	r := srv.routes()
+
+	// WriteTimeout bounds how long a handler may spend writing its response,
+	// which protects against slow readers but would cut off long SSE streams.
+	// streamChat lifts the write deadline for its own connection, so the
+	// timeout only applies to blocking routes. Blocking chat requests give
+	// Azure at most AZURE_TIMEOUT_BLOCKING, which loadConfig keeps below
+	// WriteTimeout, so a slow completion ends in a 504 rather than a
+	// silently dropped response.
+	server := &http.Server{
+		Addr:              cfg.Server.Addr,
+		Handler:           r,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		TLSConfig:         &tls.Config{MinVersion: cfg.Server.TLSMinVersion},
+	}
+
+	// Shutdown does not interrupt active connections, so streams are
+	// drained separately or they would hold it open until the timeout
+	server.RegisterOnShutdown(func() { srv.streams.drain(cfg.Server.StreamShutdownGrace) })
+
+	go func() {
+		log.Printf("Server started at %s", cfg.Server.Addr)
+		var err error
+		if cfg.Server.TLSCertFile != "" && cfg.Server.TLSKeyFile != "" {
+			err = server.ListenAndServeTLS(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Printf("Shutting down, draining requests for up to %s", cfg.Server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown did not complete: %v", err)
+	}
+	srv.audit.Close()
 }
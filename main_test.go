@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// azureStub records the payloads sent to it and replies with a canned
+// response, streaming it as SSE deltas when the payload asks for a stream.
+type azureStub struct {
+	mu       sync.Mutex
+	payloads []map[string]interface{}
+	headers  []http.Header
+
+	content string
+	deltas  []string
+	handler http.HandlerFunc // overrides the canned reply when set
+}
+
+func (a *azureStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&payload)
+	a.mu.Lock()
+	a.payloads = append(a.payloads, payload)
+	a.headers = append(a.headers, r.Header.Clone())
+	a.mu.Unlock()
+
+	if a.handler != nil {
+		a.handler(w, r)
+		return
+	}
+
+	if payload["stream"] == true {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, d := range a.deltas {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", d)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"choices": []map[string]interface{}{
+			{"message": map[string]interface{}{"content": a.content}},
+		},
+	})
+}
+
+// Payload of the nth request Azure received
+func (a *azureStub) payload(t *testing.T, n int) map[string]interface{} {
+	t.Helper()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n >= len(a.payloads) {
+		t.Fatalf("azure received %d requests, want at least %d", len(a.payloads), n+1)
+	}
+	return a.payloads[n]
+}
+
+// Start a Server pointed at the stub and return the Server and its HTTP frontend
+func newTestServer(t *testing.T, cfg *Config, azure *azureStub) (*Server, *httptest.Server) {
+	t.Helper()
+	upstream := httptest.NewServer(azure)
+	t.Cleanup(upstream.Close)
+
+	cfg.Endpoint = upstream.URL
+	cfg.AllowInsecureUpstream = true
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(srv.routes())
+	t.Cleanup(front.Close)
+	return srv, front
+}
+
+// POST a JSON body to path with optional headers as key, value pairs
+func postJSON(t *testing.T, url, body string, headers ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// Parsed server-sent event
+type sseEvent struct {
+	ID   string
+	Name string
+	Data string
+}
+
+func parseSSE(body string) []sseEvent {
+	var events []sseEvent
+	for _, block := range strings.Split(body, "\n\n") {
+		var ev sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				ev.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				ev.Name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				ev.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		if ev.Name != "" {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+func eventNames(events []sseEvent) []string {
+	names := make([]string, len(events))
+	for i, ev := range events {
+		names[i] = ev.Name
+	}
+	return names
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Upper bounds of the request latency buckets, in seconds
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// W3C traceparent: version, trace ID, parent span ID, flags
+var traceparentRegex = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// Trace ID of the request's traceparent header, or ""
+func traceID(r *http.Request) string {
+	m := traceparentRegex.FindStringSubmatch(strings.TrimSpace(r.Header.Get("traceparent")))
+	if m == nil || m[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	return m[1]
+}
+
+// Latest traced observation that fell into a bucket
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+type histogram struct {
+	counts    []uint64 // per bucket, not cumulative; the last is +Inf
+	exemplars []exemplar
+	sum       float64
+	count     uint64
+}
+
+// latencyMetrics records request durations per route
+type latencyMetrics struct {
+	mu     sync.Mutex
+	routes map[string]*histogram
+	now    func() time.Time
+}
+
+func newLatencyMetrics() *latencyMetrics {
+	return &latencyMetrics{routes: make(map[string]*histogram), now: time.Now}
+}
+
+func (m *latencyMetrics) observe(route string, seconds float64, trace string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.routes[route]
+	if !ok {
+		h = &histogram{
+			counts:    make([]uint64, len(latencyBuckets)+1),
+			exemplars: make([]exemplar, len(latencyBuckets)+1),
+		}
+		m.routes[route] = h
+	}
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+	if trace != "" {
+		h.exemplars[i] = exemplar{traceID: trace, value: seconds, at: m.now()}
+	}
+}
+
+// Middleware that times each request under its route template
+func (m *latencyMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := m.now()
+		next.ServeHTTP(w, r)
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		m.observe(route, m.now().Sub(start).Seconds(), traceID(r))
+	})
+}
+
+// Write the histograms in the Prometheus text format, or in OpenMetrics
+// with each bucket's latest trace exemplar when withExemplars is set
+func (m *latencyMetrics) write(w *strings.Builder, withExemplars bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	routes := make([]string, 0, len(m.routes))
+	for route := range m.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds Time to serve a request, by route.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	for _, route := range routes {
+		h := m.routes[route]
+		var cumulative uint64
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = fmt.Sprint(latencyBuckets[i])
+			}
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{route=%q,le=%q} %d", route, le, cumulative)
+			if e := h.exemplars[i]; withExemplars && e.traceID != "" {
+				fmt.Fprintf(w, " # {trace_id=%q} %g %.3f", e.traceID, e.value, float64(e.at.UnixMilli())/1000)
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{route=%q} %g\n", route, h.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+}
+
+// Serve the metrics for Prometheus. Exemplars are only valid in
+// OpenMetrics, so they are sent when Features.MetricsExemplars is set and
+// the scraper asks for that format.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	openMetrics := s.cfg.Features.MetricsExemplars && strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	var b strings.Builder
+	s.metrics.write(&b, openMetrics)
+	s.health.write(&b, openMetrics)
+	if openMetrics {
+		b.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func scrape(t *testing.T, url, accept string) (string, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url+"/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Header.Get("Content-Type"), readBody(t, resp)
+}
+
+func TestLatencyHistogramExemplars(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		cfg := defaultConfig()
+		cfg.Features.MetricsExemplars = enabled
+		_, front := newTestServer(t, cfg, &azureStub{content: "Answer."})
+		readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "traceparent", "00-"+testTraceID+"-00f067aa0ba902b7-01"))
+
+		// The latency is recorded just after the response is written
+		var contentType, body string
+		for i := 0; i < 50; i++ {
+			contentType, body = scrape(t, front.URL, "application/openmetrics-text; version=1.0.0")
+			if strings.Contains(body, `route="/api/chat"`) {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !strings.Contains(body, `http_request_duration_seconds_count{route="/api/chat"} 1`) {
+			t.Fatalf("enabled=%v: no chat latency in %q", enabled, body)
+		}
+		hasExemplar := strings.Contains(body, `# {trace_id="`+testTraceID+`"}`)
+		if hasExemplar != enabled {
+			t.Errorf("enabled=%v: exemplar present = %v in %q", enabled, hasExemplar, body)
+		}
+		if openMetrics := strings.HasPrefix(contentType, "application/openmetrics-text"); openMetrics != enabled {
+			t.Errorf("enabled=%v: content type %q", enabled, contentType)
+		}
+		if enabled && !strings.HasSuffix(body, "# EOF\n") {
+			t.Errorf("OpenMetrics body does not end with # EOF: %q", body)
+		}
+
+		// Plain Prometheus scrapes never carry exemplars
+		if _, body := scrape(t, front.URL, ""); strings.Contains(body, "trace_id") {
+			t.Errorf("enabled=%v: exemplar in text format: %q", enabled, body)
+		}
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	tests := map[string]string{
+		"00-" + testTraceID + "-00f067aa0ba902b7-01":              testTraceID,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": "",
+		"garbage": "",
+		"":        "",
+	}
+	for header, want := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("traceparent", header)
+		if got := traceID(r); got != want {
+			t.Errorf("traceID(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const correlationHeader = "X-Correlation-ID"
+
+var (
+	// Client-supplied IDs are echoed and logged, so only accept a safe charset
+	correlationIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+	uuidRegex          = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// Middleware that reads or generates a correlation ID, stores it in the
+// request context and echoes it back on the response.
+func correlationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(correlationHeader)
+		if !correlationIDRegex.MatchString(id) {
+			id = newCorrelationID()
+		}
+		w.Header().Set(correlationHeader, id)
+
+		ctx := context.WithValue(r.Context(), correlationContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CorrelationID returns the correlation ID of the request, or "" outside a request
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationContextKey).(string)
+	return id
+}
+
+// Azure requires x-ms-client-request-id to be a GUID, so non-UUID
+// correlation IDs get a fresh one there and stay only in X-Correlation-ID
+func azureClientRequestID(correlationID string) string {
+	if uuidRegex.MatchString(correlationID) {
+		return correlationID
+	}
+	return newCorrelationID()
+}
+
+// Generate a random UUIDv4, which Azure accepts as a client request ID
+func newCorrelationID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Log with the request's correlation ID and client IP prefixed
+func logf(ctx context.Context, format string, args ...interface{}) {
+	prefix := strings.TrimSpace(CorrelationID(ctx) + " " + clientIPFromContext(ctx))
+	if prefix != "" {
+		format = "[" + prefix + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// Middleware wraps a handler with cross-cutting behavior
+type Middleware func(http.Handler) http.Handler
+
+// Chain composes middlewares so the first one listed runs outermost
+func Chain(middlewares ...Middleware) Middleware {
+	return func(h http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+		return h
+	}
+}
+
+// Middleware that turns a handler panic into a 500 instead of a dropped
+// connection. http.ErrAbortHandler is re-raised so the server can abort
+// the response as intended.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logf(r.Context(), "Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status a handler wrote, for the request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// Streams flush through the recorder
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Lets http.ResponseController reach the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Middleware that logs each request once it has been served, with its
+// status and duration
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logf(r.Context(), "%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// Log at debug level, only when debug logging is enabled
+func debugf(ctx context.Context, enabled bool, format string, args ...interface{}) {
+	if enabled {
+		logf(ctx, "DEBUG "+format, args...)
+	}
+}
+
+// Middleware that answers 415 unless the body is declared as JSON, when
+// Features.RequireJSONContentType is on. Parameters such as charset are
+// allowed.
+func (s *Server) requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.Features.RequireJSONContentType {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
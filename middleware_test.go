@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCorrelationIDEchoedAndForwarded(t *testing.T) {
+	uuid := "123e4567-e89b-42d3-a456-426614174000"
+	tests := []struct {
+		name        string
+		sent        string
+		wantEcho    string // "" means a generated UUID
+		wantAzureID string // "" means a generated UUID
+	}{
+		{"uuid", uuid, uuid, uuid},
+		{"safe non-uuid", "gw-trace.42", "gw-trace.42", ""},
+		{"unsafe characters", "bad id\tinjected", "", ""},
+		{"missing", "", "", ""},
+		{"too long", strings.Repeat("a", 129), "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			azure := &azureStub{content: "Answer."}
+			_, front := newTestServer(t, defaultConfig(), azure)
+
+			var headers []string
+			if tt.sent != "" {
+				headers = []string{correlationHeader, tt.sent}
+			}
+			resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, headers...)
+			readBody(t, resp)
+
+			echo := resp.Header.Get(correlationHeader)
+			if tt.wantEcho != "" && echo != tt.wantEcho {
+				t.Errorf("echoed %q, want %q", echo, tt.wantEcho)
+			}
+			if tt.wantEcho == "" && !uuidRegex.MatchString(echo) {
+				t.Errorf("echoed %q, want a generated UUID", echo)
+			}
+
+			azure.mu.Lock()
+			upstream := azure.headers[0]
+			azure.mu.Unlock()
+			if got := upstream.Get(correlationHeader); got != echo {
+				t.Errorf("upstream %s = %q, want %q", correlationHeader, got, echo)
+			}
+			azureID := upstream.Get("x-ms-client-request-id")
+			if !uuidRegex.MatchString(azureID) || (tt.wantAzureID != "" && azureID != tt.wantAzureID) {
+				t.Errorf("x-ms-client-request-id = %q, want UUID %q", azureID, tt.wantAzureID)
+			}
+		})
+	}
+}
+
+func TestCorrelationIDOnErrorResponses(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), &azureStub{})
+	resp := postJSON(t, front.URL+"/api/chat", `not json`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get(correlationHeader) == "" {
+		t.Fatalf("status=%d correlation=%q", resp.StatusCode, resp.Header.Get(correlationHeader))
+	}
+}
+
+func TestChainRunsFirstMiddlewareOutermost(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := Chain(Chain(mark("recovery"), mark("logging")), mark("auth"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got := strings.Join(order, ","); got != "recovery,logging,auth,handler" {
+		t.Errorf("order = %s", got)
+	}
+}
+
+func TestBaseMiddlewareOrder(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	srv, _ := newTestServer(t, defaultConfig(), &azureStub{})
+	base := srv.baseMiddleware()
+
+	var seenID, seenIP string
+	h := base(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenID, seenIP = CorrelationID(r.Context()), clientIPFromContext(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	req := httptest.NewRequest("GET", "/tea", nil)
+	req.Header.Set(correlationHeader, "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if seenID != "req-1" || seenIP == "" {
+		t.Errorf("handler saw correlation ID %q and client IP %q, want both set", seenID, seenIP)
+	}
+	if logged := buf.String(); !strings.Contains(logged, "[req-1") || !strings.Contains(logged, "GET /tea 418") {
+		t.Errorf("request log = %q, want the status under the correlation ID", logged)
+	}
+
+	// Recovery runs inside the correlation ID, so the panic is logged with
+	// it and the 500 still echoes it; the request log runs inside recovery
+	buf.Reset()
+	h = base(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	req = httptest.NewRequest("GET", "/boom", nil)
+	req.Header.Set(correlationHeader, "req-2")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get(correlationHeader) != "req-2" {
+		t.Errorf("status = %d, correlation = %q, want 500 with the correlation ID", rec.Code, rec.Header().Get(correlationHeader))
+	}
+	if logged := buf.String(); !strings.Contains(logged, "[req-2") || !strings.Contains(logged, "Panic serving GET /boom") {
+		t.Errorf("panic log = %q, want it under the correlation ID", logged)
+	}
+}
+
+func TestLogfPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	log.SetFlags(0)
+	t.Cleanup(func() { log.SetFlags(log.LstdFlags) })
+
+	ctx := context.Background()
+	withID := context.WithValue(ctx, correlationContextKey, "req-1")
+	withIP := context.WithValue(ctx, clientIPContextKey, "203.0.113.7")
+	for _, tt := range []struct {
+		ctx  context.Context
+		want string
+	}{
+		{ctx, "hello\n"},
+		{withID, "[req-1] hello\n"},
+		{withIP, "[203.0.113.7] hello\n"},
+		{context.WithValue(withID, clientIPContextKey, "203.0.113.7"), "[req-1 203.0.113.7] hello\n"},
+	} {
+		buf.Reset()
+		logf(tt.ctx, "hello")
+		if buf.String() != tt.want {
+			t.Errorf("logged %q, want %q", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	h := recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+}
+
+func TestProbesSkipAuthentication(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{"key": {Name: "alice"}}
+	_, front := newTestServer(t, cfg, &azureStub{})
+
+	resp, err := http.Get(front.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/readyz status = %d, want 200 without a key", resp.StatusCode)
+	}
+	resp = postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/api/chat status = %d, want 401 without a key", resp.StatusCode)
+	}
+}
+
+func TestChatRequiresJSONContentType(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), &azureStub{content: "ok"})
+
+	tests := []struct {
+		contentType string
+		want        int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", front.URL+"/api/chat", strings.NewReader(`{"message":"hi"}`))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("Content-Type %q: status = %d, want %d", tt.contentType, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestLenientContentType(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Features.RequireJSONContentType = false
+	_, front := newTestServer(t, cfg, &azureStub{content: "ok"})
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "Content-Type", "text/plain")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200 with enforcement off", resp.StatusCode)
+	}
+}
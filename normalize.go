@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeConfig rewrites answers for downstream consumers that cannot
+// handle some Unicode. Everything is off by default.
+type NormalizeConfig struct {
+	// Unicode normalization form, NFC or NFKC; empty leaves the text as is
+	Form string `json:"form"`
+
+	// Replace curly quotes with straight ones
+	Quotes bool `json:"quotes"`
+
+	// Replace em dashes with "--" and en dashes with "-"
+	Dashes bool `json:"dashes"`
+}
+
+// textNormalizer applies a NormalizeConfig. A nil textNormalizer is
+// disabled.
+type textNormalizer struct {
+	form     *norm.Form
+	replacer *strings.Replacer
+}
+
+func newTextNormalizer(cfg NormalizeConfig) (*textNormalizer, error) {
+	n := &textNormalizer{}
+	switch strings.ToUpper(cfg.Form) {
+	case "":
+	case "NFC":
+		form := norm.NFC
+		n.form = &form
+	case "NFKC":
+		form := norm.NFKC
+		n.form = &form
+	default:
+		return nil, fmt.Errorf("normalization form must be NFC or NFKC, got %q", cfg.Form)
+	}
+	var pairs []string
+	if cfg.Quotes {
+		pairs = append(pairs, "‘", "'", "’", "'", "‚", "'", "‛", "'", "“", `"`, "”", `"`, "„", `"`, "‟", `"`)
+	}
+	if cfg.Dashes {
+		pairs = append(pairs, "—", "--", "–", "-")
+	}
+	if len(pairs) > 0 {
+		n.replacer = strings.NewReplacer(pairs...)
+	}
+	if n.form == nil && n.replacer == nil {
+		return nil, nil
+	}
+	return n, nil
+}
+
+func (n *textNormalizer) normalize(s string) string {
+	if n == nil {
+		return s
+	}
+	if n.form != nil {
+		s = n.form.String(s)
+	}
+	if n.replacer != nil {
+		s = n.replacer.Replace(s)
+	}
+	return s
+}
+
+// streamNormalizer normalizes streamed text, holding back the tail that a
+// later delta could still change: an incomplete UTF-8 sequence, or the
+// last character while a combining mark may follow it
+type streamNormalizer struct {
+	n       *textNormalizer
+	pending string
+}
+
+func (n *textNormalizer) stream() *streamNormalizer {
+	return &streamNormalizer{n: n}
+}
+
+// Add a delta and return the text that is now safe to send
+func (sn *streamNormalizer) Write(delta string) string {
+	if sn.n == nil {
+		return delta
+	}
+	sn.pending += delta
+	cut := len(sn.pending)
+	start := cut - 1
+	for start > 0 && !utf8.RuneStart(sn.pending[start]) {
+		start--
+	}
+	if start >= 0 && !utf8.FullRuneInString(sn.pending[start:]) {
+		cut = start
+	}
+	if sn.n.form != nil {
+		if boundary := sn.n.form.LastBoundary([]byte(sn.pending[:cut])); boundary > 0 {
+			cut = boundary
+		} else {
+			cut = 0
+		}
+	}
+
+	out := sn.n.normalize(sn.pending[:cut])
+	sn.pending = sn.pending[cut:]
+	return out
+}
+
+// Return the remaining held-back text once the stream has ended
+func (sn *streamNormalizer) Flush() string {
+	out := sn.n.normalize(sn.pending)
+	sn.pending = ""
+	return out
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTextNormalizer(t *testing.T) {
+	if n, err := newTextNormalizer(NormalizeConfig{}); n != nil || err != nil {
+		t.Errorf("newTextNormalizer(off) = %v, %v, want a nil normalizer", n, err)
+	}
+	if _, err := newTextNormalizer(NormalizeConfig{Form: "NFD"}); err == nil {
+		t.Error("accepted the NFD form")
+	}
+
+	for _, tt := range []struct {
+		cfg        NormalizeConfig
+		text, want string
+	}{
+		{NormalizeConfig{Form: "NFC"}, "Cafe\u0301", "Café"},
+		{NormalizeConfig{Form: "nfkc"}, "ﬁne ①", "fine 1"},
+		{NormalizeConfig{Quotes: true}, "“Hi,” he said, ‘it’s fine’", `"Hi," he said, 'it's fine'`},
+		{NormalizeConfig{Dashes: true}, "Go—fast, 1–2", "Go--fast, 1-2"},
+		{NormalizeConfig{Form: "NFC"}, "“Quotes” stay", "“Quotes” stay"},
+	} {
+		n, err := newTextNormalizer(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := n.normalize(tt.text); got != tt.want {
+			t.Errorf("%+v: normalize(%q) = %q, want %q", tt.cfg, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestStreamNormalizerMatchesWholeText(t *testing.T) {
+	n, _ := newTextNormalizer(NormalizeConfig{Form: "NFC", Quotes: true, Dashes: true})
+	text := "Cafe\u0301 “naïve” — re\u0301sume\u0301 日本語 1–2"
+	want := n.normalize(text)
+	// Split at every byte, including inside multi-byte sequences and
+	// between a letter and its combining accent
+	for size := 1; size < 8; size++ {
+		sn := n.stream()
+		var got strings.Builder
+		for i := 0; i < len(text); i += size {
+			end := i + size
+			if end > len(text) {
+				end = len(text)
+			}
+			got.WriteString(sn.Write(text[i:end]))
+		}
+		got.WriteString(sn.Flush())
+		if got.String() != want {
+			t.Errorf("chunk size %d: got %q, want %q", size, got.String(), want)
+		}
+	}
+
+	var disabled *textNormalizer
+	if got := disabled.stream().Write("as is"); got != "as is" {
+		t.Errorf("disabled stream wrote %q, want the delta unchanged", got)
+	}
+}
+
+func TestNormalizeAnswers(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Normalize = NormalizeConfig{Form: "NFC", Quotes: true, Dashes: true}
+	azure := &azureStub{
+		content: "Cafe\u0301 is “open” — daily.\nReferences:\n1. Guide",
+		deltas:  []string{"Cafe", "\u0301 is “op", "en” — daily.\nReferences:\n1. Guide"},
+	}
+	_, front := newTestServer(t, cfg, azure)
+	want := "Caf\u00e9 is \"open\" -- daily."
+
+	var chat ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &chat)
+	if chat.Response != want || len(chat.References) != 1 {
+		t.Errorf("response = %q, references = %q, want %q and the reference parsed", chat.Response, chat.References, want)
+	}
+
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)))
+	var tokens strings.Builder
+	var done StreamDone
+	for _, ev := range events {
+		switch ev.Name {
+		case "token":
+			var token map[string]string
+			json.Unmarshal([]byte(ev.Data), &token)
+			tokens.WriteString(token["content"])
+		case "done":
+			json.Unmarshal([]byte(ev.Data), &done)
+		}
+	}
+	if !strings.HasPrefix(tokens.String(), want+"\n") {
+		t.Errorf("streamed tokens = %q, want them normalized", tokens.String())
+	}
+	if done.Response != want || len(done.References) != 1 {
+		t.Errorf("done = %+v, want the normalized answer and its reference", done)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import "fmt"
+
+// GenerationParams are the sampling parameters sent to Azure OpenAI
+type GenerationParams struct {
+	MaxTokens        int     `json:"maxTokens"`
+	Temperature      float64 `json:"temperature"`
+	TopP             float64 `json:"topP"`
+	FrequencyPenalty float64 `json:"frequencyPenalty"`
+	PresencePenalty  float64 `json:"presencePenalty"`
+}
+
+// Parameters used when neither the model nor the request sets them
+var defaultParams = GenerationParams{
+	MaxTokens:        2000,
+	Temperature:      0.9,
+	TopP:             0.95,
+	FrequencyPenalty: 0.5,
+	PresencePenalty:  0.5,
+}
+
+// ParamOverrides holds optional values layered over a GenerationParams
+type ParamOverrides struct {
+	MaxTokens        *int     `json:"maxTokens,omitempty"`
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"topP,omitempty"`
+	FrequencyPenalty *float64 `json:"frequencyPenalty,omitempty"`
+	PresencePenalty  *float64 `json:"presencePenalty,omitempty"`
+}
+
+// Return p with every set override applied
+func (p GenerationParams) with(o ParamOverrides) GenerationParams {
+	if o.MaxTokens != nil {
+		p.MaxTokens = *o.MaxTokens
+	}
+	if o.Temperature != nil {
+		p.Temperature = *o.Temperature
+	}
+	if o.TopP != nil {
+		p.TopP = *o.TopP
+	}
+	if o.FrequencyPenalty != nil {
+		p.FrequencyPenalty = *o.FrequencyPenalty
+	}
+	if o.PresencePenalty != nil {
+		p.PresencePenalty = *o.PresencePenalty
+	}
+	return p
+}
+
+// Return o with every override set in next replacing it
+func (o ParamOverrides) merge(next ParamOverrides) ParamOverrides {
+	if next.MaxTokens != nil {
+		o.MaxTokens = next.MaxTokens
+	}
+	if next.Temperature != nil {
+		o.Temperature = next.Temperature
+	}
+	if next.TopP != nil {
+		o.TopP = next.TopP
+	}
+	if next.FrequencyPenalty != nil {
+		o.FrequencyPenalty = next.FrequencyPenalty
+	}
+	if next.PresencePenalty != nil {
+		o.PresencePenalty = next.PresencePenalty
+	}
+	return o
+}
+
+// Check that every set override is in the range Azure accepts
+func (o ParamOverrides) validate() error {
+	if o.MaxTokens != nil && *o.MaxTokens <= 0 {
+		return fmt.Errorf("maxTokens must be positive, got %d", *o.MaxTokens)
+	}
+	if o.Temperature != nil && (*o.Temperature < 0 || *o.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2, got %v", *o.Temperature)
+	}
+	if o.TopP != nil && (*o.TopP < 0 || *o.TopP > 1) {
+		return fmt.Errorf("topP must be between 0 and 1, got %v", *o.TopP)
+	}
+	if o.FrequencyPenalty != nil && (*o.FrequencyPenalty < -2 || *o.FrequencyPenalty > 2) {
+		return fmt.Errorf("frequencyPenalty must be between -2 and 2, got %v", *o.FrequencyPenalty)
+	}
+	if o.PresencePenalty != nil && (*o.PresencePenalty < -2 || *o.PresencePenalty > 2) {
+		return fmt.Errorf("presencePenalty must be between -2 and 2, got %v", *o.PresencePenalty)
+	}
+	return nil
+}
+
+// Reports whether an optional capability flag is enabled, using def when unset
+func supported(flag *bool, def bool) bool {
+	if flag == nil {
+		return def
+	}
+	return *flag
+}
+
+// Write the generation parameters into an Azure payload, omitting the ones
+// the model does not accept. Reasoning models take max_completion_tokens
+// instead of max_tokens and reject sampling parameters, so for them the
+// Supports* flags default to false instead of true.
+func applyParams(data map[string]interface{}, p GenerationParams, model ModelConfig) {
+	if model.Reasoning {
+		data["max_completion_tokens"] = p.MaxTokens
+	} else {
+		data["max_tokens"] = p.MaxTokens
+	}
+	if supported(model.SupportsTemperature, !model.Reasoning) {
+		data["temperature"] = p.Temperature
+	}
+	if supported(model.SupportsTopP, !model.Reasoning) {
+		data["top_p"] = p.TopP
+	}
+	if supported(model.SupportsPenalties, !model.Reasoning) {
+		data["frequency_penalty"] = p.FrequencyPenalty
+		data["presence_penalty"] = p.PresencePenalty
+	}
+}
+
+// Reports whether effort is a reasoning_effort value Azure accepts
+func validReasoningEffort(effort string) bool {
+	switch effort {
+	case "low", "medium", "high":
+		return true
+	}
+	return false
+}
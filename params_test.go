@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestGenerationParamsWith(t *testing.T) {
+	temp := 0.2
+	maxTokens := 500
+
+	got := defaultParams.with(ParamOverrides{Temperature: &temp, MaxTokens: &maxTokens})
+	want := defaultParams
+	want.Temperature = 0.2
+	want.MaxTokens = 500
+	if got != want {
+		t.Fatalf("with() = %+v, want %+v", got, want)
+	}
+
+	if got := defaultParams.with(ParamOverrides{}); got != defaultParams {
+		t.Fatalf("empty overrides changed params: %+v", got)
+	}
+}
+
+func TestApplyParamsPerModelProfile(t *testing.T) {
+	yes, no := true, false
+	temp := 0.1
+
+	tests := []struct {
+		name  string
+		model ModelConfig
+		want  map[string]interface{}
+	}{
+		{
+			name:  "default model",
+			model: ModelConfig{},
+			want: map[string]interface{}{
+				"max_tokens":        2000,
+				"temperature":       0.9,
+				"top_p":             0.95,
+				"frequency_penalty": 0.5,
+				"presence_penalty":  0.5,
+			},
+		},
+		{
+			name:  "model with overrides",
+			model: ModelConfig{Defaults: ParamOverrides{Temperature: &temp}, SupportsPenalties: &no},
+			want: map[string]interface{}{
+				"max_tokens":  2000,
+				"temperature": 0.1,
+				"top_p":       0.95,
+			},
+		},
+		{
+			name:  "reasoning model",
+			model: ModelConfig{Reasoning: true},
+			want: map[string]interface{}{
+				"max_completion_tokens": 2000,
+			},
+		},
+		{
+			name:  "reasoning model opting into temperature",
+			model: ModelConfig{Reasoning: true, SupportsTemperature: &yes},
+			want: map[string]interface{}{
+				"max_completion_tokens": 2000,
+				"temperature":           0.9,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]interface{}{}
+			applyParams(data, defaultParams.with(tt.model.Defaults), tt.model)
+			if !reflect.DeepEqual(data, tt.want) {
+				t.Fatalf("payload = %v, want %v", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestReasoningEffort(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Models = map[string]ModelConfig{"o3": {Reasoning: true}, "gpt-4o": {}}
+	cfg.DefaultModel = "gpt-4o"
+	azure := &azureStub{content: "ok"}
+	_, front := newTestServer(t, cfg, azure)
+
+	tests := []struct {
+		body       string
+		wantStatus int
+	}{
+		{`{"message":"hi","model":"o3","reasoningEffort":"high"}`, http.StatusOK},
+		{`{"message":"hi","model":"o3","reasoningEffort":"extreme"}`, http.StatusBadRequest},
+		{`{"message":"hi","model":"gpt-4o","reasoningEffort":"low"}`, http.StatusBadRequest},
+		{`{"message":"hi","model":"gpt-4o"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp := postJSON(t, front.URL+"/api/chat", tt.body)
+		readBody(t, resp)
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.body, resp.StatusCode, tt.wantStatus)
+		}
+	}
+
+	if got := azure.payload(t, 0)["reasoning_effort"]; got != "high" {
+		t.Errorf("reasoning_effort = %v, want high", got)
+	}
+	if _, ok := azure.payload(t, 1)["reasoning_effort"]; ok {
+		t.Error("reasoning_effort sent without being requested")
+	}
+}
+
+func TestParamOverridesForLayersDefaults(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	cfg := &Config{
+		Defaults: ParamOverrides{Temperature: f(0.7), TopP: f(0.8)},
+		Tenants: map[string]TenantConfig{
+			"legal": {Defaults: ParamOverrides{Temperature: f(0.1)}},
+		},
+	}
+	tests := []struct {
+		name     string
+		client   *ClientConfig
+		wantTemp float64
+		wantTopP float64
+	}{
+		{"no client", nil, 0.7, 0.8},
+		{"tenant", &ClientConfig{Tenant: "legal"}, 0.1, 0.8},
+		{"client over tenant", &ClientConfig{Tenant: "legal", Defaults: ParamOverrides{Temperature: f(1.2), TopP: f(0.5)}}, 1.2, 0.5},
+	}
+	for _, tt := range tests {
+		got := defaultParams.with(cfg.paramOverridesFor(tt.client, ModelConfig{}))
+		if got.Temperature != tt.wantTemp || got.TopP != tt.wantTopP {
+			t.Errorf("%s: temperature=%v top_p=%v, want %v and %v", tt.name, got.Temperature, got.TopP, tt.wantTemp, tt.wantTopP)
+		}
+	}
+
+	if got := defaultParams.with((&Config{}).paramOverridesFor(nil, ModelConfig{})); got.Temperature != 0.9 || got.TopP != 0.95 {
+		t.Errorf("unconfigured defaults = %v and %v, want 0.9 and 0.95", got.Temperature, got.TopP)
+	}
+}
+
+func TestRequestSamplingOverridesClientDefaults(t *testing.T) {
+	low := 0.2
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{"key": {Name: "alice", Defaults: ParamOverrides{Temperature: &low}}}
+	azure := &azureStub{content: "ok"}
+	_, front := newTestServer(t, cfg, azure)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "X-API-Key", "key"))
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","temperature":1.1}`, "X-API-Key", "key"))
+	if got := azure.payload(t, 0)["temperature"]; got != 0.2 {
+		t.Errorf("client default temperature = %v, want 0.2", got)
+	}
+	if got := azure.payload(t, 1)["temperature"]; got != 1.1 {
+		t.Errorf("request temperature = %v, want 1.1", got)
+	}
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","temperature":3}`, "X-API-Key", "key")
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status for temperature 3 = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestParamProfiles(t *testing.T) {
+	precise, creative, topP, clientTemp := 0.1, 1.2, 0.5, 0.7
+	cfg := defaultConfig()
+	cfg.ParamProfiles = map[string]ParamOverrides{
+		"precise":  {Temperature: &precise, TopP: &topP},
+		"creative": {Temperature: &creative},
+	}
+	cfg.Clients = map[string]ClientConfig{"key": {Name: "alice", Defaults: ParamOverrides{Temperature: &clientTemp}}}
+	azure := &azureStub{content: "ok"}
+	_, front := newTestServer(t, cfg, azure)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","paramProfile":"precise"}`, "X-API-Key", "key"))
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","paramProfile":"precise","temperature":0.9}`, "X-API-Key", "key"))
+	if p := azure.payload(t, 0); p["temperature"] != 0.1 || p["top_p"] != 0.5 {
+		t.Errorf("profile over client defaults: temperature %v, top_p %v", p["temperature"], p["top_p"])
+	}
+	if p := azure.payload(t, 1); p["temperature"] != 0.9 || p["top_p"] != 0.5 {
+		t.Errorf("request over profile: temperature %v, top_p %v", p["temperature"], p["top_p"])
+	}
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","paramProfile":"wild"}`, "X-API-Key", "key")
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown profile status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestParamOverridesValidate(t *testing.T) {
+	hot, zero, ok := 2.5, 0, 0.3
+	if err := (ParamOverrides{Temperature: &ok}).validate(); err != nil {
+		t.Errorf("valid overrides rejected: %v", err)
+	}
+	if err := (ParamOverrides{Temperature: &hot}).validate(); err == nil {
+		t.Error("temperature 2.5 accepted")
+	}
+	if err := (ParamOverrides{MaxTokens: &zero}).validate(); err == nil {
+		t.Error("maxTokens 0 accepted")
+	}
+}
+
+func TestRequestPenalties(t *testing.T) {
+	noPenalties := false
+	cfg := defaultConfig()
+	cfg.Models = map[string]ModelConfig{
+		"gpt-4o": {},
+		"mini":   {SupportsPenalties: &noPenalties},
+	}
+	cfg.DefaultModel = "gpt-4o"
+	azure := &azureStub{content: "ok"}
+	_, front := newTestServer(t, cfg, azure)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","frequencyPenalty":0,"presencePenalty":-1.5}`))
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","model":"mini","frequencyPenalty":1}`))
+	if p := azure.payload(t, 0); p["frequency_penalty"] != 0.5 || p["presence_penalty"] != 0.5 {
+		t.Errorf("default penalties = %v/%v, want 0.5/0.5", p["frequency_penalty"], p["presence_penalty"])
+	}
+	if p := azure.payload(t, 1); p["frequency_penalty"] != 0.0 || p["presence_penalty"] != -1.5 {
+		t.Errorf("request penalties = %v/%v, want 0/-1.5", p["frequency_penalty"], p["presence_penalty"])
+	}
+	if p := azure.payload(t, 2); p["frequency_penalty"] != nil || p["presence_penalty"] != nil {
+		t.Errorf("penalties sent to a model without support: %v", p)
+	}
+
+	for _, body := range []string{
+		`{"message":"hi","frequencyPenalty":2.5}`,
+		`{"message":"hi","presencePenalty":-2.1}`,
+	} {
+		resp := postJSON(t, front.URL+"/api/chat", body)
+		readBody(t, resp)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
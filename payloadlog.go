@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Payload fields whose values are credentials, matched case-insensitively.
+// "authentication" is dropped whole since every auth type carries a secret.
+var redactedPayloadFields = map[string]bool{
+	"key":            true,
+	"api-key":        true,
+	"api_key":        true,
+	"authentication": true,
+}
+
+// Render an outbound payload for the log with credentials removed, cut
+// to limit bytes
+func payloadForLog(data map[string]interface{}, limit int) string {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("<unencodable payload: %v>", err)
+	}
+	// Round-trip through JSON so every nested value is a plain map or slice
+	var generic interface{}
+	json.Unmarshal(raw, &generic)
+	out, _ := json.Marshal(redactPayloadValue(generic))
+
+	if limit > 0 && len(out) > limit {
+		return string(out[:limit]) + fmt.Sprintf("...[truncated %d bytes]", len(out)-limit)
+	}
+	return string(out)
+}
+
+func redactPayloadValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, value := range v {
+			if redactedPayloadFields[strings.ToLower(name)] {
+				v[name] = "[redacted]"
+			} else {
+				v[name] = redactPayloadValue(value)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactPayloadValue(item)
+		}
+	}
+	return v
+}
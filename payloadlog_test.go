@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamPayloadLogNeverContainsKeys(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	cfg := defaultConfig()
+	cfg.LogUpstreamPayload = true
+	cfg.Search = SearchConfig{Endpoint: "https://search", Key: "search-secret-123", Index: "docs"}
+	_, front := newTestServer(t, cfg, &azureStub{content: "ok"})
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+
+	logged := buf.String()
+	if !strings.Contains(logged, "Azure request payload") || !strings.Contains(logged, `"index_name":"docs"`) {
+		t.Fatalf("payload not logged: %s", logged)
+	}
+	if strings.Contains(logged, "search-secret-123") {
+		t.Error("search key appears in the logged payload")
+	}
+}
+
+func TestPayloadForLogTruncates(t *testing.T) {
+	got := payloadForLog(map[string]interface{}{"messages": strings.Repeat("x", 100)}, 20)
+	if len(got) < 20 || !strings.HasSuffix(got, "[truncated 95 bytes]") {
+		t.Errorf("payloadForLog = %q", got)
+	}
+}
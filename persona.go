@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// PersonaConfig is a named assistant a request can select instead of
+// sending its own instructions
+type PersonaConfig struct {
+	// System prompt template, with the same placeholders as SystemPrompt
+	SystemPrompt string `json:"systemPrompt"`
+
+	// Sampling defaults, applied over the model, tenant and client defaults
+	Defaults ParamOverrides `json:"defaults"`
+
+	// Set false to answer without search grounding; a persona cannot turn
+	// grounding on when it is disabled for the server
+	Grounding *bool `json:"grounding,omitempty"`
+
+	// Overrides the answer footer for this persona; empty turns it off
+	Footer *string `json:"footer,omitempty"`
+}
+
+var personaNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// persona is a configured persona with its prompt template parsed
+type persona struct {
+	name         string
+	systemPrompt *systemPromptTemplate
+	defaults     ParamOverrides
+	grounding    *bool
+	footer       *string
+}
+
+// Reports whether answers in this persona use search grounding, given the
+// server-wide setting
+func (p *persona) groundingEnabled(server bool) bool {
+	if p == nil || p.grounding == nil {
+		return server
+	}
+	return server && *p.grounding
+}
+
+// Parse the system prompt of every configured persona
+func newPersonas(configs map[string]PersonaConfig, ctx PromptContext) (map[string]*persona, error) {
+	personas := make(map[string]*persona, len(configs))
+	for name, pc := range configs {
+		tmpl, err := newSystemPromptTemplate(pc.SystemPrompt, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("persona %q: %w", name, err)
+		}
+		personas[name] = &persona{name: name, systemPrompt: tmpl, defaults: pc.Defaults, grounding: pc.Grounding, footer: pc.Footer}
+	}
+	return personas, nil
+}
+
+// Check persona names and that the default persona exists
+func (c *Config) validatePersonas() error {
+	for name, pc := range c.Personas {
+		if !personaNameRegex.MatchString(name) {
+			return fmt.Errorf("persona name %q may only contain letters, digits, '-' and '_'", name)
+		}
+		if pc.SystemPrompt == "" {
+			return fmt.Errorf("persona %q has no system prompt", name)
+		}
+	}
+	if c.DefaultPersona != "" {
+		if _, ok := c.Personas[c.DefaultPersona]; !ok {
+			return fmt.Errorf("default persona %q is not configured", c.DefaultPersona)
+		}
+	}
+	return nil
+}
+
+// Resolve the persona a request asked for, falling back to the default
+// persona. Returns nil with ok true when neither is set, and ok false
+// for an unknown name.
+func (s *Server) personaFor(name string) (*persona, bool) {
+	if name == "" {
+		name = s.cfg.DefaultPersona
+	}
+	if name == "" {
+		return nil, true
+	}
+	p, ok := s.personas[name]
+	return p, ok
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidatePersonas(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"none", Config{}, false},
+		{"valid", Config{Personas: map[string]PersonaConfig{"support-agent": {SystemPrompt: "Help."}}, DefaultPersona: "support-agent"}, false},
+		{"bad name", Config{Personas: map[string]PersonaConfig{"support agent": {SystemPrompt: "Help."}}}, true},
+		{"no prompt", Config{Personas: map[string]PersonaConfig{"researcher": {}}}, true},
+		{"unknown default", Config{Personas: map[string]PersonaConfig{"researcher": {SystemPrompt: "Cite."}}, DefaultPersona: "coder"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validatePersonas(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPersonaSelection(t *testing.T) {
+	off, temp := false, 0.1
+	cfg := defaultConfig()
+	cfg.Personas = map[string]PersonaConfig{
+		"researcher": {SystemPrompt: "You are a researcher."},
+		"coder":      {SystemPrompt: "You write code.", Defaults: ParamOverrides{Temperature: &temp}, Grounding: &off},
+	}
+	cfg.DefaultPersona = "researcher"
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, cfg, azure)
+
+	if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("default persona status = %d", resp.StatusCode)
+	}
+	payload := azure.payload(t, 0)
+	if got := systemMessage(payload); got != "You are a researcher." {
+		t.Errorf("default persona system prompt = %q", got)
+	}
+	if _, ok := payload["data_sources"]; !ok {
+		t.Error("default persona should keep grounding")
+	}
+
+	if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","persona":"coder"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("coder persona status = %d", resp.StatusCode)
+	}
+	payload = azure.payload(t, 1)
+	if got := systemMessage(payload); got != "You write code." {
+		t.Errorf("coder system prompt = %q", got)
+	}
+	if _, ok := payload["data_sources"]; ok {
+		t.Error("coder persona should disable grounding")
+	}
+	if payload["temperature"] != 0.1 {
+		t.Errorf("coder temperature = %v, want 0.1", payload["temperature"])
+	}
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","persona":"poet"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown persona status = %d, want 400", resp.StatusCode)
+	}
+}
+
+// Content of the system message in an Azure payload
+func systemMessage(payload map[string]interface{}) string {
+	messages, _ := payload["messages"].([]interface{})
+	if len(messages) == 0 {
+		return ""
+	}
+	content, _ := messages[0].(map[string]interface{})["content"].(string)
+	return content
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Where a request wants the references, relative to the answer
+const (
+	referencesAfter  = "after" // the default
+	referencesBefore = "before"
+)
+
+// The heading the model is asked to put above its answer when it lists
+// the references first, with the same Markdown leeway as reference headings
+var answerHeadingRegex = regexp.MustCompile(`(?im)^[ \t]*(?:#{1,6}[ \t]*)?(?:\*\*|__)?answer(?:\*\*|__)?(?::(?:\*\*|__)?|[ \t]*$)`)
+
+func validReferencesPosition(position string) bool {
+	return position == "" || position == referencesAfter || position == referencesBefore
+}
+
+// Ask for the references ahead of the answer, replacing the request for
+// them at the end made by the prompts before it
+func formatReferencesFirstPrompt(prompt string) string {
+	return fmt.Sprintf(`%s
+
+Instead of ending with the references, start with them: first the numbered list of references under a "References:" heading, then the answer under an "Answer:" heading.`, prompt)
+}
+
+// Move a references section the model wrote ahead of its answer behind
+// it, so the content parses like any other. Content without a references
+// heading followed by an answer heading is returned as it is.
+func moveLeadingReferences(content string, headings *referenceHeadings) string {
+	start, end := headings.first(content)
+	if start < 0 {
+		return content
+	}
+	loc := answerHeadingRegex.FindStringIndex(content[end:])
+	if loc == nil {
+		return content
+	}
+	references := strings.TrimSpace(content[start : end+loc[0]])
+	answer := strings.TrimSpace(content[:start] + "\n\n" + content[end+loc[1]:])
+	return answer + "\n\n" + references
+}
+
+// Complete streamed reference lines up to an answer heading. Reports
+// whether the heading was reached, after which no line is a reference.
+func linesBeforeAnswer(lines []string) ([]string, bool) {
+	for i, line := range lines {
+		if answerHeadingRegex.MatchString(line) {
+			return lines[:i], true
+		}
+	}
+	return lines, false
+}
+
+// The body of a chat response with the references ahead of the answer,
+// for requests that set referencesPosition to before. The outer fields
+// hide the embedded ones of the same name.
+type chatResponseReferencesFirst struct {
+	SchemaVersion        int         `json:"schemaVersion"`
+	References           []string    `json:"references,omitempty"`
+	StructuredReferences []Reference `json:"structuredReferences,omitempty"`
+	ChatResponse
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMoveLeadingReferences(t *testing.T) {
+	headings := newReferenceHeadings(defaultReferenceHeadings)
+	tests := []struct {
+		name, content, want string
+	}{
+		{"sources first", "References:\n1. Foo\n2. Bar\n\n**Answer:**\nGo is a language.", "Go is a language.\n\nReferences:\n1. Foo\n2. Bar"},
+		{"already last", "Go is a language.\n\nReferences:\n1. Foo", "Go is a language.\n\nReferences:\n1. Foo"},
+		{"no answer heading", "References:\n1. Foo", "References:\n1. Foo"},
+	}
+	for _, tt := range tests {
+		if got := moveLeadingReferences(tt.content, headings); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChatReferencesPosition(t *testing.T) {
+	azure := &azureStub{content: "References:\n1. Foo\n2. Bar\n\nAnswer:\nThe answer."}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	body := readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","referencesPosition":"before"}`))
+	var got ChatResponse
+	json.Unmarshal([]byte(body), &got)
+	if got.Response != "The answer." || !reflect.DeepEqual(got.References, []string{"1. Foo", "2. Bar"}) {
+		t.Errorf("before: response = %+v", got)
+	}
+	if strings.Index(body, `"references"`) > strings.Index(body, `"response"`) {
+		t.Errorf("before: references come after the answer in %s", body)
+	}
+	if prompt := userMessage(azure.payload(t, 0)); !strings.Contains(prompt, `then the answer under an "Answer:" heading`) {
+		t.Errorf("before: prompt does not ask for sources first: %q", prompt)
+	}
+
+	azure.content = "The answer.\n\nReferences:\n1. Foo"
+	body = readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+	if strings.Index(body, `"references"`) < strings.Index(body, `"response"`) {
+		t.Errorf("after: references come before the answer in %s", body)
+	}
+	if prompt := userMessage(azure.payload(t, 1)); strings.Contains(prompt, `"Answer:" heading`) {
+		t.Errorf("after: prompt asks for sources first: %q", prompt)
+	}
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","referencesPosition":"middle"}`)
+	readBody(t, resp)
+	if resp.StatusCode != 400 {
+		t.Errorf("unknown position: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestStreamReferencesFirst(t *testing.T) {
+	azure := &azureStub{deltas: []string{"References:\n1. Foo\n", "2. Bar\n\nAns", "wer:\nThe ", "answer.\n1. Not a reference"}}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true,"referencesPosition":"before"}`)))
+	var references []string
+	var done StreamDone
+	for _, e := range events {
+		switch e.Name {
+		case "reference":
+			var ev struct{ Reference string }
+			json.Unmarshal([]byte(e.Data), &ev)
+			references = append(references, ev.Reference)
+		case "done":
+			json.Unmarshal([]byte(e.Data), &done)
+		}
+	}
+	if !reflect.DeepEqual(references, []string{"1. Foo", "2. Bar"}) {
+		t.Errorf("reference events = %q, want only the leading list", references)
+	}
+	if done.Response != "The answer.\n1. Not a reference" || !reflect.DeepEqual(done.References, []string{"1. Foo", "2. Bar"}) {
+		t.Errorf("done = %+v", done)
+	}
+}
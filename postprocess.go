@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PostProcessorConfig names a built-in transform and its parameters
+type PostProcessorConfig struct {
+	Name   string            `json:"name"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// postProcessor transforms the main answer content before it is returned
+type postProcessor func(string) string
+
+var whitespaceRunRegex = regexp.MustCompile(`[ \t]+`)
+var blankLinesRegex = regexp.MustCompile(`\n{3,}`)
+
+// Build a single post-processor from its config
+func newPostProcessor(c PostProcessorConfig) (postProcessor, error) {
+	switch c.Name {
+	case "trim":
+		return strings.TrimSpace, nil
+	case "normalize_whitespace":
+		return func(s string) string {
+			s = whitespaceRunRegex.ReplaceAllString(s, " ")
+			return blankLinesRegex.ReplaceAllString(s, "\n\n")
+		}, nil
+	case "regex_replace":
+		re, err := regexp.Compile(c.Params["pattern"])
+		if err != nil {
+			return nil, fmt.Errorf("regex_replace: %w", err)
+		}
+		replacement := c.Params["replacement"]
+		return func(s string) string {
+			return re.ReplaceAllString(s, replacement)
+		}, nil
+	case "prepend":
+		text := c.Params["text"]
+		return func(s string) string { return text + s }, nil
+	case "append":
+		text := c.Params["text"]
+		return func(s string) string { return s + text }, nil
+	}
+	return nil, fmt.Errorf("unknown post-processor %q", c.Name)
+}
+
+// postProcessChain applies post-processors in their configured order
+type postProcessChain []postProcessor
+
+func newPostProcessChain(configs []PostProcessorConfig) (postProcessChain, error) {
+	chain := make(postProcessChain, 0, len(configs))
+	for i, c := range configs {
+		p, err := newPostProcessor(c)
+		if err != nil {
+			return nil, fmt.Errorf("post-processor %d: %w", i, err)
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+func (chain postProcessChain) apply(content string) string {
+	for _, p := range chain {
+		content = p(content)
+	}
+	return content
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestPostProcessChainOrdering(t *testing.T) {
+	configs := []PostProcessorConfig{
+		{Name: "trim"},
+		{Name: "regex_replace", Params: map[string]string{"pattern": `(?i)as an ai[^.]*\.\s*`, "replacement": ""}},
+		{Name: "prepend", Params: map[string]string{"text": "> "}},
+		{Name: "append", Params: map[string]string{"text": "\n-- footer"}},
+	}
+	chain, err := newPostProcessChain(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := chain.apply("  As an AI model, I think. The answer is 42.  ")
+	if want := "> The answer is 42.\n-- footer"; got != want {
+		t.Fatalf("apply = %q, want %q", got, want)
+	}
+
+	// Reversing the order changes the result: the footer is trimmed away
+	// only when trim runs last.
+	reversed, _ := newPostProcessChain([]PostProcessorConfig{
+		{Name: "append", Params: map[string]string{"text": "  "}},
+		{Name: "trim"},
+	})
+	if got := reversed.apply("x"); got != "x" {
+		t.Fatalf("reversed apply = %q, want %q", got, "x")
+	}
+}
+
+func TestNormalizeWhitespace(t *testing.T) {
+	chain, _ := newPostProcessChain([]PostProcessorConfig{{Name: "normalize_whitespace"}})
+	if got := chain.apply("a  \t b\n\n\n\nc"); got != "a b\n\nc" {
+		t.Fatalf("apply = %q", got)
+	}
+}
+
+func TestNewPostProcessChainRejectsBadConfig(t *testing.T) {
+	for _, c := range []PostProcessorConfig{
+		{Name: "shout"},
+		{Name: "regex_replace", Params: map[string]string{"pattern": "("}},
+	} {
+		if _, err := newPostProcessChain([]PostProcessorConfig{c}); err == nil {
+			t.Errorf("config %+v accepted", c)
+		}
+	}
+}
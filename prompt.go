@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PromptContext configures the request-time values available to the
+// system prompt template
+type PromptContext struct {
+	DateFormat string `json:"dateFormat"`
+	Timezone   string `json:"timezone"`
+	Locale     string `json:"locale"`
+	OrgName    string `json:"orgName"`
+}
+
+// Values a system prompt template can reference, e.g. {{.Date}}
+type promptTemplateData struct {
+	Date     string
+	Time     string
+	Timezone string
+	Locale   string
+	OrgName  string
+}
+
+// systemPromptTemplate renders the system prompt for each request
+type systemPromptTemplate struct {
+	tmpl     *template.Template
+	ctx      PromptContext
+	location *time.Location
+}
+
+func newSystemPromptTemplate(text string, ctx PromptContext) (*systemPromptTemplate, error) {
+	tmpl, err := template.New("system").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing system prompt template: %w", err)
+	}
+	location, err := time.LoadLocation(ctx.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("loading prompt timezone: %w", err)
+	}
+
+	p := &systemPromptTemplate{tmpl: tmpl, ctx: ctx, location: location}
+	// Render once so template errors surface at startup, not per request
+	if _, err := p.render(time.Now()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *systemPromptTemplate) render(now time.Time) (string, error) {
+	now = now.In(p.location)
+	var b strings.Builder
+	err := p.tmpl.Execute(&b, promptTemplateData{
+		Date:     now.Format(p.ctx.DateFormat),
+		Time:     now.Format("15:04"),
+		Timezone: p.location.String(),
+		Locale:   p.ctx.Locale,
+		OrgName:  p.ctx.OrgName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("rendering system prompt: %w", err)
+	}
+	return b.String(), nil
+}
+
+// PromptGuardrails is text wrapped around every user message, e.g.
+// "Only answer using the provided documents. If unknown, say so."
+type PromptGuardrails struct {
+	Prefix string `json:"prefix,omitempty"`
+	Suffix string `json:"suffix,omitempty"`
+	// Appended after the suffix, for standing usage policies
+	Policy string `json:"policy,omitempty"`
+}
+
+// Wrap a formatted user prompt in the configured guardrails
+func (g PromptGuardrails) wrap(prompt string) string {
+	parts := []string{g.Prefix, prompt, g.Suffix, g.Policy}
+	kept := parts[:0]
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "\n\n")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSystemPromptTemplateRender(t *testing.T) {
+	p, err := newSystemPromptTemplate("Today is {{.Date}} in {{.Timezone}} for {{.OrgName}} ({{.Locale}}).", PromptContext{
+		DateFormat: "2006-01-02",
+		Timezone:   "America/New_York",
+		Locale:     "en-US",
+		OrgName:    "Contoso",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 02:00 UTC is still the previous day in New York
+	got, err := p.render(time.Date(2024, 3, 10, 2, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Today is 2024-03-09 in America/New_York for Contoso (en-US)."; got != want {
+		t.Fatalf("render = %q, want %q", got, want)
+	}
+}
+
+func TestSystemPromptTemplateRejectsBadConfig(t *testing.T) {
+	if _, err := newSystemPromptTemplate("{{.Date", PromptContext{Timezone: "UTC"}); err == nil {
+		t.Error("accepted an unparseable template")
+	}
+	if _, err := newSystemPromptTemplate("{{.Nope}}", PromptContext{Timezone: "UTC"}); err == nil {
+		t.Error("accepted an unknown placeholder")
+	}
+	if _, err := newSystemPromptTemplate("x", PromptContext{Timezone: "Mars/Base"}); err == nil {
+		t.Error("accepted an unknown timezone")
+	}
+}
+
+func TestPromptGuardrailsWrapUserMessage(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PromptGuardrails = PromptGuardrails{
+		Prefix: "Only answer using the provided documents.",
+		Suffix: "If unknown, say so.",
+		Policy: "Never give legal advice.",
+	}
+	azure := &azureStub{content: "ok"}
+	_, front := newTestServer(t, cfg, azure)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"What is Go?"}`))
+	messages := azure.payload(t, 0)["messages"].([]interface{})
+	got := messages[len(messages)-1].(map[string]interface{})["content"].(string)
+	want := cfg.PromptGuardrails.Prefix + "\n\n" + formatPromptWithReferenceRequest("What is Go?") + "\n\n" + cfg.PromptGuardrails.Suffix + "\n\n" + cfg.PromptGuardrails.Policy
+	if got != want {
+		t.Errorf("user prompt = %q, want %q", got, want)
+	}
+
+	if got := (PromptGuardrails{}).wrap("hi"); got != "hi" {
+		t.Errorf("empty guardrails changed the prompt to %q", got)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// AzureClient sends requests to Azure OpenAI. *http.Client is the real
+// one; recordingClient and replayClient wrap or stand in for it.
+type AzureClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// RecorderConfig controls capturing Azure exchanges for replay tests
+type RecorderConfig struct {
+	// Directory exchanges are written to, or read from when Replay is set
+	Dir string `json:"dir"`
+	// Answer from the recordings in Dir instead of calling Azure
+	Replay bool `json:"replay"`
+}
+
+// Recording is one Azure request and its response, stored as JSON
+type Recording struct {
+	Request struct {
+		Method string          `json:"method"`
+		Path   string          `json:"path"`
+		Body   json.RawMessage `json:"body"`
+	} `json:"request"`
+	Response struct {
+		Status      int    `json:"status"`
+		ContentType string `json:"contentType,omitempty"`
+		Body        string `json:"body"`
+	} `json:"response"`
+}
+
+// Payload fields holding credentials, replaced before anything is stored
+var secretFields = map[string]bool{"key": true, "api_key": true, "api-key": true, "authentication": true}
+
+// Replace credential fields anywhere in a JSON body
+func redactSecrets(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, field := range v {
+			if secretFields[k] {
+				out[k] = "[redacted]"
+				continue
+			}
+			out[k] = redactSecrets(field)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactSecrets(item)
+		}
+		return out
+	}
+	return v
+}
+
+// Read and restore a request body, returning it without credentials. The
+// recording key covers the method, path and redacted body, so recordings
+// made with one set of keys replay with another.
+func recordingRequest(req *http.Request) (json.RawMessage, string, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, "", err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	redacted := json.RawMessage("null")
+	if len(body) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, "", fmt.Errorf("recording request body: %w", err)
+		}
+		// encoding/json sorts map keys, so equal payloads encode equally
+		redacted, _ = json.Marshal(redactSecrets(v))
+	}
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.Path + "\n" + string(redacted)))
+	return redacted, hex.EncodeToString(sum[:16]), nil
+}
+
+// recordingClient passes requests through and writes each exchange to dir
+// once its response body has been read and closed
+type recordingClient struct {
+	next AzureClient
+	dir  string
+}
+
+func (rc *recordingClient) Do(req *http.Request) (*http.Response, error) {
+	body, key, err := recordingRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rc.next.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recording{}
+	rec.Request.Method, rec.Request.Path, rec.Request.Body = req.Method, req.URL.Path, body
+	rec.Response.Status, rec.Response.ContentType = resp.StatusCode, resp.Header.Get("Content-Type")
+	resp.Body = &recordingBody{ReadCloser: resp.Body, rec: rec, path: filepath.Join(rc.dir, key+".json")}
+	return resp, nil
+}
+
+// recordingBody copies a response body as it is read, so streams are not
+// held back, and saves the recording on Close
+type recordingBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	rec  *Recording
+	path string
+}
+
+func (rb *recordingBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+	rb.buf.Write(p[:n])
+	return n, err
+}
+
+func (rb *recordingBody) Close() error {
+	rb.rec.Response.Body = rb.buf.String()
+	data, _ := json.MarshalIndent(rb.rec, "", "  ")
+	if err := os.WriteFile(rb.path, data, 0o600); err != nil {
+		log.Printf("WARNING: failed to write recording %s: %v", rb.path, err)
+	}
+	return rb.ReadCloser.Close()
+}
+
+// replayClient answers from recordings in dir and never calls Azure
+type replayClient struct {
+	dir string
+}
+
+func (rc *replayClient) Do(req *http.Request) (*http.Response, error) {
+	_, key, err := recordingRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(rc.dir, key+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("no recording for %s %s: %w", req.Method, req.URL.Path, err)
+	}
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("reading recording %s: %w", key, err)
+	}
+	header := make(http.Header)
+	if rec.Response.ContentType != "" {
+		header.Set("Content-Type", rec.Response.ContentType)
+	}
+	return &http.Response{
+		StatusCode:    rec.Response.Status,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewBufferString(rec.Response.Body)),
+		ContentLength: int64(len(rec.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// The Azure client for cfg: the network, recorded or replayed
+func newAzureClient(cfg RecorderConfig) AzureClient {
+	var client AzureClient = &http.Client{}
+	switch {
+	case cfg.Dir != "" && cfg.Replay:
+		client = &replayClient{dir: cfg.Dir}
+	case cfg.Dir != "":
+		client = &recordingClient{next: client, dir: cfg.Dir}
+	}
+	return client
+}
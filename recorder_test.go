@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	record := defaultConfig()
+	record.APIKey = "azure-secret"
+	record.Search.Key = "search-secret"
+	record.Recorder.Dir = dir
+	_, front := newTestServer(t, record, &azureStub{content: "Recorded answer.", deltas: []string{"Recorded ", "stream."}})
+
+	var live ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &live)
+	liveStream := readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 2 {
+		t.Fatalf("recorded %d files, want 2", len(files))
+	}
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		if strings.Contains(string(data), "secret") {
+			t.Errorf("recording %s contains a credential: %s", file, data)
+		}
+	}
+
+	replay := defaultConfig()
+	replay.APIKey = "other-key"
+	replay.Search.Key = "other-search-key"
+	replay.Recorder = RecorderConfig{Dir: dir, Replay: true}
+	_, front = newTestServer(t, replay, &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		t.Error("replay called Azure")
+	}})
+
+	var replayed ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &replayed)
+	if replayed.Response != "Recorded answer." || replayed.Response != live.Response {
+		t.Errorf("replayed response = %q, recorded %q", replayed.Response, live.Response)
+	}
+	replayedStream := readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`))
+	if !strings.Contains(replayedStream, "stream.") || len(eventNames(parseSSE(replayedStream))) != len(eventNames(parseSSE(liveStream))) {
+		t.Errorf("replayed stream = %q, recorded %q", replayedStream, liveStream)
+	}
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"never recorded"}`)
+	readBody(t, resp)
+	if resp.StatusCode == http.StatusOK {
+		t.Error("request without a recording succeeded")
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	var payload interface{}
+	json.Unmarshal([]byte(`{"messages":[{"content":"key"}],"data_sources":[{"parameters":{"key":"s1","authentication":{"type":"api_key","key":"s2"}}}]}`), &payload)
+	out, _ := json.Marshal(redactSecrets(payload))
+	if got := string(out); strings.Contains(got, "s1") || strings.Contains(got, "s2") || !strings.Contains(got, `"content":"key"`) {
+		t.Errorf("redactSecrets = %s", got)
+	}
+}
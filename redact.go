@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// RedactionConfig controls the output filter that masks PII and blocked words
+type RedactionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Built-in patterns to apply: "email", "phone", "ssn"
+	Builtins []string `json:"builtins"`
+	// Extra regular expressions and whole words (case-insensitive) to mask
+	Patterns    []string `json:"patterns,omitempty"`
+	Words       []string `json:"words,omitempty"`
+	Replacement string   `json:"replacement"`
+}
+
+var builtinRedactionPatterns = map[string]string{
+	"email": `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"phone": `(?:\+?1[-. ]?)?(?:\(\d{3}\)|\b\d{3})[-. ]?\d{3}[-. ]\d{4}\b`,
+	"ssn":   `\b\d{3}-\d{2}-\d{4}\b`,
+}
+
+// How much trailing text a stream redactor holds back in case a match
+// continues in the next chunk. Matches longer than this that straddle a
+// chunk boundary can slip through.
+const redactionHoldback = 64
+
+// redactor masks every configured pattern. A nil redactor is disabled.
+type redactor struct {
+	patterns    []*regexp.Regexp
+	replacement string
+}
+
+func newRedactor(cfg RedactionConfig) (*redactor, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	var sources []string
+	for _, name := range cfg.Builtins {
+		p, ok := builtinRedactionPatterns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown built-in redaction pattern %q", name)
+		}
+		sources = append(sources, p)
+	}
+	sources = append(sources, cfg.Patterns...)
+	if len(cfg.Words) > 0 {
+		quoted := make([]string, len(cfg.Words))
+		for i, w := range cfg.Words {
+			quoted[i] = regexp.QuoteMeta(w)
+		}
+		sources = append(sources, `(?i)\b(?:`+strings.Join(quoted, "|")+`)\b`)
+	}
+
+	r := &redactor{replacement: cfg.Replacement}
+	for _, src := range sources {
+		re, err := regexp.Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %q: %w", src, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+func (r *redactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+// Return the earliest start of any match that ends at or after cut, or cut
+// when no match spans it
+func (r *redactor) safeCut(s string, cut int) int {
+	for _, re := range r.patterns {
+		for _, m := range re.FindAllStringIndex(s, -1) {
+			if m[0] < cut && m[1] >= cut {
+				cut = m[0]
+			}
+		}
+	}
+	return cut
+}
+
+// streamRedactor redacts streamed content, holding back the tail of the
+// text until it can no longer be part of a match spanning chunks
+type streamRedactor struct {
+	r       *redactor
+	pending string
+}
+
+func (r *redactor) stream() *streamRedactor {
+	return &streamRedactor{r: r}
+}
+
+// Add a delta and return the text that is now safe to send
+func (sr *streamRedactor) Write(delta string) string {
+	if sr.r == nil {
+		return delta
+	}
+	sr.pending += delta
+	cut := len(sr.pending) - redactionHoldback
+	if cut <= 0 {
+		return ""
+	}
+	cut = sr.r.safeCut(sr.pending, cut)
+	for cut > 0 && !utf8.RuneStart(sr.pending[cut]) {
+		cut--
+	}
+
+	out := sr.r.redact(sr.pending[:cut])
+	sr.pending = sr.pending[cut:]
+	return out
+}
+
+// Return the remaining held-back text once the stream has ended
+func (sr *streamRedactor) Flush() string {
+	out := sr.r.redact(sr.pending)
+	sr.pending = ""
+	return out
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testRedactor(t *testing.T) *redactor {
+	t.Helper()
+	r, err := newRedactor(RedactionConfig{
+		Enabled:     true,
+		Builtins:    []string{"email", "phone", "ssn"},
+		Words:       []string{"Project Falcon"},
+		Replacement: "[redacted]",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRedact(t *testing.T) {
+	r := testRedactor(t)
+	tests := map[string]string{
+		"Mail jane.doe@example.com today":        "Mail [redacted] today",
+		"Call (555) 123-4567 or 555.123.4567":    "Call [redacted] or [redacted]",
+		"SSN 123-45-6789.":                       "SSN [redacted].",
+		"About project falcon and falconry":      "About [redacted] and falconry",
+		"Nothing to hide in 2024-01-01 or 12345": "Nothing to hide in 2024-01-01 or 12345",
+	}
+	for in, want := range tests {
+		if got := r.redact(in); got != want {
+			t.Errorf("redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDisabledRedactorPassesThrough(t *testing.T) {
+	var r *redactor
+	if r.redact("a@b.com") != "a@b.com" {
+		t.Fatal("nil redactor changed content")
+	}
+	if got := r.stream().Write("a@b.com"); got != "a@b.com" {
+		t.Fatalf("nil stream redactor held back %q", got)
+	}
+}
+
+func TestStreamRedactorCrossChunkMatches(t *testing.T) {
+	r := testRedactor(t)
+	text := strings.Repeat("Some filler text here. ", 6) +
+		"Contact jane.doe@example.com or (555) 123-4567, SSN 123-45-6789, re Project Falcon." +
+		strings.Repeat(" More filler follows.", 6)
+	want := r.redact(text)
+
+	for size := 1; size <= 12; size++ {
+		sr := r.stream()
+		var out strings.Builder
+		for i := 0; i < len(text); i += size {
+			end := i + size
+			if end > len(text) {
+				end = len(text)
+			}
+			chunk := sr.Write(text[i:end])
+			if strings.Contains(chunk, "@") || strings.Contains(chunk, "6789") {
+				t.Fatalf("chunk size %d leaked PII: %q", size, chunk)
+			}
+			out.WriteString(chunk)
+		}
+		out.WriteString(sr.Flush())
+		if out.String() != want {
+			t.Errorf("chunk size %d:\n got %q\nwant %q", size, out.String(), want)
+		}
+	}
+}
+
+func TestStreamRedactorKeepsMultibyteRunesWhole(t *testing.T) {
+	r := testRedactor(t)
+	text := strings.Repeat("héllo wörld ", 20)
+	sr := r.stream()
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		out.WriteString(sr.Write(text[i : i+1]))
+	}
+	out.WriteString(sr.Flush())
+	if out.String() != text {
+		t.Fatalf("multibyte content corrupted: %q", out.String())
+	}
+}
+
+func TestNewRedactorRejectsUnknownBuiltin(t *testing.T) {
+	if _, err := newRedactor(RedactionConfig{Enabled: true, Builtins: []string{"passport"}}); err == nil {
+		t.Fatal("accepted an unknown builtin")
+	}
+}
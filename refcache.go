@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// referenceCache remembers the references found for a grounded query so
+// a repeat of it can show sources before the new answer has streamed
+type referenceCache struct {
+	mu         sync.Mutex
+	entries    map[string]cachedReferences
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+}
+
+type cachedReferences struct {
+	refs []Reference
+	at   time.Time
+}
+
+func newReferenceCache(maxEntries int, ttl time.Duration) *referenceCache {
+	return &referenceCache{
+		entries:    make(map[string]cachedReferences),
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		now:        time.Now,
+	}
+}
+
+// Cache key for a message searched against an index. Case and spacing
+// differences do not change what the search returns, so they share a key.
+func referenceCacheKey(search SearchConfig, message string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(message), " "))
+	sum := sha256.Sum256([]byte(search.Endpoint + "\x00" + search.Index + "\x00" + search.SemanticConfig + "\x00" + search.Filter + "\x00" + normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *referenceCache) get(key string) ([]Reference, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.now().Sub(entry.at) > c.ttl {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.refs, true
+}
+
+// Store refs for key. When full, expired entries are dropped first and
+// then the oldest one.
+func (c *referenceCache) put(key string, refs []Reference) {
+	if len(refs) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		oldestKey, oldest := "", c.now()
+		for k, e := range c.entries {
+			if c.now().Sub(e.at) > c.ttl {
+				delete(c.entries, k)
+				continue
+			}
+			if !e.at.After(oldest) {
+				oldestKey, oldest = k, e.at
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldestKey)
+		}
+	}
+	c.entries[key] = cachedReferences{refs: refs, at: c.now()}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// What to do when a grounded answer has no reference list, see
+// Config.ReferenceFallback
+const (
+	referenceFallbackOff         = "off"
+	referenceFallbackContextOnly = "context-only"
+	referenceFallbackFollowUp    = "followup"
+)
+
+// Instruction sent when the model answered without listing its sources
+const sourcesPrompt = `List the sources you used for your previous answer as a numbered list under a "References:" heading, using a standard academic format. Do not repeat the answer.`
+
+// Reference lines for Azure's grounding citations, numbered in order
+func citationLines(context *AzureMessageContext) []string {
+	if context == nil {
+		return nil
+	}
+	var lines []string
+	for i, ref := range citationsToReferences(context.Citations, 0) {
+		text := ref.Title
+		if ref.URL != "" {
+			text += ". " + ref.URL
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, text))
+	}
+	return lines
+}
+
+// Numbered lines of a reply to sourcesPrompt, for when the model left out
+// the heading
+func numberedLines(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(line); referenceNumberRegex.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Fill in the references of a grounded answer that has none. With
+// context-only or followup the reference list is built from Azure's
+// citations; failing that, followup asks the model once for its sources
+// when the request requires references. The follow-up's usage is added to
+// resp. A failed follow-up leaves the list empty.
+func (s *Server) fallbackReferences(ctx context.Context, required bool, endpoint string, data map[string]interface{}, resp *AzureResponse) []string {
+	mode := s.cfg.ReferenceFallback
+	if mode == referenceFallbackOff {
+		return nil
+	}
+	message := resp.Choices[0].Message
+	if lines := citationLines(message.Context); len(lines) > 0 {
+		return lines
+	}
+	if mode != referenceFallbackFollowUp || !required {
+		return nil
+	}
+
+	logf(ctx, "Answer has no references, asking for its sources")
+	next, err := s.callAzure(ctx, endpoint, withFollowUp(data, message.Content, sourcesPrompt))
+	if err != nil {
+		logf(ctx, "Sources follow-up failed, returning no references: %v", err)
+		return nil
+	}
+	resp.Usage = addUsage(resp.Usage, next.Usage)
+	content := next.Choices[0].Message.Content
+	if _, references := parseResponseAndReferences(content, s.headings); len(references) > 0 {
+		return references
+	}
+	return numberedLines(content)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestReferenceFallback(t *testing.T) {
+	withCitations := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"Answer [doc1].","context":{"citations":[
+			{"title":"Guide","url":"https://kb.example.com/guide"}]}}}]}`))
+	}
+	// No citations; a follow-up gets the sources
+	followUp := func() *azureStub {
+		azure := &azureStub{}
+		azure.handler = func(w http.ResponseWriter, r *http.Request) {
+			content := "Answer without sources."
+			if len(azure.payloads) > 1 {
+				content = "References:\n1. Smith, J. (2020). Go in practice."
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": content}}},
+			})
+		}
+		return azure
+	}
+
+	tests := []struct {
+		name  string
+		mode  string
+		azure *azureStub
+		body  string
+		want  []string
+		calls int
+	}{
+		{"off ignores citations", referenceFallbackOff, &azureStub{handler: withCitations}, `{"message":"hi"}`, nil, 1},
+		{"context-only uses citations", referenceFallbackContextOnly, &azureStub{handler: withCitations}, `{"message":"hi"}`, []string{"1. Guide. https://kb.example.com/guide"}, 1},
+		{"context-only never follows up", referenceFallbackContextOnly, followUp(), `{"message":"hi","requireReferences":true}`, nil, 1},
+		{"followup prefers citations", referenceFallbackFollowUp, &azureStub{handler: withCitations}, `{"message":"hi","requireReferences":true}`, []string{"1. Guide. https://kb.example.com/guide"}, 1},
+		{"followup only when required", referenceFallbackFollowUp, followUp(), `{"message":"hi"}`, nil, 1},
+		{"followup asks for sources", referenceFallbackFollowUp, followUp(), `{"message":"hi","requireReferences":true}`, []string{"1. Smith, J. (2020). Go in practice."}, 2},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.ReferenceFallback = tt.mode
+		_, front := newTestServer(t, cfg, tt.azure)
+
+		var got ChatResponse
+		json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", tt.body))), &got)
+		if !reflect.DeepEqual(got.References, tt.want) {
+			t.Errorf("%s: references = %q, want %q", tt.name, got.References, tt.want)
+		}
+		if n := len(tt.azure.payloads); n != tt.calls {
+			t.Errorf("%s: azure calls = %d, want %d", tt.name, n, tt.calls)
+		}
+	}
+}
+
+func TestNumberedLines(t *testing.T) {
+	got := numberedLines("Here are my sources:\n1. Go spec\n  2) Effective Go\nThanks")
+	if want := []string{"1. Go spec", "2) Effective Go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("numberedLines = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Citation returned by Azure On Your Data in the message context
+type AzureCitation struct {
+	Content  string `json:"content"`
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Filepath string `json:"filepath"`
+	ChunkID  string `json:"chunk_id"`
+
+	// Relevance of the chunk, when the search returned it; the semantic
+	// reranker's score is preferred over the original search score
+	RerankScore         *float64 `json:"rerank_score,omitempty"`
+	OriginalSearchScore *float64 `json:"original_search_score,omitempty"`
+
+	// Search index the citation was retrieved from, see labelCitations
+	SearchIndex string `json:"-"`
+}
+
+// Grounding context attached to a message when data_sources is used
+type AzureMessageContext struct {
+	Citations []AzureCitation `json:"citations"`
+	Intent    string          `json:"intent"`
+}
+
+var (
+	referenceNumberRegex = regexp.MustCompile(`^\s*(?:\[\d+\]|\d+[.)])\s*`)
+	referenceURLRegex    = regexp.MustCompile(`https?://[^\s<>()\[\]]+`)
+	referenceAPARegex    = regexp.MustCompile(`^(.+?)\s*\((\d{4})[a-z]?\)\.?\s*(.*)$`)
+)
+
+// Label citations with the index of the search that retrieved them. Azure
+// takes a single data source per request and does not name it in its
+// citations, so each one comes from the request's index.
+func (sc SearchConfig) labelCitations(citations []AzureCitation) {
+	for i := range citations {
+		citations[i].SearchIndex = sc.Index
+	}
+}
+
+// Parse a reference line written by the model into a structured Reference.
+// Handles the common "Authors (Year). Title. Publisher. URL" shape and falls
+// back to using the whole line as the title.
+func parseStructuredReference(line string) Reference {
+	ref := Reference{Source: "model"}
+	text := referenceNumberRegex.ReplaceAllString(strings.TrimSpace(line), "")
+
+	if link := referenceURLRegex.FindString(text); link != "" {
+		ref.URL = strings.TrimRight(link, ".,;")
+		text = strings.TrimSpace(strings.Replace(text, link, "", 1))
+		text = strings.TrimSuffix(strings.TrimSpace(strings.TrimSuffix(text, "Retrieved from")), ".")
+	}
+
+	if m := referenceAPARegex.FindStringSubmatch(text); m != nil {
+		ref.Authors = strings.TrimSuffix(strings.TrimSpace(m[1]), ",")
+		ref.Year = m[2]
+		text = m[3]
+		if end := strings.Index(text, ". "); end >= 0 {
+			text = text[:end]
+		}
+	}
+
+	ref.Title = strings.Trim(strings.TrimSpace(text), `."*`)
+	if ref.Title == "" {
+		ref.Title = ref.URL
+	}
+	return ref
+}
+
+// Convert Azure grounding citations to References. When snippetChars is
+// positive each reference carries its excerpt, cut to that many characters,
+// and the document location it came from.
+func citationsToReferences(citations []AzureCitation, snippetChars int) []Reference {
+	refs := make([]Reference, 0, len(citations))
+	for _, c := range citations {
+		ref := Reference{
+			Source:      "azure_search",
+			SearchIndex: c.SearchIndex,
+			Title:       c.Title,
+			URL:         c.URL,
+		}
+		if ref.Title == "" {
+			ref.Title = c.Filepath
+		}
+		ref.Score = c.RerankScore
+		if ref.Score == nil {
+			ref.Score = c.OriginalSearchScore
+		}
+		if snippetChars > 0 {
+			ref.Snippet = truncateSnippet(c.Content, snippetChars)
+			ref.Filepath = c.Filepath
+			ref.ChunkID = c.ChunkID
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// Build the structured references for a response, preferring the citations
+// Azure returned from grounding over the model's own reference list.
+func extractReferences(context *AzureMessageContext, lines []string, snippetChars int) []Reference {
+	if context != nil && len(context.Citations) > 0 {
+		return citationsToReferences(context.Citations, snippetChars)
+	}
+	refs := make([]Reference, 0, len(lines))
+	for _, line := range lines {
+		refs = append(refs, parseStructuredReference(line))
+	}
+	return refs
+}
+
+// Order references by score, highest first. References without a score
+// keep their order after the scored ones.
+func sortReferencesByScore(refs []Reference) {
+	sort.SliceStable(refs, func(i, j int) bool {
+		a, b := refs[i].Score, refs[j].Score
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		return *a > *b
+	})
+}
+
+// Collapse whitespace in a citation excerpt and cut it to max runes
+func truncateSnippet(content string, max int) string {
+	snippet := []rune(strings.Join(strings.Fields(content), " "))
+	if len(snippet) <= max {
+		return string(snippet)
+	}
+	return strings.TrimSpace(string(snippet[:max])) + "…"
+}
+
+// Cut the titles and authors of refs to the configured lengths, returning
+// a copy so cached references are left as they are. Snippets are already
+// cut to SnippetMaxChars when extracted.
+func (s *Server) limitReferenceFields(refs []Reference) []Reference {
+	if refs == nil {
+		return nil
+	}
+	limited := make([]Reference, len(refs))
+	for i, ref := range refs {
+		ref.Title = truncateField(ref.Title, s.cfg.ReferenceTitleMaxChars)
+		ref.Authors = truncateField(ref.Authors, s.cfg.ReferenceAuthorMaxChars)
+		limited[i] = ref
+	}
+	return limited
+}
+
+// Cut a reference field longer than max runes like a snippet, leaving
+// shorter ones untouched; zero max disables
+func truncateField(field string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(field) <= max {
+		return field
+	}
+	return truncateSnippet(field, max)
+}
+
+// Reference renderings selected by a request's reference_formats
+type referenceFormats struct {
+	strings    bool
+	structured bool
+	bibtex     bool
+}
+
+// Parse reference_formats, defaulting to plain strings when it is empty
+func parseReferenceFormats(names []string) (referenceFormats, error) {
+	if len(names) == 0 {
+		return referenceFormats{strings: true}, nil
+	}
+	var f referenceFormats
+	for _, name := range names {
+		switch name {
+		case "strings":
+			f.strings = true
+		case "structured":
+			f.structured = true
+		case "bibtex":
+			f.bibtex = true
+		default:
+			return f, fmt.Errorf("unknown reference format %q, want strings, structured or bibtex", name)
+		}
+	}
+	return f, nil
+}
+
+var bibtexEscaper = strings.NewReplacer(`\`, `\textbackslash{}`, "{", `\{`, "}", `\}`, "&", `\&`, "%", `\%`, "$", `\$`, "#", `\#`, "_", `\_`)
+
+// Render references as BibTeX @misc entries keyed ref1, ref2, ...
+func formatBibTeX(refs []Reference) string {
+	var b strings.Builder
+	for i, ref := range refs {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "@misc{ref%d,\n", i+1)
+		field := func(name, value string) {
+			if value != "" {
+				fmt.Fprintf(&b, "  %s = {%s},\n", name, bibtexEscaper.Replace(value))
+			}
+		}
+		field("title", ref.Title)
+		field("author", ref.Authors)
+		field("year", ref.Year)
+		if ref.URL != "" {
+			// url fields are read verbatim by the LaTeX url package, so no escaping
+			fmt.Fprintf(&b, "  url = {%s},\n", ref.URL)
+		}
+		if ref.AccessDate != "" {
+			field("note", "Accessed "+ref.AccessDate)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// Key grouping references from the same source: the URL's host without
+// "www.", then the authors, or "" when neither is known
+func referenceSourceKey(ref Reference) string {
+	if ref.URL != "" {
+		if u, err := url.Parse(ref.URL); err == nil && u.Hostname() != "" {
+			return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+		}
+	}
+	if ref.Authors != "" {
+		return "author:" + strings.ToLower(ref.Authors)
+	}
+	return ""
+}
+
+// Keep at most max references per source, in order, and report how many
+// were dropped. References with no known source are always kept.
+func capReferencesPerSource(refs []Reference, max int) ([]Reference, int) {
+	if max <= 0 {
+		return refs, 0
+	}
+	seen := make(map[string]int)
+	kept := refs[:0:0]
+	for _, ref := range refs {
+		if key := referenceSourceKey(ref); key != "" {
+			if seen[key] >= max {
+				continue
+			}
+			seen[key]++
+		}
+		kept = append(kept, ref)
+	}
+	return kept, len(refs) - len(kept)
+}
+
+// Apply the per-source cap to the model's reference lines, keyed by the
+// URL or authors parsed from each line
+func capReferenceLinesPerSource(lines []string, max int) ([]string, int) {
+	if max <= 0 {
+		return lines, 0
+	}
+	seen := make(map[string]int)
+	var kept []string
+	for _, line := range lines {
+		if key := referenceSourceKey(parseStructuredReference(line)); key != "" {
+			if seen[key] >= max {
+				continue
+			}
+			seen[key]++
+		}
+		kept = append(kept, line)
+	}
+	return kept, len(lines) - len(kept)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResponseAndReferences(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantMain string
+		wantRefs []string
+	}{
+		{"plain", "Answer.\nReferences:\n1. Foo\n2. Bar", "Answer.", []string{"1. Foo", "2. Bar"}},
+		{"no section", "Just an answer.", "Just an answer.", nil},
+		{"lower case", "Answer.\nreferences:\n1. Foo", "Answer.", []string{"1. Foo"}},
+		{"no colon", "Answer.\nSources\n1. Foo", "Answer.", []string{"1. Foo"}},
+		{"markdown heading", "Answer.\n## Bibliography\n- Foo", "Answer.", []string{"- Foo"}},
+		{"bold heading", "Answer.\n**References:**\n1. Foo", "Answer.", []string{"1. Foo"}},
+		{"inline first entry", "Answer.\nReferences: 1. Foo", "Answer.", []string{"1. Foo"}},
+		{"mid paragraph", "See the References: section of the manual.", "See the References: section of the manual.", nil},
+		{"prose at line start", "Answer.\nReferences to this are rare.", "Answer.\nReferences to this are rare.", nil},
+		{"last heading wins", "Answer.\nSources:\n1. Draft\nMore text.\nReferences:\n1. Final", "Answer.\nSources:\n1. Draft\nMore text.", []string{"1. Final"}},
+	}
+	headings := newReferenceHeadings(defaultReferenceHeadings)
+	for _, tt := range tests {
+		main, refs := parseResponseAndReferences(tt.content, headings)
+		if main != tt.wantMain || !reflect.DeepEqual(refs, tt.wantRefs) {
+			t.Errorf("%s: got %q, %q; want %q, %q", tt.name, main, refs, tt.wantMain, tt.wantRefs)
+		}
+	}
+
+	custom := newReferenceHeadings([]string{"Further reading"})
+	if _, refs := parseResponseAndReferences("Answer.\nFurther reading:\n1. Foo\nReferences:\n2. Bar", custom); !reflect.DeepEqual(refs, []string{"1. Foo", "References:", "2. Bar"}) {
+		t.Errorf("custom heading refs = %q", refs)
+	}
+}
+
+func TestParseStructuredReference(t *testing.T) {
+	tests := []struct {
+		line string
+		want Reference
+	}{
+		{
+			"1. Smith, J., & Doe, A. (2020). Understanding things. Journal of Stuff, 3(2), 1-10. https://doi.org/10.1/abc",
+			Reference{Source: "model", Title: "Understanding things", Authors: "Smith, J., & Doe, A.", Year: "2020", URL: "https://doi.org/10.1/abc"},
+		},
+		{
+			"[2] Microsoft. (2023). Azure OpenAI documentation. Retrieved from https://learn.microsoft.com/azure.",
+			Reference{Source: "model", Title: "Azure OpenAI documentation", Authors: "Microsoft.", Year: "2023", URL: "https://learn.microsoft.com/azure"},
+		},
+		{"3) Some plain title", Reference{Source: "model", Title: "Some plain title"}},
+	}
+	for _, tt := range tests {
+		if got := parseStructuredReference(tt.line); got != tt.want {
+			t.Errorf("parseStructuredReference(%q)\n got %+v\nwant %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestExtractReferencesPrefersCitations(t *testing.T) {
+	ctx := &AzureMessageContext{Citations: []AzureCitation{{Title: "Doc", URL: "https://d"}, {Filepath: "a/b.pdf"}}}
+	got := extractReferences(ctx, []string{"1. Ignored"}, 0)
+	want := []Reference{
+		{Source: "azure_search", Title: "Doc", URL: "https://d"},
+		{Source: "azure_search", Title: "a/b.pdf"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("extractReferences = %+v, want %+v", got, want)
+	}
+}
+
+func TestReferencesOnly(t *testing.T) {
+	azure := &azureStub{content: "References:\n1. Smith (2020). Title."}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat?references_only=true", `{"message":"hi"}`)
+	var refs ReferencesResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &refs)
+	if resp.StatusCode != http.StatusOK || len(refs.References) != 1 || refs.References[0].Year != "2020" {
+		t.Fatalf("status=%d references=%+v", resp.StatusCode, refs.References)
+	}
+	if got := azure.payload(t, 0)["max_tokens"]; got != float64(300) {
+		t.Errorf("max_tokens = %v, want 300", got)
+	}
+}
+
+func TestReferencesOnlyKeepsReasoningBudget(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DefaultModel = "o1"
+	cfg.Models = map[string]ModelConfig{"o1": {Reasoning: true}}
+	azure := &azureStub{content: "References:\n1. Title."}
+	_, front := newTestServer(t, cfg, azure)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat?references_only=true", `{"message":"hi"}`))
+	if got := azure.payload(t, 0)["max_completion_tokens"]; got != float64(defaultParams.MaxTokens) {
+		t.Errorf("max_completion_tokens = %v, want %d", got, defaultParams.MaxTokens)
+	}
+}
+
+func TestReferencesOnlyRequiresGrounding(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Features.Grounding = false
+	_, front := newTestServer(t, cfg, &azureStub{content: "x"})
+
+	resp := postJSON(t, front.URL+"/api/chat?references_only=true", `{"message":"hi"}`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestReferenceFormats(t *testing.T) {
+	azure := &azureStub{content: "Answer.\n\nReferences:\n1. Smith, J. (2020). Go & You. https://example.com/go"}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","reference_formats":["structured","bibtex"]}`)
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if got.References != nil {
+		t.Errorf("references = %v, want omitted when strings is not requested", got.References)
+	}
+	if len(got.StructuredReferences) != 1 || got.StructuredReferences[0].Year != "2020" {
+		t.Errorf("structuredReferences = %+v", got.StructuredReferences)
+	}
+	want := "@misc{ref1,\n  title = {Go \\& You},\n  author = {Smith, J.},\n  year = {2020},\n  url = {https://example.com/go},\n}\n"
+	if got.BibTeX != want {
+		t.Errorf("bibtex = %q, want %q", got.BibTeX, want)
+	}
+}
+
+func TestReferenceFormatsDefaultAndUnknown(t *testing.T) {
+	azure := &azureStub{content: "Answer.\n\nReferences:\n1. Smith (2020). Title."}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if len(got.References) != 1 || got.StructuredReferences != nil || got.BibTeX != "" {
+		t.Errorf("default response = %+v, want strings only", got)
+	}
+
+	resp = postJSON(t, front.URL+"/api/chat", `{"message":"hi","reference_formats":["mla"]}`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status for unknown format = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestIncludeSnippets(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SnippetMaxChars = 12
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"Answer [doc1].","context":{"citations":[
+			{"title":"Guide","content":"The  quick brown\nfox jumps","filepath":"docs/guide.md","chunk_id":"3"}]}}}]}`))
+	}}
+	_, front := newTestServer(t, cfg, azure)
+
+	for _, tt := range []struct {
+		body string
+		want Reference
+	}{
+		{`{"message":"hi"}`, Reference{Source: "azure_search", Title: "Guide"}},
+		{`{"message":"hi","include_snippets":true}`, Reference{Source: "azure_search", Title: "Guide", Snippet: "The quick br…", Filepath: "docs/guide.md", ChunkID: "3"}},
+	} {
+		resp := postJSON(t, front.URL+"/api/chat?references_only=true", tt.body)
+		var refs ReferencesResponse
+		json.Unmarshal([]byte(readBody(t, resp)), &refs)
+		if len(refs.References) != 1 || !reflect.DeepEqual(refs.References[0], tt.want) {
+			t.Errorf("%s: references = %+v, want [%+v]", tt.body, refs.References, tt.want)
+		}
+	}
+}
+
+func TestCapReferencesPerSource(t *testing.T) {
+	lines := []string{
+		"1. Go docs. https://go.dev/doc",
+		"2. Effective Go. https://www.go.dev/effective",
+		"3. Spec. https://go.dev/ref/spec",
+		"4. Smith, J. (2020). One.",
+		"5. Smith, J. (2021). Two.",
+		"6. Unattributed note",
+	}
+	got, collapsed := capReferenceLinesPerSource(lines, 1)
+	want := []string{lines[0], lines[3], lines[5]}
+	if !reflect.DeepEqual(got, want) || collapsed != 3 {
+		t.Errorf("capReferenceLinesPerSource = %q, %d, want %q, 3", got, collapsed, want)
+	}
+	if got, collapsed := capReferenceLinesPerSource(lines, 0); len(got) != len(lines) || collapsed != 0 {
+		t.Errorf("cap 0 dropped references: %q, %d", got, collapsed)
+	}
+
+	refs := citationsToReferences([]AzureCitation{{Title: "a", URL: "https://kb.example.com/a"}, {Title: "b", URL: "https://kb.example.com/b"}}, 0)
+	if kept, n := capReferencesPerSource(refs, 1); len(kept) != 1 || n != 1 {
+		t.Errorf("capReferencesPerSource kept %d, collapsed %d, want 1 and 1", len(kept), n)
+	}
+}
+
+func TestReferenceScores(t *testing.T) {
+	var citations AzureMessageContext
+	json.Unmarshal([]byte(`{"citations":[
+		{"title":"Unscored"},
+		{"title":"Low","original_search_score":1.5},
+		{"title":"High","rerank_score":3.2,"original_search_score":0.4}]}`), &citations)
+	refs := citationsToReferences(citations.Citations, 0)
+	if refs[0].Score != nil {
+		t.Errorf("unscored citation has score %v", *refs[0].Score)
+	}
+	if refs[1].Score == nil || *refs[1].Score != 1.5 || refs[2].Score == nil || *refs[2].Score != 3.2 {
+		t.Fatalf("scores = %v, %v, want the search score and the rerank score", refs[1].Score, refs[2].Score)
+	}
+	if b, _ := json.Marshal(refs[0]); strings.Contains(string(b), `"score"`) {
+		t.Errorf("unscored reference JSON = %s", b)
+	}
+
+	sortReferencesByScore(refs)
+	var titles []string
+	for _, ref := range refs {
+		titles = append(titles, ref.Title)
+	}
+	if want := []string{"High", "Low", "Unscored"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("sorted titles = %q, want %q", titles, want)
+	}
+}
+
+func TestSortReferencesByScoreFlag(t *testing.T) {
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"Answer.","context":{"citations":[
+			{"title":"Low","rerank_score":0.5},{"title":"High","rerank_score":2.5}]}}}]}`))
+	}}
+	for _, sorted := range []bool{false, true} {
+		cfg := defaultConfig()
+		cfg.SortReferencesByScore = sorted
+		_, front := newTestServer(t, cfg, azure)
+
+		var got ChatResponse
+		json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","reference_formats":["structured"]}`))), &got)
+		want := "Low"
+		if sorted {
+			want = "High"
+		}
+		if len(got.StructuredReferences) != 2 || got.StructuredReferences[0].Title != want {
+			t.Errorf("sorted=%v: references = %+v, want %s first", sorted, got.StructuredReferences, want)
+		}
+	}
+}
+
+func TestTruncateField(t *testing.T) {
+	for _, tt := range []struct {
+		field string
+		max   int
+		want  string
+	}{
+		{"Short title", 20, "Short title"},
+		{"Keeps  its\nspacing", 20, "Keeps  its\nspacing"},
+		{"A title that runs on and on", 12, "A title that…"},
+		{"Über lange Überschrift", 10, "Über lange…"},
+		{"Anything goes", 0, "Anything goes"},
+	} {
+		if got := truncateField(tt.field, tt.max); got != tt.want {
+			t.Errorf("truncateField(%q, %d) = %q, want %q", tt.field, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestReferenceFieldLimits(t *testing.T) {
+	authors := strings.Repeat("Smith, J., ", 10) + "Jones, K."
+	title := "Go " + strings.Repeat("and more Go ", 20)
+	azure := &azureStub{content: "Answer.\n\nReferences:\n1. " + authors + " (2020). " + title + ". https://example.com/go"}
+	cfg := defaultConfig()
+	cfg.ReferenceTitleMaxChars = 40
+	cfg.ReferenceAuthorMaxChars = 30
+	_, front := newTestServer(t, cfg, azure)
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","reference_formats":["structured"]}`))), &got)
+	if len(got.StructuredReferences) != 1 {
+		t.Fatalf("structuredReferences = %+v, want one", got.StructuredReferences)
+	}
+	ref := got.StructuredReferences[0]
+	if !strings.HasSuffix(ref.Title, "…") || len([]rune(ref.Title)) > 41 {
+		t.Errorf("title = %q, want it cut to 40 characters and an ellipsis", ref.Title)
+	}
+	if !strings.HasSuffix(ref.Authors, "…") || len([]rune(ref.Authors)) > 31 {
+		t.Errorf("authors = %q, want them cut to 30 characters and an ellipsis", ref.Authors)
+	}
+	if ref.Year != "2020" || ref.URL != "https://example.com/go" {
+		t.Errorf("reference = %+v, want the other fields intact", ref)
+	}
+}
+
+func TestCitationsLabeledBySearchIndex(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Search = SearchConfig{Endpoint: "https://main.search", Index: "main-index", Key: "main-key"}
+	cfg.Tenants = map[string]TenantConfig{"hr": {Search: SearchConfig{Index: "hr-index"}}}
+	cfg.Clients = map[string]ClientConfig{
+		"key-hr":   {Name: "hr", Tenant: "hr"},
+		"key-main": {Name: "main"},
+	}
+	citation := `{"title":"Handbook","url":"https://example.com/handbook"}`
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		azure.mu.Lock()
+		payload := azure.payloads[len(azure.payloads)-1]
+		azure.mu.Unlock()
+		if payload["stream"] == true {
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"context\":{\"citations\":[" + citation + "]}}}]}\n\n"))
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Answer [doc1].\"}}]}\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"Answer [doc1].","context":{"citations":[` + citation + `]}}}]}`))
+	}
+	_, front := newTestServer(t, cfg, azure)
+
+	for key, index := range map[string]string{"key-main": "main-index", "key-hr": "hr-index"} {
+		var chat ChatResponse
+		json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","reference_formats":["structured"]}`, "X-API-Key", key))), &chat)
+		if len(chat.StructuredReferences) != 1 || chat.StructuredReferences[0].SearchIndex != index {
+			t.Errorf("%s: structuredReferences = %+v, want the citation labeled %s", key, chat.StructuredReferences, index)
+		}
+
+		events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`, "X-API-Key", key)))
+		labeled := 0
+		for _, ev := range events {
+			if ev.Name != "references" && ev.Name != "enriched" {
+				continue
+			}
+			var body struct{ References []Reference }
+			json.Unmarshal([]byte(ev.Data), &body)
+			if len(body.References) != 1 || body.References[0].SearchIndex != index {
+				t.Errorf("%s: %s event = %s, want the citation labeled %s", key, ev.Name, ev.Data, index)
+			}
+			labeled++
+		}
+		if labeled != 2 {
+			t.Errorf("%s: events = %v, want references and enriched", key, eventNames(events))
+		}
+	}
+}
+
+func TestModelReferencesHaveNoSearchIndex(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Search.Index = "main-index"
+	_, front := newTestServer(t, cfg, &azureStub{content: "Answer.\nReferences:\n1. Go spec"})
+
+	var chat ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","reference_formats":["structured"]}`))), &chat)
+	if len(chat.StructuredReferences) != 1 || chat.StructuredReferences[0].SearchIndex != "" {
+		t.Errorf("structuredReferences = %+v, want model-written references unlabeled", chat.StructuredReferences)
+	}
+}
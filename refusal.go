@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Phrases that open a refusal, matched case-insensitively
+var defaultRefusalPatterns = []string{
+	`\bI(?: a|')m (?:sorry|afraid),? but I (?:can(?:no|')t|am unable to|won't)\b`,
+	`^\s*I (?:can(?:no|')t|am unable to|won't) (?:help|assist|provide|comply)`,
+	`^\s*(?:Sorry|Unfortunately),? I (?:can(?:no|')t|am unable to)\b`,
+}
+
+// Only the opening of an answer is checked, so an answer that merely
+// quotes a refusal further down is not flagged
+const refusalScanChars = 300
+
+// refusalDetector recognizes answers where the model declined to respond
+type refusalDetector struct {
+	patterns []*regexp.Regexp
+}
+
+func newRefusalDetector(patterns []string) (*refusalDetector, error) {
+	d := &refusalDetector{}
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("refusal pattern %q: %w", p, err)
+		}
+		d.patterns = append(d.patterns, re)
+	}
+	return d, nil
+}
+
+// Reports whether an answer is a refusal and why: "content_filter" when
+// Azure's filter stopped the completion, "model_refusal" when the answer
+// opens with a configured refusal phrase
+func (d *refusalDetector) detect(content, finishReason string) (bool, string) {
+	if finishReason == "content_filter" {
+		return true, "content_filter"
+	}
+	opening := []rune(content)
+	if len(opening) > refusalScanChars {
+		opening = opening[:refusalScanChars]
+	}
+	for _, re := range d.patterns {
+		if re.MatchString(string(opening)) {
+			return true, "model_refusal"
+		}
+	}
+	return false, ""
+}
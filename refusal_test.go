@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRefusalDetector(t *testing.T) {
+	d, err := newRefusalDetector(defaultRefusalPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		content, finishReason string
+		want                  string
+	}{
+		{"I'm sorry, but I can't help with that.", "stop", "model_refusal"},
+		{"I cannot assist with this request.", "stop", "model_refusal"},
+		{"Unfortunately, I am unable to share that.", "stop", "model_refusal"},
+		{"Go is a programming language.", "content_filter", "content_filter"},
+		{"Go is a programming language.", "stop", ""},
+		{strings.Repeat("Long answer. ", 40) + "I'm sorry, but I can't help with that.", "stop", ""},
+	}
+	for _, tt := range tests {
+		refused, reason := d.detect(tt.content, tt.finishReason)
+		if reason != tt.want || refused != (tt.want != "") {
+			t.Errorf("detect(%.40q, %q) = %v, %q, want %q", tt.content, tt.finishReason, refused, reason, tt.want)
+		}
+	}
+}
+
+func TestRefusalSkipsReferenceParsing(t *testing.T) {
+	azure := &azureStub{content: "I'm sorry, but I can't help with that.\nReferences:\n1. Policy"}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if resp.StatusCode != http.StatusOK || !got.Refused || got.RefusalReason != "model_refusal" || got.References != nil {
+		t.Fatalf("status=%d response=%+v, want a refusal without references", resp.StatusCode, got)
+	}
+}
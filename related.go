@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Follow-up questions asked for when a request sets include_related
+const relatedQuestionsCount = 3
+
+// The heading the model is asked to put above its related questions, with
+// the same Markdown leeway as reference headings
+var relatedHeadingRegex = regexp.MustCompile(`(?im)^[ \t]*(?:#{1,6}[ \t]*)?(?:\*\*|__)?related questions(?:\*\*|__)?(?::(?:\*\*|__)?|[ \t]*$)`)
+
+// Numbering or a bullet in front of a question
+var questionPrefixRegex = regexp.MustCompile(`^(?:\[\d+\]|\d+[.)]|[-*•])\s*`)
+
+// Ask for related questions in their own section, before the references
+// so streamed reference lines stay clean
+func formatRelatedQuestionsPrompt(prompt string) string {
+	return fmt.Sprintf(`%s
+
+Before the list of references, suggest %d related follow-up questions the user might ask next, as a numbered list under a "Related questions:" heading.`, prompt, relatedQuestionsCount)
+}
+
+// Cut the related questions section out of content, returning the rest
+// and the questions with their numbering and blank lines removed. The
+// section ends at the next reference heading, if any.
+func splitRelatedQuestions(content string, headings *referenceHeadings) (string, []string) {
+	matches := relatedHeadingRegex.FindAllStringIndex(content, -1)
+	if len(matches) == 0 {
+		return content, nil
+	}
+	m := matches[len(matches)-1]
+	rest, section := strings.TrimSpace(content[:m[0]]), content[m[1]:]
+	if start, _ := headings.last(section); start >= 0 {
+		rest += "\n\n" + strings.TrimSpace(section[start:])
+		section = section[:start]
+	}
+
+	var questions []string
+	for _, line := range strings.Split(section, "\n") {
+		question := strings.TrimSpace(questionPrefixRegex.ReplaceAllString(strings.TrimSpace(line), ""))
+		question = strings.Trim(question, "*_")
+		if question != "" && len(questions) < relatedQuestionsCount {
+			questions = append(questions, question)
+		}
+	}
+	return rest, questions
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitRelatedQuestions(t *testing.T) {
+	headings := newReferenceHeadings(defaultReferenceHeadings)
+	tests := []struct {
+		name      string
+		content   string
+		wantRest  string
+		wantQuest []string
+	}{
+		{
+			"before references",
+			"Answer.\n\nRelated questions:\n1. What is A?\n\n2) What is B?\n- What is C?\n\nReferences:\n1. Foo",
+			"Answer.\n\nReferences:\n1. Foo",
+			[]string{"What is A?", "What is B?", "What is C?"},
+		},
+		{
+			"markdown heading at the end",
+			"Answer.\n## **Related Questions**\n* **Why A?**\n* Why B?\n* Why C?\n* Why D?",
+			"Answer.",
+			[]string{"Why A?", "Why B?", "Why C?"},
+		},
+		{
+			"prose mention only",
+			"See the related questions: below are none.",
+			"See the related questions: below are none.",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		rest, questions := splitRelatedQuestions(tt.content, headings)
+		if rest != tt.wantRest || !reflect.DeepEqual(questions, tt.wantQuest) {
+			t.Errorf("%s: got %q, %q; want %q, %q", tt.name, rest, questions, tt.wantRest, tt.wantQuest)
+		}
+	}
+}
+
+func TestChatIncludeRelated(t *testing.T) {
+	azure := &azureStub{content: "Answer.\nRelated questions:\n1. Next?\n2. After?\n3. Later?\nReferences:\n1. Foo"}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","include_related":true}`))), &got)
+	if got.Response != "Answer." || !reflect.DeepEqual(got.RelatedQuestions, []string{"Next?", "After?", "Later?"}) || !reflect.DeepEqual(got.References, []string{"1. Foo"}) {
+		t.Errorf("response = %+v", got)
+	}
+	if prompt := userMessage(azure.payload(t, 0)); !strings.Contains(prompt, `"Related questions:"`) {
+		t.Errorf("prompt does not ask for related questions: %q", prompt)
+	}
+
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &got)
+	if prompt := userMessage(azure.payload(t, 1)); strings.Contains(prompt, "Related questions") {
+		t.Errorf("prompt asks for related questions without include_related: %q", prompt)
+	}
+}
+
+func TestStreamIncludeRelated(t *testing.T) {
+	azure := &azureStub{deltas: []string{"Answer.\nRelated ques", "tions:\n1. Next?\n", "References:\n1. Foo"}}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true,"include_related":true}`)))
+	var enriched EnhancedChatResponse
+	var done StreamDone
+	for _, e := range events {
+		switch e.Name {
+		case "enriched":
+			json.Unmarshal([]byte(e.Data), &enriched)
+		case "done":
+			json.Unmarshal([]byte(e.Data), &done)
+		}
+	}
+	if !reflect.DeepEqual(enriched.RelatedQuestions, []string{"Next?"}) || done.Response != "Answer." {
+		t.Errorf("enriched = %+v, done = %+v", enriched, done)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Write v as JSON with a content hash in ETag and X-Content-Hash, replying
+// 304 Not Modified when the request's If-None-Match already has it. RFC 9110
+// answers a matching If-None-Match on other methods than GET and HEAD with
+// 412 Precondition Failed.
+// encoding/json writes struct fields in declaration order and map keys
+// sorted, so the same value always hashes the same.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	etag := `"` + hash + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Content-Hash", "sha256="+hash)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotModified)
+		} else {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Reports whether an If-None-Match header value matches etag, using the
+// weak comparison RFC 9110 specifies for If-None-Match
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteJSONHashIsDeterministic(t *testing.T) {
+	v := ChatResponse{Response: "a", References: []string{"r"}, Grounded: true}
+	first, second := httptest.NewRecorder(), httptest.NewRecorder()
+	writeJSON(first, httptest.NewRequest("POST", "/", nil), v)
+	writeJSON(second, httptest.NewRequest("POST", "/", nil), v)
+
+	if first.Header().Get("ETag") == "" || first.Header().Get("ETag") != second.Header().Get("ETag") {
+		t.Fatalf("ETags differ: %q vs %q", first.Header().Get("ETag"), second.Header().Get("ETag"))
+	}
+	if first.Header().Get("X-Content-Hash") == "" {
+		t.Fatal("missing X-Content-Hash")
+	}
+}
+
+func TestWriteJSONIfNoneMatch(t *testing.T) {
+	v := ChatResponse{Response: "a"}
+	rec := httptest.NewRecorder()
+	writeJSON(rec, httptest.NewRequest("GET", "/", nil), v)
+	etag := rec.Header().Get("ETag")
+
+	for _, method := range []string{"GET", "POST"} {
+		// A match is 304 on GET and 412 on anything else
+		matched := http.StatusNotModified
+		if method == "POST" {
+			matched = http.StatusPreconditionFailed
+		}
+		for header, want := range map[string]int{
+			etag:                 matched,
+			`"other", W/` + etag: matched,
+			"*":                  matched,
+			`"other"`:            http.StatusOK,
+			"":                   http.StatusOK,
+		} {
+			req := httptest.NewRequest(method, "/", nil)
+			if header != "" {
+				req.Header.Set("If-None-Match", header)
+			}
+			rec := httptest.NewRecorder()
+			writeJSON(rec, req, v)
+			if rec.Code != want {
+				t.Errorf("%s If-None-Match %q: status %d, want %d", method, header, rec.Code, want)
+			}
+			if want == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("%s If-None-Match %q: 304 carried a body", method, header)
+			}
+		}
+	}
+}
+
+func TestChatIfNoneMatchPreconditionFailed(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), &azureStub{content: "Answer."})
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	readBody(t, resp)
+	etag := resp.Header.Get("ETag")
+
+	resp = postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "If-None-Match", etag)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("POST with a matching If-None-Match: status %d, want 412", resp.StatusCode)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// QueryRewriteConfig controls the query expansion call made before a
+// grounded request
+type QueryRewriteConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Model from Models that rewrites the query, ideally a cheap one; empty
+	// uses the default model
+	Model string `json:"model"`
+
+	// Completion budget for the rewrite
+	MaxTokens int `json:"maxTokens"`
+}
+
+// QueryRewriter turns a user's question into a query that retrieves the
+// documents needed to answer it, e.g. by adding synonyms or splitting it
+// into sub-questions.
+type QueryRewriter interface {
+	Rewrite(ctx context.Context, query string) (string, error)
+}
+
+const queryRewritePrompt = `Rewrite the user's question as a search query for a document index. Add synonyms and related terms, and split compound questions into their parts. Reply with the query only, on one line.`
+
+// modelRewriter asks a chat model to rewrite the query
+type modelRewriter struct {
+	s         *Server
+	model     ModelConfig
+	maxTokens int
+}
+
+func newModelRewriter(s *Server, cfg QueryRewriteConfig) (*modelRewriter, error) {
+	name, model, ok := s.cfg.modelFor(cfg.Model)
+	if !ok {
+		return nil, fmt.Errorf("query rewrite model %q is not configured", name)
+	}
+	return &modelRewriter{s: s, model: model, maxTokens: cfg.MaxTokens}, nil
+}
+
+func (mr *modelRewriter) Rewrite(ctx context.Context, query string) (string, error) {
+	data := map[string]interface{}{
+		"messages": []map[string]interface{}{
+			{"role": "system", "content": queryRewritePrompt},
+			{"role": "user", "content": query},
+		},
+	}
+	applyParams(data, GenerationParams{MaxTokens: mr.maxTokens, TopP: 1}, mr.model)
+	ctx, cancel := context.WithTimeout(ctx, mr.s.policyFor(mr.model.Endpoint).timeout)
+	defer cancel()
+	resp, err := mr.s.callAzure(ctx, mr.model.Endpoint, data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// Search hint appended to a prompt, since Azure derives its search query
+// from the user message. The question above it stays the one answered.
+func formatSearchQueryHint(prompt, query string) string {
+	return fmt.Sprintf("%s\n\nSearch query: %s", prompt, query)
+}
+
+// Rewrite the message for retrieval, returning "" when there is no
+// rewriter or the rewrite fails or changes nothing
+func (s *Server) rewriteQuery(ctx context.Context, message string) string {
+	if s.rewriter == nil {
+		return ""
+	}
+	expanded, err := s.rewriter.Rewrite(ctx, message)
+	if err != nil {
+		logf(ctx, "Query rewrite failed, searching with the original query: %v", err)
+		return ""
+	}
+	if expanded == "" || expanded == message {
+		return ""
+	}
+	logf(ctx, "Query rewritten for search: original=%q expanded=%q", message, expanded)
+	return expanded
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type stubRewriter struct {
+	expanded string
+	err      error
+	queries  []string
+}
+
+func (sr *stubRewriter) Rewrite(ctx context.Context, query string) (string, error) {
+	sr.queries = append(sr.queries, query)
+	return sr.expanded, sr.err
+}
+
+// Content of the last message in an Azure payload
+func userMessage(payload map[string]interface{}) string {
+	messages, _ := payload["messages"].([]interface{})
+	if len(messages) == 0 {
+		return ""
+	}
+	content, _ := messages[len(messages)-1].(map[string]interface{})["content"].(string)
+	return content
+}
+
+func TestQueryRewriteAddsSearchQuery(t *testing.T) {
+	azure := &azureStub{content: "Answer."}
+	srv, front := newTestServer(t, defaultConfig(), azure)
+	rewriter := &stubRewriter{expanded: "go generics type parameters constraints"}
+	srv.rewriter = rewriter
+
+	postJSON(t, front.URL+"/api/chat", `{"message":"How do Go generics work?"}`)
+	prompt := userMessage(azure.payload(t, 0))
+	if !strings.HasPrefix(prompt, "How do Go generics work?") {
+		t.Errorf("prompt does not start with the original question: %q", prompt)
+	}
+	if !strings.HasSuffix(prompt, "Search query: go generics type parameters constraints") {
+		t.Errorf("prompt does not end with the expanded query: %q", prompt)
+	}
+	if len(rewriter.queries) != 1 || rewriter.queries[0] != "How do Go generics work?" {
+		t.Errorf("rewriter got %q", rewriter.queries)
+	}
+}
+
+func TestQueryRewriteSkipped(t *testing.T) {
+	t.Run("failed rewrite", func(t *testing.T) {
+		azure := &azureStub{content: "Answer."}
+		srv, front := newTestServer(t, defaultConfig(), azure)
+		srv.rewriter = &stubRewriter{err: errors.New("boom")}
+
+		if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d", resp.StatusCode)
+		}
+		if prompt := userMessage(azure.payload(t, 0)); strings.Contains(prompt, "Search query:") {
+			t.Errorf("prompt has a search query after a failed rewrite: %q", prompt)
+		}
+	})
+	t.Run("grounding off", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Features.Grounding = false
+		srv, front := newTestServer(t, cfg, &azureStub{content: "Answer."})
+		rewriter := &stubRewriter{expanded: "expanded"}
+		srv.rewriter = rewriter
+
+		postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+		if len(rewriter.queries) != 0 {
+			t.Error("rewriter called for an ungrounded request")
+		}
+	})
+}
+
+func TestModelRewriter(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.QueryRewrite.Enabled = true
+	azure := &azureStub{content: "  go generics type parameters\n"}
+	srv, _ := newTestServer(t, cfg, azure)
+
+	got, err := srv.rewriter.Rewrite(context.Background(), "How do Go generics work?")
+	if err != nil || got != "go generics type parameters" {
+		t.Fatalf("Rewrite = %q, %v", got, err)
+	}
+	payload := azure.payload(t, 0)
+	if systemMessage(payload) != queryRewritePrompt || userMessage(payload) != "How do Go generics work?" {
+		t.Errorf("rewrite payload = %v", payload)
+	}
+	if payload["max_tokens"] != float64(100) || payload["data_sources"] != nil {
+		t.Errorf("rewrite payload = %v, want a small ungrounded completion", payload)
+	}
+}
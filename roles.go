@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+
+// Earlier message of a conversation supplied by the client
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// MessageRoleConfig controls client-supplied messages. Only user and
+// assistant messages are forwarded; the server's system prompt always
+// comes first.
+type MessageRoleConfig struct {
+	// Reject requests carrying system or unknown roles with 400 invalid_role
+	// instead of dropping those messages
+	Strict bool `json:"strict"`
+
+	// Most recent client messages kept, counting stored conversation turns
+	// as two messages each
+	MaxMessages int `json:"maxMessages"`
+}
+
+// Roles a client may send in messages
+var clientRoles = map[string]bool{"user": true, "assistant": true}
+
+// Check the roles of client messages and render the allowed ones as chat
+// messages, dropping the rest unless Strict. Returns how many were dropped.
+func (mc MessageRoleConfig) sanitize(messages []ChatMessage) ([]map[string]interface{}, int, error) {
+	var out []map[string]interface{}
+	dropped := 0
+	for i, m := range messages {
+		if !clientRoles[m.Role] {
+			if mc.Strict {
+				return nil, 0, fmt.Errorf("messages[%d] has role %q, want user or assistant", i, m.Role)
+			}
+			dropped++
+			continue
+		}
+		out = append(out, map[string]interface{}{"role": m.Role, "content": m.Content})
+	}
+	return out, dropped, nil
+}
+
+// Keep only the most recent max history messages
+func capHistoryMessages(messages []map[string]interface{}, max int) []map[string]interface{} {
+	if len(messages) > max {
+		return messages[len(messages)-max:]
+	}
+	return messages
+}
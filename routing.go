@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// RoutingRule sends requests that match every one of its conditions to a
+// model. Unset conditions always match.
+type RoutingRule struct {
+	// The client's tier, e.g. "premium"
+	Tier string `json:"tier,omitempty"`
+
+	// The request's priority field, e.g. "high"
+	Priority string `json:"priority,omitempty"`
+
+	// Characters in the message and any client-supplied messages
+	MinMessageChars int `json:"minMessageChars,omitempty"`
+
+	// Model from Models the request is routed to
+	Model string `json:"model"`
+}
+
+// Reports whether a request with these attributes satisfies the rule
+func (rr RoutingRule) matches(tier, priority string, messageChars int) bool {
+	return (rr.Tier == "" || rr.Tier == tier) &&
+		(rr.Priority == "" || rr.Priority == priority) &&
+		messageChars >= rr.MinMessageChars
+}
+
+// Check that every rule routes to a configured model and has a condition
+func (c *Config) validateRoutingRules() error {
+	for i, rule := range c.RoutingRules {
+		if _, ok := c.Models[rule.Model]; !ok {
+			return fmt.Errorf("routing rule %d routes to unknown model %q", i+1, rule.Model)
+		}
+		if rule.MinMessageChars < 0 {
+			return fmt.Errorf("routing rule %d has a negative minMessageChars", i+1)
+		}
+		if rule.Tier == "" && rule.Priority == "" && rule.MinMessageChars == 0 {
+			return fmt.Errorf("routing rule %d has no conditions", i+1)
+		}
+	}
+	return nil
+}
+
+// Characters a routing rule's minMessageChars is compared with
+func requestChars(req ChatRequest) int {
+	n := utf8.RuneCountInString(req.Message)
+	for _, m := range req.Messages {
+		n += utf8.RuneCountInString(m.Content)
+	}
+	return n
+}
+
+// Pick the model for a request that names none: the first rule it matches
+// whose model the client may use, else the default model. A model named by
+// the request always wins over the rules.
+func (c *Config) routeModel(client *ClientConfig, req ChatRequest) string {
+	if req.Model != "" {
+		return req.Model
+	}
+	tier := ""
+	if client != nil {
+		tier = client.Tier
+	}
+	chars := requestChars(req)
+	for _, rule := range c.RoutingRules {
+		if rule.matches(tier, req.Priority, chars) && c.modelAllowed(client, rule.Model) {
+			return rule.Model
+		}
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func routingConfig() *Config {
+	cfg := defaultConfig()
+	cfg.Models = map[string]ModelConfig{"small": {}, "large": {}, "dedicated": {}, "urgent": {}}
+	cfg.DefaultModel = "small"
+	cfg.RoutingRules = []RoutingRule{
+		{Tier: "premium", Model: "dedicated"},
+		{Priority: "high", Model: "urgent"},
+		{MinMessageChars: 20, Model: "large"},
+	}
+	return cfg
+}
+
+func TestRouteModel(t *testing.T) {
+	cfg := routingConfig()
+	premium := &ClientConfig{Name: "p", Tier: "premium"}
+	restricted := &ClientConfig{Name: "r", Tier: "premium", AllowedModels: []string{"small", "large"}}
+	long := strings.Repeat("é", 20)
+
+	tests := []struct {
+		name   string
+		client *ClientConfig
+		req    ChatRequest
+		want   string
+	}{
+		{"no rule matches", nil, ChatRequest{Message: "hi"}, ""},
+		{"tier", premium, ChatRequest{Message: long}, "dedicated"},
+		{"priority", nil, ChatRequest{Message: "hi", Priority: "high"}, "urgent"},
+		{"other priority", nil, ChatRequest{Message: "hi", Priority: "low"}, ""},
+		{"message length", nil, ChatRequest{Message: long}, "large"},
+		{"length counts client messages", nil, ChatRequest{Message: "hi", Messages: []ChatMessage{{Role: "user", Content: long}}}, "large"},
+		{"short message", nil, ChatRequest{Message: long[:len(long)-2]}, ""},
+		{"rule model not allowed", restricted, ChatRequest{Message: long}, "large"},
+		{"explicit model wins", premium, ChatRequest{Message: "hi", Model: "small"}, "small"},
+	}
+	for _, tt := range tests {
+		if got := cfg.routeModel(tt.client, tt.req); got != tt.want {
+			t.Errorf("%s: routeModel = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRoutingRules(t *testing.T) {
+	cfg := routingConfig()
+	if err := cfg.validateRoutingRules(); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []RoutingRule{
+		{Tier: "premium", Model: "missing"},
+		{Model: "large"},
+		{MinMessageChars: -1, Model: "large"},
+	} {
+		cfg.RoutingRules = []RoutingRule{rule}
+		if err := cfg.validateRoutingRules(); err == nil {
+			t.Errorf("rule %+v was accepted", rule)
+		}
+	}
+}
+
+func TestChatUsesRoutedModel(t *testing.T) {
+	cfg := routingConfig()
+	cfg.Models["urgent"] = ModelConfig{Reasoning: true}
+	azure := &azureStub{content: "ok"}
+	_, front := newTestServer(t, cfg, azure)
+
+	for _, body := range []string{`{"message":"hi"}`, `{"message":"hi","priority":"high"}`} {
+		if resp := postJSON(t, front.URL+"/api/chat", body); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d", body, resp.StatusCode)
+		}
+	}
+	if _, ok := azure.payload(t, 0)["max_completion_tokens"]; ok {
+		t.Error("unrouted request used the reasoning model")
+	}
+	if _, ok := azure.payload(t, 1)["max_completion_tokens"]; !ok {
+		t.Error("high priority request was not routed to the reasoning model")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// jsonSchema is the subset of JSON Schema used to validate structured
+// answers: type, enum, properties, required, additionalProperties, items
+// and the numeric, string and array bounds. Unknown keywords are ignored,
+// as the specification allows.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"-"`
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+}
+
+// schemaTypes accepts "type" as either a string or a list of strings
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = many
+	return nil
+}
+
+func (s *jsonSchema) UnmarshalJSON(data []byte) error {
+	type plain jsonSchema
+	var aux struct {
+		*plain
+		AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	}
+	aux.plain = (*plain)(s)
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(aux.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(aux.AdditionalProperties, &allowed); err != nil {
+			return fmt.Errorf("only boolean additionalProperties is supported")
+		}
+		s.AdditionalProperties = &allowed
+	}
+	for _, t := range s.Type {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("unknown type %q", t)
+		}
+	}
+	return nil
+}
+
+// Parse a caller-supplied schema
+func compileSchema(raw json.RawMessage) (*jsonSchema, error) {
+	var schema jsonSchema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, fmt.Errorf("invalid responseSchema: %w", err)
+	}
+	return &schema, nil
+}
+
+// Parse content as JSON and validate it, returning the parsed value and any
+// violations as "path: problem" strings
+func (s *jsonSchema) validateContent(content string) (json.RawMessage, []string) {
+	raw := json.RawMessage(strings.TrimSpace(content))
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return nil, []string{"$: response is not a single JSON value"}
+	}
+	return raw, s.validate(v, "$")
+}
+
+func (s *jsonSchema) validate(v interface{}, path string) []string {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Type) > 0 && !s.Type.matches(v) {
+		fail("expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeOf(v))
+		return errs
+	}
+	if len(s.Enum) > 0 && !enumContains(s.Enum, v) {
+		fail("value is not one of the allowed values")
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := s.Properties[name]; ok {
+				errs = append(errs, prop.validate(v[name], path+"."+name)...)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				fail("unexpected property %q", name)
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("expected at least %d items, got %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("expected at most %d items, got %d", *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				errs = append(errs, s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("expected at least %d characters, got %d", *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("expected at most %d characters, got %d", *s.MaxLength, n)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("%v is less than the minimum %v", v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("%v is greater than the maximum %v", v, *s.Maximum)
+		}
+	}
+	return errs
+}
+
+// Reports whether v has one of the listed types
+func (t schemaTypes) matches(v interface{}) bool {
+	actual := jsonTypeOf(v)
+	for _, want := range t {
+		if want == actual || (want == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// JSON Schema type name of a decoded value; whole numbers are integers
+func jsonTypeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func enumContains(enum []interface{}, v interface{}) bool {
+	want, _ := json.Marshal(v)
+	for _, e := range enum {
+		if got, _ := json.Marshal(e); bytes.Equal(got, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// User prompt asking for a JSON answer matching schema. Azure requires the
+// word JSON in the messages whenever json_object mode is on.
+func formatSchemaPrompt(message string, schema json.RawMessage) string {
+	return fmt.Sprintf(`%s
+
+Respond only with a JSON object that matches this JSON Schema:
+%s`, message, schema)
+}
+
+// Follow-up prompt asking the model to fix a response that failed validation
+func formatSchemaRetryPrompt(violations []string) string {
+	return "Your JSON did not match the schema:\n- " + strings.Join(violations, "\n- ") + "\n\nRespond only with the corrected JSON object."
+}
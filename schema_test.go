@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const personSchema = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2}
+	}
+}`
+
+func TestSchemaValidateContent(t *testing.T) {
+	schema, err := compileSchema(json.RawMessage(personSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{`{"name":"Ada","age":36,"tags":["a"]}`, nil},
+		{`{"name":"Ada"}`, []string{`$: missing required property "age"`}},
+		{`{"name":"","age":1.5}`, []string{"$.age: expected integer, got number", "$.name: expected at least 1 characters, got 0"}},
+		{`{"name":"Ada","age":3,"tags":["c"],"extra":1}`, []string{`$: unexpected property "extra"`, "$.tags[0]: value is not one of the allowed values"}},
+		{`not json`, []string{"$: response is not a single JSON value"}},
+	}
+	for _, tt := range tests {
+		_, got := schema.validateContent(tt.content)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: violations = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+
+	if _, err := compileSchema(json.RawMessage(`{"type":"decimal"}`)); err == nil {
+		t.Error("compileSchema accepted an unknown type")
+	}
+}
+
+func TestResponseSchemaRetriesOnce(t *testing.T) {
+	answers := []string{`{"name":"Ada"}`, `{"name":"Ada","age":36}`}
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		azure.mu.Lock()
+		n := len(azure.payloads) - 1
+		azure.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": answers[n%len(answers)]}}},
+		})
+	}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	body, _ := json.Marshal(map[string]interface{}{"message": "Who?", "responseSchema": json.RawMessage(personSchema)})
+	resp := postJSON(t, front.URL+"/api/chat", string(body))
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &got)
+	if resp.StatusCode != http.StatusOK || string(got.Data) != answers[1] {
+		t.Fatalf("status=%d data=%s, want 200 and the corrected object", resp.StatusCode, got.Data)
+	}
+	if format := azure.payload(t, 0)["response_format"]; !reflect.DeepEqual(format, map[string]interface{}{"type": "json_object"}) {
+		t.Errorf("response_format = %v", format)
+	}
+	retry := azure.payload(t, 1)["messages"].([]interface{})
+	last := retry[len(retry)-1].(map[string]interface{})["content"].(string)
+	if !strings.Contains(last, `missing required property "age"`) {
+		t.Errorf("retry prompt = %q, want the violations", last)
+	}
+}
+
+func TestResponseSchemaViolation(t *testing.T) {
+	azure := &azureStub{content: `{"name":"Ada"}`}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	body, _ := json.Marshal(map[string]interface{}{"message": "Who?", "responseSchema": json.RawMessage(personSchema)})
+	resp := postJSON(t, front.URL+"/api/chat", string(body))
+	var errResp ErrorResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &errResp)
+	if resp.StatusCode != http.StatusUnprocessableEntity || errResp.Code != "schema_violation" {
+		t.Fatalf("status=%d code=%q, want 422 schema_violation", resp.StatusCode, errResp.Code)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// OData field paths, e.g. "language" or "metadata/product"
+var searchFieldRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(?:/[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// Quote a value as an OData string literal
+func odataString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// Build the search filter for a request: the index's default filter ANDed
+// with an equality clause per requested field. Fields must be on the
+// index's allowlist. Returns the default filter unchanged when the request
+// has no filters.
+func (sc SearchConfig) compileFilter(filters map[string]string) (string, error) {
+	if len(filters) == 0 {
+		return sc.Filter, nil
+	}
+	allowed := make(map[string]bool, len(sc.FilterableFields))
+	for _, field := range sc.FilterableFields {
+		allowed[field] = true
+	}
+
+	fields := make([]string, 0, len(filters))
+	for field := range filters {
+		if !allowed[field] || !searchFieldRegex.MatchString(field) {
+			return "", fmt.Errorf("searchFilters field %q is not filterable", field)
+		}
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var clauses []string
+	if sc.Filter != "" {
+		clauses = append(clauses, "("+sc.Filter+")")
+	}
+	for _, field := range fields {
+		clauses = append(clauses, field+" eq "+odataString(filters[field]))
+	}
+	return strings.Join(clauses, " and "), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCompileFilter(t *testing.T) {
+	sc := SearchConfig{FilterableFields: []string{"language", "product", "meta/team"}}
+	withDefault := sc
+	withDefault.Filter = "status eq 'published' or status eq 'draft'"
+
+	tests := []struct {
+		name    string
+		sc      SearchConfig
+		filters map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"none", sc, nil, "", false},
+		{"default only", withDefault, nil, withDefault.Filter, false},
+		{"sorted clauses", sc, map[string]string{"product": "X", "language": "en"}, "language eq 'en' and product eq 'X'", false},
+		{"escaped quote", sc, map[string]string{"product": "O'Brien' or 1 eq 1"}, "product eq 'O''Brien'' or 1 eq 1'", false},
+		{"field path", sc, map[string]string{"meta/team": "docs"}, "meta/team eq 'docs'", false},
+		{"combined with default", withDefault, map[string]string{"language": "en"}, "(status eq 'published' or status eq 'draft') and language eq 'en'", false},
+		{"not allowlisted", sc, map[string]string{"owner": "me"}, "", true},
+		{"no allowlist", SearchConfig{}, map[string]string{"language": "en"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := tt.sc.compileFilter(tt.filters)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: compileFilter = %q, %v; want %q, wantErr %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSearchFiltersInPayload(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Search.FilterableFields = []string{"language"}
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, cfg, azure)
+
+	if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if got := searchParams(t, azure.payload(t, 0))["filter"]; got != nil {
+		t.Errorf("filter without searchFilters = %v, want null", got)
+	}
+
+	if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","searchFilters":{"language":"en"}}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if got := searchParams(t, azure.payload(t, 1))["filter"]; got != "language eq 'en'" {
+		t.Errorf("filter = %v", got)
+	}
+
+	if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","searchFilters":{"owner":"me"}}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("disallowed field status = %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+)
+
+// Search REST API version of the self-test's document count call
+const selfTestSearchAPIVersion = "2023-11-01"
+
+// errSelfTestSkipped marks a check that does not apply to the configuration
+var errSelfTestSkipped = errors.New("skipped")
+
+// selfTestCheck is one step of the startup self-test
+type selfTestCheck struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Reports whether the process was started to self-test instead of serving,
+// with --selftest or SELFTEST=true
+func selfTestRequested(args []string) bool {
+	for _, arg := range args {
+		if arg == "--selftest" || arg == "-selftest" {
+			return true
+		}
+	}
+	return envBool("SELFTEST", false)
+}
+
+// Load the configuration, run every check against it and write the report
+// to w. Returns the process exit code: zero when every check passed.
+func selfTest(ctx context.Context, w io.Writer) int {
+	cfg, err := loadConfig()
+	if err == nil {
+		var srv *Server
+		if srv, err = NewServer(cfg); err == nil {
+			fmt.Fprintln(w, "PASS config")
+			return runSelfTest(ctx, w, srv.selfTestChecks())
+		}
+	}
+	fmt.Fprintf(w, "FAIL config: %v\n", err)
+	fmt.Fprintln(w, "Self-test failed")
+	return 1
+}
+
+// Run checks in order, writing a line per check and a summary. Returns
+// the exit code.
+func runSelfTest(ctx context.Context, w io.Writer, checks []selfTestCheck) int {
+	failed := 0
+	for _, check := range checks {
+		err := check.run(ctx)
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "PASS %s\n", check.name)
+		case errors.Is(err, errSelfTestSkipped):
+			fmt.Fprintf(w, "SKIP %s: %v\n", check.name, err)
+		default:
+			failed++
+			fmt.Fprintf(w, "FAIL %s: %v\n", check.name, err)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, "Self-test failed: %d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+	fmt.Fprintln(w, "Self-test passed")
+	return 0
+}
+
+// The checks for this configuration: a one-token completion against every
+// model endpoint and replica, a document count on every search index, and
+// the reference parser against its fixtures
+func (s *Server) selfTestChecks() []selfTestCheck {
+	var checks []selfTestCheck
+
+	names := []string{""}
+	for name := range s.cfg.Models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name, model, _ := s.cfg.modelFor(name)
+		for _, endpoint := range model.endpoints() {
+			if seen[endpoint] {
+				continue
+			}
+			seen[endpoint] = true
+			endpoint, model := endpoint, model
+			checks = append(checks, selfTestCheck{
+				name: fmt.Sprintf("chat %s (model %q)", endpoint, name),
+				run:  func(ctx context.Context) error { return s.pingChat(ctx, endpoint, model) },
+			})
+		}
+	}
+
+	var tenants []string
+	for name, tenant := range s.cfg.Tenants {
+		if tenant.Search.Endpoint != "" {
+			tenants = append(tenants, name)
+		}
+	}
+	sort.Strings(tenants)
+	if s.cfg.Features.Grounding && s.cfg.Search.Endpoint != "" {
+		checks = append(checks, s.searchCheck("search", s.cfg.Search))
+	}
+	for _, name := range tenants {
+		checks = append(checks, s.searchCheck("search tenant "+name, s.cfg.searchConfigFor(&ClientConfig{Tenant: name})))
+	}
+
+	return append(checks,
+		selfTestCheck{name: "embeddings", run: func(context.Context) error {
+			return fmt.Errorf("%w, no embeddings deployment is used", errSelfTestSkipped)
+		}},
+		selfTestCheck{name: "reference parser", run: func(context.Context) error { return s.checkReferenceParser() }},
+	)
+}
+
+// A check counting the documents of search's index
+func (s *Server) searchCheck(name string, search SearchConfig) selfTestCheck {
+	return selfTestCheck{name: name, run: func(ctx context.Context) error { return s.pingSearch(ctx, search) }}
+}
+
+// Send a one-token completion to one of model's endpoints
+func (s *Server) pingChat(ctx context.Context, endpoint string, model ModelConfig) error {
+	data := map[string]interface{}{
+		"messages": []map[string]interface{}{{"role": "user", "content": "ping"}},
+	}
+	applyParams(data, GenerationParams{MaxTokens: 1}, model)
+	ctx, cancel := context.WithTimeout(ctx, s.policyFor(endpoint).timeout)
+	defer cancel()
+	resp, err := s.postAzure(ctx, endpoint, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Count the documents of a search index, which checks the endpoint, the
+// index name and the key in one call
+func (s *Server) pingSearch(ctx context.Context, search SearchConfig) error {
+	u, err := url.Parse(search.Endpoint)
+	if err != nil {
+		return err
+	}
+	u = u.JoinPath("indexes", search.Index, "docs", "$count")
+	u.RawQuery = url.Values{"api-version": {selfTestSearchAPIVersion}}.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.AzureTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("api-key", search.Key)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("index %q answered status %d", search.Index, resp.StatusCode)
+	}
+	return nil
+}
+
+// Answers with a references section and the lines it must parse into
+var referenceParserFixtures = []struct {
+	content string
+	main    string
+	refs    []string
+}{
+	{"Go is fast [doc1].\n\nReferences:\n1. Go spec\n2. Effective Go", "Go is fast [doc1].", []string{"1. Go spec", "2. Effective Go"}},
+	{"Answer.\n**Sources:**\n1. Smith, J. (2020). Go & You. https://example.com/go", "Answer.", []string{"1. Smith, J. (2020). Go & You. https://example.com/go"}},
+	{"No references here.", "No references here.", nil},
+}
+
+// Run the reference parser, with the configured headings, on its fixtures
+func (s *Server) checkReferenceParser() error {
+	for i, fixture := range referenceParserFixtures {
+		main, refs := parseResponseAndReferences(fixture.content, s.headings)
+		if main != fixture.main || !reflect.DeepEqual(refs, fixture.refs) {
+			return fmt.Errorf("fixture %d parsed into %q and %q, want %q and %q", i+1, main, refs, fixture.main, fixture.refs)
+		}
+	}
+	ref := parseStructuredReference("1. Smith, J. (2020). Go & You. https://example.com/go")
+	if ref.Authors != "Smith, J." || ref.Year != "2020" || ref.Title != "Go & You" || ref.URL != "https://example.com/go" {
+		return fmt.Errorf("structured reference parsed into %+v", ref)
+	}
+	return nil
+}
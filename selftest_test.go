@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunSelfTestReport(t *testing.T) {
+	checks := []selfTestCheck{
+		{name: "ok", run: func(context.Context) error { return nil }},
+		{name: "optional", run: func(context.Context) error { return fmt.Errorf("%w, nothing to check", errSelfTestSkipped) }},
+	}
+	var out strings.Builder
+	if code := runSelfTest(context.Background(), &out, checks); code != 0 {
+		t.Errorf("exit code = %d, want 0 with no failure", code)
+	}
+	if want := "PASS ok\nSKIP optional: skipped, nothing to check\nSelf-test passed\n"; out.String() != want {
+		t.Errorf("report = %q, want %q", out.String(), want)
+	}
+
+	ran := false
+	checks = append(checks,
+		selfTestCheck{name: "broken", run: func(context.Context) error { return errors.New("no route to host") }},
+		selfTestCheck{name: "after", run: func(context.Context) error { ran = true; return nil }},
+	)
+	out.Reset()
+	if code := runSelfTest(context.Background(), &out, checks); code != 1 {
+		t.Errorf("exit code = %d, want 1 with a failure", code)
+	}
+	if !strings.Contains(out.String(), "FAIL broken: no route to host\n") || !strings.HasSuffix(out.String(), "Self-test failed: 1 of 4 checks failed\n") {
+		t.Errorf("report = %q, want the failure and the count", out.String())
+	}
+	if !ran {
+		t.Error("checks after a failure did not run, want every check reported")
+	}
+}
+
+func TestSelfTestChecksAgainstStubs(t *testing.T) {
+	searchStatus := http.StatusOK
+	var searchPath, searchKey string
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		searchPath, searchKey = r.URL.Path, r.Header.Get("api-key")
+		w.WriteHeader(searchStatus)
+		fmt.Fprint(w, "42")
+	}))
+	t.Cleanup(search.Close)
+
+	cfg := defaultConfig()
+	cfg.Search = SearchConfig{Endpoint: search.URL, Key: "search-key", Index: "docs"}
+	azure := &azureStub{content: "p"}
+	srv, _ := newTestServer(t, cfg, azure)
+
+	var out strings.Builder
+	if code := runSelfTest(context.Background(), &out, srv.selfTestChecks()); code != 0 {
+		t.Fatalf("exit code = %d, report:\n%s", code, out.String())
+	}
+	if len(azure.payloads) != 1 || azure.payloads[0]["max_tokens"] != float64(1) {
+		t.Errorf("chat payloads = %v, want one one-token completion", azure.payloads)
+	}
+	if searchPath != "/indexes/docs/docs/$count" || searchKey != "search-key" {
+		t.Errorf("search call = %s with key %q, want the index document count", searchPath, searchKey)
+	}
+	for _, line := range []string{"PASS chat ", "PASS search\n", "SKIP embeddings", "PASS reference parser\n"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("report lacks %q:\n%s", line, out.String())
+		}
+	}
+
+	searchStatus = http.StatusForbidden
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+	out.Reset()
+	if code := runSelfTest(context.Background(), &out, srv.selfTestChecks()); code != 1 {
+		t.Errorf("exit code = %d, want 1 when upstreams reject the self-test", code)
+	}
+	if !strings.Contains(out.String(), "FAIL chat ") || !strings.Contains(out.String(), "FAIL search: index \"docs\" answered status 403") {
+		t.Errorf("report = %s, want the chat and search failures", out.String())
+	}
+}
+
+func TestSelfTestConfigFailure(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRIES", "-1")
+	var out strings.Builder
+	if code := selfTest(context.Background(), &out); code != 1 {
+		t.Errorf("exit code = %d, want 1 for invalid config", code)
+	}
+	if !strings.HasPrefix(out.String(), "FAIL config: ") {
+		t.Errorf("report = %q, want the config failure", out.String())
+	}
+}
+
+func TestSelfTestRequested(t *testing.T) {
+	if !selfTestRequested([]string{"--selftest"}) || selfTestRequested(nil) {
+		t.Error("want --selftest, and only it, to request the self-test")
+	}
+	t.Setenv("SELFTEST", "true")
+	if !selfTestRequested(nil) {
+		t.Error("SELFTEST=true did not request the self-test")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// streamTracker counts the SSE responses being served so shutdown can
+// wait for them, and tells them to stop when the wait runs out.
+type streamTracker struct {
+	mu       sync.Mutex
+	active   int
+	idle     chan struct{} // closed while no stream is active
+	stopping chan struct{} // closed once streams must end
+	stopOnce sync.Once
+}
+
+func newStreamTracker() *streamTracker {
+	idle := make(chan struct{})
+	close(idle)
+	return &streamTracker{idle: idle, stopping: make(chan struct{})}
+}
+
+// Register a stream; call the returned function when it ends
+func (t *streamTracker) add() func() {
+	t.mu.Lock()
+	if t.active == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.active++
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.active--
+		if t.active == 0 {
+			close(t.idle)
+		}
+	}
+}
+
+// Number of streams being served
+func (t *streamTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// Wait up to timeout for every stream to end, reporting whether they did
+func (t *streamTracker) wait(timeout time.Duration) bool {
+	t.mu.Lock()
+	idle := t.idle
+	t.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Give active streams grace to finish on their own, then tell the rest to
+// send a shutdown event and return. Registered with http.Server so it
+// runs when Shutdown starts waiting for connections to go idle.
+func (t *streamTracker) drain(grace time.Duration) {
+	if t.wait(grace) {
+		return
+	}
+	t.stopOnce.Do(func() { close(t.stopping) })
+}
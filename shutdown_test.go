@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStreamTrackerWait(t *testing.T) {
+	tr := newStreamTracker()
+	if !tr.wait(time.Millisecond) {
+		t.Fatal("wait with no streams should return true")
+	}
+	done := tr.add()
+	if tr.wait(10 * time.Millisecond) {
+		t.Fatal("wait returned true with a stream active")
+	}
+	done()
+	if !tr.wait(time.Millisecond) {
+		t.Fatal("wait should return true once the stream ended")
+	}
+}
+
+func TestDrainSendsShutdownToOpenStreams(t *testing.T) {
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}}
+	srv, front := newTestServer(t, defaultConfig(), azure)
+
+	resp := postJSON(t, front.URL+"/api/chat/stream", `{"message":"hi"}`)
+	srv.streams.drain(20 * time.Millisecond)
+
+	names := eventNames(parseSSE(readBody(t, resp)))
+	if len(names) == 0 || names[len(names)-1] != "shutdown" {
+		t.Fatalf("events = %v, want the stream to end with shutdown", names)
+	}
+	if !srv.streams.wait(time.Second) {
+		t.Error("stream still tracked after shutdown")
+	}
+}
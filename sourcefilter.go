@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Azure's inline citation markers, e.g. "[doc2]"
+var docMarkerRegex = regexp.MustCompile(`(\s*)\[doc(\d+)\]`)
+
+// Path a citation is matched on: its filepath, or else its URL
+func citationSourcePath(c AzureCitation) string {
+	if c.Filepath != "" {
+		return c.Filepath
+	}
+	return c.URL
+}
+
+// Reports whether a document may be surfaced: it must match a prefix on
+// the allowlist, when there is one, and none on the denylist
+func (sc SearchConfig) sourceAllowed(path string) bool {
+	for _, prefix := range sc.DeniedSources {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	if len(sc.AllowedSources) == 0 {
+		return true
+	}
+	for _, prefix := range sc.AllowedSources {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Drop the citations the source lists do not allow, logging each one.
+// Returns the kept citations and, for each kept citation's old docN
+// number, its new one.
+func (sc SearchConfig) filterCitations(ctx context.Context, citations []AzureCitation) ([]AzureCitation, map[int]int) {
+	if len(sc.AllowedSources) == 0 && len(sc.DeniedSources) == 0 {
+		return citations, nil
+	}
+	kept := make([]AzureCitation, 0, len(citations))
+	renumber := make(map[int]int, len(citations))
+	for i, c := range citations {
+		if !sc.sourceAllowed(citationSourcePath(c)) {
+			logf(ctx, "Filtered grounding citation from restricted source %q", citationSourcePath(c))
+			continue
+		}
+		kept = append(kept, c)
+		renumber[i+1] = len(kept)
+	}
+	return kept, renumber
+}
+
+// Point [docN] markers at the kept citations and drop those whose
+// citation was filtered out
+func renumberDocMarkers(content string, renumber map[int]int) string {
+	if renumber == nil {
+		return content
+	}
+	return docMarkerRegex.ReplaceAllStringFunc(content, func(match string) string {
+		m := docMarkerRegex.FindStringSubmatch(match)
+		n, _ := strconv.Atoi(m[2])
+		next, ok := renumber[n]
+		if !ok {
+			return ""
+		}
+		return m[1] + "[doc" + strconv.Itoa(next) + "]"
+	})
+}
+
+// Filter the citations of a grounded answer in place, fixing its markers
+func (sc SearchConfig) filterMessageCitations(ctx context.Context, content *string, msgContext *AzureMessageContext) {
+	if msgContext == nil {
+		return
+	}
+	var renumber map[int]int
+	msgContext.Citations, renumber = sc.filterCitations(ctx, msgContext.Citations)
+	*content = renumberDocMarkers(*content, renumber)
+}
+
+// System prompt addition telling the model which documents it may use,
+// "" unless InstructSources is set
+func (sc SearchConfig) sourceInstruction() string {
+	if !sc.InstructSources {
+		return ""
+	}
+	var parts []string
+	if len(sc.AllowedSources) > 0 {
+		parts = append(parts, "Only use retrieved documents whose path starts with one of: "+strings.Join(sc.AllowedSources, ", ")+".")
+	}
+	if len(sc.DeniedSources) > 0 {
+		parts = append(parts, "Ignore retrieved documents whose path starts with any of: "+strings.Join(sc.DeniedSources, ", ")+".")
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFilterCitations(t *testing.T) {
+	citations := []AzureCitation{
+		{Title: "Handbook", Filepath: "public/handbook.md"},
+		{Title: "Salaries", Filepath: "hr/salaries.xlsx"},
+		{Title: "Wiki", URL: "https://wiki.example.com/page"},
+		{Title: "Drafts", Filepath: "public/drafts/plan.md"},
+	}
+	tests := []struct {
+		name string
+		sc   SearchConfig
+		want []string
+	}{
+		{"no lists", SearchConfig{}, []string{"Handbook", "Salaries", "Wiki", "Drafts"}},
+		{"denylist", SearchConfig{DeniedSources: []string{"hr/"}}, []string{"Handbook", "Wiki", "Drafts"}},
+		{"allowlist", SearchConfig{AllowedSources: []string{"public/"}}, []string{"Handbook", "Drafts"}},
+		{"allowlist by url", SearchConfig{AllowedSources: []string{"https://wiki.example.com/"}}, []string{"Wiki"}},
+		{"deny wins", SearchConfig{AllowedSources: []string{"public/"}, DeniedSources: []string{"public/drafts/"}}, []string{"Handbook"}},
+	}
+	for _, tt := range tests {
+		kept, _ := tt.sc.filterCitations(context.Background(), citations)
+		var titles []string
+		for _, c := range kept {
+			titles = append(titles, c.Title)
+		}
+		if strings.Join(titles, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: kept %q, want %q", tt.name, titles, tt.want)
+		}
+	}
+}
+
+func TestRenumberDocMarkers(t *testing.T) {
+	_, renumber := SearchConfig{DeniedSources: []string{"hr/"}}.filterCitations(context.Background(), []AzureCitation{
+		{Filepath: "public/a.md"}, {Filepath: "hr/b.md"}, {Filepath: "public/c.md"},
+	})
+	got := renumberDocMarkers("A [doc1]. B [doc2]. C [doc3].", renumber)
+	if want := "A [doc1]. B. C [doc2]."; got != want {
+		t.Errorf("renumberDocMarkers = %q, want %q", got, want)
+	}
+}
+
+func TestRestrictedCitationsAreNotReturned(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Search.DeniedSources = []string{"hr/"}
+	cfg.Search.InstructSources = true
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"Pay is set yearly [doc1] by policy [doc2].","context":{"citations":[
+			{"title":"Salaries","filepath":"hr/salaries.xlsx"},{"title":"Handbook","filepath":"public/handbook.md"}]}}}]}`))
+	}}
+	_, front := newTestServer(t, cfg, azure)
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","reference_formats":["structured"],"inlineCitations":true}`))), &got)
+	if len(got.StructuredReferences) != 1 || got.StructuredReferences[0].Title != "Handbook" {
+		t.Errorf("references = %+v, want only the handbook", got.StructuredReferences)
+	}
+	if got.Response != "Pay is set yearly by policy [1]." {
+		t.Errorf("response = %q", got.Response)
+	}
+	if system := systemMessage(azure.payload(t, 0)); !strings.Contains(system, "Ignore retrieved documents whose path starts with any of: hr/.") {
+		t.Errorf("system prompt has no source instruction: %q", system)
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A single chunk of an Azure OpenAI streaming response
+type AzureStreamChunk struct {
+	ID    string      `json:"id"`
+	Usage *AzureUsage `json:"usage,omitempty"`
+	// Sent in the first chunk, before any choices
+	PromptFilterResults []AzurePromptFilterResult `json:"prompt_filter_results,omitempty"`
+	Choices             []struct {
+		Delta struct {
+			Content string `json:"content"`
+			// Grounding citations, sent by On Your Data ahead of the content
+			Context *AzureMessageContext `json:"context,omitempty"`
+		} `json:"delta"`
+		Index        int     `json:"index"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+
+	// Set when Azure fails after the stream has started; no more content
+	// follows
+	Error *AzureStreamError `json:"error,omitempty"`
+}
+
+// AzureStreamError is an error object Azure sends inside a stream
+type AzureStreamError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// The "error" event for an error Azure sent mid-stream. The message is
+// our own; Azure's is only logged.
+func (e *AzureStreamError) event() map[string]string {
+	code := strings.ToLower(e.Code)
+	switch {
+	case strings.Contains(code, "content_filter") || strings.Contains(code, "responsibleaipolicyviolation"):
+		return map[string]string{"code": "content_filtered", "error": "The answer was blocked by the content filter"}
+	case code == "429" || strings.Contains(code, "rate_limit") || strings.Contains(code, "too_many_requests"):
+		return map[string]string{"code": "upstream_rate_limited", "error": "Azure OpenAI is rate limiting requests, retry later"}
+	case code == "408" || strings.Contains(code, "timeout"):
+		return map[string]string{"code": "upstream_timeout", "error": "Azure OpenAI timed out during the stream"}
+	default:
+		return map[string]string{"code": "upstream_error", "error": "Azure OpenAI reported an error during the stream"}
+	}
+}
+
+// StreamDone is the payload of the final SSE event
+type StreamDone struct {
+	Response            string   `json:"response"`
+	References          []string `json:"references,omitempty"`
+	Grounded            bool     `json:"grounded"`
+	Warnings            []string `json:"warnings,omitempty"`
+	CollapsedReferences int      `json:"collapsedReferences,omitempty"`
+	Refused             bool     `json:"refused,omitempty"`
+	RefusalReason       string   `json:"refusalReason,omitempty"`
+	Cost                *Cost    `json:"cost,omitempty"`
+	UpstreamRequestID   string   `json:"upstreamRequestId,omitempty"`
+
+	PromptFilterResults []PromptFilterResult `json:"promptFilterResults,omitempty"`
+}
+
+// streamOptions are the request settings that change how a stream's
+// content is parsed
+type streamOptions struct {
+	related         bool   // the answer ends with related questions
+	referencesFirst bool   // the references come ahead of the answer
+	footer          string // disclaimer appended to the answer, if any
+
+	// The request's context documents, grounding the answer in place of
+	// Azure Search
+	documentCitations []AzureCitation
+}
+
+// turnResult is a finished answer, handed to the chat handler's bookkeeping
+type turnResult struct {
+	Content    string
+	Usage      *AzureUsage
+	Grounded   bool
+	References []Reference // parsed references, nil for refusals
+}
+
+// sseWriter writes server-sent events and flushes after each one
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	return &sseWriter{w: w, flusher: flusher}, true
+}
+
+// Send a pre-encoded event with an id
+func (s *sseWriter) raw(id, name string, payload []byte) error {
+	if _, err := fmt.Fprintf(s.w, "id: %s\nevent: %s\ndata: %s\n\n", id, name, payload); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Send a comment line, which clients ignore but keeps idle proxies from
+// closing the connection
+func (s *sseWriter) comment(text string) error {
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", text); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Send a named event with a JSON-encoded payload
+func (s *sseWriter) event(name string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, payload); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// referenceStreamer watches streamed content for the reference section
+// and yields each reference line as soon as it is complete, using the same
+// split rules as parseResponseAndReferences. A later heading restarts the
+// section, so lines already yielded from an earlier one are superseded by
+// the references in the final event.
+type referenceStreamer struct {
+	headings  *referenceHeadings
+	content   strings.Builder
+	refsStart int // offset just past the heading, or -1 until one is seen
+	lines     int // complete reference lines already consumed
+
+	// Set when the references lead; the section then ends at the answer
+	// heading, and answered is set once that is reached
+	leading  bool
+	answered bool
+}
+
+func newReferenceStreamer(headings *referenceHeadings) *referenceStreamer {
+	return &referenceStreamer{headings: headings, refsStart: -1}
+}
+
+// Append a content delta and return any newly completed reference lines
+func (rs *referenceStreamer) Write(delta string) []string {
+	rs.content.WriteString(delta)
+	content := rs.content.String()
+
+	// Only a complete line can be told apart from prose starting the same way
+	rs.seek(content[:strings.LastIndexByte(content, '\n')+1])
+	if rs.refsStart < 0 || rs.answered {
+		return nil
+	}
+
+	lines := strings.Split(content[rs.refsStart:], "\n")
+	complete := lines[:len(lines)-1] // the last line may still be growing
+	if rs.leading {
+		complete, rs.answered = linesBeforeAnswer(complete)
+	}
+
+	var refs []string
+	for _, line := range complete[rs.lines:] {
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			refs = append(refs, trimmed)
+		}
+	}
+	rs.lines = len(complete)
+	return refs
+}
+
+// Return the reference lines not yet yielded once the stream has ended
+func (rs *referenceStreamer) Flush() []string {
+	content := rs.content.String()
+	rs.seek(content)
+	if rs.refsStart < 0 || rs.answered {
+		return nil
+	}
+	lines := strings.Split(content[rs.refsStart:], "\n")
+	if rs.leading {
+		lines, _ = linesBeforeAnswer(lines)
+	}
+	var refs []string
+	for _, line := range lines[min(rs.lines, len(lines)):] {
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			refs = append(refs, trimmed)
+		}
+	}
+	rs.lines = len(lines)
+	return refs
+}
+
+// Move the section start to the last heading in content, or to the first
+// when the references lead
+func (rs *referenceStreamer) seek(content string) {
+	find := rs.headings.last
+	if rs.leading {
+		find = rs.headings.first
+	}
+	if _, end := find(content); end >= 0 && end != rs.refsStart {
+		rs.refsStart, rs.lines = end, 0
+	}
+}
+
+// Content returns everything streamed so far
+func (rs *referenceStreamer) Content() string {
+	return rs.content.String()
+}
+
+// Stream a chat completion to the client as server-sent events.
+//
+// Events, in order: "generation" with the generation ID and Azure's request
+// ID, first; then "references" with cached sources for the same query
+// when there are any, with the request's context documents when it
+// passed some, and again with the grounding citations as soon as Azure
+// sends them, "token" for each content delta, "reference" for each
+// reference line as soon as it is complete and "usage" with token counts
+// when the deployment reports them, interleaved as they arrive; once the
+// answer is complete "enriched" with the structured references, "footer"
+// with the disclaimer when one is configured, then "done" with the parsed
+// response, footer included, as the last event. A stream that fails
+// after it has started ends with "error" instead of "enriched" and "done",
+// and one cut short by the server stopping ends with "shutdown". Every
+// event carries an id so a dropped client can resume from
+// GET /api/chat/stream/{id} with Last-Event-ID.
+func (s *Server) streamChat(w http.ResponseWriter, r *http.Request, modelName, endpoint string, data map[string]interface{}, search SearchConfig, cached []Reference, opts streamOptions, onDone func(turnResult)) {
+	// Capacity is checked before the SSE headers are set, so the 503 goes
+	// out as a plain JSON error
+	if !s.generations.reserve() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.cfg.StreamRetryAfter.Seconds()))))
+		s.writeError(w, r, http.StatusServiceUnavailable, "too_many_streams", "Too many concurrent streams, retry later", nil)
+		return
+	}
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		s.generations.release()
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	data["stream"] = true
+	// Ask for a final usage chunk so streaming callers can track cost
+	data["stream_options"] = map[string]interface{}{"include_usage": true}
+
+	// The upstream read is decoupled from this connection so the
+	// generation keeps buffering while a client reconnects.
+	ctx, cancelCause := context.WithCancelCause(context.WithoutCancel(r.Context()))
+	cancel := func() { cancelCause(nil) }
+	deadline := startStreamDeadline(cancelCause, s.cfg.StreamFirstTokenTimeout, s.cfg.StreamTimeout)
+
+	var resp *http.Response
+	grounded, warnings, err := s.withSearchFallback(ctx, data, func() error {
+		var err error
+		resp, err = s.postAzure(ctx, endpoint, data)
+		if isStreamOptionsError(err) {
+			logf(ctx, "Deployment does not support stream_options, streaming without usage")
+			delete(data, "stream_options")
+			resp, err = s.postAzure(ctx, endpoint, data)
+		}
+		return err
+	})
+	if err != nil {
+		deadline.stop()
+		s.generations.release()
+		ue := err.(*upstreamError)
+		if cause := context.Cause(ctx); isStreamTimeout(cause) {
+			logf(r.Context(), "Azure stream request timed out: %v", cause)
+			ue = &upstreamError{Status: http.StatusGatewayTimeout, Message: "Azure OpenAI request timed out", Err: cause}
+		}
+		cancel()
+		logf(r.Context(), "Azure stream request failed: %v", ue)
+		s.writeUpstreamError(w, r, ue)
+		return
+	}
+
+	gen := s.generations.start(clientName(r.Context()), modelName, cancel)
+	started := map[string]string{"generationId": gen.ID}
+	if id := upstreamRequestID(resp.Header); id != "" {
+		started["upstreamRequestId"] = id
+		w.Header().Set(upstreamRequestHeader, id)
+	}
+	gen.emit("generation", started)
+	if cached != nil {
+		gen.emit("references", map[string]interface{}{"references": s.limitReferenceFields(cached), "cached": true})
+	}
+	if opts.documentCitations != nil {
+		grounded = true
+		gen.emit("references", map[string]interface{}{"references": s.limitReferenceFields(citationsToReferences(opts.documentCitations, 0)), "cached": false})
+	}
+	w.Header().Set("X-Generation-ID", gen.ID)
+
+	go s.pumpStream(ctx, gen, resp, deadline, search, grounded, opts, warnings, onDone)
+	s.serveGeneration(w, r, sse, gen, 0)
+}
+
+// Causes a stream is cancelled with when a timeout fires
+var (
+	errFirstTokenTimeout = errors.New("no token from Azure within AZURE_TIMEOUT_FIRST_TOKEN")
+	errStreamTimeout     = errors.New("stream ran longer than AZURE_TIMEOUT_STREAMING")
+)
+
+func isStreamTimeout(cause error) bool {
+	return cause == errFirstTokenTimeout || cause == errStreamTimeout
+}
+
+// streamDeadline cancels a stream that produces no token within one
+// timeout or does not finish within another. A nil timer is disabled.
+type streamDeadline struct {
+	first, total *time.Timer
+}
+
+func startStreamDeadline(cancel context.CancelCauseFunc, firstToken, total time.Duration) *streamDeadline {
+	d := &streamDeadline{}
+	if firstToken > 0 {
+		d.first = time.AfterFunc(firstToken, func() { cancel(errFirstTokenTimeout) })
+	}
+	if total > 0 {
+		d.total = time.AfterFunc(total, func() { cancel(errStreamTimeout) })
+	}
+	return d
+}
+
+// Disarm the first-token timeout; only the total one is left
+func (d *streamDeadline) firstToken() {
+	if d.first != nil {
+		d.first.Stop()
+	}
+}
+
+func (d *streamDeadline) stop() {
+	d.firstToken()
+	if d.total != nil {
+		d.total.Stop()
+	}
+}
+
+// Reports whether Azure rejected the request because the deployment's API
+// version does not know stream_options
+func isStreamOptionsError(err error) bool {
+	ue, ok := err.(*upstreamError)
+	return ok && ue.Upstream == http.StatusBadRequest && strings.Contains(string(ue.Body), "stream_options")
+}
+
+// Resume a generation after a dropped connection, replaying the events
+// after Last-Event-ID and then following it live
+func (s *Server) resumeStreamHandler(w http.ResponseWriter, r *http.Request) {
+	gen, ok := s.generations.get(mux.Vars(r)["id"])
+	if !ok || gen.Client != clientName(r.Context()) {
+		http.Error(w, "Unknown or expired generation", http.StatusNotFound)
+		return
+	}
+
+	lastSeq := 0
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || !gen.validSeq(n) {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastSeq = n
+	}
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	s.serveGeneration(w, r, sse, gen, lastSeq)
+}
+
+// Write a generation's events after seq to the client until it finishes
+// or the client goes away
+func (s *Server) serveGeneration(w http.ResponseWriter, r *http.Request, sse *sseWriter, gen *generation, seq int) {
+	// Streams outlive the server's WriteTimeout, so clear the deadline
+	// for this response only.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logf(r.Context(), "Failed to clear write deadline: %v", err)
+	}
+
+	defer s.streams.add()()
+
+	// Keep the connection alive through slow first-token latency
+	var heartbeat <-chan time.Time
+	if s.cfg.StreamHeartbeatInterval > 0 {
+		ticker := time.NewTicker(s.cfg.StreamHeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		events, done, wait, ok := gen.after(seq)
+		if !ok {
+			sse.event("error", map[string]string{"error": "Events after Last-Event-ID are no longer buffered"})
+			return
+		}
+		for _, ev := range events {
+			if err := sse.raw(strconv.Itoa(ev.Seq), ev.Name, ev.Data); err != nil {
+				logf(r.Context(), "Client disconnected: %v", err)
+				return
+			}
+			seq = ev.Seq
+			if ev.Name == "token" {
+				heartbeat = nil
+			}
+		}
+		if done {
+			return
+		}
+
+		select {
+		case <-wait:
+		case <-heartbeat:
+			if err := sse.comment("keep-alive"); err != nil {
+				logf(r.Context(), "Client disconnected: %v", err)
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.streams.stopping:
+			sse.event("shutdown", map[string]string{"error": "Server is shutting down"})
+			gen.cancel()
+			return
+		}
+	}
+}
+
+// Read the upstream Azure stream into the generation's event buffer
+func (s *Server) pumpStream(ctx context.Context, gen *generation, resp *http.Response, deadline *streamDeadline, search SearchConfig, grounded bool, opts streamOptions, warnings []string, onDone func(turnResult)) {
+	defer s.generations.finish(gen)
+	defer resp.Body.Close()
+	defer deadline.stop()
+
+	refs := newReferenceStreamer(s.headings)
+	refs.leading = opts.referencesFirst
+	redact := s.redactor.stream()
+	normalize := s.normalizer.stream()
+	batch := newTokenFlusher(s.flush)
+	referenceIndex := 0
+	finishReason := ""
+	var usage *AzureUsage
+	citations := AzureMessageContext{Citations: opts.documentCitations}
+	var promptFilters []AzurePromptFilterResult
+	emitReferences := func(lines []string) {
+		for _, line := range lines {
+			referenceIndex++
+			gen.emit("reference", map[string]interface{}{"index": referenceIndex, "reference": line})
+		}
+	}
+	emitToken := func(delta string) {
+		if delta != "" {
+			gen.emit("token", map[string]string{"content": delta})
+			emitReferences(refs.Write(delta))
+		}
+	}
+
+	// Held by the loop and the interval flush ticker while sending tokens
+	var sending sync.Mutex
+	stopTicker := batch.startTicker(&sending, emitToken)
+
+	var streamErr *AzureStreamError
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if payload == "[DONE]" {
+			break
+		}
+
+		var chunk AzureStreamChunk
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			logf(ctx, "Unmarshal stream chunk error: %v", err)
+			continue
+		}
+		if chunk.Error != nil {
+			logf(ctx, "Azure reported an error mid-stream: %s: %s", chunk.Error.Code, chunk.Error.Message)
+			streamErr = chunk.Error
+			break
+		}
+		promptFilters = append(promptFilters, chunk.PromptFilterResults...)
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+			gen.emit("usage", chunk.Usage.toTokenUsage())
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].FinishReason != nil {
+			finishReason = *chunk.Choices[0].FinishReason
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Context != nil && len(chunk.Choices[0].Delta.Context.Citations) > 0 {
+			// Citations may be split over several chunks; each event
+			// carries the full list so far. Markers in the streamed text
+			// are not renumbered after filtering.
+			search.labelCitations(chunk.Choices[0].Delta.Context.Citations)
+			allowed, _ := search.filterCitations(ctx, chunk.Choices[0].Delta.Context.Citations)
+			citations.Citations = append(citations.Citations, allowed...)
+			gen.emit("references", map[string]interface{}{"references": s.limitReferenceFields(citationsToReferences(citations.Citations, 0)), "cached": false})
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		deadline.firstToken()
+		sending.Lock()
+		emitToken(batch.Write(normalize.Write(redact.Write(chunk.Choices[0].Delta.Content))))
+		sending.Unlock()
+	}
+	stopTicker()
+	// Text already past redaction goes out before any error
+	emitToken(batch.Flush())
+	if streamErr != nil {
+		gen.emit("error", streamErr.event())
+		return
+	}
+	if ctx.Err() != nil {
+		if cause := context.Cause(ctx); isStreamTimeout(cause) {
+			logf(ctx, "Generation %s timed out: %v", gen.ID, cause)
+			gen.emit("error", map[string]string{"error": "Generation timed out"})
+			return
+		}
+		logf(ctx, "Generation %s cancelled", gen.ID)
+		gen.emit("error", map[string]string{"error": "Generation cancelled"})
+		return
+	}
+	if err := scanner.Err(); err != nil {
+		logf(ctx, "Stream read error: %v", err)
+		gen.emit("error", map[string]string{"error": "Failed to read stream from Azure OpenAI"})
+		return
+	}
+	emitToken(normalize.Write(redact.Flush()) + normalize.Flush())
+	emitReferences(refs.Flush())
+
+	content := refs.Content()
+	if opts.referencesFirst {
+		content = moveLeadingReferences(content, s.headings)
+	}
+	if s.strictPrompt != nil && grounded && strictNotFound(&citations) {
+		// The tokens already sent stand; done carries the not-found answer
+		logf(ctx, "No document cited in strict grounding mode, answering not found")
+		content, grounded = s.cfg.GroundedStrict.NotFoundMessage, false
+	}
+	refused, refusalReason := s.refusals.detect(content, finishReason)
+	mainContent, references, questions := content, []string(nil), []string(nil)
+	if !refused {
+		if opts.related {
+			mainContent, questions = splitRelatedQuestions(mainContent, s.headings)
+		}
+		mainContent, references = parseResponseAndReferences(mainContent, s.headings)
+	}
+	result := turnResult{Content: content, Usage: usage, Grounded: grounded}
+	if !refused {
+		result.References = extractReferences(&citations, references, 0)
+	}
+	onDone(result)
+	enriched := s.enrichedResponse(ctx, result.References)
+	enriched.RelatedQuestions = questions
+	gen.emit("enriched", enriched)
+
+	mainContent = withFooter(s.postProcess.apply(mainContent), opts.footer)
+	references, collapsed := capReferenceLinesPerSource(references, s.cfg.MaxReferencesPerSource)
+	done := StreamDone{
+		Response:            mainContent,
+		References:          references,
+		Grounded:            grounded,
+		Warnings:            warnings,
+		CollapsedReferences: collapsed,
+		Refused:             refused,
+		RefusalReason:       refusalReason,
+		UpstreamRequestID:   upstreamRequestID(resp.Header),
+	}
+	if s.cfg.Features.PromptFilterResults {
+		done.PromptFilterResults = promptFilterResults(promptFilters)
+	}
+	if _, model, ok := s.cfg.modelFor(gen.Model); ok {
+		done.Cost = requestCost(model, usage, s.cfg.Currency)
+	}
+	if opts.footer != "" {
+		gen.emit("footer", map[string]string{"footer": opts.footer})
+	}
+	gen.emit("done", done)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReferenceStreamerMatchesBlockingParse(t *testing.T) {
+	headings := newReferenceHeadings(defaultReferenceHeadings)
+	for _, text := range []string{
+		"Answer here.\nReferences:\n1. Foo\n2. Bar baz\n3. Qux",
+		"Answer citing the References: section.\n## Sources\n1. Foo\n2. Bar",
+	} {
+		_, want := parseResponseAndReferences(text, headings)
+		for size := 1; size < 8; size++ {
+			rs := newReferenceStreamer(headings)
+			var got []string
+			for i := 0; i < len(text); i += size {
+				end := i + size
+				if end > len(text) {
+					end = len(text)
+				}
+				got = append(got, rs.Write(text[i:end])...)
+			}
+			got = append(got, rs.Flush()...)
+
+			if strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Errorf("chunk size %d: got %q, want %q", size, got, want)
+			}
+		}
+	}
+}
+
+func streamStub() *azureStub {
+	return &azureStub{deltas: []string{"Hello ", "world.\nRefer", "ences:\n1. Foo", "\n2. Bar"}}
+}
+
+func TestStreamChatEndsWhenGenerationFinishes(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), streamStub())
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)
+	events := parseSSE(readBody(t, resp))
+
+	names := eventNames(events)
+	if len(names) == 0 || names[0] != "generation" || names[len(names)-1] != "done" {
+		t.Fatalf("events = %v, want generation first and done last", names)
+	}
+	refs := 0
+	for _, n := range names {
+		if n == "reference" {
+			refs++
+		}
+	}
+	if refs != 2 {
+		t.Errorf("got %d reference events, want 2", refs)
+	}
+}
+
+func resume(t *testing.T, url, lastEventID string, headers ...string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestResumeReplaysEventsAfterLastEventID(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), streamStub())
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)
+	all := parseSSE(readBody(t, resp))
+	id := resp.Header.Get("X-Generation-ID")
+
+	resp = resume(t, front.URL+"/api/chat/stream/"+id, "3")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("resume status = %d", resp.StatusCode)
+	}
+	replayed := parseSSE(readBody(t, resp))
+
+	if len(replayed) != len(all)-3 {
+		t.Fatalf("replayed %d events, want %d", len(replayed), len(all)-3)
+	}
+	for i, ev := range replayed {
+		if ev != all[i+3] {
+			t.Errorf("replayed[%d] = %+v, want %+v", i, ev, all[i+3])
+		}
+	}
+}
+
+func TestResumeRejectsFutureLastEventID(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), streamStub())
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)
+	readBody(t, resp)
+	id := resp.Header.Get("X-Generation-ID")
+
+	resp = resume(t, front.URL+"/api/chat/stream/"+id, "999")
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestResumeRejectsOtherClient(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{
+		"key-a": {Name: "a"},
+		"key-b": {Name: "b"},
+	}
+	_, front := newTestServer(t, cfg, streamStub())
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`, "X-API-Key", "key-a")
+	readBody(t, resp)
+	id := resp.Header.Get("X-Generation-ID")
+
+	resp = resume(t, front.URL+"/api/chat/stream/"+id, "", "X-API-Key", "key-b")
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("other client status = %d, want 404", resp.StatusCode)
+	}
+
+	resp = resume(t, front.URL+"/api/chat/stream/"+id, "", "X-API-Key", "key-a")
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("owner status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestStreamEmitsUsageEvent(t *testing.T) {
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":2,\"total_tokens\":12}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)))
+	var usage *sseEvent
+	for i := range events {
+		if events[i].Name == "usage" {
+			usage = &events[i]
+		}
+	}
+	if usage == nil || usage.Data != `{"promptTokens":10,"completionTokens":2,"totalTokens":12}` {
+		t.Fatalf("usage event = %+v", usage)
+	}
+	if opts, ok := azure.payload(t, 0)["stream_options"].(map[string]interface{}); !ok || opts["include_usage"] != true {
+		t.Errorf("stream_options = %v", azure.payload(t, 0)["stream_options"])
+	}
+}
+
+func TestStreamRetriesWithoutUnsupportedStreamOptions(t *testing.T) {
+	calls := 0
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"message":"Unrecognized request argument supplied: stream_options"}}`)
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n")
+	}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)))
+	if names := eventNames(events); names[len(names)-1] != "done" {
+		t.Fatalf("events = %v, want a completed stream", names)
+	}
+	if _, ok := azure.payload(t, 1)["stream_options"]; ok {
+		t.Error("retry still sent stream_options")
+	}
+}
+
+func TestStreamRouteAlwaysStreams(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), streamStub())
+
+	resp := postJSON(t, front.URL+"/api/chat/stream", `{"message":"hi"}`)
+	names := eventNames(parseSSE(readBody(t, resp)))
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+	if len(names) == 0 || names[len(names)-1] != "done" {
+		t.Errorf("events = %v, want a stream ending in done", names)
+	}
+
+	resp = postJSON(t, front.URL+"/api/chat/stream?references_only=true", `{"message":"hi"}`)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("references_only status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestCachedReferencesStreamBeforeTokens(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Features.CachedReferences = true
+	azure := streamStub()
+	azure.content = "Answer.\nReferences:\n1. Smith (2020). Cached."
+	_, front := newTestServer(t, cfg, azure)
+
+	resp := postJSON(t, front.URL+"/api/chat/stream", `{"message":"What is Go?"}`)
+	if names := eventNames(parseSSE(readBody(t, resp))); len(names) < 2 || names[1] == "references" {
+		t.Fatalf("first stream events = %v, want no cached references yet", names)
+	}
+
+	// A blocking answer to the same query refreshes the cache too
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"what is   go?"}`))
+
+	resp = postJSON(t, front.URL+"/api/chat/stream", `{"message":"What is Go?"}`)
+	events := parseSSE(readBody(t, resp))
+	if names := eventNames(events); len(names) < 3 || names[1] != "references" || names[2] != "token" {
+		t.Fatalf("events = %v, want cached references right after generation", names)
+	}
+	if !strings.Contains(events[1].Data, `"title":"Cached"`) || !strings.Contains(events[1].Data, `"cached":true`) {
+		t.Errorf("references event = %s", events[1].Data)
+	}
+}
+
+func TestStreamHeartbeatsUntilFirstToken(t *testing.T) {
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		time.Sleep(80 * time.Millisecond)
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(80 * time.Millisecond)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+	cfg := defaultConfig()
+	cfg.StreamHeartbeatInterval = 10 * time.Millisecond
+	_, front := newTestServer(t, cfg, azure)
+
+	body := readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`))
+	first := strings.Index(body, "event: token")
+	if first < 0 {
+		t.Fatalf("no token event in %q", body)
+	}
+	if !strings.Contains(body[:first], ": keep-alive\n\n") {
+		t.Errorf("no heartbeat before the first token: %q", body[:first])
+	}
+	if strings.Contains(body[first:], "keep-alive") {
+		t.Errorf("heartbeat after the first token: %q", body[first:])
+	}
+}
+
+func TestStreamEmitsCitationsFromDeltaContext(t *testing.T) {
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\",\"context\":{\"citations\":[{\"title\":\"Go spec\",\"url\":\"https://go.dev/ref/spec\"}]}}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"context\":{\"citations\":[{\"title\":\"Effective Go\",\"url\":\"https://go.dev/doc/effective_go\"}]}}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Go is a language [doc1].\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)))
+	if names := eventNames(events); len(names) < 4 || names[1] != "references" || names[2] != "references" || names[3] != "token" {
+		t.Fatalf("events = %v, want two references events before the first token", names)
+	}
+	var last struct {
+		References []Reference `json:"references"`
+		Cached     bool        `json:"cached"`
+	}
+	json.Unmarshal([]byte(events[2].Data), &last)
+	if len(last.References) != 2 || last.References[1].Title != "Effective Go" || last.Cached {
+		t.Errorf("accumulated references = %+v", last)
+	}
+}
+
+func TestConcurrentStreamLimit(t *testing.T) {
+	release := make(chan struct{})
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+	cfg := defaultConfig()
+	cfg.MaxConcurrentStreams = 1
+	cfg.StreamRetryAfter = 4500 * time.Millisecond
+	srv, front := newTestServer(t, cfg, azure)
+
+	first := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)
+	defer first.Body.Close()
+	if active, _ := srv.generations.usage(); active != 1 {
+		t.Fatalf("active streams = %d, want 1", active)
+	}
+
+	second := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)
+	readBody(t, second)
+	if second.StatusCode != http.StatusServiceUnavailable || second.Header.Get("Retry-After") != "5" {
+		t.Errorf("second stream status = %d, Retry-After %q, want 503 with the wait rounded up", second.StatusCode, second.Header.Get("Retry-After"))
+	}
+	if ct := second.Header.Get("Content-Type"); ct != "application/json" || second.Header.Get("Cache-Control") != "" {
+		t.Errorf("second stream Content-Type = %q, Cache-Control %q, want a JSON error without SSE headers", ct, second.Header.Get("Cache-Control"))
+	}
+
+	close(release)
+	readBody(t, first)
+	deadline := time.Now().Add(time.Second)
+	for active, _ := srv.generations.usage(); active != 0 && time.Now().Before(deadline); active, _ = srv.generations.usage() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("stream after the first finished status = %d", resp.StatusCode)
+	} else {
+		readBody(t, resp)
+	}
+}
+
+// Azure stub streaming one token per interval after an initial delay,
+// stopping when the request is cancelled
+func slowStreamStub(delay, interval time.Duration, tokens int) *azureStub {
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		wait := delay
+		for i := 0; i < tokens; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(wait):
+			}
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"word \"}}]}\n\n")
+			w.(http.Flusher).Flush()
+			wait = interval
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+	return azure
+}
+
+func TestStreamTimeouts(t *testing.T) {
+	tests := []struct {
+		name              string
+		firstToken, total time.Duration
+		azure             *azureStub
+		wantTokens        bool
+		wantLast          string
+	}{
+		{"first token too late", 30 * time.Millisecond, time.Minute, slowStreamStub(time.Second, 0, 1), false, "error"},
+		{"stream too long", time.Second, 80 * time.Millisecond, slowStreamStub(0, 30*time.Millisecond, 100), true, "error"},
+		{"long healthy stream", 50 * time.Millisecond, time.Second, slowStreamStub(0, 20*time.Millisecond, 6), true, "done"},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.StreamFirstTokenTimeout = tt.firstToken
+		cfg.StreamTimeout = tt.total
+		_, front := newTestServer(t, cfg, tt.azure)
+
+		events := parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)))
+		names := eventNames(events)
+		if len(names) == 0 || names[len(names)-1] != tt.wantLast {
+			t.Errorf("%s: events = %v, want %s last", tt.name, names, tt.wantLast)
+			continue
+		}
+		if got := strings.Contains(strings.Join(names, " "), "token"); got != tt.wantTokens {
+			t.Errorf("%s: events = %v, tokens = %v, want %v", tt.name, names, got, tt.wantTokens)
+		}
+		if last := events[len(events)-1]; tt.wantLast == "error" && !strings.Contains(last.Data, "timed out") {
+			t.Errorf("%s: error event = %q, want a timeout", tt.name, last.Data)
+		}
+	}
+}
+
+func TestStreamMidStreamAzureError(t *testing.T) {
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Partial \"}}]}\n\n")
+		fmt.Fprint(w, "event: error\ndata: {\"error\":{\"code\":\"rate_limit_exceeded\",\"message\":\"secret upstream detail\"}}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"after the error\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	body := readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`))
+	events := parseSSE(body)
+	names := eventNames(events)
+	if len(names) == 0 || names[len(names)-1] != "error" {
+		t.Fatalf("events = %v, want error last", names)
+	}
+	var got map[string]string
+	json.Unmarshal([]byte(events[len(events)-1].Data), &got)
+	if got["code"] != "upstream_rate_limited" || strings.Contains(body, "secret upstream detail") {
+		t.Errorf("error event = %v", got)
+	}
+	if strings.Contains(body, "after the error") || !strings.Contains(body, "Partial") {
+		t.Errorf("stream = %s, want the content before the error only", body)
+	}
+	for _, n := range names {
+		if n == "done" || n == "enriched" {
+			t.Errorf("events = %v, want no enriched or done after an error", names)
+		}
+	}
+}
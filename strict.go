@@ -0,0 +1,44 @@
+package main
+
+// GroundedStrictConfig confines grounded answers to the retrieved documents
+type GroundedStrictConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// System prompt template used for grounded requests instead of the
+	// default or persona prompt, with the same placeholders as SystemPrompt
+	SystemPrompt string `json:"systemPrompt"`
+
+	// Azure Search strictness, from 1 to 5, sent instead of the usual 3
+	Strictness int `json:"strictness"`
+
+	// Answer returned, ungrounded, when Azure cites no document
+	NotFoundMessage string `json:"notFoundMessage"`
+}
+
+const defaultNotFoundMessage = "Not found in the provided sources."
+
+const defaultStrictSystemPrompt = `You are an assistant that answers only from the documents retrieved for each question.
+            Rules:
+            1. Use only facts stated in the retrieved documents, never your own knowledge
+            2. Cite the document behind every statement
+            3. If the documents do not answer the question, reply exactly "Not found in the provided sources." and nothing else
+            4. List all references at the end of your response
+            Today's date is {{.Date}}.`
+
+// Tighten the search of a grounded payload: the configured strictness,
+// and answers limited to the retrieved data
+func (c GroundedStrictConfig) apply(data map[string]interface{}) {
+	sources, _ := data["data_sources"].([]map[string]interface{})
+	for _, source := range sources {
+		if params, ok := source["parameters"].(map[string]interface{}); ok {
+			params["strictness"] = c.Strictness
+			params["in_scope"] = true
+		}
+	}
+}
+
+// Reports whether a strictly grounded answer has nothing to stand on: no
+// document was cited, so it is replaced by the not-found message
+func strictNotFound(citations *AzureMessageContext) bool {
+	return citations == nil || len(citations.Citations) == 0
+}
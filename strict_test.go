@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func strictConfig() *Config {
+	cfg := defaultConfig()
+	cfg.GroundedStrict.Enabled = true
+	cfg.GroundedStrict.SystemPrompt = "Answer from the documents only."
+	cfg.Personas = map[string]PersonaConfig{"pirate": {SystemPrompt: "Talk like a pirate."}}
+	return cfg
+}
+
+func TestGroundedStrictPromptAndStrictness(t *testing.T) {
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"Answer [doc1].","context":{"citations":[{"title":"Doc"}]}}}]}`))
+	}}
+	_, front := newTestServer(t, strictConfig(), azure)
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","persona":"pirate"}`))), &got)
+	payload := azure.payload(t, 0)
+	if system := systemMessage(payload); system != "Answer from the documents only." {
+		t.Errorf("system prompt = %q, want the strict prompt over the persona's", system)
+	}
+	if params := searchParams(t, payload); params["strictness"] != float64(5) || params["in_scope"] != true {
+		t.Errorf("strictness = %v, in_scope = %v; want 5 and true", params["strictness"], params["in_scope"])
+	}
+	if !got.Grounded || got.Response != "Answer [doc1]." {
+		t.Errorf("cited answer = %+v, want it returned grounded", got)
+	}
+}
+
+func TestGroundedStrictOffKeepsDefaults(t *testing.T) {
+	azure := &azureStub{content: "Answer."}
+	_, front := newTestServer(t, defaultConfig(), azure)
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))
+	if params := searchParams(t, azure.payload(t, 0)); params["strictness"] != float64(3) || params["in_scope"] != nil {
+		t.Errorf("strictness = %v, in_scope = %v; want 3 and unset", params["strictness"], params["in_scope"])
+	}
+}
+
+func TestGroundedStrictNotFound(t *testing.T) {
+	azure := &azureStub{content: "Something from memory.", deltas: []string{"Something ", "from memory."}}
+	_, front := newTestServer(t, strictConfig(), azure)
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &got)
+	if got.Grounded || got.Response != defaultNotFoundMessage || len(got.References) != 0 {
+		t.Errorf("uncited answer = %+v, want the ungrounded not-found message", got)
+	}
+
+	var done StreamDone
+	for _, e := range parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`))) {
+		if e.Name == "done" {
+			json.Unmarshal([]byte(e.Data), &done)
+		}
+	}
+	if done.Grounded || done.Response != defaultNotFoundMessage {
+		t.Errorf("uncited stream done = %+v, want the ungrounded not-found message", done)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// ConversationSummaryConfig controls GET /api/conversations/{id}/summary
+type ConversationSummaryConfig struct {
+	// Model from Models that writes summaries, ideally a cheap one; empty
+	// uses the default model
+	Model string `json:"model"`
+
+	// Completion budget for a summary
+	MaxTokens int `json:"maxTokens"`
+}
+
+// ConversationSummary is the body of a summary response
+type ConversationSummary struct {
+	ConversationID string `json:"conversationId"`
+	Summary        string `json:"summary"`
+	Turns          int    `json:"turns"`
+	Cached         bool   `json:"cached"`
+
+	// Older turns were dropped to keep the conversation under its size limit
+	Compacted bool `json:"compacted,omitempty"`
+}
+
+const summaryPrompt = `Summarize the conversation below in one or two sentences for a conversation list preview. Name the topic first. Reply with the summary only.`
+
+// summaryCache keeps the last summary of each conversation with the number
+// of turns it covers, so a summary is reused until the conversation grows.
+// Entries are keyed by owner and conversation ID.
+type summaryCache struct {
+	mu         sync.Mutex
+	entries    map[summaryKey]cachedSummary
+	maxEntries int
+}
+
+type summaryKey struct {
+	owner, id string
+}
+
+type cachedSummary struct {
+	turns   int
+	summary string
+}
+
+func newSummaryCache(maxEntries int) *summaryCache {
+	return &summaryCache{entries: make(map[summaryKey]cachedSummary), maxEntries: maxEntries}
+}
+
+// The cached summary of owner's conversation id, if it still covers every
+// one of turns
+func (sc *summaryCache) get(owner, id string, turns int) (string, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	c, ok := sc.entries[summaryKey{owner, id}]
+	if !ok || c.turns != turns {
+		return "", false
+	}
+	return c.summary, true
+}
+
+func (sc *summaryCache) put(owner, id string, turns int, summary string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	key := summaryKey{owner, id}
+	if _, ok := sc.entries[key]; !ok && sc.maxEntries > 0 && len(sc.entries) >= sc.maxEntries {
+		for other := range sc.entries {
+			delete(sc.entries, other)
+			break
+		}
+	}
+	sc.entries[key] = cachedSummary{turns: turns, summary: summary}
+}
+
+// Forget the summary of owner's conversation id, e.g. after a new turn
+func (sc *summaryCache) invalidate(owner, id string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.entries, summaryKey{owner, id})
+}
+
+// Render turns as a plain transcript for summarizing
+func formatTranscript(turns []Turn) string {
+	var b strings.Builder
+	for _, t := range turns {
+		fmt.Fprintf(&b, "User: %s\nAssistant: %s\n\n", t.User, t.Assistant)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Ask the summary model for a summary of turns
+func (s *Server) summarize(ctx context.Context, turns []Turn) (string, error) {
+	_, model, _ := s.cfg.modelFor(s.cfg.ConversationSummary.Model)
+	data := map[string]interface{}{
+		"messages": []map[string]interface{}{
+			{"role": "system", "content": summaryPrompt},
+			{"role": "user", "content": formatTranscript(turns)},
+		},
+	}
+	applyParams(data, GenerationParams{MaxTokens: s.cfg.ConversationSummary.MaxTokens, TopP: 1}, model)
+
+	ctx, cancel := context.WithTimeout(ctx, s.policyFor(model.Endpoint).timeout)
+	defer cancel()
+	resp, err := s.callAzure(ctx, model.Endpoint, data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// Return a short summary of one of the caller's stored conversations,
+// generating it when the conversation has grown since the last one
+func (s *Server) conversationSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	owner, id := clientName(r.Context()), mux.Vars(r)["id"]
+	turns, err := s.conversations.Load(owner, id)
+	if errors.Is(err, errConversationOwner) {
+		http.Error(w, "Unknown conversation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logf(r.Context(), "Failed to load conversation: %v", err)
+		http.Error(w, "Failed to load conversation", http.StatusInternalServerError)
+		return
+	}
+	if len(turns) == 0 {
+		http.Error(w, "Unknown conversation", http.StatusNotFound)
+		return
+	}
+
+	summary := ConversationSummary{ConversationID: id, Turns: len(turns)}
+	if store, ok := s.conversations.(interface{ Compacted(string) bool }); ok {
+		summary.Compacted = store.Compacted(id)
+	}
+	summary.Summary, summary.Cached = s.summaries.get(owner, id, len(turns))
+	if !summary.Cached {
+		// Only the most recent turns fit a cheap model's budget
+		text, err := s.summarize(r.Context(), historyWindow(turns, s.cfg.MaxHistoryTurns))
+		if err != nil {
+			ue := err.(*upstreamError)
+			logf(r.Context(), "Azure summary request failed: %v", ue)
+			s.writeUpstreamError(w, r, ue)
+			return
+		}
+		summary.Summary = text
+		s.summaries.put(owner, id, len(turns), text)
+	}
+	writeJSON(w, r, summary)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func getSummary(t *testing.T, url string) (int, ConversationSummary) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary ConversationSummary
+	json.Unmarshal([]byte(readBody(t, resp)), &summary)
+	return resp.StatusCode, summary
+}
+
+func TestConversationSummary(t *testing.T) {
+	azure := &azureStub{}
+	azure.handler = func(w http.ResponseWriter, r *http.Request) {
+		content := "Answer."
+		if len(azure.payloads) > 0 && systemMessage(azure.payloads[len(azure.payloads)-1]) == summaryPrompt {
+			content = " Go generics basics. "
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": content}}},
+		})
+	}
+	srv, front := newTestServer(t, defaultConfig(), azure)
+	url := front.URL + "/api/conversations/c1/summary"
+
+	if status, _ := getSummary(t, url); status != http.StatusNotFound {
+		t.Fatalf("unknown conversation status = %d, want 404", status)
+	}
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"How do generics work?","conversationId":"c1"}`))
+	status, first := getSummary(t, url)
+	if status != http.StatusOK || first.Summary != "Go generics basics." || first.Turns != 1 || first.Cached {
+		t.Fatalf("status=%d summary = %+v", status, first)
+	}
+	payload := azure.payload(t, 1)
+	if transcript := userMessage(payload); !strings.Contains(transcript, "User: How do generics work?") || !strings.Contains(transcript, "Assistant: Answer.") {
+		t.Errorf("summary transcript = %q", transcript)
+	}
+	if payload["data_sources"] != nil || payload["max_tokens"] != float64(80) {
+		t.Errorf("summary payload = %v, want a small ungrounded completion", payload)
+	}
+
+	if _, again := getSummary(t, url); !again.Cached || len(azure.payloads) != 2 {
+		t.Errorf("second summary = %+v after %d Azure calls, want it cached", again, len(azure.payloads))
+	}
+
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"And constraints?","conversationId":"c1"}`))
+	if _, fresh := getSummary(t, url); fresh.Cached || fresh.Turns != 2 {
+		t.Errorf("summary after a new turn = %+v, want a fresh one", fresh)
+	}
+	if _, ok := srv.summaries.get("", "c1", 2); !ok {
+		t.Error("fresh summary was not cached")
+	}
+}
+
+func TestConversationSummaryRejectsOtherClient(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = map[string]ClientConfig{
+		"key-a": {Name: "a"},
+		"key-b": {Name: "b"},
+	}
+	azure := &azureStub{content: "A private topic."}
+	srv, front := newTestServer(t, cfg, azure)
+	readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"secret","conversationId":"c1"}`, "X-API-Key", "key-a"))
+	srv.summaries.put("a", "c1", 1, "A private topic.")
+
+	req, _ := http.NewRequest("GET", front.URL+"/api/conversations/c1/summary", nil)
+	req.Header.Set("X-API-Key", "key-b")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusNotFound || strings.Contains(body, "private") {
+		t.Errorf("other client got status %d and %q, want 404 without the summary", resp.StatusCode, body)
+	}
+	if _, ok := srv.summaries.get("b", "c1", 1); ok {
+		t.Error("summary cache served the owner's summary under another client")
+	}
+	if len(azure.payloads) != 1 {
+		t.Errorf("Azure got %d requests, want no summary generated for the other client", len(azure.payloads))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// When streamed deltas are sent on as token events, from Config.StreamFlush
+const (
+	flushImmediate = "immediate" // every delta as it arrives
+	flushWord      = "word"      // up to the last whitespace
+	flushSentence  = "sentence"  // up to the last sentence end
+	flushInterval  = "interval"  // everything, at most once per interval
+)
+
+// Text held back past this many bytes is sent anyway, so a long run
+// without a boundary does not stall the stream
+const maxHeldTokenBytes = 512
+
+// A sentence end: terminal punctuation, optionally closed by quotes or
+// brackets, followed by whitespace; full-width punctuation, which takes
+// none; or a line break
+var sentenceBoundaryRegex = regexp.MustCompile(`[.!?]+["'”’)\]]*\s+|[。！？]+|\n`)
+
+type flushPolicy struct {
+	mode     string
+	interval time.Duration
+}
+
+// Parse immediate, word, sentence or interval:<duration> such as
+// interval:50ms
+func parseFlushPolicy(s string) (flushPolicy, error) {
+	switch s {
+	case "", flushImmediate:
+		return flushPolicy{mode: flushImmediate}, nil
+	case flushWord, flushSentence:
+		return flushPolicy{mode: s}, nil
+	}
+	if d, ok := strings.CutPrefix(s, flushInterval+":"); ok {
+		interval, err := time.ParseDuration(d)
+		if err != nil || interval <= 0 {
+			return flushPolicy{}, fmt.Errorf("STREAM_FLUSH interval must be a positive duration such as interval:50ms, got %q", s)
+		}
+		return flushPolicy{mode: flushInterval, interval: interval}, nil
+	}
+	return flushPolicy{}, fmt.Errorf("STREAM_FLUSH must be immediate, word, sentence or interval:<duration>, got %q", s)
+}
+
+// tokenFlusher batches streamed deltas into fewer token events
+type tokenFlusher struct {
+	policy  flushPolicy
+	pending string
+	last    time.Time // when the interval policy last sent
+	now     func() time.Time
+}
+
+func newTokenFlusher(policy flushPolicy) *tokenFlusher {
+	return &tokenFlusher{policy: policy, now: time.Now}
+}
+
+// Add a delta and return the text to send now, if any
+func (f *tokenFlusher) Write(delta string) string {
+	f.pending += delta
+	cut := 0
+	switch f.policy.mode {
+	case flushWord:
+		if i := strings.LastIndexFunc(f.pending, unicode.IsSpace); i >= 0 {
+			_, size := utf8.DecodeRuneInString(f.pending[i:])
+			cut = i + size
+		}
+	case flushSentence:
+		if ends := sentenceBoundaryRegex.FindAllStringIndex(f.pending, -1); len(ends) > 0 {
+			cut = ends[len(ends)-1][1]
+		}
+	case flushInterval:
+		// The first delta goes out at once so the first token is not delayed
+		if now := f.now(); now.Sub(f.last) >= f.policy.interval {
+			f.last = now
+			cut = len(f.pending)
+		}
+	default:
+		cut = len(f.pending)
+	}
+	if len(f.pending) > maxHeldTokenBytes {
+		cut = len(f.pending)
+	}
+
+	out := f.pending[:cut]
+	f.pending = f.pending[cut:]
+	return out
+}
+
+// Send held-back text from a ticker whenever an interval passes without a
+// delta doing it, so a slow upstream does not hold tokens back until its
+// next delta. emit is called with mu held, which callers also hold around
+// Write. The returned stop waits for the ticker to exit. Only the interval
+// policy runs a ticker.
+func (f *tokenFlusher) startTicker(mu *sync.Mutex, emit func(string)) (stop func()) {
+	if f.policy.mode != flushInterval {
+		return func() {}
+	}
+	ticker := time.NewTicker(f.policy.interval)
+	quit, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				mu.Lock()
+				if now := f.now(); f.pending != "" && now.Sub(f.last) >= f.policy.interval {
+					f.last = now
+					emit(f.Flush())
+				}
+				mu.Unlock()
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(quit)
+		<-exited
+	}
+}
+
+// Return the text still held back once the stream has ended
+func (f *tokenFlusher) Flush() string {
+	out := f.pending
+	f.pending = ""
+	return out
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Feed deltas through a flusher, returning what each Write sent and the
+// final Flush
+func runFlusher(f *tokenFlusher, deltas ...string) ([]string, string) {
+	var sent []string
+	for _, d := range deltas {
+		sent = append(sent, f.Write(d))
+	}
+	return sent, f.Flush()
+}
+
+func TestTokenFlusherPolicies(t *testing.T) {
+	deltas := []string{"Hel", "lo wor", "ld. How", " are", " you?"}
+	tests := []struct {
+		policy    string
+		wantSent  []string
+		wantFinal string
+	}{
+		{"immediate", deltas, ""},
+		{"word", []string{"", "Hello ", "world. ", "How ", "are "}, "you?"},
+		{"sentence", []string{"", "", "Hello world. ", "", ""}, "How are you?"},
+	}
+	for _, tt := range tests {
+		policy, err := parseFlushPolicy(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent, final := runFlusher(newTokenFlusher(policy), deltas...)
+		if !reflect.DeepEqual(sent, tt.wantSent) || final != tt.wantFinal {
+			t.Errorf("%s: sent %q then %q, want %q then %q", tt.policy, sent, final, tt.wantSent, tt.wantFinal)
+		}
+	}
+}
+
+func TestTokenFlusherInterval(t *testing.T) {
+	policy, err := parseFlushPolicy("interval:50ms")
+	if err != nil || policy.interval != 50*time.Millisecond {
+		t.Fatalf("policy = %+v, %v", policy, err)
+	}
+	now := time.Unix(100, 0)
+	f := newTokenFlusher(policy)
+	f.now = func() time.Time { return now }
+
+	if got := f.Write("a"); got != "a" {
+		t.Errorf("first delta = %q, want it sent at once", got)
+	}
+	now = now.Add(20 * time.Millisecond)
+	if got := f.Write("b"); got != "" {
+		t.Errorf("delta within the interval = %q, want it held", got)
+	}
+	now = now.Add(30 * time.Millisecond)
+	if got := f.Write("c"); got != "bc" {
+		t.Errorf("delta at the interval = %q, want everything held", got)
+	}
+	f.Write("d")
+	if got := f.Flush(); got != "d" {
+		t.Errorf("final flush = %q, want the held delta", got)
+	}
+}
+
+func TestTokenFlusherSendsLongRuns(t *testing.T) {
+	f := newTokenFlusher(flushPolicy{mode: flushWord})
+	long := strings.Repeat("x", maxHeldTokenBytes+1)
+	if got := f.Write(long); got != long {
+		t.Errorf("held %d bytes without a boundary", len(long))
+	}
+}
+
+func TestParseFlushPolicyRejectsUnknown(t *testing.T) {
+	for _, s := range []string{"paragraph", "interval:", "interval:-5ms", "interval:fast"} {
+		if _, err := parseFlushPolicy(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestStreamFlushBySentence(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.StreamFlush = flushSentence
+	azure := &azureStub{deltas: []string{"One", " two.", " Three", " four.\n", "References:\n1. Foo"}}
+	_, front := newTestServer(t, cfg, azure)
+
+	var tokens []string
+	var done StreamDone
+	for _, e := range parseSSE(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`))) {
+		switch e.Name {
+		case "token":
+			tokens = append(tokens, e.Data)
+		case "done":
+			json.Unmarshal([]byte(e.Data), &done)
+		}
+	}
+	want := []string{`{"content":"One two. "}`, `{"content":"Three four.\n"}`, `{"content":"References:\n1. "}`, `{"content":"Foo"}`}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Errorf("tokens = %q, want %q", tokens, want)
+	}
+	if done.Response != "One two. Three four." || !reflect.DeepEqual(done.References, []string{"1. Foo"}) {
+		t.Errorf("done = %+v", done)
+	}
+}
+
+func TestStreamFlushIntervalWithSlowUpstream(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.StreamFlush = "interval:50ms"
+	release := make(chan struct{})
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		// The first delta goes out at once and the second is held for the
+		// interval, then the upstream pauses
+		for _, delta := range []string{"Hel", "lo"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", delta)
+		}
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(2 * time.Second):
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\" world\"}}]}\n\ndata: [DONE]\n\n")
+	}}
+	_, front := newTestServer(t, cfg, azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi","stream":true}`)
+	defer resp.Body.Close()
+	events := make(chan sseEvent)
+	go func() {
+		defer close(events)
+		buf := make([]byte, 4096)
+		var body strings.Builder
+		seen := 0
+		for {
+			n, err := resp.Body.Read(buf)
+			body.Write(buf[:n])
+			complete := body.String()
+			parsed := parseSSE(complete[:strings.LastIndex(complete, "\n\n")+1])
+			for ; seen < len(parsed); seen++ {
+				events <- parsed[seen]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var tokens []string
+	for e := range events {
+		if e.Name != "token" {
+			continue
+		}
+		var token map[string]string
+		json.Unmarshal([]byte(e.Data), &token)
+		tokens = append(tokens, token["content"])
+		if len(tokens) == 2 {
+			close(release)
+		}
+	}
+	if want := []string{"Hel", "lo", " world"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("tokens = %q, want the held delta sent during the upstream pause", tokens)
+	}
+}
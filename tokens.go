@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// TokenEstimator counts the tokens a model would see for some text. A
+// precise tokenizer can be plugged in by adding it to tokenEstimators from
+// an init function and selecting it with TOKEN_ESTIMATOR.
+type TokenEstimator interface {
+	Name() string
+	CountTokens(text string) int
+}
+
+// Estimators selectable by name in config
+var tokenEstimators = map[string]TokenEstimator{
+	"pieces": pieceEstimator{},
+	"chars":  charEstimator{},
+}
+
+func newTokenEstimator(name string) (TokenEstimator, error) {
+	est, ok := tokenEstimators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown token estimator %q", name)
+	}
+	return est, nil
+}
+
+// pieceEstimator uses estimateTokens, close to cl100k on English prose
+type pieceEstimator struct{}
+
+func (pieceEstimator) Name() string                { return "pieces" }
+func (pieceEstimator) CountTokens(text string) int { return estimateTokens(text) }
+
+// charEstimator charges one token per four characters, rounded up: the
+// cheapest estimate, and a looser one
+type charEstimator struct{}
+
+func (charEstimator) Name() string { return "chars" }
+func (charEstimator) CountTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// A simplified version of the cl100k pre-tokenizer: contractions, words
+// with their leading space, numbers, punctuation runs and whitespace are
+// split into separate pieces.
+var tokenPieceRegex = regexp.MustCompile(`'(?:[sdmt]|ll|ve|re)| ?\p{L}+| ?\p{N}{1,3}| ?[^\s\p{L}\p{N}]+|\s+`)
+
+// Estimate the number of tokens in text. This is an approximation, not a
+// tokenizer: each piece is charged one token per six characters, so common
+// English words count as one token and rare long words as several. Expect
+// it to be off by a few percent on prose and more on code or other scripts.
+func estimateTokens(text string) int {
+	tokens := 0
+	for _, piece := range tokenPieceRegex.FindAllString(text, -1) {
+		n := utf8.RuneCountInString(piece)
+		tokens += (n + 5) / 6
+	}
+	return tokens
+}
+
+// Estimate the prompt tokens of a chat messages array, including the
+// per-message overhead the chat format adds.
+func estimateMessagesTokens(est TokenEstimator, messages []map[string]interface{}) int {
+	tokens := 3 // every reply is primed with <|start|>assistant<|message|>
+	for _, m := range messages {
+		tokens += 4
+		if content, ok := m["content"].(string); ok {
+			tokens += est.CountTokens(content)
+		}
+	}
+	return tokens
+}
+
+// Size max_tokens to what is left of the context window after the prompt
+// and a safety margin, capped at ceiling. Reports false when nothing is left.
+// Like the cost estimate, this cannot count retrieved grounding documents,
+// which the margin has to absorb.
+func autoMaxTokens(contextWindow, promptTokens, margin, ceiling int) (int, bool) {
+	n := contextWindow - promptTokens - margin
+	if n <= 0 {
+		return 0, false
+	}
+	if n > ceiling {
+		n = ceiling
+	}
+	return n, true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokensKnownCounts(t *testing.T) {
+	// Counts from the cl100k_base tokenizer
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"Hello, world!", 4},
+		{"The quick brown fox jumps over the lazy dog.", 10},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := estimateTokens(tt.text); got != tt.want {
+			t.Errorf("estimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTokenEstimatorsWithinBounds(t *testing.T) {
+	// Texts with approximate cl100k_base token counts; every estimator must land
+	// within half to double of the real count
+	samples := []struct {
+		text   string
+		tokens int
+	}{
+		{"The quick brown fox jumps over the lazy dog.", 10},
+		{"Azure OpenAI grounds answers on documents retrieved from a search index, then cites them.", 18},
+		{"func main() { fmt.Println(\"hello\") }", 10},
+	}
+	for name, est := range tokenEstimators {
+		if est.Name() != name {
+			t.Errorf("estimator registered as %q reports name %q", name, est.Name())
+		}
+		for _, sample := range samples {
+			got := est.CountTokens(sample.text)
+			if got < sample.tokens/2 || got > sample.tokens*2 {
+				t.Errorf("%s: CountTokens(%q) = %d, want within [%d, %d]", name, sample.text, got, sample.tokens/2, sample.tokens*2)
+			}
+		}
+	}
+}
+
+func TestCharEstimator(t *testing.T) {
+	for text, want := range map[string]int{"": 0, "abcd": 1, "abcde": 2, "héllo wörld": 3} {
+		if got := (charEstimator{}).CountTokens(text); got != want {
+			t.Errorf("CountTokens(%q) = %d, want %d", text, got, want)
+		}
+	}
+	if _, err := newTokenEstimator("tiktoken"); err == nil {
+		t.Error("unknown estimator was accepted")
+	}
+}
+
+func TestDebugPromptTokens(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TokenEstimator = "chars"
+	_, front := newTestServer(t, cfg, &azureStub{content: "Answer."})
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi","debug":true}`))), &got)
+	if got.Debug == nil || got.Debug.TokenEstimator != "chars" || got.Debug.PromptTokens == 0 {
+		t.Fatalf("debug = %+v", got.Debug)
+	}
+}
+
+func TestAutoMaxTokens(t *testing.T) {
+	tests := []struct {
+		window, prompt, margin, ceiling int
+		want                            int
+		ok                              bool
+	}{
+		{8000, 1000, 256, 4096, 4096, true},
+		{2000, 1000, 256, 4096, 744, true},
+		{1200, 1000, 256, 4096, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := autoMaxTokens(tt.window, tt.prompt, tt.margin, tt.ceiling)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("autoMaxTokens(%d, %d, %d, %d) = %d, %v, want %d, %v", tt.window, tt.prompt, tt.margin, tt.ceiling, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestChatSizesMaxTokensToContextWindow(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Models = map[string]ModelConfig{"small": {ContextWindow: 1000}, "tiny": {ContextWindow: 100}}
+	cfg.DefaultModel = "small"
+	azure := &azureStub{content: "ok"}
+	_, front := newTestServer(t, cfg, azure)
+
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	readBody(t, resp)
+	got, _ := azure.payload(t, 0)["max_tokens"].(float64)
+	if resp.StatusCode != http.StatusOK || got <= 0 || got >= 1000-256 {
+		t.Fatalf("status=%d max_tokens=%v, want within the window minus the margin", resp.StatusCode, got)
+	}
+
+	resp = postJSON(t, front.URL+"/api/chat", `{"message":"hi","model":"tiny"}`)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "context_window_exceeded") {
+		t.Errorf("status=%d body=%s, want 400 context_window_exceeded", resp.StatusCode, body)
+	}
+}
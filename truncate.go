@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Cut content to at most max runes including the trailing ellipsis,
+// preferring the end of a sentence and otherwise the end of a word.
+// Reports whether anything was cut; max <= 0 leaves content unchanged.
+func truncateResponse(content string, max int) (string, bool) {
+	runes := []rune(content)
+	if max <= 0 || len(runes) <= max {
+		return content, false
+	}
+	limit := max - 1 // room for the ellipsis
+
+	// Boundaries are the whitespace after a word; a sentence end counts when
+	// it keeps at least half the allowance, so a short first sentence does
+	// not swallow the rest
+	sentence, word := -1, -1
+	for i := 1; i <= limit; i++ {
+		if !unicode.IsSpace(runes[i]) {
+			continue
+		}
+		if strings.ContainsRune(".!?", runes[i-1]) {
+			sentence = i
+		}
+		word = i
+	}
+	end := limit
+	switch {
+	case sentence >= limit/2:
+		end = sentence
+	case word > 0:
+		end = word
+	}
+	return strings.TrimRightFunc(string(runes[:end]), unicode.IsSpace) + "…", true
+}
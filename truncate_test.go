@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTruncateResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		max     int
+		want    string
+		cut     bool
+	}{
+		{"fits", "Short answer.", 20, "Short answer.", false},
+		{"disabled", "Short answer.", 0, "Short answer.", false},
+		{"sentence boundary", "First sentence here. Second sentence follows.", 30, "First sentence here.…", true},
+		{"word boundary", "Alpha beta gamma delta epsilon", 14, "Alpha beta…", true},
+		{"short first sentence", "Yes. This explains the answer in detail", 30, "Yes. This explains the answer…", true},
+		{"boundary right at the limit", "Alpha beta gamma", 11, "Alpha beta…", true},
+		{"one long word", "Supercalifragilistic", 6, "Super…", true},
+		{"runes not bytes", "Idées très géniales", 11, "Idées très…", true},
+	}
+	for _, tt := range tests {
+		got, cut := truncateResponse(tt.content, tt.max)
+		if got != tt.want || cut != tt.cut {
+			t.Errorf("%s: truncateResponse = %q, %v; want %q, %v", tt.name, got, cut, tt.want, tt.cut)
+		}
+		if n := len([]rune(got)); tt.max > 0 && n > tt.max {
+			t.Errorf("%s: %d runes, over the %d limit", tt.name, n, tt.max)
+		}
+	}
+}
+
+func TestMaxResponseCharsKeepsReferences(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxResponseChars = 25
+	azure := &azureStub{content: "Go is fast. It compiles to native code quickly.\nReferences:\n1. Go spec\n2. Effective Go"}
+	_, front := newTestServer(t, cfg, azure)
+
+	var got ChatResponse
+	json.Unmarshal([]byte(readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`))), &got)
+	if got.Response != "Go is fast. It compiles…" || !got.TruncatedDisplay {
+		t.Errorf("response = %q, truncatedDisplay = %v", got.Response, got.TruncatedDisplay)
+	}
+	if len(got.References) != 2 {
+		t.Errorf("references = %q, want both", got.References)
+	}
+}
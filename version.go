@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response envelope versions a client can ask for with Accept-Version.
+// Requests without the header get the latest.
+const (
+	// The original envelope: the answer and its reference lines only
+	responseVersion1 = 1
+	// Every ChatResponse field
+	responseVersion2 = 2
+
+	latestResponseVersion = responseVersion2
+)
+
+// chatResponseV1 is the chat response envelope of version 1
+type chatResponseV1 struct {
+	SchemaVersion int      `json:"schemaVersion"`
+	Response      string   `json:"response"`
+	References    []string `json:"references,omitempty"`
+}
+
+// The envelope version a request asked for in Accept-Version, e.g. "1" or
+// "v1", or the latest when it sent none
+func responseVersion(r *http.Request) (int, error) {
+	header := strings.TrimSpace(r.Header.Get("Accept-Version"))
+	if header == "" {
+		return latestResponseVersion, nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(header), "v"))
+	if err != nil || version < responseVersion1 || version > latestResponseVersion {
+		return 0, fmt.Errorf("Accept-Version must be between %d and %d, got %q", responseVersion1, latestResponseVersion, header)
+	}
+	return version, nil
+}
+
+// Shape a chat response into the envelope of the given version
+func shapeChatResponse(resp ChatResponse, version int) interface{} {
+	switch version {
+	case responseVersion1:
+		return chatResponseV1{SchemaVersion: version, Response: resp.Response, References: resp.References}
+	default:
+		resp.SchemaVersion = version
+		if resp.referencesFirst {
+			return chatResponseReferencesFirst{
+				SchemaVersion:        version,
+				References:           resp.References,
+				StructuredReferences: resp.StructuredReferences,
+				ChatResponse:         resp,
+			}
+		}
+		return resp
+	}
+}
+
+// Write a chat response in the requested envelope version. The body differs
+// per version, so caches must key on Accept-Version too.
+func writeChatResponse(w http.ResponseWriter, r *http.Request, resp ChatResponse, version int) {
+	w.Header().Add("Vary", "Accept-Version")
+	writeJSON(w, r, shapeChatResponse(resp, version))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestResponseVersion(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    int
+		wantErr bool
+	}{
+		{"", latestResponseVersion, false},
+		{"1", 1, false},
+		{"v2", 2, false},
+		{" V1 ", 1, false},
+		{"0", 0, true},
+		{"3", 0, true},
+		{"latest", 0, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/chat", nil)
+		r.Header.Set("Accept-Version", tt.header)
+		got, err := responseVersion(r)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("Accept-Version %q: got %d, %v; want %d, wantErr %v", tt.header, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// Top-level keys of a JSON object
+func jsonKeys(t *testing.T, body []byte) []string {
+	t.Helper()
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestShapeChatResponseVersions(t *testing.T) {
+	parsed := ChatResponse{
+		Response:             "Answer.",
+		References:           []string{"1. Foo"},
+		Grounded:             true,
+		StructuredReferences: []Reference{{Source: "model", Title: "Foo"}},
+	}
+
+	v1, _ := json.Marshal(shapeChatResponse(parsed, responseVersion1))
+	if got, want := jsonKeys(t, v1), []string{"references", "response", "schemaVersion"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("version 1 keys = %v, want %v", got, want)
+	}
+
+	v2, _ := json.Marshal(shapeChatResponse(parsed, responseVersion2))
+	var got ChatResponse
+	json.Unmarshal(v2, &got)
+	if got.SchemaVersion != 2 || !got.Grounded || len(got.StructuredReferences) != 1 || got.References[0] != "1. Foo" {
+		t.Errorf("version 2 = %s", v2)
+	}
+}
+
+func TestChatHonorsAcceptVersion(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), &azureStub{content: "Answer.\nReferences:\n1. Foo"})
+
+	var latest ChatResponse
+	resp := postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`)
+	json.Unmarshal([]byte(readBody(t, resp)), &latest)
+	if latest.SchemaVersion != latestResponseVersion || resp.Header.Get("Vary") != "Accept-Version" {
+		t.Errorf("default schemaVersion = %d, Vary = %q", latest.SchemaVersion, resp.Header.Get("Vary"))
+	}
+
+	body := readBody(t, postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "Accept-Version", "1"))
+	if got, want := jsonKeys(t, []byte(body)), []string{"references", "response", "schemaVersion"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("version 1 keys = %v, want %v", got, want)
+	}
+
+	resp = postJSON(t, front.URL+"/api/chat", `{"message":"hi"}`, "Accept-Version", "9")
+	var e ErrorResponse
+	json.Unmarshal([]byte(readBody(t, resp)), &e)
+	if resp.StatusCode != http.StatusNotAcceptable || e.Code != "unsupported_version" {
+		t.Errorf("unknown version: status = %d, error = %+v", resp.StatusCode, e)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// WarmupConfig controls the preflight completion sent at startup
+type WarmupConfig struct {
+	// Send a one-token completion at startup to open the TLS connection
+	// and check the API key before the first real request
+	OnStart bool `json:"onStart"`
+	// Report not ready on /readyz until the warm-up has succeeded
+	Required bool `json:"required"`
+}
+
+// Send a minimal completion to the default model's deployment
+func (s *Server) warmUp(ctx context.Context) error {
+	_, model, _ := s.cfg.modelFor("")
+	data := map[string]interface{}{
+		"messages": []map[string]interface{}{
+			{"role": "user", "content": "ping"},
+		},
+	}
+	applyParams(data, GenerationParams{MaxTokens: 1}, model)
+
+	ctx, cancel := context.WithTimeout(ctx, s.policyFor(model.Endpoint).timeout)
+	defer cancel()
+	resp, err := s.postAzure(ctx, model.Endpoint, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Run the startup warm-up, marking the server ready once it succeeds
+func (s *Server) runWarmup(ctx context.Context) {
+	if err := s.warmUp(ctx); err != nil {
+		log.Printf("WARNING: Azure OpenAI warm-up failed, check AZURE_ENDPOINT and AZURE_API_KEY: %v", err)
+		return
+	}
+	log.Printf("Azure OpenAI warm-up succeeded")
+	s.ready.Store(true)
+}
+
+// Report whether the server is ready to take traffic
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		http.Error(w, "Azure OpenAI warm-up has not succeeded", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestWarmupGatesReadiness(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Warmup = WarmupConfig{OnStart: true, Required: true}
+	azure := &azureStub{content: "pong"}
+	srv, front := newTestServer(t, cfg, azure)
+
+	if resp, _ := http.Get(front.URL + "/readyz"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status before warm-up = %d, want 503", resp.StatusCode)
+	}
+
+	srv.runWarmup(context.Background())
+	if resp, _ := http.Get(front.URL + "/readyz"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status after warm-up = %d, want 200", resp.StatusCode)
+	}
+	if got := azure.payload(t, 0)["max_tokens"]; got != float64(1) {
+		t.Errorf("warm-up max_tokens = %v, want 1", got)
+	}
+}
+
+func TestWarmupFailureStaysNotReady(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Warmup = WarmupConfig{OnStart: true, Required: true}
+	azure := &azureStub{handler: func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"code":"401","message":"Access denied"}}`, http.StatusUnauthorized)
+	}}
+	srv, front := newTestServer(t, cfg, azure)
+
+	srv.runWarmup(context.Background())
+	if resp, _ := http.Get(front.URL + "/readyz"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status after failed warm-up = %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestReadyWithoutRequiredWarmup(t *testing.T) {
+	_, front := newTestServer(t, defaultConfig(), &azureStub{})
+	if resp, _ := http.Get(front.URL + "/readyz"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+}